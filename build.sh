@@ -1,4 +1,7 @@
 #!/bin/bash
+commit=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+build_date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
 for language in java python; do
-    docker build -t ipv6tester-$language -f "docker/src/Dockerfile-$language" .
+    docker build -t ipv6tester-$language -f "docker/src/Dockerfile-$language" \
+        --build-arg GIT_COMMIT="$commit" --build-arg BUILD_DATE="$build_date" .
 done
@@ -4,7 +4,13 @@ import java.net.Inet6Address;
 import java.net.InetSocketAddress;
 import java.net.ServerSocket;
 import java.net.Socket;
+import java.net.SocketTimeoutException;
 import java.io.*;
+import java.nio.charset.StandardCharsets;
+import java.security.GeneralSecurityException;
+import java.security.MessageDigest;
+import java.security.SecureRandom;
+import java.time.Instant;
 import java.time.LocalDateTime;
 import java.time.format.DateTimeFormatter;
 import java.util.concurrent.ExecutorService;
@@ -12,29 +18,112 @@ import java.util.concurrent.Executors;
 import java.util.concurrent.RejectedExecutionException;
 import java.net.NetworkInterface;
 import java.net.InetAddress;
+import java.util.ArrayList;
+import java.util.Arrays;
 import java.util.Collections;
+import java.util.Comparator;
+import java.util.HexFormat;
 import java.util.List;
+import java.util.Map;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.atomic.AtomicLong;
+import javax.crypto.Mac;
+import javax.crypto.spec.SecretKeySpec;
 
 public class IPv6Tester {
     private static final int DEFAULT_PORT = 8080;
     private static final String DEFAULT_IPV6_ADDRESS = "::1";
     private static final DateTimeFormatter formatter = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss");
     private static final int MAX_CLIENTS = 10;
+    private static final int MAX_LINE_LENGTH = 4096;
+    private static final long MAX_CONNECTION_BYTES = 1024 * 1024;
+    private static final int READ_TIMEOUT_SECONDS = 60;
+    private static final int CALLBACK_TIMEOUT_SECONDS = 5;
+    private static final int MIN_RATE_GRACE_SECONDS = 10;
+    private static final int MAX_POW_BITS = 28;
+    private static final int MAX_THROUGHPUT_SECONDS = 60;
+    private static final int THROUGHPUT_CHUNK = 65536;
+    private static final String SESSION_LABEL = "[A-Za-z0-9][A-Za-z0-9_.-]{0,63}";
+    private static final int MAX_SESSIONS = 1000;
+    private static final int SESSION_EXPIRY_SECONDS = 3600;
+    private static final SecureRandom random = new SecureRandom();
     private static final ExecutorService executorService = Executors.newFixedThreadPool(MAX_CLIENTS);
+    private static final DateTimeFormatter traceFormatter = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss.SSSSSS");
+    private static PrintStream traceOutput;
+    private static double minRate;
+    private static double maxRate;
+    private static TokenBucket totalBucket;
+    private static double maxSessionRate;
+    // Named test sessions, so teams sharing a server can tell their results apart
+    private static final Map<String, Session> sessions = new ConcurrentHashMap<>();
+    // Abuse protection for public servers: a shared secret, a proof of work, or both
+    private static byte[] authSecret;
+    private static int powBits;
+    // Deliberate misbehavior for client resilience tests; see ChaosOutputStream
+    private static double chaosDelay;
+    private static double chaosJitter;
+    private static double chaosDropRate;
+    private static double chaosGarble;
+    private static long chaosCloseAfter;
 
     public static void main(String[] args) {
         // Prefer IPv6 addresses
         // System.setProperty("java.net.preferIPv4Stack", "false");
         // System.setProperty("java.net.preferIPv6Addresses", "true");
 
-        if (args.length < 1 || args.length > 3) {
+        List<String> positional = new ArrayList<>();
+        for (int i = 0; i < args.length; i++) {
+            if (args[i].equals("--trace") && i + 1 < args.length) {
+                openTrace(args[++i]);
+            } else if (args[i].equals("--min-rate") && i + 1 < args.length) {
+                minRate = parseRate(args[++i]);
+            } else if (args[i].equals("--max-rate") && i + 1 < args.length) {
+                maxRate = parseRate(args[++i]);
+            } else if (args[i].equals("--max-session-rate") && i + 1 < args.length) {
+                maxSessionRate = parseRate(args[++i]);
+            } else if (args[i].equals("--require-auth")) {
+                String secret = System.getenv("IPV6_TESTER_SECRET");
+                if (secret == null || secret.isEmpty()) {
+                    System.err.println("Error: --require-auth needs the shared secret in IPV6_TESTER_SECRET");
+                    System.exit(1);
+                }
+                authSecret = secret.getBytes(StandardCharsets.UTF_8);
+            } else if (args[i].equals("--pow-bits") && i + 1 < args.length) {
+                powBits = parsePowBits(args[++i]);
+            } else if (args[i].equals("--delay") && i + 1 < args.length) {
+                chaosDelay = parseRate(args[++i]);
+            } else if (args[i].equals("--jitter") && i + 1 < args.length) {
+                chaosJitter = parseRate(args[++i]);
+            } else if (args[i].equals("--drop-rate") && i + 1 < args.length) {
+                chaosDropRate = parseProbability(args[++i]);
+            } else if (args[i].equals("--garble") && i + 1 < args.length) {
+                chaosGarble = parseProbability(args[++i]);
+            } else if (args[i].equals("--close-after") && i + 1 < args.length) {
+                chaosCloseAfter = (long) parseRate(args[++i]);
+            } else if (args[i].equals("--strict-v6")) {
+                // Not implemented here; silently ignoring it would pass tests that should fail
+                System.err.println("Error: --strict-v6 is only supported by the Python client");
+                System.exit(1);
+            } else if (args[i].equals("--max-total-rate") && i + 1 < args.length) {
+                double rate = parseRate(args[++i]);
+                totalBucket = rate > 0 ? new TokenBucket(rate) : null;
+            } else {
+                positional.add(args[i]);
+            }
+        }
+
+        if (positional.size() < 1 || positional.size() > 3) {
             printUsage();
             System.exit(1);
         }
 
-        String mode = args[0];
-        String ipv6Address = args.length > 1 ? args[1] : DEFAULT_IPV6_ADDRESS;
-        int port = args.length > 2 ? parsePort(args[2]) : DEFAULT_PORT;
+        String mode = positional.get(0);
+        if (mode.equals("version") || mode.equals("--version")) {
+            printVersion();
+            return;
+        }
+        String ipv6Address = positional.size() > 1 ? positional.get(1) : DEFAULT_IPV6_ADDRESS;
+        int port = positional.size() > 2 ? parsePort(positional.get(2)) : DEFAULT_PORT;
 
         if (!mode.equals("server") && !mode.equals("client")) {
             printUsage();
@@ -58,6 +147,16 @@ public class IPv6Tester {
         System.out.println("  server|client    - Required. Run as server or client");
         System.out.println("  ipv6_address     - Optional. IPv6 address (default: ::1)");
         System.out.println("  port             - Optional. Port number (default: 8080)");
+        System.out.println("  --trace FILE     - Optional. Hexdump every byte sent and received to FILE");
+        System.out.println("  --min-rate N     - Optional. Server: close clients sending a line slower than N bytes/s");
+        System.out.println("  --max-rate N     - Optional. Server: cap sending at N bytes/s per connection; --max-total-rate N overall,");
+        System.out.println("                     --max-session-rate N per named test session");
+        System.out.println("  --require-auth   - Optional. Server: require the IPV6_TESTER_SECRET secret before tests");
+        System.out.println("  --pow-bits N     - Optional. Server: require an N-bit proof of work before tests");
+        System.out.println("  --delay MS       - Optional. Server: delay every write by MS ms, varied by --jitter MS either way;");
+        System.out.println("                     --drop-rate P drops and --garble P corrupts writes with probability P,");
+        System.out.println("                     --close-after N closes connections after sending N bytes");
+        System.out.println("  version          - Print build information and optional features");
         System.out.println("\nAvailable IPv6 addresses on this host:");
         printAvailableIPv6Addresses();
         System.out.println("\nJava IPv6 properties:");
@@ -69,6 +168,30 @@ public class IPv6Tester {
         System.out.println("  java IPv6Tester client 2001:db8:1234:5678::1 8888");
     }
 
+    /**
+     * Prints the commit and build date baked into container images by build.sh, plus the
+     * optional features this implementation has, so scripts can branch on capabilities.
+     */
+    private static void printVersion() {
+        System.out.println("IPv6Tester");
+        System.out.println("  Commit:     " + System.getenv().getOrDefault("IPV6_TESTER_COMMIT", "unknown"));
+        System.out.println("  Build date: " + System.getenv().getOrDefault("IPV6_TESTER_BUILD_DATE", "unknown (running from source)"));
+        System.out.println("  Java:       " + System.getProperty("java.version") + " (" + System.getProperty("os.name") + ")");
+        System.out.println("  Features:");
+        // The JDK has no raw socket API, and packet capture and QUIC are not implemented
+        System.out.println("    raw-sockets     no");
+        System.out.println("    pcap            no");
+        System.out.println("    quic            no");
+        // Server features, named as in the Python tester's version output; it has all of them
+        String[][] serverFeatures = {
+                {"trace", "yes"}, {"verified-echo", "yes"}, {"callback", "yes"}, {"one-way-delay", "yes"},
+                {"throughput", "yes"}, {"auth", "yes"}, {"proof-of-work", "yes"}, {"sessions", "yes"},
+                {"rate-limits", "yes"}, {"min-rate", "yes"}, {"chaos", "yes"}, {"fuzz", "no"}, {"diagnostics", "no"}};
+        for (String[] feature : serverFeatures) {
+            System.out.printf("    %-16s%s%n", feature[0], feature[1]);
+        }
+    }
+
     private static void printAvailableIPv6Addresses() {
         try {
             List<NetworkInterface> interfaces = Collections.list(NetworkInterface.getNetworkInterfaces());
@@ -103,12 +226,76 @@ public class IPv6Tester {
         return DEFAULT_PORT; // Will never reach here due to System.exit
     }
 
+    private static double parseRate(String rateStr) {
+        try {
+            double rate = Double.parseDouble(rateStr);
+            if (rate < 0) {
+                System.err.println("Error: Rate must not be negative");
+                System.exit(1);
+            }
+            return rate;
+        } catch (NumberFormatException e) {
+            System.err.println("Error: Invalid rate");
+            System.exit(1);
+        }
+        return 0; // Will never reach here due to System.exit
+    }
+
+    private static double parseProbability(String probabilityStr) {
+        try {
+            double probability = Double.parseDouble(probabilityStr);
+            if (probability < 0 || probability > 1) {
+                System.err.println("Error: Probability must be between 0 and 1");
+                System.exit(1);
+            }
+            return probability;
+        } catch (NumberFormatException e) {
+            System.err.println("Error: Invalid probability");
+            System.exit(1);
+        }
+        return 0; // Will never reach here due to System.exit
+    }
+
+    private static int parsePowBits(String bitsStr) {
+        try {
+            int bits = Integer.parseInt(bitsStr);
+            if (bits < 0 || bits > MAX_POW_BITS) {
+                System.err.println("Error: Proof of work bits must be between 0 and " + MAX_POW_BITS);
+                System.exit(1);
+            }
+            return bits;
+        } catch (NumberFormatException e) {
+            System.err.println("Error: Invalid proof of work bits");
+            System.exit(1);
+        }
+        return 0; // Will never reach here due to System.exit
+    }
+
     private static void runServer(String ipv6Address, int port) throws IOException {
         try (ServerSocket serverSocket = new ServerSocket()) {
             // Bind to specified IPv6 address
             serverSocket.bind(new InetSocketAddress(ipv6Address, port));
             System.out.println("IPv6 Server started on [" + ipv6Address + "]:" + port);
             System.out.println("Maximum number of simultaneous clients: " + MAX_CLIENTS);
+            if (minRate > 0) {
+                System.out.println("Minimum client data rate: " + minRate + " bytes/s after " + MIN_RATE_GRACE_SECONDS + " seconds");
+            }
+            if (authSecret != null || powBits > 0) {
+                System.out.println("Tests require authentication: " + (authSecret != null ? "the shared secret" : "")
+                        + (authSecret != null && powBits > 0 ? " and " : "")
+                        + (powBits > 0 ? "a " + powBits + "-bit proof of work" : ""));
+            }
+            if (maxRate > 0 || totalBucket != null || maxSessionRate > 0) {
+                System.out.println("Maximum send rate: " + (maxRate > 0 ? maxRate + " bytes/s per connection" : "unlimited per connection")
+                        + ", " + (maxSessionRate > 0 ? maxSessionRate + " bytes/s per session" : "unlimited per session")
+                        + ", " + (totalBucket != null ? totalBucket.rate + " bytes/s in total" : "unlimited in total"));
+            }
+            if (chaosEnabled()) {
+                System.out.println("Chaos: delay " + chaosDelay + " ms" + (chaosJitter > 0 ? " +/- " + chaosJitter + " ms" : "")
+                        + (chaosDropRate > 0 ? ", drop " + Math.round(chaosDropRate * 100) + "% of writes" : "")
+                        + (chaosGarble > 0 ? ", garble " + Math.round(chaosGarble * 100) + "% of writes" : "")
+                        + (chaosCloseAfter > 0 ? ", close connections after " + chaosCloseAfter + " bytes" : ""));
+            }
 
             while (true) {
                 try {
@@ -133,32 +320,474 @@ public class IPv6Tester {
 
     private static void handleClient(Socket clientSocket, String serverAddress) {
         String clientAddress = clientSocket.getInetAddress().getHostAddress();
+        String peer = "[" + clientAddress + "]:" + clientSocket.getPort();
+        String who = "[" + clientAddress + "]";
+        Session session = null;
         try (clientSocket;
-             PrintWriter out = new PrintWriter(clientSocket.getOutputStream(), true);
-             BufferedReader in = new BufferedReader(new InputStreamReader(clientSocket.getInputStream()))) {
+             OutputStream output = chaos(traced(clientSocket.getOutputStream(), peer));
+             PrintWriter out = new PrintWriter(output, true);
+             InputStream in = new BufferedInputStream(traced(clientSocket.getInputStream(), peer))) {
+            // Bandwidth caps, so a public echo endpoint can't be used to saturate the uplink
+            List<TokenBucket> buckets = new ArrayList<>();
+            if (maxRate > 0) {
+                buckets.add(new TokenBucket(maxRate));
+            }
+            if (totalBucket != null) {
+                buckets.add(totalBucket);
+            }
+            long bytesReceived = 0;
+            String nonce = null;
+            boolean authenticated = authSecret == null && powBits == 0;
+            ChaosOutputStream chaosStream = output instanceof ChaosOutputStream stream ? stream : null;
             while (true) {
-                // Read client message
-                String message = in.readLine();
+                // PrintWriter swallows write errors, including --close-after closing the connection mid-line
+                if (out.checkError()) {
+                    String reason = chaosStream != null && chaosStream.closeReason != null ? chaosStream.closeReason
+                            : "write failed";
+                    System.out.println("Closing connection from " + who + ": " + reason);
+                    break;
+                }
+                // Read client message, bounded in length and idle time
+                String message;
+                try {
+                    message = readLine(clientSocket, in);
+                } catch (LineTooLongException e) {
+                    rejectClient(out, who, "line exceeds " + MAX_LINE_LENGTH + " bytes");
+                    break;
+                } catch (SlowClientException e) {
+                    rejectClient(out, who, "sending slower than " + minRate + " bytes/s");
+                    break;
+                } catch (SocketTimeoutException e) {
+                    rejectClient(out, who, "idle for " + READ_TIMEOUT_SECONDS + " seconds");
+                    break;
+                }
                 if (message == null) {
                     
-                    System.out.println("Client disconnected: [" + clientAddress + "]");
+                    System.out.println("Client disconnected: " + who);
+                    break;
+                }
+
+                int length = message.getBytes(StandardCharsets.UTF_8).length + 1;
+                bytesReceived += length;
+                if (session != null) {
+                    session.bytesReceived.addAndGet(length);
+                }
+                if (bytesReceived > MAX_CONNECTION_BYTES) {
+                    rejectClient(out, who, "connection exceeded " + MAX_CONNECTION_BYTES + " bytes");
                     break;
                 }
-                System.out.println("Received from client [" + clientAddress + "]: " + message);
+
+                if (message.equals("CHALLENGE")) {
+                    byte[] bytes = new byte[16];
+                    random.nextBytes(bytes);
+                    nonce = HexFormat.of().formatHex(bytes);
+                    send(out, buckets, "CHALLENGE " + nonce + " " + powBits);
+                    continue;
+                }
+                if (message.startsWith("AUTH ")) {
+                    String failure = checkAuth(nonce, message);
+                    send(out, buckets, "AUTH " + (failure != null ? "FAILED " + failure : "OK"));
+                    if (failure != null) {
+                        System.out.println("Closing connection from " + who + ": authentication failed, " + failure);
+                        break;
+                    }
+                    authenticated = true;
+                    continue;
+                }
+                if (!authenticated && (message.startsWith("ECHO ") || message.startsWith("CALLBACK ") || message.startsWith("TIME ")
+                        || message.startsWith("THROUGHPUT ") || message.startsWith("SESSION "))) {
+                    // Echo, callback and timing tests could be turned against third parties, and sessions fill a
+                    // table shared by every client; demand proof first
+                    send(out, buckets, "ERROR authentication required; send CHALLENGE");
+                    continue;
+                }
+
+                if (message.startsWith("SESSION ")) {
+                    String label = message.substring(8).trim();
+                    if (session != null) {
+                        send(out, buckets, "ERROR session is already " + session.label);
+                    } else if (!label.matches(SESSION_LABEL)) {
+                        send(out, buckets, "ERROR invalid session label; use up to 64 letters, digits, '.', '_' or '-'");
+                    } else if ((session = joinSession(label)) == null) {
+                        send(out, buckets, "ERROR too many sessions (at most " + MAX_SESSIONS + ")");
+                    } else {
+                        if (session.bucket != null) {
+                            buckets.add(session.bucket);
+                        }
+                        System.out.println("Client " + who + " joined session " + label);
+                        who = "[" + clientAddress + "] (session " + label + ")";
+                        send(out, buckets, "SESSION OK " + label);
+                    }
+                    continue;
+                }
+
+                if (message.startsWith("ECHO ")) {
+                    // Verified echo frames go back unchanged and without the usual delay
+                    send(out, buckets, message);
+                    continue;
+                }
+                if (message.startsWith("CALLBACK ")) {
+                    // Firewall pinhole checks: connect back to the client's own address, never a third party
+                    send(out, buckets, callBack(clientSocket.getInetAddress(), message));
+                    continue;
+                }
+                if (message.startsWith("TIME ")) {
+                    // One-way delay probes: append our receive and send times in epoch nanoseconds
+                    long received = epochNanos();
+                    send(out, buckets, message + " " + received + " " + epochNanos());
+                    continue;
+                }
+                if (message.startsWith("THROUGHPUT ")) {
+                    // Bulk transfer tests: the connection carries data in the negotiated direction until it ends
+                    String[] fields = message.split(" ");
+                    if (fields.length != 3 || !fields[1].matches("up|down|bidir") || !fields[2].matches("\\d{1,2}")
+                            || Integer.parseInt(fields[2]) < 1 || Integer.parseInt(fields[2]) > MAX_THROUGHPUT_SECONDS) {
+                        send(out, buckets, "ERROR usage: THROUGHPUT up|down|bidir SECONDS (1-" + MAX_THROUGHPUT_SECONDS + ")");
+                        continue;
+                    }
+                    System.out.println("Throughput test with " + who + ": " + fields[1] + " for " + fields[2] + " s");
+                    send(out, buckets, "THROUGHPUT OK " + fields[1] + " " + fields[2]);
+                    long[] counts;
+                    try {
+                        counts = serveThroughput(clientSocket, in, output, buckets, fields[1], Integer.parseInt(fields[2]));
+                    } catch (SocketTimeoutException e) {
+                        System.out.println("Closing connection from " + who + ": " + e.getMessage());
+                        break;
+                    }
+                    if (session != null) {
+                        session.bytesReceived.addAndGet(counts[0]);
+                    }
+                    System.out.println("Throughput test with " + who + " finished: received " + counts[0] + " bytes, sent " + counts[1] + " bytes");
+                    break;
+                }
+                System.out.println("Received from client " + who + ": " + message);
 
                 // Send response with timestamp
                 String response = "Server received your message at " + LocalDateTime.now().format(formatter) + " at address " + serverAddress;
-                out.println(response);
+                send(out, buckets, response);
 
                 // Add a delay of 1 second
                 Thread.sleep(1000);
             }
+        } catch (ChaosCloseException e) {
+            System.out.println("Closing connection from " + who + ": " + e.getMessage());
         } catch (IOException e) {
-            System.err.println("Error handling client [" + clientAddress + "]: " + e.getMessage());
+            System.err.println("Error handling client " + who + ": " + e.getMessage());
             e.printStackTrace();
         } catch (InterruptedException e) {
             Thread.currentThread().interrupt();
-            System.err.println("Sleep interrupted for client [" + clientAddress + "]: " + e.getMessage());
+            System.err.println("Sleep interrupted for client " + who + ": " + e.getMessage());
+        } finally {
+            if (session != null) {
+                synchronized (sessions) {
+                    session.active--;
+                    session.idleSince = System.nanoTime();
+                }
+                System.out.println("Session " + session.label + " so far: " + session.connections.get() + " connections, "
+                        + session.bytesReceived.get() + " bytes received");
+            }
+        }
+    }
+
+    /**
+     * Reads a newline-terminated line of at most MAX_LINE_LENGTH bytes, so a client
+     * streaming an endless line can't exhaust memory. Returns null at end of stream.
+     * With --min-rate, a line still arriving slower than that after the grace period
+     * is abandoned, so slowloris-style clients can't hold a worker forever.
+     * Throws SocketTimeoutException unless the whole line arrives within READ_TIMEOUT_SECONDS,
+     * however steadily its bytes trickle in.
+     */
+    private static String readLine(Socket socket, InputStream in) throws IOException {
+        ByteArrayOutputStream line = new ByteArrayOutputStream();
+        long deadline = System.nanoTime() + READ_TIMEOUT_SECONDS * 1_000_000_000L;
+        long started = 0;
+        int b;
+        while (true) {
+            long remaining = (deadline - System.nanoTime()) / 1_000_000;
+            if (remaining <= 0) {
+                throw new SocketTimeoutException("no complete line within " + READ_TIMEOUT_SECONDS + " seconds");
+            }
+            socket.setSoTimeout((int) remaining);
+            if ((b = in.read()) == -1 || b == '\n') {
+                break;
+            }
+            if (line.size() >= MAX_LINE_LENGTH) {
+                throw new LineTooLongException();
+            }
+            line.write(b);
+            // The rate is measured from the first byte of the line, so idle time between requests doesn't count
+            long now = System.nanoTime();
+            if (started == 0) {
+                started = now;
+            }
+            double elapsed = (now - started) / 1e9;
+            if (minRate > 0 && elapsed >= MIN_RATE_GRACE_SECONDS && line.size() / elapsed < minRate) {
+                throw new SlowClientException();
+            }
+        }
+        if (b == -1 && line.size() == 0) {
+            return null;
+        }
+        String message = line.toString(StandardCharsets.UTF_8);
+        return message.endsWith("\r") ? message.substring(0, message.length() - 1) : message;
+    }
+
+    /**
+     * Handles "CALLBACK <port> <token>": connects to the port on the requesting client's own
+     * address and sends the token back, so the client can tell whether inbound connections
+     * get through its firewall.
+     */
+    private static String callBack(InetAddress clientAddress, String message) {
+        String[] fields = message.split(" ");
+        if (fields.length != 3 || !fields[1].matches("\\d{1,5}") || !fields[2].matches("[0-9a-f]{1,64}")) {
+            return "CALLBACK FAILED malformed request";
+        }
+        int port = Integer.parseInt(fields[1]);
+        if (port < 1 || port > 65535) {
+            return "CALLBACK FAILED malformed request";
+        }
+        String target = "[" + clientAddress.getHostAddress() + "]:" + port;
+        try (Socket socket = new Socket()) {
+            socket.connect(new InetSocketAddress(clientAddress, port), CALLBACK_TIMEOUT_SECONDS * 1000);
+            socket.getOutputStream().write(("CALLBACK " + fields[2] + "\n").getBytes(StandardCharsets.UTF_8));
+            System.out.println("Callback to " + target + " succeeded");
+            return "CALLBACK OK " + target;
+        } catch (SocketTimeoutException e) {
+            System.out.println("Callback to " + target + " timed out");
+            return "CALLBACK FAILED " + target + " timed out";
+        } catch (IOException e) {
+            System.out.println("Callback to " + target + " failed: " + e.getMessage());
+            return "CALLBACK FAILED " + target + " " + e.getMessage();
+        }
+    }
+
+    private static long epochNanos() {
+        Instant now = Instant.now();
+        return now.getEpochSecond() * 1_000_000_000L + now.getNano();
+    }
+
+    /**
+     * Validates "AUTH <mac> <counter>" against the challenge sent on this connection: the
+     * mac must be HMAC-SHA256 of the nonce under the shared secret, and SHA-256 of
+     * "nonce:counter" must start with powBits zero bits. Returns why it failed, or null.
+     */
+    private static String checkAuth(String nonce, String message) {
+        String[] fields = message.split(" ");
+        if (nonce == null) {
+            return "no challenge was issued";
+        }
+        if (fields.length != 3) {
+            return "malformed request";
+        }
+        try {
+            if (authSecret != null) {
+                Mac mac = Mac.getInstance("HmacSHA256");
+                mac.init(new SecretKeySpec(authSecret, "HmacSHA256"));
+                String expected = HexFormat.of().formatHex(mac.doFinal(nonce.getBytes(StandardCharsets.UTF_8)));
+                if (!MessageDigest.isEqual(expected.getBytes(StandardCharsets.UTF_8), fields[1].getBytes(StandardCharsets.UTF_8))) {
+                    return "wrong secret";
+                }
+            }
+            if (fields[2].length() > 20) {
+                return "proof of work is not valid";
+            }
+            byte[] digest = MessageDigest.getInstance("SHA-256").digest((nonce + ":" + fields[2]).getBytes(StandardCharsets.UTF_8));
+            for (int bit = 0; bit < powBits; bit++) {
+                if ((digest[bit / 8] & (0x80 >> (bit % 8))) != 0) {
+                    return "proof of work is not valid";
+                }
+            }
+        } catch (GeneralSecurityException e) {
+            return "server error: " + e.getMessage();
+        }
+        return null;
+    }
+
+    /**
+     * Sends a line once the connection's, session's and server's token buckets allow it.
+     */
+    private static void send(PrintWriter out, List<TokenBucket> buckets, String line) throws InterruptedException {
+        throttle(buckets, line.getBytes(StandardCharsets.UTF_8).length + System.lineSeparator().length());
+        out.println(line);
+    }
+
+    private static void throttle(List<TokenBucket> buckets, int length) throws InterruptedException {
+        double delay = 0;
+        for (TokenBucket bucket : buckets) {
+            delay = Math.max(delay, bucket.take(length));
+        }
+        if (delay > 0) {
+            Thread.sleep((long) Math.ceil(delay * 1000));
+        }
+    }
+
+    /**
+     * Runs the data phase of a THROUGHPUT test. Unless the client only uploads, a second
+     * thread sends filler for the given seconds; meanwhile we read until the client
+     * half-closes, then send "THROUGHPUT RESULT <received> <receive_ns> <sent>". The filler
+     * holds no newlines, so the client finds the result after the last one. Returns
+     * {received, sent}, or closes the socket and throws SocketTimeoutException if the client
+     * is still sending, or not reading, READ_TIMEOUT_SECONDS after the test should have ended.
+     */
+    private static long[] serveThroughput(Socket socket, InputStream in, OutputStream output, List<TokenBucket> buckets,
+                                          String direction, int seconds) throws IOException, InterruptedException {
+        long started = System.nanoTime();
+        long deadline = started + seconds * 1_000_000_000L;
+        AtomicLong sent = new AtomicLong();
+        Thread sender = null;
+        if (!direction.equals("up")) {
+            sender = new Thread(() -> {
+                byte[] chunk = new byte[THROUGHPUT_CHUNK];
+                try {
+                    while (System.nanoTime() < deadline) {
+                        throttle(buckets, chunk.length);
+                        output.write(chunk);
+                        sent.addAndGet(chunk.length);
+                    }
+                    output.flush();
+                } catch (IOException | InterruptedException e) {
+                    // The client went away; the reading side notices too
+                }
+            });
+            sender.start();
+        }
+        // The whole phase is bounded, so a client that keeps uploading or trickles bytes can't hold a worker
+        long readDeadline = started + (seconds + READ_TIMEOUT_SECONDS) * 1_000_000_000L;
+        byte[] buffer = new byte[THROUGHPUT_CHUNK];
+        long received = 0;
+        long receiveNanos = 0;
+        boolean expired = false;
+        while (true) {
+            long remaining = (readDeadline - System.nanoTime()) / 1_000_000;
+            if (remaining <= 0) {
+                expired = true;
+                break;
+            }
+            socket.setSoTimeout((int) Math.max(1, remaining));
+            int count;
+            try {
+                count = in.read(buffer);
+            } catch (SocketTimeoutException e) {
+                expired = true;
+                break;
+            }
+            if (count == -1) {
+                break;
+            }
+            received += count;
+            receiveNanos = System.nanoTime() - started;
+        }
+        if (sender != null) {
+            if (!expired) {
+                sender.join(Math.max(1, (readDeadline - System.nanoTime()) / 1_000_000));
+            }
+            if (expired || sender.isAlive()) {
+                // Blocking writes have no timeout: a client that stops reading leaves the sender stuck until we close
+                socket.close();
+                sender.join();
+                expired = true;
+            }
+        }
+        if (expired) {
+            throw new SocketTimeoutException(
+                    "throughput test still running after " + (seconds + READ_TIMEOUT_SECONDS) + " seconds");
+        }
+        output.write(("\nTHROUGHPUT RESULT " + received + " " + receiveNanos + " " + sent.get() + "\n").getBytes(StandardCharsets.UTF_8));
+        output.flush();
+        return new long[] {received, sent.get()};
+    }
+
+    /**
+     * Joins the named session, creating it if needed, or returns null when the table is full.
+     * Sessions without connections are forgotten after SESSION_EXPIRY_SECONDS idle, and the
+     * longest idle ones go first when the table is full.
+     */
+    private static Session joinSession(String label) {
+        synchronized (sessions) {
+            long now = System.nanoTime();
+            List<Session> idle = new ArrayList<>();
+            for (Session session : sessions.values()) {
+                if (session.active == 0 && !session.label.equals(label)) {
+                    idle.add(session);
+                }
+            }
+            idle.sort(Comparator.comparingLong(session -> session.idleSince));
+            for (Session session : idle) {
+                if (now - session.idleSince > SESSION_EXPIRY_SECONDS * 1_000_000_000L
+                        || sessions.size() >= MAX_SESSIONS) {
+                    sessions.remove(session.label);
+                }
+            }
+            if (!sessions.containsKey(label) && sessions.size() >= MAX_SESSIONS) {
+                return null;
+            }
+            Session session = sessions.computeIfAbsent(label, Session::new);
+            session.active++;
+            session.connections.incrementAndGet();
+            return session;
+        }
+    }
+
+    private static void rejectClient(PrintWriter out, String who, String reason) {
+        System.out.println("Closing connection from " + who + ": " + reason);
+        out.println("ERROR " + reason);
+    }
+
+    private static class LineTooLongException extends IOException {
+    }
+
+    private static class ChaosCloseException extends IOException {
+        ChaosCloseException(String message) {
+            super(message);
+        }
+    }
+
+    private static class SlowClientException extends IOException {
+    }
+
+    /**
+     * Token bucket rate limiter in bytes per second with one second's worth of burst,
+     * shared between connections for the server-wide cap.
+     */
+    private static class TokenBucket {
+        private final double rate;
+        private double tokens;
+        private long updated = System.nanoTime();
+
+        TokenBucket(double rate) {
+            this.rate = rate;
+            this.tokens = rate;
+        }
+
+        /**
+         * Takes amount tokens, going into debt if there are too few, and returns the
+         * seconds until the debt is repaid.
+         */
+        synchronized double take(int amount) {
+            long now = System.nanoTime();
+            tokens = Math.min(rate, tokens + (now - updated) / 1e9 * rate);
+            updated = now;
+            tokens -= amount;
+            return Math.max(0, -tokens / rate);
+        }
+    }
+
+    /**
+     * A named test session: its connections share one send cap with --max-session-rate,
+     * and are counted together so a team can find its own results on a shared server.
+     */
+    private static class Session {
+        private final String label;
+        private final TokenBucket bucket;
+        private final AtomicLong connections = new AtomicLong();
+        private final AtomicLong bytesReceived = new AtomicLong();
+        // Guarded by the sessions map
+        private int active;
+        private long idleSince = System.nanoTime();
+
+        Session(String label) {
+            this.label = label;
+            this.bucket = maxSessionRate > 0 ? new TokenBucket(maxSessionRate) : null;
         }
     }
 
@@ -168,8 +797,9 @@ public class IPv6Tester {
             socket.connect(new InetSocketAddress(ipv6Address, port));
             System.out.println("Connected to server at [" + ipv6Address + "]:" + port);
 
-            try (PrintWriter out = new PrintWriter(socket.getOutputStream(), true);
-                 BufferedReader in = new BufferedReader(new InputStreamReader(socket.getInputStream()))) {
+            String peer = "[" + ipv6Address + "]:" + port;
+            try (PrintWriter out = new PrintWriter(traced(socket.getOutputStream(), peer), true);
+                 BufferedReader in = new BufferedReader(new InputStreamReader(traced(socket.getInputStream(), peer)))) {
 
                 for (int i = 0; i < 20; i++) {
                     // Send message to server
@@ -192,4 +822,155 @@ public class IPv6Tester {
             }
         }
     }
-} 
+
+    private static void openTrace(String path) {
+        try {
+            traceOutput = new PrintStream(new FileOutputStream(path, true), true, StandardCharsets.UTF_8);
+        } catch (IOException e) {
+            System.err.println("Error: Could not open trace file " + path + ": " + e.getMessage());
+            System.exit(1);
+        }
+    }
+
+    private static InputStream traced(InputStream in, String peer) {
+        return traceOutput == null ? in : new TraceInputStream(in, peer);
+    }
+
+    private static OutputStream traced(OutputStream out, String peer) {
+        return traceOutput == null ? out : new TraceOutputStream(out, peer);
+    }
+
+    private static boolean chaosEnabled() {
+        return chaosDelay > 0 || chaosJitter > 0 || chaosDropRate > 0 || chaosGarble > 0 || chaosCloseAfter > 0;
+    }
+
+    private static OutputStream chaos(OutputStream out) {
+        return chaosEnabled() ? new ChaosOutputStream(out) : out;
+    }
+
+    /**
+     * Appends a timestamped hexdump of the given bytes to the trace file. The direction
+     * is ">>>" for data sent to the peer and "<<<" for data received from it.
+     */
+    private static synchronized void trace(String peer, String direction, byte[] data, int offset, int length) {
+        if (length <= 0) {
+            return;
+        }
+        traceOutput.printf("%s %s %s %d bytes%n", LocalDateTime.now().format(traceFormatter), peer, direction, length);
+        for (int row = 0; row < length; row += 16) {
+            StringBuilder hex = new StringBuilder();
+            StringBuilder text = new StringBuilder();
+            for (int i = row; i < row + 16; i++) {
+                if (i == row + 8) {
+                    hex.append(' ');
+                }
+                if (i < length) {
+                    int b = data[offset + i] & 0xff;
+                    hex.append(String.format("%02x ", b));
+                    text.append(b >= 0x20 && b < 0x7f ? (char) b : '.');
+                } else {
+                    hex.append("   ");
+                }
+            }
+            traceOutput.printf("  %08x  %s |%s|%n", row, hex, text);
+        }
+    }
+
+    private static class TraceInputStream extends FilterInputStream {
+        private final String peer;
+
+        TraceInputStream(InputStream in, String peer) {
+            super(in);
+            this.peer = peer;
+        }
+
+        @Override
+        public int read() throws IOException {
+            int b = super.read();
+            if (b != -1) {
+                trace(peer, "<<<", new byte[] {(byte) b}, 0, 1);
+            }
+            return b;
+        }
+
+        @Override
+        public int read(byte[] buffer, int offset, int length) throws IOException {
+            int count = super.read(buffer, offset, length);
+            trace(peer, "<<<", buffer, offset, count);
+            return count;
+        }
+    }
+
+    private static class TraceOutputStream extends FilterOutputStream {
+        private final String peer;
+
+        TraceOutputStream(OutputStream out, String peer) {
+            super(out);
+            this.peer = peer;
+        }
+
+        @Override
+        public void write(int b) throws IOException {
+            trace(peer, ">>>", new byte[] {(byte) b}, 0, 1);
+            out.write(b);
+        }
+
+        @Override
+        public void write(byte[] buffer, int offset, int length) throws IOException {
+            trace(peer, ">>>", buffer, offset, length);
+            out.write(buffer, offset, length);
+        }
+    }
+
+    /**
+     * Misbehaves on purpose, so clients can be tested against pathological servers. Each
+     * write (a response line or a throughput chunk) is delayed by --delay and --jitter,
+     * then may be dropped (--drop-rate), have one byte corrupted (--garble), or be cut
+     * short when the connection reaches --close-after bytes.
+     */
+    private static class ChaosOutputStream extends FilterOutputStream {
+        private long sent;
+        private volatile String closeReason;
+
+        ChaosOutputStream(OutputStream out) {
+            super(out);
+        }
+
+        @Override
+        public void write(int b) throws IOException {
+            write(new byte[] {(byte) b}, 0, 1);
+        }
+
+        @Override
+        public void write(byte[] buffer, int offset, int length) throws IOException {
+            if (length <= 0) {
+                return;
+            }
+            double delay = chaosDelay + (random.nextDouble() * 2 - 1) * chaosJitter;
+            if (delay > 0) {
+                try {
+                    Thread.sleep((long) delay);
+                } catch (InterruptedException e) {
+                    Thread.currentThread().interrupt();
+                    throw new InterruptedIOException("chaos delay interrupted");
+                }
+            }
+            if (random.nextDouble() < chaosDropRate) {
+                return;
+            }
+            byte[] data = Arrays.copyOfRange(buffer, offset, offset + length);
+            if (random.nextDouble() < chaosGarble) {
+                data[random.nextInt(length)] ^= (byte) (1 + random.nextInt(255));
+            }
+            if (chaosCloseAfter > 0 && sent + length >= chaosCloseAfter) {
+                out.write(data, 0, (int) (chaosCloseAfter - sent));
+                out.flush();
+                out.close();
+                closeReason = "closed after " + chaosCloseAfter + " bytes (--close-after)";
+                throw new ChaosCloseException(closeReason);
+            }
+            sent += length;
+            out.write(data, 0, length);
+        }
+    }
+}
@@ -1,19 +1,769 @@
 #!/usr/bin/env python3
 import asyncio
+import base64
+import csv
+import json
 import socket
 import sys
 import datetime
+import functools
+import gc
 import argparse
-from typing import List, Tuple
+import hashlib
+import hmac
+import http.client
+import io
+import ipaddress
+import re
+import secrets
+import select
+import shlex
+import signal
+import ssl
+import struct
+from typing import Callable, List, NamedTuple, Optional, Tuple
 import logging
 import os
+import queue
+import random
 import subprocess
+import threading
+import time
+import traceback
+import tracemalloc
+import urllib.parse
+import zlib
+from xml.etree import ElementTree
+
+class Tracer:
+    """Hexdump every byte sent and received on traced connections to a file."""
+
+    def __init__(self, path: str):
+        self.file = open(path, "a")
+
+    def record(self, peer: str, direction: str, data: bytes) -> None:
+        """Append a timestamped hexdump of data; direction is '>>>' for sent and '<<<' for received."""
+        if not data:
+            return
+        timestamp = datetime.datetime.now().strftime("%Y-%m-%d %H:%M:%S.%f")
+        lines = [f"{timestamp} {peer} {direction} {len(data)} bytes"]
+        for offset in range(0, len(data), 16):
+            row = data[offset:offset + 16]
+            hex_bytes = " ".join(f"{b:02x}" for b in row[:8]) + "  " + " ".join(f"{b:02x}" for b in row[8:])
+            text = "".join(chr(b) if 0x20 <= b < 0x7f else "." for b in row)
+            lines.append(f"  {offset:08x}  {hex_bytes:<49} |{text}|")
+        self.file.write("\n".join(lines) + "\n")
+        self.file.flush()
+
+    def wrap(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, peer: str) -> Tuple["TracingStream", "TracingStream"]:
+        """Wrap a stream pair so everything passing through it is recorded."""
+        return TracingStream(reader, self, peer), TracingStream(writer, self, peer)
+
+
+class TracingStream:
+    """Proxy for an asyncio stream reader or writer that records data through a Tracer."""
+
+    def __init__(self, stream, tracer: Tracer, peer: str):
+        self._stream = stream
+        self._tracer = tracer
+        self._peer = peer
+
+    async def readline(self) -> bytes:
+        data = await self._stream.readline()
+        self._tracer.record(self._peer, "<<<", data)
+        return data
+
+    async def read(self, n: int = -1) -> bytes:
+        data = await self._stream.read(n)
+        self._tracer.record(self._peer, "<<<", data)
+        return data
+
+    async def readexactly(self, n: int) -> bytes:
+        data = await self._stream.readexactly(n)
+        self._tracer.record(self._peer, "<<<", data)
+        return data
+
+    def write(self, data: bytes) -> None:
+        self._tracer.record(self._peer, ">>>", data)
+        self._stream.write(data)
+
+    def __getattr__(self, name):
+        return getattr(self._stream, name)
+
+
+class TokenBucket:
+    """Token bucket rate limiter in bytes per second, shareable between connections."""
+
+    def __init__(self, rate: float, clock: Callable[[], float] = time.monotonic):
+        self.rate = rate
+        self.clock = clock
+        # One second's worth of burst
+        self.tokens = rate
+        self.updated = clock()
+
+    def take(self, amount: int) -> float:
+        """Take amount tokens, going into debt if there are too few; returns seconds until the debt is repaid."""
+        now = self.clock()
+        self.tokens = min(self.rate, self.tokens + (now - self.updated) * self.rate)
+        self.updated = now
+        self.tokens -= amount
+        return max(0.0, -self.tokens / self.rate)
+
+
+class ThrottledStream:
+    """Proxy for an asyncio stream writer that holds written data back until its token buckets allow it."""
+
+    def __init__(self, stream, buckets: List[TokenBucket]):
+        self._stream = stream
+        self._buckets = buckets
+        self._pending = b""
+
+    def write(self, data: bytes) -> None:
+        self._pending += data
+
+    async def drain(self) -> None:
+        data, self._pending = self._pending, b""
+        if data:
+            await asyncio.sleep(max((bucket.take(len(data)) for bucket in self._buckets), default=0))
+            self._stream.write(data)
+        await self._stream.drain()
+
+    def __getattr__(self, name):
+        return getattr(self._stream, name)
+
+
+class ChaosStream:
+    """Proxy for an asyncio stream writer that misbehaves on purpose, to test clients against pathological servers.
+
+    Each drain is one write: a response line or a throughput chunk. It is delayed, then may be dropped, have a
+    byte garbled, or be cut off when the connection reaches its byte limit.
+    """
+
+    def __init__(self, stream, chaos: dict):
+        self._stream = stream
+        self._chaos = chaos
+        self._pending = b""
+        self._sent = 0
+
+    def write(self, data: bytes) -> None:
+        self._pending += data
+
+    async def drain(self) -> None:
+        data, self._pending = self._pending, b""
+        if data:
+            chaos = self._chaos
+            delay = chaos["delay"] + random.uniform(-chaos["jitter"], chaos["jitter"])
+            if delay > 0:
+                await asyncio.sleep(delay / 1000)
+            if random.random() < chaos["drop_rate"]:
+                return
+            if random.random() < chaos["garble"]:
+                index = random.randrange(len(data))
+                data = data[:index] + bytes([data[index] ^ random.randint(1, 255)]) + data[index + 1:]
+            limit = chaos["close_after"]
+            if limit and self._sent + len(data) >= limit:
+                self._stream.write(data[:limit - self._sent])
+                await self._stream.drain()
+                self._stream.close()
+                raise ConnectionAbortedError(f"closed after {limit} bytes (--close-after)")
+            self._sent += len(data)
+            self._stream.write(data)
+        await self._stream.drain()
+
+    def __getattr__(self, name):
+        return getattr(self._stream, name)
+
+
+class SyslogHandler(logging.Handler):
+    """Ship log records as RFC 5424 syslog messages to a collector over IPv6.
+
+    The URL is udp://, tcp:// (octet-counted framing, RFC 6587) or tls:// (RFC 5425), with optional
+    facility= and, for tls, ca= query parameters. Stream transports send from a background thread, so a slow
+    or unreachable collector never stalls the event loop; records that don't fit in its queue are dropped.
+    """
+
+    QUEUE_SIZE = 1000
+    FACILITIES = {"user": 1, "daemon": 3, **{f"local{number}": 16 + number for number in range(8)}}
+    DEFAULT_PORTS = {"udp": 514, "tcp": 514, "tls": 6514}
+
+    def __init__(self, url: str, app_name: str):
+        super().__init__()
+        parts = urllib.parse.urlsplit(url)
+        query = dict(urllib.parse.parse_qsl(parts.query))
+        if parts.scheme not in self.DEFAULT_PORTS or not parts.hostname:
+            raise ValueError(f"invalid syslog URL '{url}': expected udp://, tcp:// or tls://[ADDRESS]:PORT")
+        if query.get("facility", "user") not in self.FACILITIES:
+            raise ValueError(f"unknown syslog facility '{query['facility']}'")
+        self.transport = parts.scheme
+        self.facility = self.FACILITIES[query.get("facility", "user")]
+        # Collectors must be reached over IPv6; that is part of what this tests
+        self.address = socket.getaddrinfo(parts.hostname, parts.port or self.DEFAULT_PORTS[parts.scheme],
+                                          socket.AF_INET6, socket.SOCK_STREAM)[0][4]
+        self.server_name = parts.hostname
+        self.context = None
+        if self.transport == "tls":
+            self.context = ssl.create_default_context(cafile=query.get("ca"))
+        self.app_name = re.sub(r"[^!-~]", "_", app_name)[:48] or "-"
+        self.hostname = socket.gethostname()[:255] or "-"
+        self.sequence = 0
+        self.sock = None
+        self.connect()
+        self.queue = None
+        self.sender = None
+        if self.transport != "udp":
+            self.start_sender()
+            # A forked worker gets neither the sender thread nor a stream of its own to share
+            os.register_at_fork(after_in_child=self.start_sender)
+
+    def start_sender(self) -> None:
+        if self.sender is not None and self.sock is not None:
+            self.sock.close()
+            self.sock = None
+        self.queue = queue.Queue(self.QUEUE_SIZE)
+        self.sender = threading.Thread(target=self.send_queued, name="syslog", daemon=True)
+        self.sender.start()
+
+    def send_queued(self) -> None:
+        while (message := self.queue.get()) is not None:
+            self.send(message)
+
+    def connect(self) -> None:
+        if self.transport == "udp":
+            self.sock = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+            self.sock.connect(self.address)
+            return
+        sock = socket.create_connection(self.address[:2], timeout=5)
+        self.sock = self.context.wrap_socket(sock, server_hostname=self.server_name) if self.context else sock
+
+    def emit(self, record: logging.LogRecord) -> None:
+        text = self.format(record).strip()
+        if not text:
+            return
+        severity = 3 if record.levelno >= logging.ERROR else 4 if record.levelno >= logging.WARNING else \
+            6 if record.levelno >= logging.INFO else 7
+        self.sequence += 1
+        timestamp = datetime.datetime.fromtimestamp(record.created).astimezone().isoformat(timespec="microseconds")
+        # The meta SD-ID's sequenceId lets the collector spot messages lost in transit (RFC 5424 section 7.3.1)
+        message = (f"<{self.facility * 8 + severity}>1 {timestamp} {self.hostname} {self.app_name} {os.getpid()} - "
+                   f"[meta sequenceId=\"{self.sequence}\"] ").encode() + b"\xef\xbb\xbf" + text.encode()
+        if self.queue is None:
+            if not self.send(message):
+                self.handleError(record)
+            return
+        try:
+            self.queue.put_nowait(message)
+        except queue.Full:
+            # The collector is down or too slow; the gap in sequenceId shows it what was lost
+            pass
+
+    def send(self, message: bytes) -> bool:
+        for _ in range(2):
+            try:
+                if self.sock is None:
+                    self.connect()
+                if self.transport == "udp":
+                    self.sock.send(message)
+                else:
+                    self.sock.sendall(f"{len(message)} ".encode() + message)
+                return True
+            except OSError:
+                if self.sock is not None:
+                    self.sock.close()
+                    self.sock = None
+        return False
+
+    def close(self) -> None:
+        if self.sender is not None and self.sender.is_alive():
+            # Flush what is queued at exit, but don't hang on a collector that is down
+            try:
+                self.queue.put(None, timeout=1)
+                self.sender.join(5)
+            except queue.Full:
+                pass
+        if self.sock is not None:
+            self.sock.close()
+            self.sock = None
+        super().close()
+
+
+class FlowExporter:
+    """Export an IPFIX (RFC 7011) flow record for each handled connection to a collector over UDP."""
+
+    TEMPLATE_ID = 256
+    # (information element, length): source and destination address and port, protocol, octets,
+    # flowStartMilliseconds, flowEndMilliseconds and flowEndReason
+    FIELDS = ((27, 16), (28, 16), (7, 2), (11, 2), (4, 1), (1, 8), (152, 8), (153, 8), (136, 1))
+    # Collectors forget templates received over UDP, so resend it this often (RFC 7011 section 8.4)
+    TEMPLATE_REFRESH = 60
+
+    def __init__(self, address: tuple):
+        self.sock = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+        self.sock.connect(address)
+        self.pid = None
+        self.sequence = 0
+        self.template_sent = None
+
+    def export(self, source: tuple, destination: tuple, octets: int, start_ms: int, end_ms: int,
+               end_reason: int) -> None:
+        """Send one TCP flow record; source and destination are (address, port) pairs."""
+        if self.pid != os.getpid():
+            # Each forked worker is its own observation domain, with its own sequence numbers and template
+            self.pid, self.sequence, self.template_sent = os.getpid(), 0, None
+        now = time.monotonic()
+        sets = b""
+        if self.template_sent is None or now - self.template_sent >= self.TEMPLATE_REFRESH:
+            template = struct.pack("!HH", self.TEMPLATE_ID, len(self.FIELDS)) + \
+                b"".join(struct.pack("!HH", *field) for field in self.FIELDS)
+            sets += struct.pack("!HH", 2, 4 + len(template)) + template
+            self.template_sent = now
+        record = (ipaddress.IPv6Address(source[0]).packed + ipaddress.IPv6Address(destination[0]).packed
+                  + struct.pack("!HHBQQQB", source[1], destination[1], socket.IPPROTO_TCP, octets, start_ms, end_ms,
+                                end_reason))
+        sets += struct.pack("!HH", self.TEMPLATE_ID, 4 + len(record)) + record
+        header = struct.pack("!HHIII", 10, 16 + len(sets), int(time.time()), self.sequence, self.pid & 0xffffffff)
+        # The sequence number counts data records sent before this message
+        self.sequence = (self.sequence + 1) & 0xffffffff
+        try:
+            self.sock.send(header + sets)
+        except OSError:
+            # Flow export is best effort; a missing collector must not affect the test service
+            pass
+
+
+DNS_TYPES = {
+    "A": 1, "NS": 2, "CNAME": 5, "SOA": 6, "PTR": 12, "MX": 15, "TXT": 16,
+    "AAAA": 28, "SRV": 33, "OPT": 41, "RRSIG": 46, "SVCB": 64, "HTTPS": 65, "ANY": 255,
+}
+DNS_TYPE_NAMES = {value: name for name, value in DNS_TYPES.items()}
+# SvcParamKeys of SVCB and HTTPS records (RFC 9460 section 14.3.2)
+SVCB_KEYS = {0: "mandatory", 1: "alpn", 2: "no-default-alpn", 3: "port", 4: "ipv4hint", 5: "ech", 6: "ipv6hint"}
+DNS_RCODES = {0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED"}
+DNS_RCODE_VALUES = {name: value for value, name in DNS_RCODES.items()}
+DNS_CLASS_IN = 1
+DNS_CLASS_CH = 3
+
+
+class DNSRecord(NamedTuple):
+    """A resource record; value holds the presentation form of rdata."""
+    name: str
+    type: int
+    rclass: int
+    ttl: int
+    rdata: bytes
+    value: str = ""
+
+
+class DNSMessage:
+    """Minimal DNS message encoder and decoder (RFC 1035) used by the DNS tools."""
+    QR = 0x8000
+    AA = 0x0400
+    TC = 0x0200
+    RD = 0x0100
+    RA = 0x0080
+    AD = 0x0020
+    CD = 0x0010
+
+    def __init__(self, id: int = 0, flags: int = 0):
+        self.id = id
+        self.flags = flags
+        self.questions: List[Tuple[str, int, int]] = []
+        self.answers: List[DNSRecord] = []
+        self.authority: List[DNSRecord] = []
+        self.additional: List[DNSRecord] = []
+
+    @property
+    def rcode(self) -> int:
+        return self.flags & 0x000f
+
+    @staticmethod
+    def encode_name(name: str) -> bytes:
+        """Encode a domain name as uncompressed wire-format labels."""
+        encoded = b""
+        for label in name.rstrip(".").split("."):
+            if not label:
+                continue
+            # DNS-SD instance names are raw UTF-8; IDNs should be given in punycode
+            raw = label.encode()
+            if len(raw) > 63:
+                raise ValueError(f"label '{label}' is longer than 63 bytes")
+            encoded += bytes([len(raw)]) + raw
+        return encoded + b"\x00"
+
+    @staticmethod
+    def decode_name(data: bytes, offset: int) -> Tuple[str, int]:
+        """Decode a possibly compressed name, returning it and the offset just past it."""
+        labels = []
+        end = None
+        for _ in range(128):
+            length = data[offset]
+            if length & 0xc0 == 0xc0:
+                if end is None:
+                    end = offset + 2
+                offset = ((length & 0x3f) << 8) | data[offset + 1]
+                continue
+            if length == 0:
+                name = ".".join(labels) + "."
+                return name, end if end is not None else offset + 1
+            labels.append(data[offset + 1:offset + 1 + length].decode(errors="replace"))
+            offset += 1 + length
+        raise ValueError("too many compression pointers in name")
+
+    @staticmethod
+    def format_rdata(rtype: int, data: bytes, offset: int, length: int) -> str:
+        """Render rdata in presentation format; names inside rdata may point into data."""
+        rdata = data[offset:offset + length]
+        if rtype == DNS_TYPES["A"] and length == 4:
+            return str(ipaddress.IPv4Address(rdata))
+        if rtype == DNS_TYPES["AAAA"] and length == 16:
+            return str(ipaddress.IPv6Address(rdata))
+        if rtype in (DNS_TYPES["NS"], DNS_TYPES["CNAME"], DNS_TYPES["PTR"]):
+            return DNSMessage.decode_name(data, offset)[0]
+        if rtype == DNS_TYPES["MX"]:
+            return f"{int.from_bytes(rdata[:2], 'big')} {DNSMessage.decode_name(data, offset + 2)[0]}"
+        if rtype == DNS_TYPES["SRV"]:
+            priority, weight, port = struct.unpack("!HHH", rdata[:6])
+            return f"{priority} {weight} {port} {DNSMessage.decode_name(data, offset + 6)[0]}"
+        if rtype == DNS_TYPES["SOA"]:
+            mname, position = DNSMessage.decode_name(data, offset)
+            rname, position = DNSMessage.decode_name(data, position)
+            serial, refresh, retry, expire, minimum = struct.unpack("!IIIII", data[position:position + 20])
+            return f"{mname} {rname} {serial} {refresh} {retry} {expire} {minimum}"
+        if rtype == DNS_TYPES["TXT"]:
+            strings, position = [], 0
+            while position < length:
+                size = rdata[position]
+                strings.append(rdata[position + 1:position + 1 + size].decode(errors="replace"))
+                position += 1 + size
+            return " ".join(json.dumps(text) for text in strings)
+        if rtype == DNS_TYPES["RRSIG"] and length > 18:
+            covered, algorithm, labels, ttl, expiration, inception, key_tag = struct.unpack("!HBBIIIH", rdata[:18])
+            signer, position = DNSMessage.decode_name(rdata, 18)
+            times = [datetime.datetime.fromtimestamp(value, datetime.timezone.utc).strftime("%Y%m%d%H%M%S")
+                     for value in (expiration, inception)]
+            return (f"{DNS_TYPE_NAMES.get(covered, covered)} {algorithm} {labels} {ttl} {times[0]} {times[1]} "
+                    f"{key_tag} {signer} {base64.b64encode(rdata[position:]).decode()}")
+        if rtype in (DNS_TYPES["SVCB"], DNS_TYPES["HTTPS"]):
+            priority, target, params = DNSMessage.decode_svcb(rdata)
+            return " ".join([str(priority), target] + [DNSMessage.format_svc_param(key, value)
+                                                       for key, value in params])
+        return f"\\# {length} {rdata.hex()}"
+
+    @staticmethod
+    def decode_svcb(rdata: bytes) -> Tuple[int, str, List[Tuple[int, bytes]]]:
+        """Split SVCB or HTTPS rdata into its priority, target name and SvcParams (RFC 9460 section 2.2)."""
+        priority = int.from_bytes(rdata[:2], "big")
+        # The target name is never compressed, so it decodes from the rdata alone
+        target, position = DNSMessage.decode_name(rdata, 2)
+        params = []
+        while position < len(rdata):
+            key, size = struct.unpack("!HH", rdata[position:position + 4])
+            if position + 4 + size > len(rdata):
+                raise ValueError("SvcParam runs past the end of the record")
+            params.append((key, rdata[position + 4:position + 4 + size]))
+            position += 4 + size
+        return priority, target, params
+
+    @staticmethod
+    def format_svc_param(key: int, value: bytes) -> str:
+        """Render one SvcParam in presentation format, e.g. alpn=h2,h3 or ipv6hint=2001:db8::1."""
+        name = SVCB_KEYS.get(key, f"key{key}")
+        if key == 0 and len(value) % 2 == 0:
+            keys = [SVCB_KEYS.get(number, f"key{number}") for (number,) in struct.iter_unpack("!H", value)]
+            return f"{name}={','.join(keys)}"
+        if key == 1:
+            protocols, position = [], 0
+            while position < len(value):
+                protocols.append(value[position + 1:position + 1 + value[position]].decode(errors="replace"))
+                position += 1 + value[position]
+            return f"{name}={','.join(protocols)}"
+        if key == 2:
+            return name
+        if key == 3 and len(value) == 2:
+            return f"{name}={int.from_bytes(value, 'big')}"
+        if key == 4 and len(value) % 4 == 0:
+            addresses = [str(ipaddress.IPv4Address(value[start:start + 4])) for start in range(0, len(value), 4)]
+            return f"{name}={','.join(addresses)}"
+        if key == 5:
+            return f"{name}={base64.b64encode(value).decode()}"
+        if key == 6 and len(value) % 16 == 0:
+            addresses = [str(ipaddress.IPv6Address(value[start:start + 16])) for start in range(0, len(value), 16)]
+            return f"{name}={','.join(addresses)}"
+        return f"{name}={value.hex()}"
+
+    @staticmethod
+    def encode_rdata(rtype: int, value: str) -> bytes:
+        """Encode presentation-format rdata for the record types the responder serves."""
+        if rtype == DNS_TYPES["A"]:
+            return ipaddress.IPv4Address(value).packed
+        if rtype == DNS_TYPES["AAAA"]:
+            return ipaddress.IPv6Address(value).packed
+        if rtype in (DNS_TYPES["NS"], DNS_TYPES["CNAME"], DNS_TYPES["PTR"]):
+            return DNSMessage.encode_name(value)
+        if rtype == DNS_TYPES["MX"]:
+            preference, exchange = value.split()
+            return struct.pack("!H", int(preference)) + DNSMessage.encode_name(exchange)
+        if rtype == DNS_TYPES["SRV"]:
+            priority, weight, port, target = value.split()
+            return struct.pack("!HHH", int(priority), int(weight), int(port)) + DNSMessage.encode_name(target)
+        if rtype == DNS_TYPES["SOA"]:
+            mname, rname, *numbers = value.split()
+            return (DNSMessage.encode_name(mname) + DNSMessage.encode_name(rname) +
+                    struct.pack("!IIIII", *(int(number) for number in numbers)))
+        if rtype == DNS_TYPES["TXT"]:
+            encoded = b""
+            for text in shlex.split(value):
+                raw = text.encode()
+                for start in range(0, max(len(raw), 1), 255):
+                    chunk = raw[start:start + 255]
+                    encoded += bytes([len(chunk)]) + chunk
+            return encoded
+        raise ValueError(f"unsupported record type {DNS_TYPE_NAMES.get(rtype, rtype)}")
+
+    def encode(self) -> bytes:
+        """Encode the message without name compression."""
+        data = struct.pack("!HHHHHH", self.id, self.flags, len(self.questions), len(self.answers),
+                           len(self.authority), len(self.additional))
+        for name, qtype, qclass in self.questions:
+            data += self.encode_name(name) + struct.pack("!HH", qtype, qclass)
+        for record in self.answers + self.authority + self.additional:
+            data += self.encode_name(record.name)
+            data += struct.pack("!HHIH", record.type, record.rclass, record.ttl, len(record.rdata)) + record.rdata
+        return data
+
+    @classmethod
+    def decode(cls, data: bytes) -> "DNSMessage":
+        """Decode a wire-format message; raises ValueError if it is malformed."""
+        try:
+            id, flags, qdcount, ancount, nscount, arcount = struct.unpack("!HHHHHH", data[:12])
+            message = cls(id, flags)
+            offset = 12
+            for _ in range(qdcount):
+                name, offset = cls.decode_name(data, offset)
+                qtype, qclass = struct.unpack("!HH", data[offset:offset + 4])
+                message.questions.append((name, qtype, qclass))
+                offset += 4
+            for section, count in ((message.answers, ancount), (message.authority, nscount),
+                                   (message.additional, arcount)):
+                for _ in range(count):
+                    name, offset = cls.decode_name(data, offset)
+                    rtype, rclass, ttl, length = struct.unpack("!HHIH", data[offset:offset + 10])
+                    offset += 10
+                    if offset + length > len(data):
+                        raise ValueError("record data runs past the end of the message")
+                    value = cls.format_rdata(rtype, data, offset, length) if rtype != DNS_TYPES["OPT"] else ""
+                    section.append(DNSRecord(name, rtype, rclass, ttl, data[offset:offset + length], value))
+                    offset += length
+        except (IndexError, struct.error, UnicodeError) as e:
+            raise ValueError(f"malformed DNS message: {e}") from e
+        return message
+
+    def edns_payload_size(self) -> Optional[int]:
+        """Return the UDP payload size advertised in an OPT record, if present."""
+        for record in self.additional:
+            if record.type == DNS_TYPES["OPT"]:
+                return record.rclass
+        return None
+
 
 class IPv6Tester:
     DEFAULT_PORT = 8080
     DEFAULT_IPV6_ADDRESS = "::1"
     MAX_CLIENTS = 10
+    MAX_LINE_LENGTH = 4096
+    MAX_CONNECTION_BYTES = 1024 * 1024
+    READ_TIMEOUT = 60
+    MIN_RATE_GRACE = 10
+    SD_LISTEN_FDS_START = 3
+    DIAG_HEAP_TOP = 25
+    MAX_POW_BITS = 28
+    AUTH_HELP = ("Authenticate first, with the secret in IPV6_TESTER_SECRET if set and any proof of work the server "
+                 "asks for")
+    MAX_THROUGHPUT_SECONDS = 60
+    THROUGHPUT_CHUNK = 65536
+    SERVER_FEATURES = ("trace", "verified-echo", "callback", "one-way-delay", "throughput", "auth", "proof-of-work",
+                       "sessions", "rate-limits", "min-rate", "chaos", "fuzz", "diagnostics")
+    FUZZ_CASES = ("huge", "nul", "utf8", "split", "unterminated")
+    FUZZ_HUGE_LENGTH = 1024 * 1024
+    # Longest server response line client and verify accept
+    CLIENT_MAX_LINE = 65536
+    SESSION_LABEL = re.compile(r"[A-Za-z0-9][A-Za-z0-9_.-]{0,63}")
+    MAX_SESSIONS = 1000
+    SESSION_EXPIRY = 3600
+    SESSION_HELP = "Label the test with a session name, so a shared server keeps its stats and logs apart"
     DATE_FORMAT = "%Y-%m-%d %H:%M:%S"
+    # Response fields that differ on every run or server, masked before replay compares responses
+    REPLAY_VOLATILE = [
+        (re.compile(rb"\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?"), b"<time>"),
+        (re.compile(rb"(?m)^(Server received your message at .*? at address )\S+"), rb"\1<address>"),
+        (re.compile(rb"(?m)^(TIME \S+) \d+ \d+"), rb"\1 <time> <time>"),
+        (re.compile(rb"(?m)^THROUGHPUT RESULT .*"), b"THROUGHPUT RESULT <counts>"),
+    ]
+    LINK_LOCAL_PREFIX = ipaddress.IPv6Network("fe80::/64")
+    NAT64_PREFIX = ipaddress.IPv6Network("64:ff9b::/96")
+    DNS_DEFAULT_ZONE = "ipv6.test."
+    DNS_UDP_PAYLOAD_SIZE = 512
+    DNS_MAX_UDP_PAYLOAD_SIZE = 4096
+    DEFAULT_RESOLVER = "2606:4700:4700::1111"
+    DNS_TRANSPORT_LABELS = {"do53": "Do53", "dot": "DoT", "doh": "DoH"}
+    MDNS_GROUP = "ff02::fb"
+    MDNS_PORT = 5353
+    MDNS_SERVICES = "_services._dns-sd._udp.local."
+    DEFAULT_NTP_SERVER = "2.pool.ntp.org"
+    NTP_EPOCH_OFFSET = 2208988800
+    BANNER_SERVICES = {"ftp": 21, "ssh": 22, "smtp": 25, "http": 80, "pop3": 110, "imap": 143}
+    # Key exchange methods whose client public value can be sent without real key material;
+    # host key algorithms are requested one family per connection so each key is collected.
+    SSH_KEX_ALGORITHMS = ["curve25519-sha256", "curve25519-sha256@libssh.org",
+                          "ecdh-sha2-nistp256", "diffie-hellman-group14-sha256"]
+    SSH_HOST_KEY_FAMILIES = [
+        ["ssh-ed25519"],
+        ["ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521"],
+        ["rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"],
+    ]
+    SSH_CIPHERS = "aes128-ctr,aes256-ctr,aes128-gcm@openssh.com,aes256-gcm@openssh.com,chacha20-poly1305@openssh.com"
+    SSH_MACS = "hmac-sha2-256,hmac-sha2-512,hmac-sha1"
+    P256_GENERATOR = bytes.fromhex(
+        "04"
+        "6b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296"
+        "4fe342e2fe1a7f9b8ee7eb4a7c0f9e162bce33576b315ececbb6406837bf51f5")
+    X509_NAME_ATTRIBUTES = {b"\x55\x04\x03": "CN", b"\x55\x04\x0a": "O", b"\x55\x04\x0b": "OU", b"\x55\x04\x06": "C"}
+    X509_SUBJECT_ALT_NAME = b"\x55\x1d\x11"
+    SNMP_SYSTEM = {"sysDescr": "1.3.6.1.2.1.1.1.0", "sysObjectID": "1.3.6.1.2.1.1.2.0",
+                   "sysUpTime": "1.3.6.1.2.1.1.3.0", "sysName": "1.3.6.1.2.1.1.5.0"}
+    SNMP_IF_ENTRY = "1.3.6.1.2.1.2.2.1"
+    # ifTable columns fetched per row, in display order
+    SNMP_IF_COLUMNS = {"ifDescr": 2, "ifAdminStatus": 7, "ifOperStatus": 8, "ifSpeed": 5}
+    SNMP_IF_STATUS = {"1": "up", "2": "down", "3": "testing", "5": "dormant", "6": "absent", "7": "lowlyr"}
+    SNMP_ERRORS = {1: "tooBig", 2: "noSuchName", 3: "badValue", 4: "readOnly", 5: "genErr", 6: "noAccess"}
+    EDNS_NSID = 3
+    ANYCAST_HTTP_HEADERS = ["cf-ray", "x-amz-cf-pop", "x-served-by", "x-cache", "via", "server"]
+    UDP_TEST_PORT = 5201
+    UDP_TEST_MAGIC = b"V6UT"
+    UDP_TEST_DATA, UDP_TEST_END, UDP_TEST_INTERVAL, UDP_TEST_SUMMARY = range(4)
+    # magic, type, session, sequence, send time (ns), report interval (ms)
+    UDP_TEST_HEADER = struct.Struct("!4sBxxxIIQI")
+    # magic, type, session, interval index (or datagrams sent), received, lost, duplicates, reordered, jitter (us)
+    UDP_TEST_REPORT = struct.Struct("!4sBxxxIIIIIII")
+    FLEET_PORT = 8091
+    ARPHRD_SIT = 776
+    ENCAP_PORT = 4141
+    ENCAP_MAGIC = b"V6ENCAP"
+    # Encapsulation name -> (IPv4 protocol, header before the IPv6 packet); GRE carries IPv6 as 0x86dd
+    ENCAPSULATIONS = {"6in4": (41, b""), "gre": (47, b"\x00\x00\x86\xdd")}
+    ENCAP_INNER = (ipaddress.IPv6Address("2001:db8::41:1"), ipaddress.IPv6Address("2001:db8::41:2"))
+    SRV6_NEXT_HEADERS = {4: "IPv4", 6: "TCP", 17: "UDP", 41: "IPv6", 58: "ICMPv6", 59: "none", 143: "Ethernet"}
+    SRV6_TLVS = {5: "HMAC"}
+    FLEET_PROBE_PORT = 5202
+    FLEET_PROBE_MAGIC = b"V6FL"
+    FLEET_PROBE_TIMEOUT = 1.0
+    FLEET_MAX_PROBES = 100
+    FLEET_HEARTBEAT = 10
+    FLEET_MISSED_HEARTBEATS = 3
+    FLEET_MAX_RECONNECT_DELAY = 60
+    PROBE_METHODS = {
+        "raw": "raw ICMPv6 socket",
+        "icmp": "unprivileged ICMPv6 datagram socket",
+        "udp": "UDP probes",
+    }
+    TRACEROUTE_PORT = 33434
+    SO_EE_ORIGIN_ICMP6 = 3
+    HEALTH_PORT = 8086
+    PCP_PORT = 5351
+    PCP_RESULTS = {
+        0: "SUCCESS", 1: "UNSUPP_VERSION", 2: "NOT_AUTHORIZED", 3: "MALFORMED_REQUEST", 4: "UNSUPP_OPCODE",
+        5: "UNSUPP_OPTION", 6: "MALFORMED_OPTION", 7: "NETWORK_FAILURE", 8: "NO_RESOURCES",
+        9: "UNSUPP_PROTOCOL", 10: "USER_EX_QUOTA", 11: "CANNOT_PROVIDE_EXTERNAL", 12: "ADDRESS_MISMATCH",
+        13: "EXCESSIVE_REMOTE_PEERS",
+    }
+    SSDP_PORT = 1900
+    UPNP_FIREWALL_SERVICE = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+    CALLBACK_TIMEOUT = 5
+    MYIP_URL = "https://api6.ipify.org"
+    DEFAULT_STUN_SERVER = "stun.l.google.com:19302"
+    STUN_PORT = 3478
+    STUN_MAGIC_COOKIE = 0x2112A442
+    RDAP_BOOTSTRAP = "https://data.iana.org/rdap/ipv6.json"
+    RIPESTAT_URL = "https://stat.ripe.net/data/"
+    RTR_PORT = 3323
+    BACKLOG_MAX_CONNECTIONS = 5000
+    NDP_SCAN_MAX_ADDRESSES = 65536
+    NDP_SCAN_MAX_RATE = 500
+    # Seconds by which two routers' prefix lifetimes may disagree once the time between their RAs is accounted for
+    RA_LIFETIME_TOLERANCE = 10
+    IDLE_LISTEN_BACKLOG = 4096
+    DISCARD_BUFFER_SIZE = 1024 * 1024
+    CLASSIC_SERVICES = {"echo": 7, "discard": 9, "daytime": 13, "chargen": 19, "time": 37}
+    # UDP reply bytes per second to each source address, so a spoofed source can't turn us into an amplifier
+    CLASSIC_UDP_RATE = 4096
+    CLASSIC_UDP_MAX_SOURCES = 10000
+    # Weighted payload sizes, DSCP values and protocols, average packets per second and burst length
+    GENERATE_PROFILES = {
+        "imix": {"sizes": "64:7,570:4,1400:1", "dscp": "0", "mix": "udp", "rate": 1000, "burst": 1},
+        "voip": {"sizes": "160", "dscp": "46", "mix": "udp", "rate": 50, "burst": 1},
+        "video": {"sizes": "1200:9,300:1", "dscp": "34", "mix": "udp", "rate": 900, "burst": 30},
+        "bulk": {"sizes": "1400", "dscp": "8", "mix": "tcp", "rate": 0, "burst": 64},
+        "mixed": {"sizes": "160:2,1200:3,1400:5", "dscp": "46:2,34:3,0:5", "mix": "udp:4,tcp:1", "rate": 2000,
+                  "burst": 4},
+    }
+    PROXY_VARIABLES = ["http_proxy", "https_proxy", "all_proxy", "HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY"]
+    MAC_ADDRESS = re.compile(r"[0-9A-Fa-f]{2}(?::[0-9A-Fa-f]{2}){5,7}")
+    # Loose match for anything that might be an IPv6 address in free-form text;
+    # candidates are validated with the ipaddress module before being rewritten.
+    IPV6_CANDIDATE = re.compile(r"(?<![\w.:])[0-9A-Fa-f.]*:[0-9A-Fa-f:.]*(?:%[\w-]+)?(?:/\d{1,3})?(?![\w:])")
+    DEFAULT_ANONYMIZE_PREFIX = 48
+    ADDRESS_CLASSES = {
+        "gua": ipaddress.IPv6Network("2000::/3"),
+        "ula": ipaddress.IPv6Network("fd00::/8"),
+        "link-local": ipaddress.IPv6Network("fe80::/64"),
+    }
+    MULTICAST_SCOPES = {
+        "interface": 0x1, "link": 0x2, "realm": 0x3, "admin": 0x4,
+        "site": 0x5, "organization": 0x8, "global": 0xe,
+    }
+    # In-line address lengths in bytes for each (M, AC, AM) combination of RFC 6282.
+    # Combinations that are missing from the table are reserved.
+    LOWPAN_INLINE_LENGTHS = {
+        (0, 0, 0): 16, (0, 0, 1): 8, (0, 0, 2): 2, (0, 0, 3): 0,
+        (0, 1, 0): 0, (0, 1, 1): 8, (0, 1, 2): 2, (0, 1, 3): 0,
+        (1, 0, 0): 16, (1, 0, 1): 6, (1, 0, 2): 4, (1, 0, 3): 1,
+        (1, 1, 0): 6,
+    }
+    # Default policy table of RFC 6724 section 2.1: prefix, precedence, label; longest prefixes first
+    RFC6724_POLICY = [
+        ("::1/128", 50, 0), ("::ffff:0:0/96", 35, 4), ("::/96", 1, 3), ("2001::/32", 5, 5), ("2002::/16", 30, 2),
+        ("3ffe::/16", 1, 12), ("fec0::/10", 1, 11), ("fc00::/7", 3, 13), ("::/0", 40, 1),
+    ]
+    # glibc's built-in tables when gai.conf doesn't replace them; these are still RFC 3484's
+    GLIBC_LABELS = {"::1/128": 0, "2002::/16": 2, "::/96": 3, "::ffff:0:0/96": 4, "fec0::/10": 5, "fc00::/7": 6,
+                    "2001::/32": 7, "::/0": 1}
+    GLIBC_PRECEDENCES = {"::1/128": 50, "2002::/16": 30, "::/96": 20, "::ffff:0:0/96": 10, "::/0": 40}
+    # 6to4 and Teredo, which RFC 6724 rule 7 ranks below native transport
+    TUNNELED_PREFIXES = [ipaddress.IPv6Network("2002::/16"), ipaddress.IPv6Network("2001::/32")]
+    # Accepted values of each IPv6 knob per sysconfig profile; knobs a profile doesn't list are not checked
+    SYSCONFIG_PROFILES = {
+        "host": {"disable_ipv6": ("0",), "forwarding": ("0",), "accept_ra": ("1", "2"), "use_tempaddr": ("2",),
+                 "autoconf": ("1",), "prefer_ipv6": ("1",)},
+        "router": {"disable_ipv6": ("0",), "forwarding": ("1",), "accept_ra": ("0", "2"), "use_tempaddr": ("0", "-1"),
+                   "accept_redirects": ("0",), "prefer_ipv6": ("1",)},
+        "server": {"disable_ipv6": ("0",), "forwarding": ("0",), "use_tempaddr": ("0", "-1"),
+                   "accept_redirects": ("0",), "prefer_ipv6": ("1",)},
+    }
+    # Why each profile wants its values, shown with a deviation
+    SYSCONFIG_KNOBS = {
+        "disable_ipv6": dict.fromkeys(("host", "router", "server"), "IPv6 must be enabled"),
+        "forwarding": {"host": "hosts don't route packets", "router": "a router forwards packets",
+                       "server": "servers don't route packets"},
+        "accept_ra": {"host": "hosts take their prefixes and default route from router advertisements",
+                      "router": "with forwarding on, 1 ignores router advertisements; 2 accepts them, 0 is static"},
+        "use_tempaddr": {"host": "temporary addresses keep outgoing connections private",
+                         "router": "a router's addresses must be stable",
+                         "server": "allowlists and logs need stable source addresses"},
+        "autoconf": {"host": "SLAAC gives the host its addresses"},
+        "accept_redirects": {"router": "routers should not follow redirects",
+                             "server": "spoofed redirects can divert a server's traffic"},
+        "prefer_ipv6": dict.fromkeys(("host", "router", "server"),
+                                     "the prefix policies should rank IPv6 above IPv4-mapped addresses"),
+    }
 
     def __init__(self):
         self.logger = logging.getLogger(__name__)
@@ -22,13 +772,108 @@ class IPv6Tester:
         formatter = logging.Formatter('%(message)s')
         handler.setFormatter(formatter)
         self.logger.addHandler(handler)
+        self.tracer = None
+        # Read by the rate limits, read timeouts and session expiry; unit tests swap in a fake clock
+        self.clock = time.monotonic
+        self.started = self.clock()
+        self.server_stats = {"accepted": 0, "active": 0, "rejected": 0, "bytes_received": 0}
+        # Named test sessions, so teams sharing a server can tell their results apart: label -> stats and bucket
+        self.sessions = {}
+        # Abuse protection for public servers: a shared secret, a proof of work, or both
+        self.auth_secret = None
+        self.pow_bits = 0
+        # IPFIX export of handled connections, so the server doubles as a flow-export test source
+        self.flow_exporter = None
+        # Deliberate misbehavior for client resilience tests: delay and jitter in ms, probabilities, a byte limit
+        self.chaos = None
+        # Whether FUZZ frames get their adversarial responses
+        self.fuzz = False
+
+    def trace(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, peer: str):
+        """Return the stream pair, wrapped for tracing when --trace is enabled."""
+        if self.tracer is None:
+            return reader, writer
+        return self.tracer.wrap(reader, writer, peer)
 
     def print_usage(self) -> None:
         """Print usage information and available IPv6 addresses."""
         self.logger.info("Usage: python ipv6_tester.py <server|client> [ipv6_address] [port]")
+        self.logger.info("       python ipv6_tester.py <tool> [options]")
         self.logger.info("  server|client    - Required. Run as server or client")
         self.logger.info("  ipv6_address     - Optional. IPv6 address (default: ::1)")
         self.logger.info("  port             - Optional. Port number (default: 8080)")
+        self.logger.info("  --trace FILE     - Optional. Hexdump every byte sent and received to FILE")
+        self.logger.info("  --sndbuf N       - Optional. Socket send buffer size in bytes; --rcvbuf N for receive")
+        self.logger.info("  --queue-report N - Optional. Server: log accept queue pressure every N seconds (Linux)")
+        self.logger.info("  --min-rate N     - Optional. Server: close clients sending a line slower than N bytes/s")
+        self.logger.info("  --max-rate N     - Optional. Server: cap sending at N bytes/s per connection; "
+                         "--max-total-rate N overall,")
+        self.logger.info("                     --max-session-rate N per named test session")
+        self.logger.info("  --require-auth   - Optional. Server: require the IPV6_TESTER_SECRET secret before tests")
+        self.logger.info("  --pow-bits N     - Optional. Server: require an N-bit proof of work before tests")
+        self.logger.info("  --workers N      - Optional. Server: accept in N processes sharing the port (SO_REUSEPORT)")
+        self.logger.info("  --diag-addr A:P  - Optional. Server: serve runtime diagnostics over HTTP, e.g. [::1]:6060")
+
+        self.logger.info("\nTools:")
+        self.logger.info("  lowpan compress|expand  - 6LoWPAN IPHC address compression (RFC 6282)")
+        self.logger.info("  anonymize               - Mask addresses in logs with a keyed, consistent hash")
+        self.logger.info("  normalize               - Canonicalize address/prefix lists (RFC 5952), flag duplicates")
+        self.logger.info("  cidr                    - Report prefix overlaps, containment, gaps, and aggregates")
+        self.logger.info("  plan                    - Plan nibble-aligned site allocations from a parent prefix")
+        self.logger.info("  random                  - Generate reproducible random addresses or prefixes")
+        self.logger.info("  verify                  - Verified echo: detect corrupted, reordered, duplicated, lost data")
+        self.logger.info("  leak-check              - Detect connections to dual-stack targets silently using IPv4")
+        self.logger.info("  dns-server              - Authoritative DNS responder for a test zone (UDP and TCP)")
+        self.logger.info("  resolve                 - Compare answers and latency over Do53, DoT, and DoH")
+        self.logger.info("  dns-watch               - Watch AAAA answers for changes that suggest poisoning or hijacks")
+        self.logger.info("  browse                  - Discover link-local services and hosts with mDNS (ff02::fb)")
+        self.logger.info("  ntp                     - Query an NTP server over IPv6 for offset, delay, and stratum")
+        self.logger.info("  banner                  - Grab SMTP, IMAP, SSH, HTTP, and other service banners over IPv6")
+        self.logger.info("  sshkeys                 - Compare SSH host key fingerprints on IPv6 and IPv4 endpoints")
+        self.logger.info("  cert                    - Inspect TLS certificate chains on IPv6 endpoints and diff against IPv4")
+        self.logger.info("  anycast                 - Report which anycast PoP answers from each local source address")
+        self.logger.info("  udp-server              - Receive udp-test datagrams and report loss and jitter")
+        self.logger.info("  udp-test                - Measure UDP loss, duplication, reordering, and jitter")
+        self.logger.info("  owd                     - Estimate one-way delay in each direction against the server")
+        self.logger.info("  completion              - Print a bash, zsh, fish, or PowerShell completion script")
+        self.logger.info("  version                 - Print build information and available optional features")
+        self.logger.info("  ping                    - Ping over IPv6, without raw sockets if necessary")
+        self.logger.info("  traceroute              - Trace the IPv6 path, without raw sockets if necessary")
+        self.logger.info("  container-check         - Score whether IPv6 works inside this container or namespace")
+        self.logger.info("  health                  - Serve /healthz and /readyz gated on working IPv6 egress")
+        self.logger.info("  portmap                 - Test PCP and UPnP inbound port mapping on the local router")
+        self.logger.info("  callback                - Have a public server connect back to verify inbound IPv6")
+        self.logger.info("  myip                    - Show the external IPv6 address and detect NAT66 or proxies")
+        self.logger.info("  stun                    - Gather STUN and TURN candidates over IPv6")
+        self.logger.info("  rdap                    - Look up the allocation and abuse contacts of a prefix")
+        self.logger.info("  bgp                     - Show the BGP route, origin and visibility for an address")
+        self.logger.info("  replay                  - Replay a recorded client session against another server")
+        self.logger.info("  generate                - Send synthetic traffic with size, burst, DSCP and UDP/TCP mix")
+        self.logger.info("  sink                    - Discard TCP and UDP traffic, counting it per source")
+        self.logger.info("  inetd                   - Serve echo, discard, chargen, daytime and time over TCP6/UDP6")
+        self.logger.info("  handshake               - Test TCP options, Fast Open, half-close and simultaneous open")
+        self.logger.info("  backlog                 - Hold many incomplete connections to stress a listener's queues")
+        self.logger.info("  slowloris               - Trickle requests slowly to check a listener's data rate timeouts")
+        self.logger.info("  idle listen|connect     - Hold 100k+ idle connections to size firewall state tables")
+        self.logger.info("  bench                   - Benchmark the tool itself, with a loopback self-test")
+        self.logger.info("  throughput              - Measure upload, download or bidirectional throughput to the server")
+        self.logger.info("  fleet coordinator|agent - Full-mesh IPv6 latency and loss between agents at several sites")
+        self.logger.info("  tunnel-check            - Validate a 6in4 tunnel broker tunnel end to end")
+        self.logger.info("  encap listen|probe      - Check whether the network passes 6in4 (protocol 41) or GRE")
+        self.logger.info("  wireguard               - Check that a WireGuard peer completes a handshake over IPv6")
+        self.logger.info("  srv6                    - Capture or read packets and decode SRv6 segment lists")
+        self.logger.info("  mld query|listen        - Send MLDv2 queries and show the multicast groups hosts joined")
+        self.logger.info("  ra-guard                - Alert on Router Advertisements from routers not on an allowlist")
+        self.logger.info("  ndp-scan                - Lab only: measure a neighbor cache under NDP exhaustion pressure")
+        self.logger.info("  solicited               - Compute solicited-node multicast addresses and Ethernet MACs")
+        self.logger.info("  wol                     - Wake a machine with magic packets over IPv6 UDP")
+        self.logger.info("  snmp                    - Query a device's sysDescr and ifTable over SNMP on IPv6")
+        self.logger.info("  fuzz                    - Check how the client copes with adversarial server responses")
+        self.logger.info("  tls-matrix              - Report the certificate and ALPN served for each SNI and ALPN offer")
+        self.logger.info("  resolver-check          - Audit resolv.conf, NRPT rules and the hosts file for IPv6 problems")
+        self.logger.info("  sysconfig               - Check OS IPv6 settings against a host, router or server profile")
+        self.logger.info("  addrselect              - Show the RFC 6724 policy table and simulate address selection")
+        self.logger.info("  gai                     - Compare getaddrinfo's address order with a direct DNS lookup")
         
         self.logger.info("\nAvailable IPv6 addresses on this host:")
         self.print_available_ipv6_addresses()
@@ -57,6 +902,7 @@ class IPv6Tester:
         self.logger.info("  python ipv6_tester.py server")
         self.logger.info("  python ipv6_tester.py server 2001:db8:1234:5678::1")
         self.logger.info("  python ipv6_tester.py client 2001:db8:1234:5678::1 8888")
+        self.logger.info("  python ipv6_tester.py lowpan compress 2001:db8::ff:fe00:1 --context 2001:db8::/64")
 
     def print_available_ipv6_addresses(self) -> None:
         """Print all available IPv6 addresses on the system."""
@@ -74,30 +920,238 @@ class IPv6Tester:
         """Log IPv6 properties of a socket from a stream writer."""
         try:
             sock = writer.get_extra_info('socket')
+            if sock is None:
+                # An in-memory pipe, as in the unit tests
+                return
             self.logger.info(f"\nSocket properties for {context}:")
             self.logger.info(f"  Socket family: {sock.family}")
             self.logger.info(f"  Socket type: {sock.type}")
             self.logger.info(f"  Socket protocol: {sock.proto}")
             self.logger.info(f"  Socket IPv6 only: {sock.getsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY)}")
+            self.logger.info(f"  Send buffer: {sock.getsockopt(socket.SOL_SOCKET, socket.SO_SNDBUF)} bytes")
+            self.logger.info(f"  Receive buffer: {sock.getsockopt(socket.SOL_SOCKET, socket.SO_RCVBUF)} bytes")
         except Exception as e:
             self.logger.error(f"Could not get socket properties for {context}: {e}")
 
-    async def handle_client(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, server_address: str) -> None:
+    def set_buffer_sizes(self, sock: socket.socket, sndbuf: int, rcvbuf: int) -> None:
+        """Request socket buffer sizes (0 keeps the default) and log what the kernel actually granted."""
+        for option, name, size, limit in ((socket.SO_SNDBUF, "Send", sndbuf, "net.core.wmem_max"),
+                                          (socket.SO_RCVBUF, "Receive", rcvbuf, "net.core.rmem_max")):
+            if not size:
+                continue
+            sock.setsockopt(socket.SOL_SOCKET, option, size)
+            granted = sock.getsockopt(socket.SOL_SOCKET, option)
+            if sys.platform.startswith("linux"):
+                # Linux doubles the request to leave room for its own bookkeeping, and reports the doubled size
+                granted //= 2
+            self.logger.info(f"{name} buffer: requested {size} bytes, got {granted}"
+                             + (f"; capped by {limit}, raise it with sysctl" if granted < size else ""))
+
+    async def read_line(self, reader: asyncio.StreamReader, pending: bytearray, min_rate: float = 0) -> bytes:
+        """Read one line through the connection's pending buffer, like readline().
+
+        Raises asyncio.TimeoutError when the line takes longer than READ_TIMEOUT, and ValueError
+        when it is too long or, with min_rate, still arriving slower than that after MIN_RATE_GRACE.
+        """
+        deadline = self.clock() + self.READ_TIMEOUT
+        # The rate is measured from the first byte of the line, so idle time between requests doesn't count
+        started = self.clock() if pending else None
+        while b"\n" not in pending:
+            if len(pending) > self.MAX_LINE_LENGTH:
+                raise ValueError(f"line exceeds {self.MAX_LINE_LENGTH} bytes")
+            now = self.clock()
+            if min_rate and started is not None and now - started >= self.MIN_RATE_GRACE \
+                    and len(pending) / (now - started) < min_rate:
+                raise ValueError(f"sending slower than {min_rate:g} bytes/s")
+            if now >= deadline:
+                raise asyncio.TimeoutError
+            try:
+                # Wake up every second to re-check the rate even if nothing arrives
+                data = await asyncio.wait_for(reader.read(self.MAX_LINE_LENGTH), min(1.0, deadline - now))
+            except asyncio.TimeoutError:
+                continue
+            if not data:
+                line = bytes(pending)
+                pending.clear()
+                return line
+            if started is None:
+                started = self.clock()
+            pending += data
+        end = pending.index(b"\n") + 1
+        if end > self.MAX_LINE_LENGTH:
+            raise ValueError(f"line exceeds {self.MAX_LINE_LENGTH} bytes")
+        line = bytes(pending[:end])
+        del pending[:end]
+        return line
+
+    async def handle_client(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, server_address: str,
+                            min_rate: float = 0, max_rate: float = 0,
+                            total_bucket: Optional[TokenBucket] = None, session_rate: float = 0) -> None:
         """Handle individual client connections."""
-        client_address = writer.get_extra_info('peername')[0]
-        self.logger.info(f"Client connected from: [{client_address}]")
-        self.log_socket_properties(writer, f"client connection from [{client_address}]")
+        client_address, client_port = writer.get_extra_info('peername')[:2]
+        local_address = writer.get_extra_info('sockname')[:2]
+        started_ms = time.time_ns() // 1000000
+        # flowEndReason: 3 is end of flow detected, 1 is idle timeout
+        end_reason = 3
+        peer = f"[{client_address}]"
+        reader, writer = self.trace(reader, writer, f"[{client_address}]:{writer.get_extra_info('peername')[1]}")
+        if self.chaos:
+            writer = ChaosStream(writer, self.chaos)
+        # Bandwidth caps, so a public echo endpoint can't be used to saturate the uplink
+        buckets = ([TokenBucket(max_rate, self.clock)] if max_rate > 0 else []) + ([total_bucket] if total_bucket else [])
+        if buckets or session_rate > 0:
+            writer = ThrottledStream(writer, buckets)
+        self.logger.info(f"Client connected from: {peer}")
+        self.log_socket_properties(writer, f"client connection from {peer}")
+        # Counted in the server's totals and, once the client names one, in its session's
+        counters = [self.server_stats]
+        self.server_stats["accepted"] += 1
+        self.server_stats["active"] += 1
 
+        bytes_received = 0
+        pending = bytearray()
+        nonce = None
+        authenticated = self.auth_secret is None and not self.pow_bits
+        session = None
         try:
             while True:
-                # Read client message
-                data = await reader.readline()
+                # Read client message, bounded in length, idle time and, optionally, data rate
+                try:
+                    data = await self.read_line(reader, pending, min_rate)
+                except ValueError as e:
+                    await self.reject_client(writer, peer, str(e), counters)
+                    break
+                except asyncio.TimeoutError:
+                    await self.reject_client(writer, peer, f"idle for {self.READ_TIMEOUT} seconds", counters)
+                    end_reason = 1
+                    break
                 if not data:
-                    self.logger.info(f"Client disconnected: [{client_address}]")
+                    self.logger.info(f"Client disconnected: {peer}")
+                    break
+
+                bytes_received += len(data)
+                for stats in counters:
+                    stats["bytes_received"] += len(data)
+                if bytes_received > self.MAX_CONNECTION_BYTES:
+                    await self.reject_client(writer, peer, f"connection exceeded {self.MAX_CONNECTION_BYTES} bytes",
+                                             counters)
+                    break
+
+                if data.rstrip(b"\r\n") == b"CHALLENGE":
+                    nonce = secrets.token_hex(16)
+                    writer.write(f"CHALLENGE {nonce} {self.pow_bits}\n".encode())
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"AUTH "):
+                    failure = self.check_auth(nonce, data.decode(errors="replace").split()[1:])
+                    writer.write(f"AUTH {'FAILED ' + failure if failure else 'OK'}\n".encode())
+                    await writer.drain()
+                    if failure:
+                        self.logger.info(f"Closing connection from {peer}: authentication failed, {failure}")
+                        for stats in counters:
+                            stats["rejected"] += 1
+                        break
+                    authenticated = True
+                    continue
+
+                if not authenticated and data.startswith((b"ECHO ", b"CALLBACK ", b"TIME ", b"THROUGHPUT ",
+                                                                 b"FUZZ ", b"SESSION ")):
+                    # Echo, callback and timing tests could be turned against third parties, and sessions fill a
+                    # table shared by every client; demand proof first
+                    writer.write(b"ERROR authentication required; send CHALLENGE\n")
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"SESSION "):
+                    label = data[8:].decode(errors="replace").strip()
+                    if session is not None:
+                        writer.write(f"ERROR session is already {session}\n".encode())
+                    elif not self.SESSION_LABEL.fullmatch(label):
+                        writer.write(b"ERROR invalid session label; use up to 64 letters, digits, '.', '_' or '-'\n")
+                    elif not self.prune_sessions(label):
+                        writer.write(f"ERROR too many sessions (at most {self.MAX_SESSIONS})\n".encode())
+                    else:
+                        session = label
+                        entry = self.sessions.setdefault(label, {
+                            "stats": {"accepted": 0, "active": 0, "rejected": 0, "bytes_received": 0},
+                            "bucket": TokenBucket(session_rate, self.clock) if session_rate > 0 else None,
+                            "idle_since": self.clock()})
+                        counters.append(entry["stats"])
+                        entry["stats"]["accepted"] += 1
+                        entry["stats"]["active"] += 1
+                        if entry["bucket"]:
+                            buckets.append(entry["bucket"])
+                        self.logger.info(f"Client {peer} joined session {label}")
+                        peer = f"[{client_address}] (session {label})"
+                        writer.write(f"SESSION OK {label}\n".encode())
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"ECHO "):
+                    # Verified echo frames go back byte for byte and without the usual delay
+                    writer.write(data if data.endswith(b"\n") else data + b"\n")
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"CALLBACK "):
+                    # Firewall pinhole checks: connect back to the client's own address, never a third party
+                    writer.write(f"{await self.call_back(client_address, data)}\n".encode())
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"TIME "):
+                    # One-way delay probes: append our receive and send times in epoch nanoseconds
+                    received = time.time_ns()
+                    writer.write(data.rstrip(b"\r\n") + f" {received} {time.time_ns()}\n".encode())
+                    await writer.drain()
+                    continue
+
+                if data.startswith(b"THROUGHPUT "):
+                    # Bulk transfer tests: the connection carries data in the negotiated direction until it ends
+                    fields = data.decode(errors="replace").split()
+                    if len(fields) != 3 or fields[1] not in ("up", "down", "bidir") or not fields[2].isdigit() \
+                            or not 1 <= int(fields[2]) <= self.MAX_THROUGHPUT_SECONDS:
+                        writer.write(f"ERROR usage: THROUGHPUT up|down|bidir SECONDS "
+                                     f"(1-{self.MAX_THROUGHPUT_SECONDS})\n".encode())
+                        await writer.drain()
+                        continue
+                    direction, seconds = fields[1], int(fields[2])
+                    self.logger.info(f"Throughput test with {peer}: {direction} for {seconds} s")
+                    writer.write(f"THROUGHPUT OK {direction} {seconds}\n".encode())
+                    await writer.drain()
+                    received, sent = await self.serve_throughput(reader, writer, direction, seconds, len(pending))
+                    pending.clear()
+                    bytes_received += received
+                    for stats in counters:
+                        stats["bytes_received"] += received
+                    self.logger.info(f"Throughput test with {peer} finished: received {received} bytes, "
+                                     f"sent {sent} bytes")
                     break
 
-                message = data.decode().strip()
-                self.logger.info(f"Received from client [{client_address}]: {message}")
+                if data.startswith(b"FUZZ "):
+                    # Parser tests: answer with the adversarial response the client asked for
+                    case = data[5:].decode(errors="replace").strip()
+                    if not self.fuzz:
+                        writer.write(b"ERROR fuzzing is disabled; start the server with --fuzz\n")
+                    elif case not in self.FUZZ_CASES:
+                        writer.write(f"ERROR usage: FUZZ {'|'.join(self.FUZZ_CASES)}\n".encode())
+                    elif case == "split":
+                        response = self.fuzz_response(case)
+                        for index in range(len(response)):
+                            writer.write(response[index:index + 1])
+                            await writer.drain()
+                            await asyncio.sleep(0.01)
+                    else:
+                        writer.write(self.fuzz_response(case))
+                    await writer.drain()
+                    if case == "unterminated" and self.fuzz:
+                        self.logger.info(f"Closing connection from {peer} after an unterminated fuzz response")
+                        break
+                    continue
+
+                message = data.decode(errors='replace').strip()
+                self.logger.info(f"Received from client {peer}: {message}")
 
                 # Send response with timestamp
                 timestamp = datetime.datetime.now().strftime(self.DATE_FORMAT)
@@ -108,38 +1162,415 @@ class IPv6Tester:
                 # Add a delay of 1 second
                 await asyncio.sleep(1)
 
+        except ConnectionAbortedError as e:
+            # --close-after cut the connection short
+            self.logger.info(f"Closing connection from {peer}: {e}")
         except Exception as e:
-            self.logger.error(f"Error handling client [{client_address}]: {e}")
+            self.logger.error(f"Error handling client {peer}: {e}")
         finally:
+            for stats in counters:
+                stats["active"] -= 1
+            if session in self.sessions:
+                self.sessions[session]["idle_since"] = self.clock()
+            if self.flow_exporter:
+                self.flow_exporter.export((client_address, client_port), local_address, bytes_received, started_ms,
+                                          time.time_ns() // 1000000, end_reason)
             writer.close()
-            await writer.wait_closed()
+            try:
+                await writer.wait_closed()
+            except OSError:
+                # A client that closes with our response unread resets the connection
+                pass
+
+    async def serve_throughput(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, direction: str,
+                               seconds: int, buffered: int) -> Tuple[int, int]:
+        """Run the data phase of a THROUGHPUT test and report what we received; returns (received, sent).
+
+        Unless the client only uploads, we send filler for seconds. Either way we read until the client
+        half-closes, then send a final 'THROUGHPUT RESULT <received> <receive_ns> <sent>' line. The filler
+        holds no newlines, so the client finds the result after the last one.
+        """
+        loop = asyncio.get_running_loop()
+        started = loop.time()
+        received, receive_time, sent = buffered, 0.0, 0
+
+        async def send() -> None:
+            nonlocal sent
+            chunk = bytes(self.THROUGHPUT_CHUNK)
+            while loop.time() - started < seconds:
+                writer.write(chunk)
+                await writer.drain()
+                sent += len(chunk)
+
+        async def receive() -> None:
+            nonlocal received, receive_time
+            while data := await reader.read(self.THROUGHPUT_CHUNK):
+                received += len(data)
+                receive_time = loop.time() - started
+
+        await asyncio.wait_for(asyncio.gather(receive(), *([send()] if direction != "up" else [])),
+                               seconds + self.READ_TIMEOUT)
+        writer.write(f"\nTHROUGHPUT RESULT {received} {int(receive_time * 1e9)} {sent}\n".encode())
+        await writer.drain()
+        return received, sent
+
+    def proof_of_work_valid(self, nonce: str, counter: str, bits: int) -> bool:
+        """Check that SHA-256 of 'nonce:counter' starts with bits zero bits."""
+        digest = int.from_bytes(hashlib.sha256(f"{nonce}:{counter}".encode()).digest(), "big")
+        return digest >> (256 - bits) == 0 if bits else True
+
+    def solve_proof_of_work(self, nonce: str, bits: int) -> str:
+        """Find a counter for which proof_of_work_valid holds; takes about 2**bits hashes."""
+        counter = 0
+        while not self.proof_of_work_valid(nonce, str(counter), bits):
+            counter += 1
+        return str(counter)
+
+    def check_auth(self, nonce: Optional[str], fields: List[str]) -> Optional[str]:
+        """Validate the fields of 'AUTH <mac> <counter>' against our challenge; returns why it failed, or None."""
+        if nonce is None:
+            return "no challenge was issued"
+        if len(fields) != 2:
+            return "malformed request"
+        mac, counter = fields
+        if self.auth_secret is not None:
+            expected = hmac.new(self.auth_secret, nonce.encode(), hashlib.sha256).hexdigest()
+            # Compared as bytes: compare_digest raises TypeError for a str with non-ASCII characters
+            if not hmac.compare_digest(mac.encode(), expected.encode()):
+                return "wrong secret"
+        if len(counter) > 20 or not self.proof_of_work_valid(nonce, counter, self.pow_bits):
+            return "proof of work is not valid"
+        return None
+
+    async def authenticate(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter,
+                           timeout: float) -> None:
+        """Answer the server's challenge with IPV6_TESTER_SECRET and a proof of work; raises ValueError if refused."""
+        writer.write(b"CHALLENGE\n")
+        await writer.drain()
+        fields = (await asyncio.wait_for(reader.readline(), timeout)).decode(errors="replace").split()
+        if len(fields) != 3 or fields[0] != "CHALLENGE" or not fields[2].isdigit():
+            raise ValueError(f"unexpected challenge: {' '.join(fields) or 'none'}; does the server support AUTH?")
+        nonce, bits = fields[1], int(fields[2])
+        if bits > self.MAX_POW_BITS:
+            raise ValueError(f"server asks for a {bits}-bit proof of work, more than the {self.MAX_POW_BITS} "
+                             f"bits this client will compute")
+        secret = os.environ.get("IPV6_TESTER_SECRET")
+        mac = hmac.new(secret.encode(), nonce.encode(), hashlib.sha256).hexdigest() if secret else "-"
+        started = time.monotonic()
+        counter = self.solve_proof_of_work(nonce, bits)
+        if bits:
+            self.logger.info(f"Solved a {bits}-bit proof of work in {time.monotonic() - started:.2f} s")
+        writer.write(f"AUTH {mac} {counter}\n".encode())
+        await writer.drain()
+        reply = (await asyncio.wait_for(reader.readline(), timeout)).decode(errors="replace").strip()
+        if reply != "AUTH OK":
+            raise ValueError(f"authentication refused: {reply or 'connection closed'}")
+
+    async def declare_session(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter, label: str,
+                              timeout: float) -> None:
+        """Tell the server which named session this test belongs to; raises ValueError if it refuses."""
+        writer.write(f"SESSION {label}\n".encode())
+        await writer.drain()
+        reply = (await asyncio.wait_for(reader.readline(), timeout)).decode(errors="replace").strip()
+        if reply.startswith("ERROR "):
+            raise ValueError(f"session refused: {reply[6:]}")
+        if reply != f"SESSION OK {label}":
+            raise ValueError(f"unexpected reply to SESSION: {reply or 'connection closed'}; does the server support it?")
 
-    async def run_server(self, ipv6_address: str, port: int) -> None:
+    def prune_sessions(self, label: str) -> bool:
+        """Forget sessions without connections once idle for SESSION_EXPIRY seconds, and the longest idle ones
+        when the table is full; returns whether label has or can get an entry."""
+        now = self.clock()
+        idle = sorted((entry["idle_since"], name) for name, entry in self.sessions.items()
+                      if not entry["stats"]["active"] and name != label)
+        for since, name in idle:
+            if now - since > self.SESSION_EXPIRY or len(self.sessions) >= self.MAX_SESSIONS:
+                del self.sessions[name]
+        return label in self.sessions or len(self.sessions) < self.MAX_SESSIONS
+
+    async def reject_client(self, writer: asyncio.StreamWriter, peer: str, reason: str,
+                            counters: List[dict]) -> None:
+        """Tell a client why its connection is being closed, counting it in the server and session stats."""
+        self.logger.info(f"Closing connection from {peer}: {reason}")
+        for stats in counters:
+            stats["rejected"] += 1
+        writer.write(f"ERROR {reason}\n".encode())
+        await writer.drain()
+
+    def activated_socket(self) -> Optional[socket.socket]:
+        """Return the listening socket passed by systemd socket activation, or None if there is none."""
+        if os.environ.get("LISTEN_PID") != str(os.getpid()):
+            return None
+        count = int(os.environ.get("LISTEN_FDS", "0"))
+        # Like sd_listen_fds(1): child processes must not think the sockets are theirs
+        for name in ("LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"):
+            os.environ.pop(name, None)
+        sockets = [socket.socket(fileno=fd) for fd in range(self.SD_LISTEN_FDS_START, self.SD_LISTEN_FDS_START + count)]
+        for sock in sockets:
+            if sock.family == socket.AF_INET6 and sock.type == socket.SOCK_STREAM:
+                for other in sockets:
+                    if other is not sock:
+                        self.logger.warning(f"Ignoring extra activated socket {other.getsockname()}")
+                return sock
+        raise OSError(f"none of the {count} activated sockets is an IPv6 stream socket")
+
+    async def run_server(self, ipv6_address: str, port: int, queue_report: float = 0, min_rate: float = 0,
+                         reuse_port: bool = False, sndbuf: int = 0, rcvbuf: int = 0,
+                         diag_address: Optional[Tuple[str, int]] = None, max_rate: float = 0,
+                         max_total_rate: float = 0, max_session_rate: float = 0) -> None:
         """Run the IPv6 server."""
+        total_bucket = TokenBucket(max_total_rate, self.clock) if max_total_rate > 0 else None
         try:
-            server = await asyncio.start_server(
-                lambda r, w: self.handle_client(r, w, ipv6_address),
-                ipv6_address,
-                port,
-                family=socket.AF_INET6
-            )
+            sock = self.activated_socket()
+            if sock is not None:
+                # systemd bound the socket, possibly to a privileged port, and passes it in
+                ipv6_address, port = sock.getsockname()[:2]
+                server = await asyncio.start_server(
+                    lambda r, w: self.handle_client(r, w, ipv6_address, min_rate, max_rate, total_bucket,
+                                                max_session_rate),
+                    sock=sock,
+                    limit=self.MAX_LINE_LENGTH
+                )
+                self.logger.info("Using the socket passed by systemd socket activation")
+            else:
+                server = await asyncio.start_server(
+                    lambda r, w: self.handle_client(r, w, ipv6_address, min_rate, max_rate, total_bucket,
+                                                max_session_rate),
+                    ipv6_address,
+                    port,
+                    family=socket.AF_INET6,
+                    limit=self.MAX_LINE_LENGTH,
+                    reuse_port=reuse_port or None
+                )
             self.logger.info(f"IPv6 Server started on [{ipv6_address}]:{port}")
             self.logger.info(f"Maximum number of simultaneous clients: {self.MAX_CLIENTS}")
+            # Accepted connections inherit the listener's buffer sizes
+            for listener in server.sockets:
+                self.set_buffer_sizes(listener, sndbuf, rcvbuf)
+            if min_rate > 0:
+                self.logger.info(f"Minimum client data rate: {min_rate:g} bytes/s after {self.MIN_RATE_GRACE} seconds")
+            if self.auth_secret is not None or self.pow_bits:
+                self.logger.info("Tests require authentication: "
+                                 + " and ".join((["the shared secret"] if self.auth_secret is not None else [])
+                                                + ([f"a {self.pow_bits}-bit proof of work"] if self.pow_bits else [])))
+            if max_rate > 0 or max_total_rate > 0 or max_session_rate > 0:
+                limits = [f"{max_rate:g} bytes/s per connection" if max_rate > 0 else "",
+                          f"{max_session_rate:g} bytes/s per session" if max_session_rate > 0 else "",
+                          f"{max_total_rate:g} bytes/s in total" if max_total_rate > 0 else ""]
+                self.logger.info(f"Maximum send rate: {', '.join(limit for limit in limits if limit)}")
+            if self.chaos:
+                self.logger.warning(f"Chaos: {self.describe_chaos()}")
+            if self.fuzz:
+                self.logger.warning(f"Fuzzing: FUZZ frames get adversarial responses ({', '.join(self.FUZZ_CASES)})")
+
+            if diag_address:
+                await self.run_diagnostics_server(*diag_address)
 
             async with server:
-                await server.serve_forever()
+                if queue_report > 0:
+                    await asyncio.gather(server.serve_forever(), self.report_queue_pressure(port, queue_report))
+                else:
+                    await server.serve_forever()
         except Exception as e:
             self.logger.error(f"Server error: {e}")
 
-    async def run_client(self, ipv6_address: str, port: int) -> None:
+    def run_workers(self, workers: int, ipv6_address: str, port: int, queue_report: float, min_rate: float,
+                    sndbuf: int = 0, rcvbuf: int = 0, diag_address: Optional[Tuple[str, int]] = None,
+                    max_rate: float = 0, max_total_rate: float = 0, max_session_rate: float = 0) -> None:
+        """Run the server in several processes, each with its own SO_REUSEPORT listener on the same port."""
+        self.logger.info(f"Starting {workers} workers with SO_REUSEPORT on [{ipv6_address}]:{port}")
+        children = []
+        for index in range(workers):
+            pid = os.fork()
+            if pid == 0:
+                # The kernel spreads new connections across the workers' sockets; one reports the shared queue
+                # and serves diagnostics. Each gets an equal share of the total and session rates.
+                try:
+                    asyncio.run(self.run_server(ipv6_address, port, queue_report if index == 0 else 0, min_rate,
+                                                True, sndbuf, rcvbuf, diag_address if index == 0 else None,
+                                                max_rate, max_total_rate / workers, max_session_rate / workers))
+                except KeyboardInterrupt:
+                    pass
+                os._exit(0)
+            children.append(pid)
+        # Pass a stop request from a service manager on to every worker
+        signal.signal(signal.SIGTERM, lambda signum, frame: [os.kill(pid, signum) for pid in children])
+        for pid in children:
+            while True:
+                try:
+                    os.waitpid(pid, 0)
+                    break
+                except KeyboardInterrupt:
+                    # Ctrl-C reaches the whole process group, so the workers are shutting down too
+                    continue
+
+    def diagnostic_vars(self) -> dict:
+        """Collect runtime variables for /debug/vars, in the spirit of Go's expvar."""
+        try:
+            open_files = len(os.listdir("/proc/self/fd"))
+        except OSError:
+            open_files = None
+        traced, peak = tracemalloc.get_traced_memory() if tracemalloc.is_tracing() else (None, None)
+        return {
+            "uptime_seconds": round(self.clock() - self.started, 1),
+            "connections": dict(self.server_stats),
+            "sessions": {label: dict(entry["stats"]) for label, entry in self.sessions.items()},
+            "rss_bytes": self.memory_usage(),
+            "open_files": open_files,
+            "asyncio_tasks": len(asyncio.all_tasks()),
+            "threads": threading.active_count(),
+            "gc_counts": gc.get_count(),
+            "gc_collections": [generation["collections"] for generation in gc.get_stats()],
+            "tracemalloc_bytes": traced,
+            "tracemalloc_peak_bytes": peak,
+            "python": sys.version.split()[0],
+        }
+
+    def diagnostic_stacks(self) -> str:
+        """Format the stack of every asyncio task and thread, like a goroutine dump."""
+        output = io.StringIO()
+        for task in asyncio.all_tasks():
+            output.write(f"Task {task.get_name()} ({getattr(task.get_coro(), '__qualname__', 'unknown')}):\n")
+            for frame in task.get_stack():
+                output.write(f"  {frame.f_code.co_filename}:{frame.f_lineno} in {frame.f_code.co_name}\n")
+            output.write("\n")
+        names = {thread.ident: thread.name for thread in threading.enumerate()}
+        for ident, frame in sys._current_frames().items():
+            output.write(f"Thread {names.get(ident, ident)}:\n")
+            output.write("".join(f"  {line}" for line in traceback.format_stack(frame)))
+            output.write("\n")
+        return output.getvalue()
+
+    def diagnostic_heap(self, query: dict) -> str:
+        """Report the top allocation sites; start=1 starts allocation tracing and stop=1 stops it afterwards.
+
+        Tracing slows every allocation and keeps a traceback for each, so it only runs when asked for.
+        """
+        if not tracemalloc.is_tracing():
+            if query.get("start") != "1":
+                return "Allocation tracing is off; request /debug/heap?start=1 to start it\n"
+            tracemalloc.start()
+            return "Allocation tracing started; request /debug/heap for the top allocation sites, and " \
+                   "/debug/heap?stop=1 to stop it\n"
+        statistics = tracemalloc.take_snapshot().statistics("lineno")
+        total = sum(statistic.size for statistic in statistics)
+        lines = [f"{total} bytes in {len(statistics)} allocation sites; top {self.DIAG_HEAP_TOP}:"]
+        lines.extend(f"  {statistic.size:>10} bytes {statistic.count:>7} blocks  {statistic.traceback[0]}"
+                     for statistic in statistics[:self.DIAG_HEAP_TOP])
+        if query.get("stop") == "1":
+            tracemalloc.stop()
+            lines.append("Allocation tracing stopped")
+        return "\n".join(lines) + "\n"
+
+    def describe_chaos(self) -> str:
+        """Summarize the active chaos options for the startup log."""
+        chaos = self.chaos
+        parts = [f"delay {chaos['delay']:g} ms" + (f" ± {chaos['jitter']:g} ms" if chaos["jitter"] else "")]
+        if chaos["drop_rate"]:
+            parts.append(f"drop {chaos['drop_rate']:.0%} of writes")
+        if chaos["garble"]:
+            parts.append(f"garble {chaos['garble']:.0%} of writes")
+        if chaos["close_after"]:
+            parts.append(f"close connections after {chaos['close_after']} bytes")
+        return ", ".join(parts)
+
+    async def run_diagnostics_server(self, address: str, port: int) -> asyncio.AbstractServer:
+        """Serve /debug/vars, /debug/stacks and /debug/heap for profiling a long-running server.
+
+        With IPV6_TESTER_DIAG_TOKEN set, every request needs it as an "Authorization: Bearer" header.
+        """
+        token = os.environ.get("IPV6_TESTER_DIAG_TOKEN", "").encode()
+
+        async def handle(reader: asyncio.StreamReader, writer: asyncio.StreamWriter) -> None:
+            try:
+                request = await asyncio.wait_for(reader.readline(), self.READ_TIMEOUT)
+                authorized = not token
+                while (header := await asyncio.wait_for(reader.readline(), self.READ_TIMEOUT)) not in \
+                        (b"\r\n", b"\n", b""):
+                    name, _, value = header.partition(b":")
+                    if token and name.strip().lower() == b"authorization":
+                        authorized = hmac.compare_digest(value.strip(), b"Bearer " + token)
+                parts = request.decode(errors="replace").split()
+                path, _, query = parts[1].partition("?") if len(parts) >= 2 else ("", "", "")
+                status, content_type = "200 OK", "text/plain"
+                if not authorized:
+                    status, body = "401 Unauthorized", "missing or wrong Authorization: Bearer token\n"
+                elif path == "/debug/vars":
+                    body, content_type = json.dumps(self.diagnostic_vars(), indent=2) + "\n", "application/json"
+                elif path == "/debug/stacks":
+                    body = self.diagnostic_stacks()
+                elif path == "/debug/heap":
+                    query = dict(urllib.parse.parse_qsl(query))
+                    peer = ipaddress.ip_address(writer.get_extra_info("peername")[0].split("%")[0])
+                    if query.get("start") == "1" and not peer.is_loopback:
+                        # Tracing slows every allocation, so only someone on the server itself may turn it on
+                        status, body = "403 Forbidden", "allocation tracing can only be started from loopback\n"
+                    else:
+                        # A snapshot of a large heap takes seconds; don't stall the test connections meanwhile
+                        body = await asyncio.get_running_loop().run_in_executor(None, self.diagnostic_heap, query)
+                else:
+                    status, body = "404 Not Found", "not found; try /debug/vars, /debug/stacks or /debug/heap\n"
+                data = body.encode()
+                writer.write(f"HTTP/1.1 {status}\r\nContent-Type: {content_type}\r\nContent-Length: {len(data)}\r\n"
+                             f"Connection: close\r\n\r\n".encode() + data)
+                await writer.drain()
+            except (asyncio.TimeoutError, ValueError, OSError):
+                pass
+            finally:
+                writer.close()
+
+        server = await asyncio.start_server(handle, address, port, family=socket.AF_INET6,
+                                            limit=self.MAX_LINE_LENGTH)
+        self.logger.info(f"Diagnostics on http://[{address}]:{port}/debug/vars, /debug/stacks and /debug/heap"
+                         + (" (token required)" if token else ""))
+        return server
+
+    def ipv4_leak(self, address: str) -> Optional[str]:
+        """Describe how a peer address actually reaches IPv4, or return None for native IPv6."""
+        address = ipaddress.ip_address(address.split("%")[0])
+        if address.version == 4:
+            return f"connection used IPv4 ({address})"
+        if address.ipv4_mapped is not None:
+            return f"connection used an IPv4-mapped address ({self.format_address(address)})"
+        if address in self.NAT64_PREFIX:
+            return f"connection is translated to IPv4 by NAT64 ({address})"
+        return None
+
+    def open_tracer(self, path: str) -> bool:
+        """Start hexdumping traced connections to path; logs why and returns False if it can't be opened."""
+        try:
+            self.tracer = Tracer(path)
+        except OSError as e:
+            self.logger.error(f"Error: cannot open trace file {path}: {e.strerror or e}")
+            return False
+        return True
+
+    async def dial(self, ipv6_address: str, port: int) -> Tuple[asyncio.StreamReader, asyncio.StreamWriter]:
+        """Open a client connection to a test server. The client tools all connect through here, so unit tests
+        can replace it with an in-memory pipe to handle_client and run both ends without sockets."""
+        return await asyncio.open_connection(ipv6_address, port, family=socket.AF_INET6, limit=self.CLIENT_MAX_LINE)
+
+    async def run_client(self, ipv6_address: str, port: int, strict_v6: bool = False, sndbuf: int = 0,
+                         rcvbuf: int = 0) -> bool:
         """Run the IPv6 client."""
         try:
-            reader, writer = await asyncio.open_connection(
-                ipv6_address,
-                port,
-                family=socket.AF_INET6
-            )
+            if strict_v6:
+                # Check the layers below the connection too: what the name resolves to, and any configured proxy
+                leaks = self.resolution_leaks(ipv6_address, port) + self.proxy_leaks()
+                if leaks:
+                    self.logger.error(f"Strict IPv6 check failed: {'; '.join(leaks)}")
+                    return False
+            reader, writer = await self.dial(ipv6_address, port)
+            if strict_v6:
+                leak = self.ipv4_leak(writer.get_extra_info('peername')[0])
+                if leak:
+                    self.logger.error(f"Strict IPv6 check failed: {leak}")
+                    writer.close()
+                    await writer.wait_closed()
+                    return False
+            reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
             self.logger.info(f"Connected to server at [{ipv6_address}]:{port}")
+            self.set_buffer_sizes(writer.get_extra_info('socket'), sndbuf, rcvbuf)
             self.log_socket_properties(writer, f"client connection to [{ipv6_address}]:{port}")
 
             try:
@@ -152,8 +1583,11 @@ class IPv6Tester:
                     self.logger.info(f"Sent to server: {message.strip()}")
 
                     # Read server response
-                    response = await reader.readline()
-                    self.logger.info(f"Server response: {response.decode().strip()}")
+                    response = await self.read_response(reader)
+                    if response is None:
+                        self.logger.info("Server closed the connection")
+                        break
+                    self.logger.info(f"Server response: {response.strip()}")
 
                     # Wait 1 second before next iteration
                     if i < 19:
@@ -165,26 +1599,8336 @@ class IPv6Tester:
 
         except Exception as e:
             self.logger.error(f"Client error: {e}")
+            return False
+        return True
 
-    def main(self) -> None:
-        """Main entry point for the IPv6 tester."""
-        if len(sys.argv) < 2:
-            self.print_usage()
-            sys.exit(1)
+    async def read_response(self, reader: asyncio.StreamReader) -> Optional[str]:
+        """Read one server response line for client and verify, without its line terminator.
 
-        mode = sys.argv[1]
-        ipv6_address = sys.argv[2] if len(sys.argv) > 2 else self.DEFAULT_IPV6_ADDRESS
-        port = int(sys.argv[3]) if len(sys.argv) > 3 else self.DEFAULT_PORT
+        Invalid UTF-8 decodes with replacement characters, a line cut off by the connection closing is returned
+        as is, and None means the connection closed. A line longer than the stream's limit (CLIENT_MAX_LINE)
+        raises ValueError rather than being buffered.
+        """
+        line = await reader.readline()
+        if not line:
+            return None
+        return line.decode(errors="replace").rstrip("\r\n")
 
-        if mode not in ['server', 'client']:
-            self.print_usage()
-            sys.exit(1)
+    async def verify_echo(self, ipv6_address: str, port: int, count: int, size: int,
+                          interval: float, timeout: float, auth: bool = False,
+                          session: Optional[str] = None) -> bool:
+        """Send sequenced, checksummed frames and validate what the server echoes back."""
+        reader, writer = await self.dial(ipv6_address, port)
+        reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+        self.logger.info(f"Connected to server at [{ipv6_address}]:{port}")
+        if auth:
+            await self.authenticate(reader, writer, timeout)
+        if session:
+            await self.declare_session(reader, writer, session, timeout)
+        sent = {}
+        seen = set()
+        stats = dict.fromkeys(["received", "intact", "corrupted", "reordered", "duplicated", "unexpected"], 0)
+        highest = -1
+
+        async def receive() -> None:
+            nonlocal highest
+            while len(seen) < count:
+                line = await self.read_response(reader)
+                if line is None:
+                    self.logger.info("Server closed the connection")
+                    return
+                fields = line.split(" ", 3)
+                if len(fields) != 4 or fields[0] != "ECHO" or not fields[1].isdigit():
+                    self.logger.info(f"Unexpected response: {line.strip()}")
+                    stats["unexpected"] += 1
+                    continue
+                seq, checksum, payload = int(fields[1]), fields[2], fields[3]
+                stats["received"] += 1
+                if seq in seen:
+                    self.logger.info(f"Duplicated echo for seq {seq}")
+                    stats["duplicated"] += 1
+                    continue
+                if seq not in sent or checksum != f"{zlib.crc32(payload.encode()):08x}" or payload != sent[seq]:
+                    self.logger.info(f"Corrupted echo for seq {seq}")
+                    stats["corrupted"] += 1
+                    if seq in sent:
+                        seen.add(seq)
+                    continue
+                if seq < highest:
+                    self.logger.info(f"Reordered echo: seq {seq} arrived after seq {highest}")
+                    stats["reordered"] += 1
+                seen.add(seq)
+                highest = max(highest, seq)
+                stats["intact"] += 1
+
+        receiver = asyncio.create_task(receive())
+        try:
+            for seq in range(count):
+                payload = secrets.token_hex((size + 1) // 2)[:size]
+                sent[seq] = payload
+                writer.write(f"ECHO {seq} {zlib.crc32(payload.encode()):08x} {payload}\n".encode())
+                await writer.drain()
+                if receiver.done():
+                    break
+                await asyncio.sleep(interval)
+            try:
+                await asyncio.wait_for(receiver, timeout)
+            except asyncio.TimeoutError:
+                pass
+        finally:
+            writer.close()
+            await writer.wait_closed()
+
+        lost = len(sent) - len(seen)
+        self.logger.info(f"\nVerified echo results for [{ipv6_address}]:{port}:")
+        self.logger.info(f"  Sent: {len(sent)}")
+        for name, value in stats.items():
+            self.logger.info(f"  {name.capitalize()}: {value}")
+        self.logger.info(f"  Lost: {lost}")
+        return stats["intact"] == len(sent) and not (stats["reordered"] or stats["duplicated"] or stats["unexpected"])
+
+    def run_verify(self, args: List[str]) -> int:
+        """Run the verified-echo client against an IPv6 server."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py verify",
+                                         description="Send sequenced, checksummed payloads to the server and count "
+                                                     "corrupted, reordered, duplicated, and lost echoes.")
+        parser.add_argument("address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"Server IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--count", type=int, default=100, help="Number of payloads to send (default: 100)")
+        parser.add_argument("--size", type=int, default=64, help="Payload size in bytes (default: 64)")
+        parser.add_argument("--interval", type=float, default=0.1, help="Seconds between payloads (default: 0.1)")
+        parser.add_argument("--timeout", type=float, default=5.0,
+                            help="Seconds to wait for outstanding echoes after the last send (default: 5)")
+        parser.add_argument("--auth", action="store_true", help=self.AUTH_HELP)
+        parser.add_argument("--session", metavar="LABEL", help=self.SESSION_HELP)
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        options = parser.parse_args(args)
+
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+        if not 1 <= options.size <= self.MAX_LINE_LENGTH - 64:
+            self.logger.error(f"Error: Payload size must be between 1 and {self.MAX_LINE_LENGTH - 64}")
+            return 1
+        try:
+            intact = asyncio.run(self.verify_echo(options.address, options.port, options.count, options.size,
+                                                  options.interval, options.timeout, options.auth, options.session))
+        except (OSError, ValueError, asyncio.TimeoutError) as e:
+            self.logger.error(f"Client error: {e}")
+            return 1
+        return 0 if intact else 1
+
+    def fuzz_response(self, case: str) -> bytes:
+        """Return the adversarial response a --fuzz server sends for a FUZZ frame."""
+        if case == "huge":
+            return b"FUZZ huge " + b"A" * (self.FUZZ_HUGE_LENGTH - 11) + b"\n"
+        if case == "nul":
+            return b"FUZZ nul \x00leading\x00embedded\x00\x00doubled\x00\n"
+        if case == "utf8":
+            # A bad continuation, a lone continuation, truncated sequences, an overlong '/', a surrogate, 0xff 0xfe
+            return b"FUZZ utf8 \xc3\x28 \xa0\xa1 \xe2\x82 \xf0\x9f\x98 \xc0\xaf \xed\xa0\x80 \xff\xfe\n"
+        if case == "split":
+            return b"FUZZ split this line arrives one byte per write\n"
+        # The connection closes without a line terminator
+        return b"FUZZ unterminated no newline before the connection closes"
+
+    async def fuzz_case(self, ipv6_address: str, port: int, case: str, timeout: float,
+                        auth: bool = False) -> Tuple[str, str]:
+        """Request one adversarial response and read it the way client and verify do; returns (status, detail)."""
+        reader, writer = await asyncio.wait_for(self.dial(ipv6_address, port), timeout)
+        reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+        try:
+            if auth:
+                await self.authenticate(reader, writer, timeout)
+            writer.write(f"FUZZ {case}\n".encode())
+            await writer.drain()
+            line = await asyncio.wait_for(self.read_response(reader), timeout)
+        except asyncio.TimeoutError:
+            return "FAIL", f"no complete response within {timeout:g} s"
+        except ValueError as e:
+            if case == "huge":
+                return "PASS", f"line over the {self.CLIENT_MAX_LINE}-byte limit refused ({e})"
+            return "FAIL", f"response refused: {e}"
+        except UnicodeError as e:
+            return "FAIL", f"response could not be decoded: {e}"
+        finally:
+            writer.close()
+        if line is None:
+            return "FAIL", "connection closed without a response"
+        if line.startswith("ERROR "):
+            return "FAIL", f"server answered {line.strip()}"
+        expected = self.fuzz_response(case).decode(errors="replace").rstrip("\n")
+        if line != expected:
+            return "FAIL", f"got {len(line)} characters that differ from the expected {len(expected)}"
+        if case == "huge":
+            return "PASS", f"{len(line)}-character line read intact"
+        if case == "nul":
+            return "PASS", f"{line.count(chr(0))} NUL bytes kept, line length {len(line)}"
+        if case == "utf8":
+            return "PASS", f"decoded with {line.count(chr(0xfffd))} replacement characters instead of failing"
+        if case == "split":
+            return "PASS", f"reassembled {len(line)} characters from one-byte writes"
+        return "PASS", f"partial line of {len(line)} characters kept when the connection closed"
+
+    def run_fuzz(self, args: List[str]) -> int:
+        """Exercise client response parsing against a server started with --fuzz."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py fuzz",
+                                         description="Ask a server started with --fuzz for adversarial responses "
+                                                     "(a huge line, NUL bytes, invalid UTF-8, a line split across "
+                                                     "one-byte writes, a line cut off by the connection closing) "
+                                                     "and assert that the response reader of the client and verify "
+                                                     "tools handles each one. Every case uses its own connection.")
+        parser.add_argument("address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"Server IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--case", action="append", choices=self.FUZZ_CASES,
+                            help="Case to run (repeatable; default: all)")
+        parser.add_argument("--timeout", type=float, default=10.0, help="Seconds to wait for each case (default: 10)")
+        parser.add_argument("--auth", action="store_true", help=self.AUTH_HELP)
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        options = parser.parse_args(args)
+
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+        self.logger.info(f"Fuzzing response parsing against [{options.address}]:{options.port}:")
+        failed = 0
+        for case in options.case or self.FUZZ_CASES:
+            try:
+                status, detail = asyncio.run(self.fuzz_case(options.address, options.port, case, options.timeout,
+                                                            options.auth))
+            except (OSError, ValueError, asyncio.TimeoutError) as e:
+                status, detail = "FAIL", f"connection failed: {e or 'timed out'}"
+            failed += status == "FAIL"
+            self.logger.info(f"  [{status}] {case}: {detail}")
+        return 1 if failed else 0
+
+    def proxy_leaks(self) -> List[str]:
+        """List the proxies configured in the environment that can only be reached over IPv4."""
+        leaks = []
+        for variable in self.PROXY_VARIABLES:
+            value = os.environ.get(variable)
+            if not value:
+                continue
+            proxy_host = urllib.parse.urlsplit(value if "://" in value else f"//{value}").hostname
+            try:
+                families = {info[0] for info in socket.getaddrinfo(proxy_host, None)}
+            except (socket.gaierror, UnicodeError):
+                continue
+            if socket.AF_INET6 not in families:
+                leaks.append(f"proxy {proxy_host} from {variable} is only reachable over IPv4")
+        return leaks
+
+    def resolution_leaks(self, host: str, port: int) -> List[str]:
+        """List how resolving host leads to IPv4: no AAAA records, or only IPv4-mapped or DNS64-synthesized ones."""
+        infos = socket.getaddrinfo(host, port, type=socket.SOCK_STREAM)
+        aaaa = [info[4][0] for info in infos if info[0] == socket.AF_INET6]
+        if any(not self.ipv4_leak(address) for address in aaaa):
+            return []
+        if aaaa:
+            return [f"{host} only resolves to IPv4-mapped or NAT64 addresses, such as {aaaa[0]}"]
+        return [f"{host} resolves to IPv4 addresses only"]
+
+    def run_leak_check(self, args: List[str]) -> int:
+        """Check whether connections to a dual-stack target silently use IPv4."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py leak-check",
+                                         description="Resolve a dual-stack target, connect the way an ordinary "
+                                                     "application would, and report whether IPv4 was used.")
+        parser.add_argument("host", help="Target hostname")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Target port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Connection timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        try:
+            infos = socket.getaddrinfo(options.host, options.port, type=socket.SOCK_STREAM)
+        except socket.gaierror as e:
+            self.logger.error(f"Error: Could not resolve {options.host}: {e}")
+            return 1
+        ipv6 = [info[4][0] for info in infos if info[0] == socket.AF_INET6 and not self.ipv4_leak(info[4][0])]
+        ipv4 = [info[4][0] for info in infos if info[0] == socket.AF_INET]
+
+        self.logger.info(f"Leak check for {options.host} port {options.port}:")
+        self.logger.info(f"  AAAA: {', '.join(ipv6) or 'none'}")
+        self.logger.info(f"  A: {', '.join(ipv4) or 'none'}")
+        self.logger.info(f"  Resolver order: {', '.join(info[4][0] for info in infos)}")
+
+        leaks = []
+        try:
+            with socket.create_connection((options.host, options.port), timeout=options.timeout) as sock:
+                used = sock.getpeername()[0]
+            self.logger.info(f"  Default connection used: {used}")
+            leak = self.ipv4_leak(used)
+            if leak and ipv6:
+                leaks.append(f"default {leak} although the target has AAAA records")
+        except OSError as e:
+            self.logger.info(f"  Default connection failed: {e}")
+
+        for address in ipv6:
+            try:
+                with socket.create_connection((address, options.port), timeout=options.timeout):
+                    self.logger.info(f"  IPv6 connection to [{address}]: ok")
+            except OSError as e:
+                self.logger.info(f"  IPv6 connection to [{address}]: failed ({e})")
+
+        for variable in self.PROXY_VARIABLES:
+            if os.environ.get(variable):
+                self.logger.info(f"  Proxy {variable}={os.environ[variable]}")
+        leaks += self.proxy_leaks()
+
+        if not ipv6:
+            self.logger.info(f"\nResult: {options.host} has no AAAA records, it is not dual-stack")
+            return 1
+        if leaks:
+            for leak in leaks:
+                self.logger.info(f"\nLEAK: {leak}")
+            return 1
+        self.logger.info("\nResult: no IPv4 leaks detected")
+        return 0
+
+    def default_dns_records(self, address: str) -> List[str]:
+        """Build the records served when no zone file is given, including oversized answers
+        that can't fit in a 512-byte UDP response, for exercising truncation and TCP fallback."""
+        if ipaddress.IPv6Address(address.split("%")[0]).is_unspecified:
+            address = "::1"
+        records = [
+            "@ 60 SOA ns1 hostmaster 1 3600 600 86400 60",
+            "@ 60 NS ns1",
+            f"@ 60 AAAA {address}",
+            f"ns1 60 AAAA {address}",
+            f"www 60 AAAA {address}",
+            "alias 60 CNAME www",
+            "v4only 60 A 192.0.2.1",
+            'txt 60 TXT "IPv6 test responder"',
+            "big 60 TXT " + " ".join(f'"{chr(ord("a") + i % 26) * 200}"' for i in range(10)),
+        ]
+        records += [f"many 60 AAAA 2001:db8::{i:x}" for i in range(1, 41)]
+        return records
+
+    def load_dns_zone(self, zone: str, lines: List[str]) -> dict:
+        """Parse 'name [ttl] TYPE value' lines into a {(name, type): [DNSRecord]} table.
+        Names are relative to the zone unless they end with a dot, and '@' is the zone apex."""
+        records = {}
+        for line in lines:
+            fields = line.split(None, 3)
+            if len(fields) >= 3 and not fields[1].isdigit():
+                fields = [fields[0], "3600"] + line.split(None, 2)[1:]
+            if len(fields) != 4 or fields[2].upper() not in DNS_TYPES:
+                raise ValueError(f"invalid record '{line}', expected 'name [ttl] TYPE value'")
+            name, ttl, rtype, value = fields[0], int(fields[1]), DNS_TYPES[fields[2].upper()], fields[3]
+            if name == "@":
+                name = zone
+            elif not name.endswith("."):
+                name = f"{name}.{zone}"
+            if rtype in (DNS_TYPES["NS"], DNS_TYPES["CNAME"], DNS_TYPES["PTR"]) and not value.endswith("."):
+                value = f"{value}.{zone}"
+            elif rtype == DNS_TYPES["SOA"]:
+                value = " ".join(part if part.endswith(".") or part.isdigit() else f"{part}.{zone}"
+                                 for part in value.split())
+            rdata = DNSMessage.encode_rdata(rtype, value)
+            records.setdefault((name.lower(), rtype), []).append(DNSRecord(name, rtype, DNS_CLASS_IN, ttl, rdata, value))
+        if (zone, DNS_TYPES["SOA"]) not in records:
+            raise ValueError(f"zone {zone} has no SOA record")
+        return records
+
+    def answer_dns_query(self, query: DNSMessage, zone: str, records: dict) -> DNSMessage:
+        """Build an authoritative response for a query against the zone."""
+        response = DNSMessage(query.id, DNSMessage.QR | DNSMessage.AA | (query.flags & DNSMessage.RD))
+        response.questions = query.questions[:1]
+        if query.edns_payload_size() is not None:
+            response.additional.append(DNSRecord("", DNS_TYPES["OPT"], self.DNS_MAX_UDP_PAYLOAD_SIZE, 0, b""))
+        if (query.flags >> 11) & 0xf:
+            response.flags |= DNS_RCODE_VALUES["NOTIMP"]
+            return response
+        if len(query.questions) != 1:
+            response.flags |= DNS_RCODE_VALUES["FORMERR"]
+            return response
+
+        name, qtype, _ = query.questions[0]
+        name = name.lower()
+        if name != zone and not name.endswith("." + zone):
+            response.flags = (response.flags & ~DNSMessage.AA) | DNS_RCODE_VALUES["REFUSED"]
+            return response
+        if not any(owner == name for owner, _ in records):
+            response.flags |= DNS_RCODE_VALUES["NXDOMAIN"]
+            response.authority = records[(zone, DNS_TYPES["SOA"])]
+            return response
+
+        cname = records.get((name, DNS_TYPES["CNAME"]))
+        if cname and qtype != DNS_TYPES["CNAME"]:
+            response.answers += cname
+            name = cname[0].value.lower()
+        if qtype == DNS_TYPES["ANY"]:
+            response.answers += [record for (owner, _), matches in records.items() if owner == name for record in matches]
+        else:
+            response.answers += records.get((name, qtype), [])
+        if not response.answers:
+            response.authority = records[(zone, DNS_TYPES["SOA"])]
+        return response
+
+    def dns_response(self, data: bytes, zone: str, records: dict, transport: str,
+                     client_address: str, force_truncation: bool = False) -> Optional[bytes]:
+        """Answer one wire-format query, truncating UDP responses that don't fit."""
+        try:
+            query = DNSMessage.decode(data)
+        except ValueError as e:
+            self.logger.info(f"Malformed query from [{client_address}] via {transport}: {e}")
+            return None
+        if query.flags & DNSMessage.QR or not query.questions:
+            return None
+        response = self.answer_dns_query(query, zone, records)
+        encoded = response.encode()
+        truncated = False
+        if transport == "UDP":
+            advertised = query.edns_payload_size()
+            limit = min(max(advertised, self.DNS_UDP_PAYLOAD_SIZE), self.DNS_MAX_UDP_PAYLOAD_SIZE) \
+                if advertised is not None else self.DNS_UDP_PAYLOAD_SIZE
+            if force_truncation or len(encoded) > limit:
+                response.flags |= DNSMessage.TC
+                response.answers, response.authority = [], []
+                encoded = response.encode()
+                truncated = True
+
+        name, qtype, _ = query.questions[0]
+        self.logger.info(f"Query from [{client_address}] via {transport}: {name} "
+                         f"{DNS_TYPE_NAMES.get(qtype, qtype)} -> {DNS_RCODES.get(response.rcode, response.rcode)}, "
+                         f"{len(response.answers)} answers{' (truncated)' if truncated else ''}")
+        return encoded
+
+    async def handle_dns_tcp(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter,
+                             zone: str, records: dict) -> None:
+        """Serve length-prefixed DNS queries on a TCP connection (RFC 7766)."""
+        client_address = writer.get_extra_info('peername')[0]
+        try:
+            while True:
+                try:
+                    length = struct.unpack("!H", await asyncio.wait_for(reader.readexactly(2), self.READ_TIMEOUT))[0]
+                    data = await asyncio.wait_for(reader.readexactly(length), self.READ_TIMEOUT)
+                except (asyncio.IncompleteReadError, asyncio.TimeoutError):
+                    break
+                response = self.dns_response(data, zone, records, "TCP", client_address)
+                if response is None:
+                    break
+                writer.write(struct.pack("!H", len(response)) + response)
+                await writer.drain()
+        except Exception as e:
+            self.logger.error(f"Error handling DNS client [{client_address}]: {e}")
+        finally:
+            writer.close()
+            await writer.wait_closed()
+
+    async def run_dns_server(self, ipv6_address: str, port: int, zone: str, records: dict,
+                             force_truncation: bool) -> None:
+        """Serve the zone over UDP and TCP on the same IPv6 address and port."""
+        loop = asyncio.get_running_loop()
+        tester = self
+
+        class Protocol(asyncio.DatagramProtocol):
+            def connection_made(self, transport):
+                self.transport = transport
+
+            def datagram_received(self, data, addr):
+                response = tester.dns_response(data, zone, records, "UDP", addr[0], force_truncation)
+                if response is not None:
+                    self.transport.sendto(response, addr)
+
+        transport, _ = await loop.create_datagram_endpoint(Protocol, local_addr=(ipv6_address, port),
+                                                           family=socket.AF_INET6)
+        server = await asyncio.start_server(lambda r, w: self.handle_dns_tcp(r, w, zone, records),
+                                            ipv6_address, port, family=socket.AF_INET6)
+        self.logger.info(f"DNS responder for {zone} started on [{ipv6_address}]:{port} (UDP and TCP)")
+        if force_truncation:
+            self.logger.info("All UDP responses will be truncated to force TCP fallback")
+        try:
+            async with server:
+                await server.serve_forever()
+        finally:
+            transport.close()
+
+    def run_dns_server_tool(self, args: List[str]) -> int:
+        """Run a small authoritative DNS responder for a test zone."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py dns-server",
+                                         description="Serve a test zone authoritatively over IPv6 UDP and TCP. "
+                                                     "Responses larger than the client's UDP payload size are "
+                                                     "truncated so TCP fallback can be tested.")
+        parser.add_argument("ipv6_address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"IPv6 address to listen on (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=53, help="Port number (default: 53)")
+        parser.add_argument("--zone", default=self.DNS_DEFAULT_ZONE, help=f"Zone name (default: {self.DNS_DEFAULT_ZONE})")
+        parser.add_argument("--zone-file", help="Records as 'name [ttl] TYPE value' lines (default: built-in test records)")
+        parser.add_argument("--force-tc", action="store_true", help="Truncate every UDP response")
+        options = parser.parse_args(args)
+
+        zone = options.zone.lower().rstrip(".") + "."
+        try:
+            if options.zone_file:
+                lines = [entry for _, entry in self.read_entries(options.zone_file)]
+            else:
+                lines = self.default_dns_records(options.ipv6_address)
+            records = self.load_dns_zone(zone, lines)
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        try:
+            asyncio.run(self.run_dns_server(options.ipv6_address, options.port, zone, records, options.force_tc))
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+        except OSError as e:
+            self.logger.error(f"Server error: {e}")
+            return 1
+        return 0
+
+    def build_dns_query(self, name: str, qtype: int, payload_size: int = 1232, dnssec: bool = False) -> DNSMessage:
+        """Build a recursive query with an EDNS OPT record advertising payload_size.
+
+        With dnssec, the query sets DO to ask for RRSIGs and AD to ask whether the resolver validated them.
+        """
+        query = DNSMessage(secrets.randbits(16), DNSMessage.RD | (DNSMessage.AD if dnssec else 0))
+        query.questions.append((name if name.endswith(".") else name + ".", qtype, DNS_CLASS_IN))
+        query.additional.append(DNSRecord("", DNS_TYPES["OPT"], payload_size, 0x8000 if dnssec else 0, b""))
+        return query
+
+    def dns_tcp_exchange(self, sock: socket.socket, query: bytes) -> bytes:
+        """Send a length-prefixed query on a stream socket and read the length-prefixed response."""
+        sock.sendall(struct.pack("!H", len(query)) + query)
+        header = self.recv_exactly(sock, 2)
+        return self.recv_exactly(sock, struct.unpack("!H", header)[0])
+
+    def recv_exactly(self, sock: socket.socket, length: int) -> bytes:
+        """Read exactly length bytes from a stream socket."""
+        data = b""
+        while len(data) < length:
+            chunk = sock.recv(length - len(data))
+            if not chunk:
+                raise ConnectionError("connection closed before the full response arrived")
+            data += chunk
+        return data
+
+    def tls_context(self, insecure: bool, alpn: List[str]) -> ssl.SSLContext:
+        """Create a client TLS context, optionally without certificate verification."""
+        context = ssl.create_default_context()
+        if insecure:
+            context.check_hostname = False
+            context.verify_mode = ssl.CERT_NONE
+        context.set_alpn_protocols(alpn)
+        return context
 
+    def resolve_do53(self, server: str, query: bytes, timeout: float) -> Tuple[bytes, str]:
+        """Query over UDP, retrying over TCP when the response is truncated."""
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.settimeout(timeout)
+            sock.sendto(query, (server, 53))
+            while True:
+                response = sock.recv(65535)
+                if response[:2] == query[:2]:
+                    break
+        if not struct.unpack("!H", response[2:4])[0] & DNSMessage.TC:
+            return response, "UDP"
+        with socket.create_connection((server, 53), timeout=timeout) as sock:
+            return self.dns_tcp_exchange(sock, query), "TCP fallback"
+
+    def resolve_dot(self, server: str, query: bytes, timeout: float, tls_name: Optional[str],
+                    insecure: bool) -> Tuple[bytes, str]:
+        """Query over DNS-over-TLS (RFC 7858)."""
+        context = self.tls_context(insecure, ["dot"])
+        with socket.create_connection((server, 853), timeout=timeout) as raw:
+            with context.wrap_socket(raw, server_hostname=tls_name or server) as sock:
+                return self.dns_tcp_exchange(sock, query), sock.version()
+
+    def resolve_doh(self, server: str, query: bytes, timeout: float, tls_name: Optional[str],
+                    insecure: bool, path: str) -> Tuple[bytes, str]:
+        """Query over DNS-over-HTTPS (RFC 8484) with an HTTP/1.1 POST."""
+        context = self.tls_context(insecure, ["http/1.1"])
+        raw = socket.create_connection((server, 443), timeout=timeout)
+        connection = http.client.HTTPSConnection(f"[{server}]", 443, timeout=timeout, context=context)
+        connection.sock = context.wrap_socket(raw, server_hostname=tls_name or server)
         try:
-            if mode == 'server':
-                asyncio.run(self.run_server(ipv6_address, port))
+            headers = {"Content-Type": "application/dns-message", "Accept": "application/dns-message"}
+            if tls_name:
+                headers["Host"] = tls_name
+            connection.request("POST", path, body=query, headers=headers)
+            response = connection.getresponse()
+            body = response.read()
+            if response.status != 200:
+                raise ConnectionError(f"HTTP {response.status} {response.reason}")
+            return body, connection.sock.version()
+        finally:
+            connection.close()
+
+    def dnssec_status(self, response: DNSMessage, qtype: int,
+                      retry: Callable[[], DNSMessage]) -> Tuple[bool, str]:
+        """Classify an answer as secure, unsigned, unvalidated or bogus; returns (bogus, description).
+
+        A validating resolver sets AD on answers it authenticated and answers SERVFAIL to bogus ones, so a
+        SERVFAIL that turns into an answer when retried with CD (checking disabled) points at DNSSEC.
+        """
+        if response.rcode == DNS_RCODE_VALUES["SERVFAIL"]:
+            try:
+                unchecked = retry()
+            except (OSError, ValueError, http.client.HTTPException) as e:
+                return False, f"unknown; the retry with checking disabled failed ({e})"
+            if unchecked.rcode == DNS_RCODE_VALUES["NOERROR"]:
+                return True, "bogus; SERVFAIL, but it answers with checking disabled, so the answer failed validation"
+            return False, "unknown; SERVFAIL even with checking disabled, which is not a validation failure"
+        signatures = [record for record in response.answers if record.type == DNS_TYPES["RRSIG"]
+                      and int.from_bytes(record.rdata[:2], "big") == qtype]
+        if not signatures:
+            if response.flags & DNSMessage.AD:
+                return False, "secure (AD set), though the resolver returned no RRSIG"
+            return False, "unsigned; no RRSIG, so nothing vouches for this answer"
+        now = int(time.time())
+        for signature in signatures:
+            algorithm, _, _, expiration, inception, key_tag = struct.unpack("!BBIIIH", signature.rdata[2:18])
+            signer = DNSMessage.decode_name(signature.rdata, 18)[0]
+            if not inception <= now <= expiration:
+                window = (f"{datetime.datetime.fromtimestamp(inception, datetime.timezone.utc):%Y-%m-%d} to "
+                          f"{datetime.datetime.fromtimestamp(expiration, datetime.timezone.utc):%Y-%m-%d}")
+                return True, f"bogus; the RRSIG by {signer} key {key_tag} is only valid {window}"
+        detail = (f"RRSIG by {signer} key {key_tag} algorithm {algorithm}, expires "
+                  f"{datetime.datetime.fromtimestamp(expiration, datetime.timezone.utc):%Y-%m-%d}")
+        if response.flags & DNSMessage.AD:
+            return False, f"secure (AD set); {detail}"
+        return False, f"signed but not validated; AD is clear, so the resolver does not validate ({detail})"
+
+    def run_resolve(self, args: List[str]) -> int:
+        """Resolve a name over Do53, DoT, and DoH and compare the answers and latency."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py resolve",
+                                         description="Query IPv6-literal resolvers over plain DNS (Do53), "
+                                                     "DNS-over-TLS, and DNS-over-HTTPS, comparing answers and latency.")
+        parser.add_argument("name", help="Name to resolve")
+        parser.add_argument("--type", default="AAAA", help="Record type (default: AAAA)")
+        parser.add_argument("--server", action="append", help=f"Resolver IPv6 address, may be repeated "
+                                                              f"(default: {self.DEFAULT_RESOLVER})")
+        parser.add_argument("--transport", action="append", choices=["do53", "dot", "doh"],
+                            help="Transport to use, may be repeated (default: all)")
+        parser.add_argument("--tls-name", help="Name to send in SNI and verify the certificate against "
+                                               "(default: the resolver address)")
+        parser.add_argument("--doh-path", default="/dns-query", help="DoH URL path (default: /dns-query)")
+        parser.add_argument("--insecure", action="store_true", help="Don't verify resolver certificates")
+        parser.add_argument("--dnssec", action="store_true",
+                            help="Request DNSSEC records and report whether each answer is secure, unsigned or bogus")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        qtype = DNS_TYPES.get(options.type.upper()) or (int(options.type) if options.type.isdigit() else None)
+        if qtype is None:
+            self.logger.error(f"Error: Unknown record type {options.type}")
+            return 1
+        transports = options.transport or ["do53", "dot", "doh"]
+
+        def exchange(server: str, transport: str, name: str, qtype: int,
+                     checking_disabled: bool = False) -> Tuple[DNSMessage, str]:
+            query = self.build_dns_query(name, qtype, dnssec=options.dnssec)
+            if checking_disabled:
+                query.flags |= DNSMessage.CD
+            if transport == "do53":
+                data, detail = self.resolve_do53(server, query.encode(), options.timeout)
+            elif transport == "dot":
+                data, detail = self.resolve_dot(server, query.encode(), options.timeout,
+                                                options.tls_name, options.insecure)
             else:
-                asyncio.run(self.run_client(ipv6_address, port))
+                data, detail = self.resolve_doh(server, query.encode(), options.timeout,
+                                                options.tls_name, options.insecure, options.doh_path)
+            response = DNSMessage.decode(data)
+            if response.id != query.id:
+                raise ValueError("response ID does not match the query")
+            return response, detail
+
+        failures = 0
+        for server in options.server or [self.DEFAULT_RESOLVER]:
+            self.logger.info(f"Resolving {options.name} {options.type.upper()} via {server}:")
+            baseline = None
+            for transport in transports:
+                start = time.perf_counter()
+                try:
+                    response, detail = exchange(server, transport, options.name, qtype)
+                    elapsed = (time.perf_counter() - start) * 1000
+                except (OSError, ValueError, http.client.HTTPException) as e:
+                    self.logger.info(f"  {self.DNS_TRANSPORT_LABELS[transport]:<5} failed: {e}")
+                    failures += 1
+                    continue
+
+                # Signatures are summarized in the DNSSEC line rather than listed
+                answers = sorted(f"{DNS_TYPE_NAMES.get(record.type, record.type)} {record.value}"
+                                 for record in response.answers if record.type != DNS_TYPES["RRSIG"])
+                comparison = ""
+                if baseline is None:
+                    baseline, baseline_transport = answers, transport
+                    services = [record for record in response.answers if record.type == qtype]
+                elif answers != baseline:
+                    comparison = " (differs from the first transport)"
+                    failures += 1
+                self.logger.info(f"  {self.DNS_TRANSPORT_LABELS[transport]:<5} {DNS_RCODES.get(response.rcode, response.rcode):<8} "
+                                 f"{elapsed:7.1f} ms  {detail}{comparison}")
+                for answer in answers:
+                    self.logger.info(f"        {answer}")
+                if options.dnssec:
+                    bogus, status = self.dnssec_status(
+                        response, qtype,
+                        lambda: exchange(server, transport, options.name, qtype, checking_disabled=True)[0])
+                    self.logger.info(f"        DNSSEC: {status}")
+                    failures += bogus
+            if baseline is None or qtype not in (DNS_TYPES["SVCB"], DNS_TYPES["HTTPS"]):
+                continue
+            # Clients may connect to the hinted addresses before the AAAA lookup finishes, so stale hints matter
+            for record in services:
+                priority, target, params = DNSMessage.decode_svcb(record.rdata)
+                hinted = {self.format_address(ipaddress.IPv6Address(value[start:start + 16]))
+                          for key, value in params if key == 6 for start in range(0, len(value) - 15, 16)}
+                if priority == 0 or not hinted:
+                    continue
+                host = record.name if target == "." else target
+                try:
+                    response, _ = exchange(server, baseline_transport, host, DNS_TYPES["AAAA"])
+                except (OSError, ValueError, http.client.HTTPException) as e:
+                    self.logger.info(f"  ipv6hint check for {host} failed: {e}")
+                    failures += 1
+                    continue
+                actual = {self.format_address(ipaddress.IPv6Address(answer.rdata))
+                          for answer in response.answers if answer.type == DNS_TYPES["AAAA"]}
+                if hinted == actual:
+                    self.logger.info(f"  ipv6hint matches the AAAA records of {host}")
+                    continue
+                failures += 1
+                self.logger.info(f"  ipv6hint does not match the AAAA records of {host}:")
+                if hinted - actual:
+                    self.logger.info(f"        hinted but not in AAAA: {', '.join(sorted(hinted - actual))}")
+                if actual - hinted:
+                    self.logger.info(f"        in AAAA but not hinted: {', '.join(sorted(actual - hinted))}")
+        return 1 if failures else 0
+
+    def watch_alerts(self, state: dict, response: DNSMessage, known: List[ipaddress.IPv6Network],
+                     learn_length: int, now: float) -> List[str]:
+        """Compare one AAAA answer with what was seen before; updates state and returns alerts."""
+        records = [record for record in response.answers if record.type == DNS_TYPES["AAAA"]]
+        addresses = {self.format_address(ipaddress.IPv6Address(record.rdata)) for record in records}
+        ttl = min((record.ttl for record in records), default=0)
+        alerts = []
+        # Each address is reported once, when it first appears
+        for text in sorted(addresses - state.get("addresses", set())):
+            address = ipaddress.IPv6Address(text)
+            if not address.is_global or address.ipv4_mapped is not None:
+                # Blocking resolvers and captive portals answer with ::, ::1 or a mapped IPv4 address
+                alerts.append(f"{text} is not a global unicast address")
+            elif known and not any(address in prefix for prefix in known):
+                alerts.append(f"{text} is outside the known prefixes")
+        if "addresses" not in state:
+            state.update(addresses=addresses, ttl=ttl, max_ttl=ttl, expires=now + ttl, rcode=response.rcode)
+            if learn_length:
+                # Without --prefix, the first answers define what is expected from then on
+                known.extend(ipaddress.IPv6Network(f"{text}/{learn_length}", strict=False) for text in addresses
+                             if ipaddress.IPv6Address(text).is_global)
+            return alerts
+        if response.rcode != state["rcode"]:
+            alerts.append(f"response code changed from {DNS_RCODES.get(state['rcode'], state['rcode'])} to "
+                          f"{DNS_RCODES.get(response.rcode, response.rcode)}")
+        if addresses != state["addresses"] and now < state["expires"] - 1:
+            # A cache serves the same RRset until its TTL runs out; an earlier change was injected or overwritten
+            previous = ", ".join(sorted(state["addresses"])) or "none"
+            alerts.append(f"answer changed {state['expires'] - now:.0f} s before the previous TTL expired: "
+                          f"{previous} -> {', '.join(sorted(addresses)) or 'none'}")
+        if addresses and ttl > state["max_ttl"]:
+            # Caches count TTLs down from the authoritative value, so a longer one came from somewhere else
+            alerts.append(f"TTL {ttl} s is longer than any seen before ({state['max_ttl']} s)")
+        if addresses != state["addresses"] or now >= state["expires"] - 1:
+            state.update(expires=now + ttl)
+        state.update(addresses=addresses, ttl=ttl, max_ttl=max(state["max_ttl"], ttl), rcode=response.rcode)
+        return alerts
+
+    def run_dns_watch(self, args: List[str]) -> int:
+        """Resolve AAAA records repeatedly and alert on changes that suggest cache poisoning or hijacking."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py dns-watch",
+                                         description="Resolve the AAAA records of names repeatedly and alert when "
+                                                     "the answers change unexpectedly: before the previous TTL "
+                                                     "expired, with a TTL that goes up or exceeds the original, "
+                                                     "with addresses outside the known prefixes, or with non-global "
+                                                     "addresses. A lightweight detector for DNS hijacks and cache "
+                                                     "poisoning that affect IPv6.")
+        parser.add_argument("name", nargs="+", help="Names to watch")
+        parser.add_argument("--server", action="append", help=f"Resolver IPv6 address, may be repeated "
+                                                              f"(default: {self.DEFAULT_RESOLVER})")
+        parser.add_argument("--prefix", action="append", type=ipaddress.IPv6Network, metavar="PREFIX",
+                            help="Prefix the answers are expected in, may be repeated (default: learn from the "
+                                 "first answers)")
+        parser.add_argument("--learn-length", type=int, default=48,
+                            help="Prefix length to learn from the first answers without --prefix (default: 48)")
+        parser.add_argument("--interval", type=float, default=30.0, help="Seconds between rounds (default: 30)")
+        parser.add_argument("--count", type=int, default=0, help="Rounds to run (default: until interrupted)")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        if not 0 <= options.learn_length <= 128:
+            parser.error("--learn-length must be between 0 and 128")
+        if options.interval < 1:
+            parser.error("--interval must be at least 1 second")
+        servers = options.server or [self.DEFAULT_RESOLVER]
+        known = {name: list(options.prefix or []) for name in options.name}
+        states = {(name, server): {} for name in options.name for server in servers}
+        alerts = 0
+        self.logger.info(f"Watching AAAA for {', '.join(options.name)} via {', '.join(servers)} every "
+                         f"{options.interval:g} s" + (f", expecting {', '.join(str(p) for p in options.prefix)}"
+                                                      if options.prefix else ""))
+        try:
+            round_number = 0
+            while not options.count or round_number < options.count:
+                if round_number:
+                    time.sleep(options.interval)
+                round_number += 1
+                for (name, server), state in states.items():
+                    try:
+                        query = self.build_dns_query(name, DNS_TYPES["AAAA"])
+                        response = DNSMessage.decode(self.resolve_do53(server, query.encode(), options.timeout)[0])
+                        if response.id != query.id:
+                            raise ValueError("response ID does not match the query")
+                    except (OSError, ValueError) as e:
+                        self.logger.info(f"{time.strftime('%H:%M:%S')} {name} via {server}: query failed: {e}")
+                        continue
+                    first = not state
+                    messages = self.watch_alerts(state, response, known[name],
+                                                 0 if options.prefix else options.learn_length, time.monotonic())
+                    if first:
+                        self.logger.info(f"{time.strftime('%H:%M:%S')} {name} via {server}: "
+                                         f"{', '.join(sorted(state['addresses'])) or 'no AAAA'} (TTL {state['ttl']})")
+                    for message in messages:
+                        self.logger.warning(f"{time.strftime('%H:%M:%S')} ALERT {name} via {server}: {message}")
+                    alerts += len(messages)
+        except KeyboardInterrupt:
+            self.logger.info("\nStopped")
+        self.logger.info(f"{alerts} alerts")
+        return 1 if alerts else 0
+
+    def mdns_round(self, sock: socket.socket, scope_id: int, questions: List[Tuple[str, int]],
+                   wait: float, records: dict, responders: set) -> None:
+        """Send one-shot mDNS queries (RFC 6762 section 5.1) and cache every record heard for wait seconds."""
+        if not questions:
+            return
+        query = DNSMessage()
+        query.questions = [(name, qtype, DNS_CLASS_IN) for name, qtype in questions]
+        sock.sendto(query.encode(), (self.MDNS_GROUP, self.MDNS_PORT, 0, scope_id))
+        deadline = time.monotonic() + wait
+        while (remaining := deadline - time.monotonic()) > 0:
+            sock.settimeout(remaining)
+            try:
+                data, sender = sock.recvfrom(9000)
+                response = DNSMessage.decode(data)
+            except socket.timeout:
+                break
+            except ValueError:
+                continue
+            responders.add(sender[0])
+            for record in response.answers + response.additional:
+                if record.type != DNS_TYPES["OPT"]:
+                    records.setdefault((record.name.lower(), record.type), set()).add(record.value)
+
+    def run_browse(self, args: List[str]) -> int:
+        """Discover services and hosts on the local link with mDNS over IPv6."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py browse",
+                                         description="Query ff02::fb for DNS-SD services, their instances, and the "
+                                                     "AAAA records of the hosts providing them.")
+        parser.add_argument("--interface", action="append",
+                            help="Interface to browse on, may be repeated (default: all non-loopback interfaces)")
+        parser.add_argument("--service", action="append",
+                            help="Service type to browse, e.g. _http._tcp (default: enumerate all service types)")
+        parser.add_argument("--wait", type=float, default=1.5, help="Seconds to listen after each query (default: 1.5)")
+        options = parser.parse_args(args)
+
+        interfaces = options.interface or [name for _, name in socket.if_nameindex() if name != "lo"]
+        found = False
+        for interface in interfaces:
+            try:
+                scope_id = socket.if_nametoindex(interface)
+            except OSError:
+                self.logger.error(f"Error: No such interface {interface}")
+                return 1
+            records, responders = {}, set()
+            with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+                sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_IF, scope_id)
+                sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_HOPS, 255)
+                sock.bind(("::", 0))
+                try:
+                    if options.service:
+                        services = [f"{service.rstrip('.')}.local." for service in options.service]
+                    else:
+                        self.mdns_round(sock, scope_id, [(self.MDNS_SERVICES, DNS_TYPES["PTR"])],
+                                        options.wait, records, responders)
+                        services = sorted(records.get((self.MDNS_SERVICES, DNS_TYPES["PTR"]), []))
+                    self.mdns_round(sock, scope_id, [(service, DNS_TYPES["PTR"]) for service in services],
+                                    options.wait, records, responders)
+                    instances = sorted({instance for service in services
+                                        for instance in records.get((service.lower(), DNS_TYPES["PTR"]), [])})
+                    self.mdns_round(sock, scope_id, [(instance, qtype) for instance in instances
+                                                     for qtype in (DNS_TYPES["SRV"], DNS_TYPES["TXT"])
+                                                     if (instance.lower(), qtype) not in records],
+                                    options.wait, records, responders)
+                    hosts = sorted({srv.split()[3] for instance in instances
+                                    for srv in records.get((instance.lower(), DNS_TYPES["SRV"]), [])})
+                    self.mdns_round(sock, scope_id, [(host, DNS_TYPES["AAAA"]) for host in hosts
+                                                     if (host.lower(), DNS_TYPES["AAAA"]) not in records],
+                                    options.wait, records, responders)
+                except OSError as e:
+                    self.logger.info(f"Skipping {interface}: {e}")
+                    continue
+
+            self.logger.info(f"mDNS on {interface} ({self.MDNS_GROUP}): {len(responders)} responders")
+            for responder in sorted(responders):
+                self.logger.info(f"  Responder: {responder}")
+            for service in services:
+                self.logger.info(f"  Service {service}")
+                for instance in sorted(records.get((service.lower(), DNS_TYPES["PTR"]), [])):
+                    found = True
+                    for srv in sorted(records.get((instance.lower(), DNS_TYPES["SRV"]), [])):
+                        _, _, port, target = srv.split()
+                        self.logger.info(f"    {instance} -> {target}:{port}")
+                    if (instance.lower(), DNS_TYPES["SRV"]) not in records:
+                        self.logger.info(f"    {instance}")
+                    for txt in sorted(records.get((instance.lower(), DNS_TYPES["TXT"]), [])):
+                        self.logger.info(f"      TXT {txt}")
+            hosts = sorted({name for name, rtype in records if rtype == DNS_TYPES["AAAA"]})
+            for host in hosts:
+                found = True
+                self.logger.info(f"  Host {host} AAAA {', '.join(sorted(records[(host, DNS_TYPES['AAAA'])]))}")
+        return 0 if found else 1
+
+    def ntp_query(self, address: Tuple, timeout: float) -> dict:
+        """Send one SNTPv4 client request (RFC 4330) and compute offset and delay."""
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.settimeout(timeout)
+            t1 = time.time()
+            transmit = int((t1 + self.NTP_EPOCH_OFFSET) * 2**32)
+            # LI=0, VN=4, Mode=3 (client)
+            request = struct.pack("!B39xQ", (4 << 3) | 3, transmit)
+            sock.sendto(request, address)
+            while True:
+                data, _ = sock.recvfrom(1024)
+                t4 = time.time()
+                if len(data) >= 48 and struct.unpack("!Q", data[24:32])[0] == transmit:
+                    break
+        flags, stratum, poll, precision, _, _, refid = struct.unpack("!BBbbII4s", data[:16])
+        t2, t3 = (value / 2**32 - self.NTP_EPOCH_OFFSET for value in struct.unpack("!QQ", data[32:48]))
+        if stratum == 0:
+            reference = f"kiss code {refid.decode(errors='replace')}"
+        elif stratum == 1:
+            reference = refid.rstrip(b"\x00").decode(errors="replace")
+        else:
+            reference = refid.hex()
+        return {
+            "leap": flags >> 6,
+            "version": (flags >> 3) & 0x7,
+            "stratum": stratum,
+            "reference": reference,
+            "offset": ((t2 - t1) + (t3 - t4)) / 2,
+            "delay": (t4 - t1) - (t3 - t2),
+        }
+
+    def run_ntp(self, args: List[str]) -> int:
+        """Query an NTP server over IPv6 and report offset, delay, and stratum."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py ntp",
+                                         description="Query an NTP server over IPv6 only and report clock offset, "
+                                                     "round-trip delay, and stratum.")
+        parser.add_argument("server", nargs="?", default=self.DEFAULT_NTP_SERVER,
+                            help=f"NTP server name or IPv6 address (default: {self.DEFAULT_NTP_SERVER})")
+        parser.add_argument("--count", type=int, default=4, help="Number of samples (default: 4)")
+        parser.add_argument("--timeout", type=float, default=2.0, help="Timeout per sample in seconds (default: 2)")
+        options = parser.parse_args(args)
+
+        try:
+            address = socket.getaddrinfo(options.server, 123, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        except socket.gaierror as e:
+            self.logger.error(f"Error: Could not resolve an IPv6 address for {options.server}: {e}")
+            return 1
+
+        self.logger.info(f"NTP server {options.server} [{address[0]}]:123")
+        samples = []
+        for i in range(options.count):
+            try:
+                sample = self.ntp_query(address, options.timeout)
+            except OSError as e:
+                self.logger.info(f"  Sample {i + 1}: failed ({e})")
+                continue
+            samples.append(sample)
+            self.logger.info(f"  Sample {i + 1}: offset {sample['offset'] * 1000:+.3f} ms, "
+                             f"delay {sample['delay'] * 1000:.3f} ms, stratum {sample['stratum']}")
+            if i < options.count - 1:
+                time.sleep(1)
+
+        if not samples:
+            self.logger.info("No responses received")
+            return 1
+        # The sample with the lowest delay has the least path asymmetry error
+        best = min(samples, key=lambda sample: sample["delay"])
+        self.logger.info(f"\nBest sample: offset {best['offset'] * 1000:+.3f} ms, delay {best['delay'] * 1000:.3f} ms")
+        self.logger.info(f"  Stratum: {best['stratum']}")
+        self.logger.info(f"  Reference: {best['reference']}")
+        self.logger.info(f"  Version: {best['version']}")
+        self.logger.info(f"  Leap indicator: {best['leap']}{' (clock unsynchronized)' if best['leap'] == 3 else ''}")
+        return 0 if best["stratum"] != 0 and best["leap"] != 3 else 1
+
+    def banner_exchange(self, service: str, sock: socket.socket, host: str) -> List[str]:
+        """Run the opening exchange for a service and return the transcript."""
+        reader = sock.makefile("rb")
+        transcript = []
+
+        def receive(until=None) -> str:
+            # Read one reply; until(line) decides when a multi-line reply is complete
+            while True:
+                line = reader.readline(self.MAX_LINE_LENGTH).decode(errors="replace").rstrip("\r\n")
+                if not line and not transcript:
+                    raise ConnectionError("connection closed without a greeting")
+                transcript.append(f"S: {line}")
+                if not line or until is None or until(line):
+                    return line
+
+        def send(*lines: str) -> None:
+            transcript.extend(f"C: {line}" for line in lines)
+            sock.sendall("".join(f"{line}\r\n" for line in lines).encode())
+
+        def final_reply(line: str) -> bool:
+            # SMTP and FTP continue multi-line replies with "NNN-"
+            return len(line) < 4 or line[3] != "-"
+
+        if service == "ssh":
+            receive(lambda line: line.startswith("SSH-"))
+        elif service == "smtp":
+            receive(final_reply)
+            send("EHLO ipv6-tester.invalid")
+            receive(final_reply)
+            send("QUIT")
+        elif service == "ftp":
+            receive(final_reply)
+            send("QUIT")
+        elif service == "imap":
+            receive()
+            send("a1 CAPABILITY")
+            receive(lambda line: line.startswith("a1 "))
+            send("a2 LOGOUT")
+        elif service == "pop3":
+            receive()
+            send("QUIT")
+        elif service == "http":
+            authority = f"[{host}]" if ":" in host else host
+            send("HEAD / HTTP/1.1", f"Host: {authority}", "User-Agent: ipv6_tester", "Connection: close", "")
+            receive(lambda line: not line)
+        return transcript
+
+    def run_banner(self, args: List[str]) -> int:
+        """Grab service banners from a host's IPv6 addresses."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py banner",
+                                         description="Connect to common service ports over IPv6, complete the "
+                                                     "opening protocol exchange, and report what the server said.")
+        parser.add_argument("host", help="Hostname or IPv6 address")
+        parser.add_argument("--service", action="append",
+                            help="Service as name or name:port, may be repeated "
+                                 f"(default: {', '.join(self.BANNER_SERVICES)})")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        services = []
+        for spec in options.service or list(self.BANNER_SERVICES):
+            name, _, port = spec.partition(":")
+            if name not in self.BANNER_SERVICES or (port and not port.isdigit()):
+                self.logger.error(f"Error: Invalid service '{spec}', expected one of "
+                                  f"{', '.join(self.BANNER_SERVICES)} with an optional :port")
+                return 1
+            services.append((name, int(port) if port else self.BANNER_SERVICES[name]))
+
+        try:
+            address = socket.getaddrinfo(options.host, None, socket.AF_INET6, socket.SOCK_STREAM)[0][4][0]
+        except socket.gaierror as e:
+            self.logger.error(f"Error: Could not resolve an IPv6 address for {options.host}: {e}")
+            return 1
+
+        self.logger.info(f"Banner grab for {options.host} [{address}]:")
+        answered = 0
+        for name, port in services:
+            try:
+                with socket.create_connection((address, port), timeout=options.timeout) as sock:
+                    transcript = self.banner_exchange(name, sock, options.host)
+            except (OSError, ConnectionError) as e:
+                self.logger.info(f"  {name} ({port}): {e}")
+                continue
+            answered += 1
+            self.logger.info(f"  {name} ({port}):")
+            for line in transcript:
+                self.logger.info(f"    {line}")
+        return 0 if answered else 1
+
+    def ssh_string(self, data: bytes) -> bytes:
+        """Encode an SSH string (RFC 4251 section 5)."""
+        return struct.pack("!I", len(data)) + data
+
+    def ssh_read_string(self, data: bytes, offset: int) -> Tuple[bytes, int]:
+        """Decode an SSH string, returning it and the offset just past it."""
+        length = struct.unpack("!I", data[offset:offset + 4])[0]
+        if offset + 4 + length > len(data):
+            raise ValueError("SSH string runs past the end of the packet")
+        return data[offset + 4:offset + 4 + length], offset + 4 + length
+
+    def ssh_send_packet(self, sock: socket.socket, payload: bytes) -> None:
+        """Send an unencrypted SSH binary packet (RFC 4253 section 6)."""
+        padding = 8 - (len(payload) + 5) % 8
+        if padding < 4:
+            padding += 8
+        sock.sendall(struct.pack("!IB", len(payload) + padding + 1, padding) + payload + bytes(padding))
+
+    def ssh_read_packet(self, sock: socket.socket) -> bytes:
+        """Read an unencrypted SSH binary packet and return its payload."""
+        length = struct.unpack("!I", self.recv_exactly(sock, 4))[0]
+        if not 5 <= length <= 35000:
+            raise ValueError(f"invalid SSH packet length {length}")
+        packet = self.recv_exactly(sock, length)
+        return packet[1:length - packet[0]]
+
+    def ssh_host_key(self, address: str, port: int, host_key_algorithms: List[str],
+                     timeout: float) -> Tuple[str, Optional[bytes]]:
+        """Run the version exchange and the start of key exchange, returning the server's version
+        string and the host key blob it offers for the given algorithms (None if it has none)."""
+        with socket.create_connection((address, port), timeout=timeout) as sock:
+            # Servers may send other lines before the version string (RFC 4253 section 4.2)
+            while True:
+                line = b""
+                while not line.endswith(b"\n") and len(line) < 255:
+                    byte = sock.recv(1)
+                    if not byte:
+                        raise ConnectionError("connection closed before the SSH version exchange")
+                    line += byte
+                line = line.decode(errors="replace").rstrip("\r\n")
+                if line.startswith("SSH-"):
+                    break
+            sock.sendall(b"SSH-2.0-ipv6_tester\r\n")
+
+            server_kexinit = self.ssh_read_packet(sock)
+            while server_kexinit[0] != 20:
+                server_kexinit = self.ssh_read_packet(sock)
+            server_kex = self.ssh_read_string(server_kexinit, 17)[0].decode().split(",")
+            kex = next((name for name in self.SSH_KEX_ALGORITHMS if name in server_kex), None)
+            if kex is None:
+                raise ConnectionError(f"no supported key exchange (server offers {', '.join(server_kex)})")
+
+            name_lists = [",".join(self.SSH_KEX_ALGORITHMS), ",".join(host_key_algorithms)]
+            name_lists += [self.SSH_CIPHERS] * 2 + [self.SSH_MACS] * 2 + ["none"] * 2 + [""] * 2
+            kexinit = bytes([20]) + secrets.token_bytes(16)
+            kexinit += b"".join(self.ssh_string(name.encode()) for name in name_lists) + bytes(5)
+            self.ssh_send_packet(sock, kexinit)
+
+            # The host key arrives before any shared secret is needed, so the client's public value
+            # only has to be well formed: a random X25519 key, the P-256 generator, or g^1 for group14.
+            if kex.startswith("curve25519"):
+                public = self.ssh_string(secrets.token_bytes(32))
+            elif kex == "ecdh-sha2-nistp256":
+                public = self.ssh_string(self.P256_GENERATOR)
+            else:
+                public = self.ssh_string(b"\x02")
+            self.ssh_send_packet(sock, bytes([30]) + public)
+
+            while True:
+                reply = self.ssh_read_packet(sock)
+                if reply[0] == 1:
+                    return line, None
+                if reply[0] == 31:
+                    return line, self.ssh_read_string(reply, 1)[0]
+
+    def ssh_fingerprints(self, address: str, port: int, timeout: float) -> Tuple[str, dict]:
+        """Collect {key type: SHA256 fingerprint} for every host key family the server offers."""
+        version, keys = "", {}
+        for algorithms in self.SSH_HOST_KEY_FAMILIES:
+            try:
+                version, blob = self.ssh_host_key(address, port, algorithms, timeout)
+            except ConnectionError:
+                continue
+            if blob:
+                key_type = self.ssh_read_string(blob, 0)[0].decode()
+                digest = base64.b64encode(hashlib.sha256(blob).digest()).decode().rstrip("=")
+                keys[key_type] = f"SHA256:{digest}"
+        return version, keys
+
+    def run_ssh_keys(self, args: List[str]) -> int:
+        """Collect SSH host key fingerprints over IPv6 and compare them with the IPv4 endpoint."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py sshkeys",
+                                         description="Perform the SSH version exchange and collect host key "
+                                                     "fingerprints from a host's IPv6 and IPv4 addresses, flagging "
+                                                     "endpoints that present different keys.")
+        parser.add_argument("host", help="Hostname or address")
+        parser.add_argument("port", nargs="?", type=int, default=22, help="SSH port (default: 22)")
+        parser.add_argument("--no-ipv4", action="store_true", help="Only check the IPv6 endpoint")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        endpoints = []
+        for label, family in (("IPv6", socket.AF_INET6), ("IPv4", socket.AF_INET)):
+            if family == socket.AF_INET and options.no_ipv4:
+                continue
+            try:
+                infos = socket.getaddrinfo(options.host, options.port, family, socket.SOCK_STREAM)
+                endpoints.append((label, infos[0][4][0]))
+            except socket.gaierror:
+                self.logger.info(f"No {label} address for {options.host}")
+        if not any(label == "IPv6" for label, _ in endpoints):
+            return 1
+
+        self.logger.info(f"SSH host keys for {options.host} port {options.port}:")
+        results = {}
+        for label, address in endpoints:
+            try:
+                version, keys = self.ssh_fingerprints(address, options.port, options.timeout)
+            except (OSError, ValueError) as e:
+                self.logger.info(f"  {label} [{address}]: {e}")
+                continue
+            results[label] = keys
+            self.logger.info(f"  {label} [{address}]: {version}")
+            for key_type, fingerprint in sorted(keys.items()):
+                self.logger.info(f"    {key_type} {fingerprint}")
+
+        if "IPv6" not in results:
+            return 1
+        if "IPv4" not in results:
+            return 0
+        mismatches = [key_type for key_type in sorted(set(results["IPv6"]) | set(results["IPv4"]))
+                      if results["IPv6"].get(key_type) != results["IPv4"].get(key_type)]
+        for key_type in mismatches:
+            self.logger.info(f"\nMISMATCH {key_type}: IPv6 {results['IPv6'].get(key_type, 'missing')}, "
+                             f"IPv4 {results['IPv4'].get(key_type, 'missing')}")
+        if not mismatches:
+            self.logger.info("\nIPv6 and IPv4 endpoints present the same host keys")
+        return 1 if mismatches else 0
+
+    def der_read(self, data: bytes, offset: int) -> Tuple[int, bytes, int]:
+        """Read one DER element, returning its tag, contents, and the offset just past it."""
+        if offset + 2 > len(data):
+            raise ValueError("DER element header runs past the end of the data")
+        tag, length = data[offset], data[offset + 1]
+        offset += 2
+        if length & 0x80:
+            count = length & 0x7f
+            length = int.from_bytes(data[offset:offset + count], "big")
+            offset += count
+        if offset + length > len(data):
+            raise ValueError("DER element runs past the end of the data")
+        return tag, data[offset:offset + length], offset + length
+
+    def der_children(self, data: bytes) -> List[Tuple[int, bytes]]:
+        """Split the contents of a DER constructed element into (tag, contents) pairs."""
+        children, offset = [], 0
+        while offset < len(data):
+            tag, content, offset = self.der_read(data, offset)
+            children.append((tag, content))
+        return children
+
+    def decode_certificate(self, der: bytes) -> dict:
+        """Extract the cert tool's fields from a DER X.509 certificate; raises ValueError if it is malformed."""
+        try:
+            certificate = self.der_children(self.der_read(der, 0)[1])
+            fields = self.der_children(certificate[0][1])
+            if fields[0][0] == 0xa0:
+                fields = fields[1:]
+
+            def name(content: bytes) -> str:
+                parts = []
+                for _, rdn in self.der_children(content):
+                    for _, attribute in self.der_children(rdn):
+                        (_, oid), (_, value) = self.der_children(attribute)[:2]
+                        label = self.X509_NAME_ATTRIBUTES.get(oid)
+                        if label:
+                            parts.append(f"{label}={value.decode(errors='replace')}")
+                return ", ".join(parts) or "(empty)"
+
+            def when(tag: int, value: bytes) -> datetime.datetime:
+                text = value.decode()
+                if tag == 0x17:
+                    # UTCTime years 50-99 are 19xx (RFC 5280 section 4.1.2.5.1)
+                    text = ("19" if int(text[:2]) >= 50 else "20") + text
+                return datetime.datetime.strptime(text, "%Y%m%d%H%M%SZ").replace(tzinfo=datetime.timezone.utc)
+
+            not_before, not_after = [when(tag, value) for tag, value in self.der_children(fields[3][1])]
+            names = []
+            extensions = next((content for tag, content in fields[6:] if tag == 0xa3), b"")
+            for _, extension in self.der_children(self.der_read(extensions, 0)[1]) if extensions else []:
+                parts = self.der_children(extension)
+                if parts[0][1] == self.X509_SUBJECT_ALT_NAME:
+                    for tag, value in self.der_children(self.der_read(parts[-1][1], 0)[1]):
+                        if tag == 0x82:
+                            names.append(value.decode(errors="replace"))
+                        elif tag == 0x87 and len(value) == 16:
+                            names.append(self.format_address(ipaddress.IPv6Address(value)))
+                        elif tag == 0x87 and len(value) == 4:
+                            names.append(str(ipaddress.IPv4Address(value)))
+            return {
+                "subject": name(fields[4][1]),
+                "issuer": name(fields[2][1]),
+                "not_before": not_before,
+                "not_after": not_after,
+                "names": names,
+                "sha256": hashlib.sha256(der).hexdigest(),
+            }
+        except (IndexError, UnicodeError) as e:
+            raise ValueError(f"malformed certificate: {e}") from e
+
+    def tls_handshake(self, address: str, port: int, server_name: Optional[str], alpn: List[str],
+                      timeout: float) -> dict:
+        """Connect with TLS and return the negotiated parameters and the presented certificate chain.
+        Verification is attempted first; on failure the handshake is repeated without it so the
+        chain can still be inspected."""
+        verify_error = None
+        for insecure in (False, True):
+            context = self.tls_context(insecure, alpn)
+            if server_name is None:
+                context.check_hostname = False
+            try:
+                with socket.create_connection((address, port), timeout=timeout) as raw:
+                    with context.wrap_socket(raw, server_hostname=server_name) as sock:
+                        if hasattr(sock, "get_unverified_chain"):
+                            chain = sock.get_unverified_chain()
+                        else:
+                            chain = [sock.getpeercert(binary_form=True)]
+                        return {
+                            "version": sock.version(),
+                            "cipher": sock.cipher()[0],
+                            "alpn": sock.selected_alpn_protocol(),
+                            "verify_error": verify_error,
+                            "chain": [self.decode_certificate(der) for der in chain],
+                        }
+            except ssl.SSLCertVerificationError as e:
+                verify_error = e.verify_message
+
+    def run_cert(self, args: List[str]) -> int:
+        """Inspect the TLS certificate chain on a host's IPv6 endpoints and diff it against IPv4."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py cert",
+                                         description="Dump the TLS certificate chain, SNI behavior, ALPN, and expiry "
+                                                     "presented on each of a host's IPv6 addresses and compare them "
+                                                     "with the IPv4 endpoint.")
+        parser.add_argument("host", help="Hostname or address")
+        parser.add_argument("port", nargs="?", type=int, default=443, help="TLS port (default: 443)")
+        parser.add_argument("--sni", help="Server name to send (default: the hostname)")
+        parser.add_argument("--alpn", default="h2,http/1.1", help="Comma-separated ALPN protocols to offer "
+                                                                   "(default: h2,http/1.1)")
+        parser.add_argument("--no-ipv4", action="store_true", help="Only check the IPv6 endpoints")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        server_name = options.sni
+        if server_name is None:
+            try:
+                ipaddress.ip_address(options.host)
+            except ValueError:
+                server_name = options.host
+        alpn = [protocol for protocol in options.alpn.split(",") if protocol]
+
+        endpoints = []
+        for label, family in (("IPv6", socket.AF_INET6), ("IPv4", socket.AF_INET)):
+            if family == socket.AF_INET and options.no_ipv4:
+                continue
+            try:
+                infos = socket.getaddrinfo(options.host, options.port, family, socket.SOCK_STREAM)
+            except socket.gaierror:
+                self.logger.info(f"No {label} address for {options.host}")
+                continue
+            addresses = list(dict.fromkeys(info[4][0] for info in infos))
+            endpoints += [(label, address) for address in (addresses if label == "IPv6" else addresses[:1])]
+        if not any(label == "IPv6" for label, _ in endpoints):
+            return 1
+
+        self.logger.info(f"TLS certificates for {options.host} port {options.port} "
+                         f"(SNI {server_name or 'none'}, ALPN {options.alpn or 'none'}):")
+        now = datetime.datetime.now(datetime.timezone.utc)
+        results, failed = [], False
+        for label, address in endpoints:
+            try:
+                result = self.tls_handshake(address, options.port, server_name, alpn, options.timeout)
+            except (OSError, ValueError) as e:
+                self.logger.info(f"  {label} [{address}]: {e}")
+                failed = True
+                continue
+            status = f"not verified ({result['verify_error']})" if result["verify_error"] else "verified"
+            self.logger.info(f"  {label} [{address}]: {result['version']} {result['cipher']}, "
+                             f"ALPN {result['alpn'] or 'none'}, {status}")
+            for index, certificate in enumerate(result["chain"]):
+                days = (certificate["not_after"] - now).days
+                expiry = "EXPIRED" if days < 0 else f"{days} days left"
+                self.logger.info(f"    [{index}] {certificate['subject']}")
+                self.logger.info(f"        issuer:   {certificate['issuer']}")
+                self.logger.info(f"        validity: {certificate['not_before']:%Y-%m-%d %H:%M:%S} to "
+                                 f"{certificate['not_after']:%Y-%m-%d %H:%M:%S} UTC ({expiry})")
+                if certificate["names"]:
+                    self.logger.info(f"        names:    {', '.join(certificate['names'])}")
+                self.logger.info(f"        sha256:   {certificate['sha256']}")
+                failed = failed or days < 0
+
+            if server_name is not None:
+                try:
+                    default = self.tls_handshake(address, options.port, None, alpn, options.timeout)
+                    leaf = default["chain"][0]
+                    if leaf["sha256"] == result["chain"][0]["sha256"]:
+                        self.logger.info("    without SNI: same leaf certificate")
+                    else:
+                        self.logger.info(f"    without SNI: different leaf certificate ({leaf['subject']})")
+                except (OSError, ValueError) as e:
+                    self.logger.info(f"    without SNI: handshake failed ({e})")
+            results.append((label, address, result))
+
+        ipv4 = next((result for label, _, result in results if label == "IPv4"), None)
+        if ipv4 is None:
+            return 1 if failed else 0
+        differences = []
+        for label, address, result in results:
+            if label != "IPv6":
+                continue
+            for field in ("version", "alpn"):
+                if result[field] != ipv4[field]:
+                    differences.append(f"[{address}] {field} {result[field]} vs IPv4 {ipv4[field]}")
+            if result["verify_error"] != ipv4["verify_error"]:
+                differences.append(f"[{address}] verification {result['verify_error'] or 'ok'} "
+                                   f"vs IPv4 {ipv4['verify_error'] or 'ok'}")
+            chain = [certificate["sha256"] for certificate in result["chain"]]
+            ipv4_chain = [certificate["sha256"] for certificate in ipv4["chain"]]
+            if chain[:1] != ipv4_chain[:1]:
+                differences.append(f"[{address}] leaf certificate {result['chain'][0]['subject']} "
+                                   f"(expires {result['chain'][0]['not_after']:%Y-%m-%d}) vs IPv4 "
+                                   f"{ipv4['chain'][0]['subject']} (expires {ipv4['chain'][0]['not_after']:%Y-%m-%d})")
+            elif chain != ipv4_chain:
+                differences.append(f"[{address}] intermediate chain differs ({len(chain)} vs IPv4 "
+                                   f"{len(ipv4_chain)} certificates)")
+        if differences:
+            self.logger.info("\nDifferences between IPv6 and IPv4 endpoints:")
+            for difference in differences:
+                self.logger.info(f"  {difference}")
+        else:
+            self.logger.info("\nIPv6 and IPv4 endpoints present the same certificate chain")
+        return 1 if failed or differences else 0
+
+    def run_tls_matrix(self, args: List[str]) -> int:
+        """Report the certificate and protocol an IPv6 TLS endpoint serves for each SNI and ALPN combination."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py tls-matrix",
+                                         description="Connect to an IPv6 TLS endpoint once for every combination "
+                                                     "of server name and ALPN list, and report the certificate and "
+                                                     "protocol served for each, to audit SNI-based routing on IPv6 "
+                                                     "frontends.")
+        parser.add_argument("host", help="Hostname or IPv6 address")
+        parser.add_argument("port", nargs="?", type=int, default=443, help="TLS port (default: 443)")
+        parser.add_argument("--sni", action="append", metavar="NAME",
+                            help="Server name to send; 'none' sends no SNI (repeatable; default: the hostname and "
+                                 "none)")
+        parser.add_argument("--alpn", action="append", metavar="LIST",
+                            help="Comma-separated ALPN protocols to offer; 'none' offers none (repeatable; default: "
+                                 "h2, http/1.1, h2,http/1.1 and none)")
+        parser.add_argument("--address", help="IPv6 address to connect to (default: the host's first)")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        try:
+            ipaddress.IPv6Address(options.host)
+            names = options.sni or ["none"]
+        except ValueError:
+            names = options.sni or [options.host, "none"]
+        alpn_lists = options.alpn or ["h2", "http/1.1", "h2,http/1.1", "none"]
+        address = options.address
+        if address is None:
+            try:
+                address = socket.getaddrinfo(options.host, options.port, socket.AF_INET6,
+                                             socket.SOCK_STREAM)[0][4][0]
+            except socket.gaierror as e:
+                self.logger.error(f"Cannot resolve {options.host} to an IPv6 address: {e}")
+                return 1
+
+        self.logger.info(f"SNI and ALPN matrix for [{address}]:{options.port}:")
+        self.logger.info(f"  {'SNI':<28} {'ALPN offered':<16} Result")
+        certificates, selected = {}, {}
+        succeeded = 0
+        for name in names:
+            server_name = None if name == "none" else name
+            label = name if server_name else "(no SNI)"
+            for alpn_list in alpn_lists:
+                alpn = [] if alpn_list == "none" else [protocol for protocol in alpn_list.split(",") if protocol]
+                try:
+                    result = self.tls_handshake(address, options.port, server_name, alpn, options.timeout)
+                except ssl.SSLError as e:
+                    self.logger.info(f"  {label:<28} {alpn_list:<16} handshake failed: {e.reason or e}")
+                    continue
+                except OSError as e:
+                    self.logger.info(f"  {label:<28} {alpn_list:<16} {e.strerror or e}")
+                    continue
+                except ValueError as e:
+                    self.logger.info(f"  {label:<28} {alpn_list:<16} {e}")
+                    continue
+                succeeded += 1
+                leaf = result["chain"][0]
+                certificates.setdefault(leaf["sha256"], (leaf, []))[1].append(label)
+                selected.setdefault(alpn_list, {}).setdefault(result["alpn"] or "none", []).append(label)
+                status = f"not verified ({result['verify_error']})" if result["verify_error"] else "verified"
+                self.logger.info(f"  {label:<28} {alpn_list:<16} {result['version']}, ALPN {result['alpn'] or 'none'}, "
+                                 f"{leaf['subject']} ({leaf['sha256'][:16]}), {status}")
+        if not succeeded:
+            return 1
+
+        self.logger.info(f"\nCertificates served: {len(certificates)}")
+        for fingerprint, (leaf, served) in certificates.items():
+            self.logger.info(f"  {leaf['subject']} ({fingerprint[:16]}), served for "
+                             f"{', '.join(dict.fromkeys(served))}")
+            if leaf["names"]:
+                self.logger.info(f"    names: {', '.join(leaf['names'])}")
+        self.logger.info("Protocols selected:")
+        for alpn_list, protocols in selected.items():
+            if len(protocols) == 1:
+                self.logger.info(f"  {alpn_list}: {next(iter(protocols))} for every SNI")
+            else:
+                self.logger.info(f"  {alpn_list}: " + "; ".join(f"{protocol} for {', '.join(served)}"
+                                                                 for protocol, served in protocols.items()))
+        return 0
+
+    def anycast_dns_identity(self, target: str, source: Optional[str], timeout: float) -> dict:
+        """Ask a DNS server which instance answered, via NSID and the id.server/hostname.bind CHAOS names."""
+        identity = {}
+        for name in ("id.server.", "hostname.bind."):
+            query = DNSMessage(secrets.randbits(16))
+            query.questions.append((name, DNS_TYPES["TXT"], DNS_CLASS_CH))
+            query.additional.append(DNSRecord("", DNS_TYPES["OPT"], 1232, 0, struct.pack("!HH", self.EDNS_NSID, 0)))
+            with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+                sock.settimeout(timeout)
+                if source:
+                    sock.bind((source, 0))
+                sock.sendto(query.encode(), (target, 53))
+                while True:
+                    data, _ = sock.recvfrom(65535)
+                    response = DNSMessage.decode(data)
+                    if response.id == query.id:
+                        break
+            for record in response.additional:
+                if record.type != DNS_TYPES["OPT"]:
+                    continue
+                offset = 0
+                while offset + 4 <= len(record.rdata):
+                    code, length = struct.unpack("!HH", record.rdata[offset:offset + 4])
+                    value = record.rdata[offset + 4:offset + 4 + length]
+                    if code == self.EDNS_NSID and value:
+                        text = value.decode(errors="replace")
+                        identity["nsid"] = text if text.isprintable() else value.hex()
+                    offset += 4 + length
+            texts = [record.value for record in response.answers if record.type == DNS_TYPES["TXT"]]
+            if texts:
+                identity[name.rstrip(".")] = " ".join(texts)
+                break
+        return identity
+
+    def anycast_http_identity(self, target: str, source: Optional[str], timeout: float) -> dict:
+        """Send an HTTP HEAD request and collect the headers CDNs use to name the serving PoP."""
+        connection = http.client.HTTPConnection(target, 80, timeout=timeout,
+                                                source_address=(source, 0) if source else None)
+        try:
+            connection.request("HEAD", "/", headers={"User-Agent": "ipv6_tester"})
+            response = connection.getresponse()
+            return {header: response.getheader(header) for header in self.ANYCAST_HTTP_HEADERS
+                    if response.getheader(header)}
+        finally:
+            connection.close()
+
+    def anycast_pop(self, identity: dict) -> Optional[str]:
+        """Reduce the collected identity to a single label naming the instance that answered."""
+        if "cf-ray" in identity and "-" in identity["cf-ray"]:
+            return identity["cf-ray"].rsplit("-", 1)[1]
+        for key in ("nsid", "id.server", "hostname.bind", "x-amz-cf-pop", "x-served-by"):
+            if key in identity:
+                return identity[key].strip('"')
+        return None
+
+    def run_anycast(self, args: List[str]) -> int:
+        """Report which anycast instance answers from each local source address."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py anycast",
+                                         description="Probe an anycast IPv6 address and report which PoP answered, "
+                                                     "using DNS NSID, CHAOS TXT identity names, and CDN HTTP headers. "
+                                                     "Repeat --source to compare answers across local addresses.")
+        parser.add_argument("target", nargs="?", default=self.DEFAULT_RESOLVER,
+                            help=f"Anycast address or hostname (default: {self.DEFAULT_RESOLVER})")
+        parser.add_argument("--source", action="append",
+                            help="Local IPv6 address to send from (repeatable; default: chosen by the kernel)")
+        parser.add_argument("--no-dns", action="store_true", help="Skip the DNS identity queries")
+        parser.add_argument("--no-http", action="store_true", help="Skip the HTTP header probe")
+        parser.add_argument("--timeout", type=float, default=3.0, help="Timeout in seconds (default: 3)")
+        options = parser.parse_args(args)
+
+        try:
+            target = socket.getaddrinfo(options.target, 53, socket.AF_INET6, socket.SOCK_DGRAM)[0][4][0]
+        except socket.gaierror as e:
+            self.logger.error(f"Cannot resolve {options.target} to an IPv6 address: {e}")
+            return 1
+        try:
+            reverse = socket.gethostbyaddr(target)[0]
+        except OSError:
+            reverse = "no PTR record"
+        self.logger.info(f"Anycast probe of {target} ({reverse}):")
+
+        pops = {}
+        for source in options.source or [None]:
+            identity = {}
+            self.logger.info(f"  source {source or 'default'}:")
+            probes = []
+            if not options.no_dns:
+                probes.append(("DNS", self.anycast_dns_identity))
+            if not options.no_http:
+                probes.append(("HTTP", self.anycast_http_identity))
+            for label, probe in probes:
+                try:
+                    found = probe(target, source, options.timeout)
+                except (OSError, ValueError, http.client.HTTPException) as e:
+                    self.logger.info(f"    {label}: {e or type(e).__name__}")
+                    continue
+                if not found:
+                    self.logger.info(f"    {label}: no identity in the response")
+                for key, value in found.items():
+                    self.logger.info(f"    {key + ':':<16}{value}")
+                identity.update(found)
+            pop = self.anycast_pop(identity)
+            if pop:
+                pops.setdefault(pop, []).append(source or "default")
+
+        if not pops:
+            self.logger.info("\nNo probe identified the answering instance")
+            return 1
+        if len(pops) == 1:
+            self.logger.info(f"\nAll sources reached the same instance: {next(iter(pops))}")
+        else:
+            self.logger.info(f"\nSources reached {len(pops)} different instances:")
+            for pop, sources in pops.items():
+                self.logger.info(f"  {pop}: {', '.join(sources)}")
+        return 0
+
+    def run_udp_server(self, args: List[str]) -> int:
+        """Receive sequenced datagrams and report loss, duplication, reordering, and jitter per interval."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py udp-server",
+                                         description="Receive udp-test datagrams and send back per-interval loss, "
+                                                     "duplication, reordering, and RFC 3550 jitter reports.")
+        parser.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        parser.add_argument("port", nargs="?", type=int, default=self.UDP_TEST_PORT,
+                            help=f"UDP port (default: {self.UDP_TEST_PORT})")
+        options = parser.parse_args(args)
+
+        sessions = {}
+
+        def close_interval(sock: socket.socket, peer: Tuple, state: dict) -> None:
+            expected = state["highest"] - state["reported_highest"]
+            lost = max(0, expected - state["interval"]["received"])
+            state["reported_highest"] = state["highest"]
+            interval = state["interval"]
+            self.logger.info(f"[{peer[0]}]:{peer[1]} session {state['id']:08x} interval {state['index']}: "
+                             f"received {interval['received']}, lost {lost}, duplicates {interval['duplicates']}, "
+                             f"reordered {interval['reordered']}, jitter {state['jitter'] * 1000:.3f} ms")
+            sock.sendto(self.UDP_TEST_REPORT.pack(self.UDP_TEST_MAGIC, self.UDP_TEST_INTERVAL, state["id"],
+                                                  state["index"], interval["received"], lost,
+                                                  interval["duplicates"], interval["reordered"],
+                                                  int(state["jitter"] * 1e6)), peer)
+            state["index"] += 1
+            state["interval"] = {"received": 0, "duplicates": 0, "reordered": 0}
+
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.bind((options.ipv6_address, options.port))
+            self.logger.info(f"UDP test server listening on [{options.ipv6_address}]:{options.port}")
+            while True:
+                data, peer = sock.recvfrom(65535)
+                arrival = time.time()
+                if len(data) < self.UDP_TEST_HEADER.size:
+                    continue
+                magic, kind, session, sequence, sent_ns, interval = self.UDP_TEST_HEADER.unpack_from(data)
+                if magic != self.UDP_TEST_MAGIC:
+                    continue
+                key = (peer[0], peer[1], session)
+                if kind == self.UDP_TEST_DATA:
+                    state = sessions.get(key)
+                    if state is None:
+                        self.logger.info(f"[{peer[0]}]:{peer[1]} session {session:08x} started")
+                        state = sessions[key] = {
+                            "id": session, "start": arrival, "interval_length": interval / 1000, "index": 0,
+                            "seen": set(), "highest": 0, "reported_highest": 0, "transit": None, "jitter": 0.0,
+                            "duplicates": 0, "reordered": 0,
+                            "interval": {"received": 0, "duplicates": 0, "reordered": 0},
+                        }
+                    while arrival - state["start"] >= (state["index"] + 1) * state["interval_length"]:
+                        close_interval(sock, peer, state)
+                    if sequence in state["seen"]:
+                        state["duplicates"] += 1
+                        state["interval"]["duplicates"] += 1
+                        continue
+                    state["seen"].add(sequence)
+                    state["interval"]["received"] += 1
+                    if sequence < state["highest"]:
+                        state["reordered"] += 1
+                        state["interval"]["reordered"] += 1
+                    state["highest"] = max(state["highest"], sequence)
+                    # Interarrival jitter estimate from RFC 3550 section 6.4.1; the clock offset between
+                    # the hosts cancels out because only differences in transit time are used.
+                    transit = arrival - sent_ns / 1e9
+                    if state["transit"] is not None:
+                        state["jitter"] += (abs(transit - state["transit"]) - state["jitter"]) / 16
+                    state["transit"] = transit
+                elif kind == self.UDP_TEST_END:
+                    state = sessions.get(key)
+                    if state is None:
+                        continue
+                    if state["interval"]["received"] or state["highest"] > state["reported_highest"]:
+                        close_interval(sock, peer, state)
+                    received = len(state["seen"])
+                    lost = max(0, sequence - received)
+                    sock.sendto(self.UDP_TEST_REPORT.pack(self.UDP_TEST_MAGIC, self.UDP_TEST_SUMMARY, session,
+                                                          sequence, received, lost, state["duplicates"],
+                                                          state["reordered"], int(state["jitter"] * 1e6)), peer)
+                    if not state.get("ended"):
+                        state["ended"] = True
+                        self.logger.info(f"[{peer[0]}]:{peer[1]} session {session:08x} finished: sent {sequence}, "
+                                         f"received {received}, lost {lost}")
+                    # Keep only recently finished sessions so repeated END datagrams are still answered
+                    for stale in [k for k, s in sessions.items() if s.get("ended") and k != key]:
+                        del sessions[stale]
+
+    def run_udp_test(self, args: List[str]) -> int:
+        """Send sequenced datagrams at a fixed rate and print the server's loss and jitter reports."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py udp-test",
+                                         description="Send sequenced UDP datagrams to a udp-server at a fixed rate "
+                                                     "and print its per-interval loss, duplication, reordering, "
+                                                     "and jitter reports.")
+        parser.add_argument("ipv6_address", help="Address of the udp-server")
+        parser.add_argument("port", nargs="?", type=int, default=self.UDP_TEST_PORT,
+                            help=f"UDP port (default: {self.UDP_TEST_PORT})")
+        parser.add_argument("--rate", type=float, default=100, help="Datagrams per second (default: 100)")
+        parser.add_argument("--size", type=int, default=512, help="Datagram payload size in bytes (default: 512)")
+        parser.add_argument("--duration", type=float, default=10, help="Test length in seconds (default: 10)")
+        parser.add_argument("--interval", type=float, default=1, help="Report interval in seconds (default: 1)")
+        options = parser.parse_args(args)
+        if options.rate <= 0 or options.duration <= 0 or options.interval <= 0:
+            parser.error("--rate, --duration, and --interval must be positive")
+        if not self.UDP_TEST_HEADER.size <= options.size <= 65507:
+            parser.error(f"--size must be between {self.UDP_TEST_HEADER.size} and 65507")
+
+        session = secrets.randbits(32)
+        padding = bytes(options.size - self.UDP_TEST_HEADER.size)
+        interval_ms = int(options.interval * 1000)
+        total = max(1, int(options.rate * options.duration))
+
+        def show(report: bytes) -> Optional[tuple]:
+            if len(report) != self.UDP_TEST_REPORT.size:
+                return None
+            fields = self.UDP_TEST_REPORT.unpack(report)
+            if fields[0] != self.UDP_TEST_MAGIC or fields[2] != session:
+                return None
+            kind, index, received, lost, duplicates, reordered, jitter = fields[1], *fields[3:]
+            if kind == self.UDP_TEST_INTERVAL:
+                start = index * options.interval
+                self.logger.info(f"  {f'{start:.1f}-{start + options.interval:.1f} s':<14}{received:>9}{lost:>7}"
+                                 f"{duplicates:>6}{reordered:>10}{jitter / 1000:>10.3f} ms")
+            return fields
+
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.connect((options.ipv6_address, options.port))
+            self.logger.info(f"UDP test to [{options.ipv6_address}]:{options.port}: {options.rate:g} datagrams/s "
+                             f"of {options.size} bytes for {options.duration:g} s")
+            self.logger.info(f"  {'Interval':<14}{'Received':>9}{'Lost':>7}{'Dup':>6}{'Reorder':>10}{'Jitter':>13}")
+            start = time.monotonic()
+            for sequence in range(1, total + 1):
+                delay = start + (sequence - 1) / options.rate - time.monotonic()
+                if delay > 0:
+                    sock.settimeout(delay)
+                    try:
+                        while True:
+                            show(sock.recv(65535))
+                    except (socket.timeout, ConnectionRefusedError):
+                        pass
+                header = self.UDP_TEST_HEADER.pack(self.UDP_TEST_MAGIC, self.UDP_TEST_DATA, session, sequence,
+                                                   time.time_ns(), interval_ms)
+                try:
+                    sock.send(header + padding)
+                except ConnectionRefusedError:
+                    # An ICMPv6 port unreachable from an earlier datagram; keep sending
+                    pass
+
+            sock.settimeout(1.0)
+            end = self.UDP_TEST_HEADER.pack(self.UDP_TEST_MAGIC, self.UDP_TEST_END, session, total, 0, 0)
+            for _ in range(5):
+                try:
+                    sock.send(end)
+                    while True:
+                        summary = show(sock.recv(65535))
+                        if summary and summary[1] == self.UDP_TEST_SUMMARY:
+                            break
+                except (socket.timeout, ConnectionRefusedError):
+                    continue
+                _, _, _, sent, received, lost, duplicates, reordered, jitter = summary
+                self.logger.info(f"\nTotal: sent {sent}, received {received}, lost {lost} ({lost / sent:.2%}), "
+                                 f"duplicates {duplicates}, reordered {reordered}, jitter {jitter / 1000:.3f} ms")
+                return 0
+        self.logger.error("No summary from the server; is udp-server running on the target?")
+        return 1
+
+    async def call_back(self, client_address: str, data: bytes) -> str:
+        """Connect back to the client's own address for a pinhole check and describe the outcome."""
+        fields = data.decode(errors="replace").split()
+        if (len(fields) != 3 or not fields[1].isdigit() or not 1 <= int(fields[1]) <= 65535
+                or not re.fullmatch(r"[0-9a-f]{1,64}", fields[2])):
+            return "CALLBACK FAILED malformed request"
+        port, token = int(fields[1]), fields[2]
+        target = f"[{client_address}]:{port}"
+        try:
+            _, writer = await asyncio.wait_for(asyncio.open_connection(client_address, port), self.CALLBACK_TIMEOUT)
+        except asyncio.TimeoutError:
+            self.logger.info(f"Callback to {target} timed out")
+            return f"CALLBACK FAILED {target} timed out"
+        except OSError as e:
+            reason = os.strerror(e.errno) if e.errno else str(e)
+            self.logger.info(f"Callback to {target} failed: {reason}")
+            return f"CALLBACK FAILED {target} {reason}"
+        writer.write(f"CALLBACK {token}\n".encode())
+        await writer.drain()
+        writer.close()
+        await writer.wait_closed()
+        self.logger.info(f"Callback to {target} succeeded")
+        return f"CALLBACK OK {target}"
+
+    async def callback_test(self, ipv6_address: str, port: int, bind: str, listen_port: int,
+                            timeout: float, auth: bool = False, session: Optional[str] = None) -> bool:
+        """Ask the server to connect back to a local listener and report whether it got through."""
+        token = secrets.token_hex(16)
+        received = asyncio.Event()
+
+        async def accept(reader: asyncio.StreamReader, writer: asyncio.StreamWriter) -> None:
+            try:
+                line = await asyncio.wait_for(reader.readline(), timeout)
+                if line.decode(errors="replace").split() == ["CALLBACK", token]:
+                    received.set()
+            except (asyncio.TimeoutError, ValueError, OSError):
+                pass
+            finally:
+                writer.close()
+
+        listener = await asyncio.start_server(accept, bind, listen_port, family=socket.AF_INET6)
+        listen_port = listener.sockets[0].getsockname()[1]
+        async with listener:
+            reader, writer = await self.dial(ipv6_address, port)
+            reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+            local = writer.get_extra_info("sockname")[0]
+            self.logger.info(f"Callback test via [{ipv6_address}]:{port}:")
+            self.logger.info(f"  Listening on port {listen_port}; connecting from {local}")
+            try:
+                if auth:
+                    await self.authenticate(reader, writer, timeout)
+                if session:
+                    await self.declare_session(reader, writer, session, timeout)
+                writer.write(f"CALLBACK {listen_port} {token}\n".encode())
+                await writer.drain()
+                reply = await asyncio.wait_for(reader.readline(), timeout + self.CALLBACK_TIMEOUT)
+            finally:
+                writer.close()
+                await writer.wait_closed()
+            try:
+                # The token can trail the server's reply slightly
+                await asyncio.wait_for(received.wait(), 1.0)
+            except asyncio.TimeoutError:
+                pass
+
+        fields = reply.decode(errors="replace").strip().split(" ", 3)
+        if len(fields) < 3 or fields[0] != "CALLBACK":
+            self.logger.info(f"  Unexpected response: {reply.decode(errors='replace').strip() or 'none'}; "
+                             f"does the server support CALLBACK?")
+            return False
+        seen = fields[2].rsplit(":", 1)[0].strip("[]")
+        if seen.split("%")[0] != local.split("%")[0]:
+            self.logger.info(f"  Server saw this host as {seen}, not {local}: the path uses NAT66 or a proxy")
+        if fields[1] == "OK" and received.is_set():
+            self.logger.info(f"  Server connected back to {fields[2]} and delivered the token")
+            self.logger.info(f"\nResult: inbound IPv6 connections to port {listen_port} are permitted")
+            return True
+        if fields[1] == "OK":
+            self.logger.info(f"  Server connected to {fields[2]}, but the token never reached this listener")
+            self.logger.info("\nResult: something else answered on that address and port (a proxy or another host)")
+            return False
+        self.logger.info(f"  Server could not connect back: {' '.join(fields[2:])}")
+        reason = "dropped, most likely by a stateful firewall" if fields[-1].endswith("timed out") else "rejected"
+        self.logger.info(f"\nResult: inbound IPv6 connections to port {listen_port} are {reason}")
+        return False
+
+    def run_callback(self, args: List[str]) -> int:
+        """Check whether inbound IPv6 connections reach this host, using a public server to call back."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py callback",
+                                         description="Ask a public instance of the server to connect back to this "
+                                                     "host's global IPv6 address, to verify whether inbound "
+                                                     "connections get through the firewall. The server only ever "
+                                                     "connects to the address the request came from.")
+        parser.add_argument("address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"Server IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--listen-port", type=int, default=0,
+                            help="Local port to receive the callback on (default: any free port)")
+        parser.add_argument("--bind", default="::", help="Local address to listen on (default: ::)")
+        parser.add_argument("--timeout", type=float, default=10.0, help="Seconds to wait for the server (default: 10)")
+        parser.add_argument("--auth", action="store_true", help=self.AUTH_HELP)
+        parser.add_argument("--session", metavar="LABEL", help=self.SESSION_HELP)
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        options = parser.parse_args(args)
+
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+        try:
+            permitted = asyncio.run(self.callback_test(options.address, options.port, options.bind,
+                                                       options.listen_port, options.timeout, options.auth,
+                                                       options.session))
+        except (OSError, ValueError, asyncio.TimeoutError) as e:
+            self.logger.error(f"Client error: {e or 'timed out waiting for the server'}")
+            return 1
+        return 0 if permitted else 1
+
+    async def time_probes(self, ipv6_address: str, port: int, count: int, interval: float,
+                          timeout: float, auth: bool = False,
+                          session: Optional[str] = None) -> List[Tuple[int, int, int, int]]:
+        """Exchange TIME frames with the server, returning (t1, t2, t3, t4) in epoch nanoseconds:
+        client send, server receive, server send, and client receive."""
+        reader, writer = await self.dial(ipv6_address, port)
+        reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+        samples = []
+        try:
+            if auth:
+                await self.authenticate(reader, writer, timeout)
+            if session:
+                await self.declare_session(reader, writer, session, timeout)
+            for probe in range(count):
+                t1 = time.time_ns()
+                writer.write(f"TIME {t1}\n".encode())
+                await writer.drain()
+                line = await asyncio.wait_for(reader.readline(), timeout)
+                t4 = time.time_ns()
+                fields = line.decode(errors="replace").split()
+                if len(fields) != 4 or fields[0] != "TIME" or not all(field.isdigit() for field in fields[1:]):
+                    raise ValueError(f"unexpected response: {line.decode(errors='replace').strip()}")
+                if int(fields[1]) != t1:
+                    raise ValueError("response does not match the probe that was sent")
+                samples.append((t1, int(fields[2]), int(fields[3]), t4))
+                if probe < count - 1:
+                    await asyncio.sleep(interval)
+        finally:
+            writer.close()
+            await writer.wait_closed()
+        return samples
+
+    def run_owd(self, args: List[str]) -> int:
+        """Estimate one-way delay in each direction from server timestamps."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py owd",
+                                         description="Exchange timestamps with the server to estimate one-way delay "
+                                                     "in each direction. The estimates are only as good as the "
+                                                     "synchronization between the two clocks.")
+        parser.add_argument("address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"Server IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--count", type=int, default=10, help="Number of probes (default: 10)")
+        parser.add_argument("--interval", type=float, default=0.2, help="Seconds between probes (default: 0.2)")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Seconds to wait for each reply (default: 5)")
+        parser.add_argument("--ntp", nargs="?", const=self.DEFAULT_NTP_SERVER, metavar="SERVER",
+                            help=f"Check the local clock against an NTP server (default: {self.DEFAULT_NTP_SERVER})")
+        parser.add_argument("--auth", action="store_true", help=self.AUTH_HELP)
+        parser.add_argument("--session", metavar="LABEL", help=self.SESSION_HELP)
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        options = parser.parse_args(args)
+
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+        if options.count < 1:
+            parser.error("--count must be at least 1")
+        try:
+            samples = asyncio.run(self.time_probes(options.address, options.port, options.count,
+                                                   options.interval, options.timeout, options.auth,
+                                                   options.session))
+        except (OSError, ValueError, asyncio.TimeoutError) as e:
+            self.logger.error(f"Client error: {e or 'timed out waiting for a reply'}")
+            return 1
+
+        self.logger.info(f"One-way delay to [{options.address}]:{options.port} ({len(samples)} probes):")
+        self.logger.info(f"  {'Probe':<7}{'Forward':>12}{'Reverse':>12}{'RTT':>12}")
+        for probe, (t1, t2, t3, t4) in enumerate(samples, 1):
+            self.logger.info(f"  {probe:<7}{(t2 - t1) / 1e6:>9.3f} ms{(t4 - t3) / 1e6:>9.3f} ms"
+                             f"{((t4 - t1) - (t3 - t2)) / 1e6:>9.3f} ms")
+
+        # The probe with the smallest RTT saw the least queueing, so it gives the cleanest estimate
+        t1, t2, t3, t4 = min(samples, key=lambda sample: (sample[3] - sample[0]) - (sample[2] - sample[1]))
+        forward, reverse = (t2 - t1) / 1e6, (t4 - t3) / 1e6
+        rtt = forward + reverse
+        offset = (forward - reverse) / 2
+        self.logger.info(f"\nMinimum-RTT probe: forward {forward:.3f} ms, reverse {reverse:.3f} ms, RTT {rtt:.3f} ms")
+        self.logger.info(f"Clock offset if the path were symmetric (server - client): {offset:+.3f} ms")
+
+        if forward < 0 or reverse < 0:
+            self.logger.warning("Warning: a negative one-way delay means the clocks are out of sync by more than "
+                                "the delay itself; the forward and reverse figures are not meaningful.")
+        elif abs(offset) > rtt / 4:
+            self.logger.warning(f"Warning: forward and reverse differ by {abs(forward - reverse):.3f} ms. This is "
+                                f"either asymmetric routing or a clock offset of up to {abs(offset):.3f} ms; "
+                                f"timestamps alone cannot tell them apart.")
+
+        if options.ntp:
+            try:
+                address = socket.getaddrinfo(options.ntp, 123, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+                result = self.ntp_query(address, options.timeout)
+            except (OSError, ValueError) as e:
+                self.logger.error(f"NTP cross-check against {options.ntp} failed: {e}")
+                return 0
+            local = result["offset"] * 1000
+            self.logger.info(f"Local clock offset from NTP server {options.ntp}: {local:+.3f} ms "
+                             f"(delay {result['delay'] * 1000:.3f} ms)")
+            if abs(local) > rtt / 10:
+                self.logger.warning("Warning: the local clock is off by more than a tenth of the RTT; synchronize it "
+                                    "(and the server's) before trusting one-way figures.")
+        return 0
+
+    async def throughput_test(self, ipv6_address: str, port: int, direction: str, seconds: int,
+                              auth: bool = False, session: Optional[str] = None) -> dict:
+        """Negotiate a THROUGHPUT test with the server and move data in the given direction for seconds.
+
+        Returns what we sent and received, and what the server reported receiving, with the time each took.
+        """
+        reader, writer = await self.dial(ipv6_address, port)
+        reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+        loop = asyncio.get_running_loop()
+        result = {"sent": 0, "received": 0, "receive_seconds": 0.0}
+        try:
+            if auth:
+                await self.authenticate(reader, writer, self.CALLBACK_TIMEOUT)
+            if session:
+                await self.declare_session(reader, writer, session, self.CALLBACK_TIMEOUT)
+            writer.write(f"THROUGHPUT {direction} {seconds}\n".encode())
+            await writer.drain()
+            reply = (await asyncio.wait_for(reader.readline(), self.CALLBACK_TIMEOUT)).decode(errors="replace").strip()
+            if reply != f"THROUGHPUT OK {direction} {seconds}":
+                raise ValueError(f"server refused the test: {reply or 'connection closed'}")
+            started = loop.time()
+
+            async def send() -> None:
+                chunk = bytes(self.THROUGHPUT_CHUNK)
+                while loop.time() - started < seconds:
+                    writer.write(chunk)
+                    await writer.drain()
+                    result["sent"] += len(chunk)
+
+            async def receive() -> bytes:
+                tail = b""
+                while data := await reader.read(self.THROUGHPUT_CHUNK):
+                    result["received"] += len(data)
+                    result["receive_seconds"] = loop.time() - started
+                    tail = (tail + data)[-256:]
+                return tail
+
+            receiver = asyncio.create_task(receive())
+            if direction == "down":
+                await asyncio.sleep(seconds)
+            else:
+                await send()
+            # Our end of the data phase; the server answers with its counts once it has read everything
+            writer.write_eof()
+            tail = await asyncio.wait_for(receiver, self.READ_TIMEOUT)
+        finally:
+            writer.close()
+
+        line = tail.rstrip(b"\n").rsplit(b"\n", 1)[-1]
+        fields = line.decode(errors="replace").split()
+        if len(fields) != 5 or fields[:2] != ["THROUGHPUT", "RESULT"] or not all(f.isdigit() for f in fields[2:]):
+            raise ValueError("the server closed the connection without reporting a result")
+        # Don't count the result line as data
+        result["received"] -= len(line) + 2
+        result["server_received"] = int(fields[2])
+        result["server_receive_seconds"] = int(fields[3]) / 1e9
+        result["server_sent"] = int(fields[4])
+        return result
+
+    def run_throughput(self, args: List[str]) -> int:
+        """Measure upload, download or simultaneous bidirectional throughput against the server."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py throughput",
+                                         description="Measure TCP throughput over IPv6 against the server, like "
+                                                     "iperf3. The direction is negotiated on the test connection, so "
+                                                     "one invocation measures upload (the default), download "
+                                                     "(--reverse) or both at once (--bidir) without a second listener "
+                                                     "on the client.")
+        parser.add_argument("address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"Server IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        direction = parser.add_mutually_exclusive_group()
+        direction.add_argument("--reverse", action="store_true", help="Download: the server sends, we receive")
+        direction.add_argument("--bidir", action="store_true", help="Upload and download at the same time")
+        parser.add_argument("--time", type=int, default=10,
+                            help=f"Seconds to transfer (default: 10, at most {self.MAX_THROUGHPUT_SECONDS})")
+        parser.add_argument("--auth", action="store_true", help=self.AUTH_HELP)
+        parser.add_argument("--session", metavar="LABEL", help=self.SESSION_HELP)
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        options = parser.parse_args(args)
+
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+        if not 1 <= options.time <= self.MAX_THROUGHPUT_SECONDS:
+            parser.error(f"--time must be between 1 and {self.MAX_THROUGHPUT_SECONDS} seconds")
+        direction = "bidir" if options.bidir else "down" if options.reverse else "up"
+        label = {"up": "upload", "down": "download", "bidir": "bidirectional"}[direction]
+        self.logger.info(f"Running a {options.time} s {label} test against [{options.address}]:{options.port}")
+        try:
+            result = asyncio.run(self.throughput_test(options.address, options.port, direction, options.time,
+                                                      options.auth, options.session))
+        except (OSError, ValueError, asyncio.TimeoutError) as e:
+            self.logger.error(f"Client error: {e or 'timed out waiting for the server'}")
+            return 1
+
+        self.logger.info("Results:")
+        if direction != "down":
+            seconds = result["server_receive_seconds"] or options.time
+            self.logger.info(f"  Upload:   {result['server_received'] * 8 / seconds / 1e6:10.2f} Mbit/s "
+                             f"({result['server_received']} of {result['sent']} bytes sent reached the server)")
+        if direction != "up":
+            seconds = result["receive_seconds"] or options.time
+            self.logger.info(f"  Download: {result['received'] * 8 / seconds / 1e6:10.2f} Mbit/s "
+                             f"({result['received']} of {result['server_sent']} bytes sent by the server)")
+        return 0
+
+    def tool_parsers(self) -> dict:
+        """Build the argument parser of every mode and tool without running them."""
+        class Built(BaseException):
+            pass
+
+        def capture(parser, *args, **kwargs):
+            raise Built(parser)
+
+        parsers = {mode: self.mode_parser(mode) for mode in ("server", "client")}
+        original = argparse.ArgumentParser.parse_args
+        argparse.ArgumentParser.parse_args = capture
+        try:
+            for name, run in self.tool_commands().items():
+                try:
+                    run([])
+                except Built as built:
+                    parsers[name] = built.args[0]
+        finally:
+            argparse.ArgumentParser.parse_args = original
+        return parsers
+
+    def completion_spec(self) -> dict:
+        """Describe each command for the completion scripts: its description, the words that can
+        follow it (flags and subcommands), the flags that take a value, and fixed value choices."""
+        spec = {}
+        for name, parser in self.tool_parsers().items():
+            words, takes_value, choices = [], [], {}
+            pending = [parser]
+            while pending:
+                current = pending.pop()
+                for action in current._actions:
+                    if isinstance(action, argparse._SubParsersAction):
+                        words += list(action.choices)
+                        pending += list(action.choices.values())
+                        continue
+                    for option in action.option_strings:
+                        words.append(option)
+                        if action.nargs != 0:
+                            takes_value.append(option)
+                            if action.dest == "interface":
+                                choices[option] = None
+                            elif action.choices:
+                                choices[option] = [str(choice) for choice in action.choices]
+            description = (parser.description or f"Run the IPv6 {name}").split(". ")[0].rstrip(".")
+            spec[name] = {"description": description, "words": list(dict.fromkeys(words)),
+                          "takes_value": list(dict.fromkeys(takes_value)), "choices": choices}
+        return spec
+
+    def completion_bash(self, spec: dict) -> str:
+        lines = ["# bash completion for ipv6_tester.py",
+                 "_ipv6_tester() {",
+                 '    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" words',
+                 '    if [ "$COMP_CWORD" -eq 1 ]; then',
+                 f'        COMPREPLY=($(compgen -W "{" ".join(spec)}" -- "$cur"))',
+                 "        return",
+                 "    fi",
+                 '    case "${COMP_WORDS[1]} $prev" in']
+        for name, command in spec.items():
+            for option, values in command["choices"].items():
+                if values is None:
+                    lines.append(f'        "{name} {option}") words="$(ls /sys/class/net 2>/dev/null)" ;;')
+                else:
+                    lines.append(f'        "{name} {option}") words="{" ".join(values)}" ;;')
+            if command["takes_value"]:
+                other = "|".join(f'"{name} {option}"' for option in command["takes_value"]
+                                 if option not in command["choices"])
+                if other:
+                    lines.append(f"        {other}) COMPREPLY=(); compopt -o default; return ;;")
+        lines.append('        *) case "${COMP_WORDS[1]}" in')
+        for name, command in spec.items():
+            lines.append(f'            {name}) words="{" ".join(command["words"])}" ;;')
+        lines += ["           esac ;;",
+                  "    esac",
+                  '    COMPREPLY=($(compgen -W "$words" -- "$cur"))',
+                  "}",
+                  "complete -o default -F _ipv6_tester ipv6_tester.py ipv6_tester"]
+        return "\n".join(lines) + "\n"
+
+    def completion_zsh(self, spec: dict) -> str:
+        lines = ["#compdef ipv6_tester.py ipv6_tester",
+                 "_ipv6_tester() {",
+                 "    if (( CURRENT == 2 )); then",
+                 "        local -a tools=("]
+        for name, command in spec.items():
+            description = command["description"].replace(":", "\\:")
+            lines.append(f"            {shlex.quote(name + ':' + description)}")
+        lines += ["        )",
+                  "        _describe tool tools",
+                  "        return",
+                  "    fi",
+                  '    case "${words[2]} ${words[CURRENT-1]}" in']
+        for name, command in spec.items():
+            for option, values in command["choices"].items():
+                if values is None:
+                    lines.append(f'        "{name} {option}") _net_interfaces; return ;;')
+                else:
+                    lines.append(f'        "{name} {option}") compadd -- {" ".join(values)}; return ;;')
+            other = "|".join(f'"{name} {option}"' for option in command["takes_value"]
+                             if option not in command["choices"])
+            if other:
+                lines.append(f"        {other}) _files; return ;;")
+        lines += ["    esac",
+                  '    case "${words[2]}" in']
+        for name, command in spec.items():
+            lines.append(f"        {name}) compadd -- {' '.join(command['words'])} ;;")
+        lines += ["    esac",
+                  "    _files",
+                  "}",
+                  '_ipv6_tester "$@"']
+        return "\n".join(lines) + "\n"
+
+    def completion_fish(self, spec: dict) -> str:
+        lines = ["# fish completion for ipv6_tester.py"]
+        for program in ("ipv6_tester.py", "ipv6_tester"):
+            for name, command in spec.items():
+                lines.append(f"complete -c {program} -f -n __fish_use_subcommand -a {name} "
+                             f"-d {shlex.quote(command['description'])}")
+                condition = f"'__fish_seen_subcommand_from {name}'"
+                for word in command["words"]:
+                    if not word.startswith("-"):
+                        lines.append(f"complete -c {program} -f -n {condition} -a {word}")
+                        continue
+                    flag = f"-l {word[2:]}" if word.startswith("--") else f"-s {word[1:]}"
+                    values = command["choices"].get(word, False)
+                    if values is None:
+                        flag += " -x -a '(__fish_print_interfaces)'"
+                    elif values:
+                        flag += f" -x -a {shlex.quote(' '.join(values))}"
+                    elif word in command["takes_value"]:
+                        flag += " -r"
+                    lines.append(f"complete -c {program} -n {condition} {flag}")
+        return "\n".join(lines) + "\n"
+
+    def completion_powershell(self, spec: dict) -> str:
+        def array(values: List[str]) -> str:
+            return "@(" + ", ".join("'" + value.replace("'", "''") + "'" for value in values) + ")"
+
+        lines = ["# PowerShell completion for ipv6_tester.py",
+                 "Register-ArgumentCompleter -Native -CommandName ipv6_tester.py, ipv6_tester -ScriptBlock {",
+                 "    param($wordToComplete, $commandAst, $cursorPosition)",
+                 "    $tools = @{"]
+        lines += [f"        '{name}' = {array(command['words'])}" for name, command in spec.items()]
+        lines += ["    }", "    $values = @{"]
+        for name, command in spec.items():
+            for option, values in command["choices"].items():
+                value = "'interfaces'" if values is None else array(values)
+                lines.append(f"        '{name} {option}' = {value}")
+        lines += ["    }",
+                  "    $elements = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })",
+                  "    $count = if ($wordToComplete) { $elements.Count - 1 } else { $elements.Count }",
+                  "    if ($count -le 1) {",
+                  "        $candidates = $tools.Keys",
+                  "    } else {",
+                  "        $key = \"$($elements[1]) $($elements[$count - 1])\"",
+                  "        if ($values[$key] -eq 'interfaces') {",
+                  "            $candidates = [System.Net.NetworkInformation.NetworkInterface]::GetAllNetworkInterfaces().Name",
+                  "        } elseif ($values.ContainsKey($key)) {",
+                  "            $candidates = $values[$key]",
+                  "        } else {",
+                  "            $candidates = $tools[$elements[1]]",
+                  "        }",
+                  "    }",
+                  "    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | Sort-Object | ForEach-Object {",
+                  "        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)",
+                  "    }",
+                  "}"]
+        return "\n".join(lines) + "\n"
+
+    def run_completion(self, args: List[str]) -> int:
+        """Print a shell completion script for the modes, tools, and their flags."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py completion",
+                                         description="Print a completion script covering every mode, tool, and flag, "
+                                                     "with network interface names for --interface.")
+        parser.add_argument("shell", choices=["bash", "zsh", "fish", "powershell"], help="Shell to generate for")
+        options = parser.parse_args(args)
+
+        generators = {
+            "bash": self.completion_bash,
+            "zsh": self.completion_zsh,
+            "fish": self.completion_fish,
+            "powershell": self.completion_powershell,
+        }
+        sys.stdout.write(generators[options.shell](self.completion_spec()))
+        return 0
+
+    def build_info(self) -> dict:
+        """Collect the commit, build date, runtime, and optional features of this copy of the tester."""
+        commit = os.environ.get("IPV6_TESTER_COMMIT")
+        if not commit:
+            try:
+                result = subprocess.run(["git", "-C", os.path.dirname(os.path.abspath(__file__)), "rev-parse",
+                                         "--short", "HEAD"], capture_output=True, text=True, timeout=5)
+                commit = result.stdout.strip() if result.returncode == 0 else None
+            except (OSError, subprocess.SubprocessError):
+                commit = None
+
+        def can_open(kind: int) -> bool:
+            try:
+                socket.socket(socket.AF_INET6, kind, socket.IPPROTO_ICMPV6).close()
+                return True
+            except OSError:
+                return False
+
+        return {
+            "commit": commit or "unknown",
+            "build_date": os.environ.get("IPV6_TESTER_BUILD_DATE") or "unknown (running from source)",
+            "python": sys.version.split()[0],
+            "platform": sys.platform,
+            "features": {
+                "ipv6": socket.has_ipv6,
+                "raw-sockets": can_open(socket.SOCK_RAW),
+                "icmp-datagram": can_open(socket.SOCK_DGRAM),
+                "tls1.3": ssl.HAS_TLSv1_3,
+                "tls-chain": hasattr(ssl.SSLSocket, "get_unverified_chain"),
+                # Live capture (srv6) uses Linux packet sockets; QUIC is not implemented by either tester
+                "pcap": hasattr(socket, "AF_PACKET"),
+                "quic": False,
+                # The Java server prints the same server feature names, answering no for the ones it lacks
+                **dict.fromkeys(self.SERVER_FEATURES, True),
+            },
+            "tools": sorted(self.tool_commands()),
+        }
+
+    def run_version(self, args: List[str]) -> int:
+        """Print build information and the optional features available at runtime."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py version",
+                                         description="Print the commit, build date, runtime, and available optional "
+                                                     "features, for bug reports and scripts that branch on capabilities.")
+        parser.add_argument("--json", action="store_true", help="Print the information as JSON")
+        options = parser.parse_args(args)
+
+        info = self.build_info()
+        if options.json:
+            sys.stdout.write(json.dumps(info, indent=2) + "\n")
+            return 0
+        lines = [
+            "ipv6_tester.py",
+            f"  Commit:     {info['commit']}",
+            f"  Build date: {info['build_date']}",
+            f"  Python:     {info['python']} ({info['platform']})",
+            "  Features:",
+        ]
+        lines += [f"    {name:<16}{'yes' if available else 'no'}" for name, available in info["features"].items()]
+        lines.append(f"  Tools:      {' '.join(info['tools'])}")
+        sys.stdout.write("\n".join(lines) + "\n")
+        return 0
+
+    def open_probe_socket(self, method: str) -> Tuple[socket.socket, str]:
+        """Open the most capable probe socket allowed: a raw ICMPv6 socket, then an unprivileged
+        ICMPv6 datagram socket (Linux ping_group_range, macOS), then a plain UDP socket."""
+        kinds = {
+            "raw": (socket.SOCK_RAW, socket.IPPROTO_ICMPV6),
+            "icmp": (socket.SOCK_DGRAM, socket.IPPROTO_ICMPV6),
+            "udp": (socket.SOCK_DGRAM, socket.IPPROTO_UDP),
+        }
+        errors = []
+        for name in (["raw", "icmp", "udp"] if method == "auto" else [method]):
+            try:
+                sock = socket.socket(socket.AF_INET6, *kinds[name])
+            except OSError as e:
+                errors.append(f"{name}: {e.strerror or e}")
+                continue
+            if errors:
+                self.logger.info(f"Falling back to {self.PROBE_METHODS[name]} ({'; '.join(errors)})")
+            if name != "raw" and sys.platform.startswith("linux"):
+                # Deliver ICMPv6 errors for our probes on the socket's error queue
+                sock.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_RECVERR", 25), 1)
+            return sock, name
+        raise PermissionError(f"no usable probe socket ({'; '.join(errors)}). Run as root or with CAP_NET_RAW, "
+                              f"or allow unprivileged ICMP with: sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"")
+
+    def send_probe(self, sock: socket.socket, method: str, target: str, ident: int, seq: int,
+                   size: int, port: int) -> None:
+        """Send one echo request, or one UDP datagram to port + seq so errors identify the probe.
+
+        Sequence numbers wrap at 16 bits, and UDP ports wrap back to port before passing 65535.
+        """
+        seq &= 0xffff
+        payload = struct.pack("!H", seq) + bytes(max(0, size - 2))
+        if method == "udp":
+            sock.sendto(payload, (target, port + seq % (65536 - port)))
+        else:
+            # The kernel fills in the ICMPv6 checksum (RFC 3542 section 3.1)
+            sock.sendto(struct.pack("!BBHHH", 128, 0, 0, ident, seq) + payload, (target, 0))
+
+    def await_probe(self, sock: socket.socket, method: str, ident: int, seq: int,
+                    deadline: float) -> Optional[Tuple[str, str]]:
+        """Wait for the answer to probe seq, returning (kind, responder) where kind is "reply",
+        "time-exceeded", or "unreachable"; None on timeout."""
+        kinds = {1: "unreachable", 3: "time-exceeded"}
+        seq &= 0xffff
+        sock.setblocking(False)
+        while True:
+            remaining = deadline - time.monotonic()
+            if remaining <= 0:
+                return None
+            # Queued errors also make the socket readable
+            readable, _, _ = select.select([sock], [], [], remaining)
+            if not readable:
+                continue
+            if method != "raw" and sys.platform.startswith("linux"):
+                try:
+                    data, ancillary, _, _ = sock.recvmsg(2048, 512, socket.MSG_ERRQUEUE)
+                except BlockingIOError:
+                    pass
+                else:
+                    for level, kind, cmsg in ancillary:
+                        if level != socket.IPPROTO_IPV6 or len(cmsg) < 16 + 24:
+                            continue
+                        # struct sock_extended_err followed by the offender's sockaddr_in6
+                        origin, icmp_type, icmp_code = struct.unpack("!BBB", cmsg[4:7])
+                        if origin != self.SO_EE_ORIGIN_ICMP6 or icmp_type not in kinds:
+                            continue
+                        responder = self.format_address(ipaddress.IPv6Address(cmsg[16 + 8:16 + 24]))
+                        probe = struct.unpack("!H", data[8:10] if method == "icmp" else data[:2])[0]
+                        if probe != seq:
+                            continue
+                        if method == "udp" and icmp_type == 1 and icmp_code == 4:
+                            return "reply", responder
+                        return kinds[icmp_type], responder
+                    continue
+            try:
+                data, address = sock.recvfrom(2048)
+            except ConnectionRefusedError:
+                # Without an error queue this is the best a UDP probe gets: the target said port unreachable
+                return "reply", "target"
+            except BlockingIOError:
+                continue
+            if method == "udp" or len(data) < 8:
+                continue
+            icmp_type, _, _, reply_ident, reply_seq = struct.unpack("!BBHHH", data[:8])
+            if icmp_type == 129 and reply_seq == seq and (method == "icmp" or reply_ident == ident):
+                return "reply", self.format_address(ipaddress.IPv6Address(address[0].split("%")[0]))
+            if icmp_type in kinds and len(data) >= 8 + 40 + 8 and data[8 + 6] == socket.IPPROTO_ICMPV6:
+                # The error quotes our packet: its IPv6 header, then the echo request
+                _, _, _, quoted_ident, quoted_seq = struct.unpack("!BBHHH", data[48:56])
+                if quoted_seq == seq and (method == "icmp" or quoted_ident == ident):
+                    return kinds[icmp_type], self.format_address(ipaddress.IPv6Address(address[0].split("%")[0]))
+
+    def probe_target(self, host: str) -> Optional[str]:
+        """Resolve a ping or traceroute target to an IPv6 address, logging failures."""
+        try:
+            return socket.getaddrinfo(host, None, socket.AF_INET6, socket.SOCK_DGRAM)[0][4][0]
+        except socket.gaierror as e:
+            self.logger.error(f"Cannot resolve {host} to an IPv6 address: {e}")
+            return None
+
+    def mmdb_decode(self, data: bytes, offset: int, base: int) -> Tuple[object, int]:
+        """Decode one MaxMind DB data field; pointers are relative to base."""
+        control = data[offset]
+        offset += 1
+        kind = control >> 5
+        if kind == 1:
+            size = (control >> 3) & 0x3
+            extra = data[offset:offset + size + 1]
+            offset += size + 1
+            if size == 3:
+                pointer = int.from_bytes(extra, "big")
+            else:
+                pointer = ((control & 0x7) << (8 * (size + 1))) + int.from_bytes(extra, "big")
+                pointer += (0, 2048, 526336)[size]
+            return self.mmdb_decode(data, base + pointer, base)[0], offset
+        if kind == 0:
+            kind = 7 + data[offset]
+            offset += 1
+        size = control & 0x1f
+        if size >= 29:
+            extra = size - 28
+            size = (29, 285, 65821)[extra - 1] + int.from_bytes(data[offset:offset + extra], "big")
+            offset += extra
+        if kind == 7 or kind == 11:
+            items = []
+            for _ in range(size * (2 if kind == 7 else 1)):
+                item, offset = self.mmdb_decode(data, offset, base)
+                items.append(item)
+            return (dict(zip(items[::2], items[1::2])) if kind == 7 else items), offset
+        value = data[offset:offset + size]
+        if kind == 2:
+            return value.decode(errors="replace"), offset + size
+        if kind == 3:
+            return struct.unpack("!d", value)[0], offset + size
+        if kind == 15:
+            return struct.unpack("!f", value)[0], offset + size
+        if kind == 14:
+            return bool(size), offset
+        if kind == 8:
+            return int.from_bytes(value, "big", signed=size == 4), offset + size
+        return (value if kind == 4 else int.from_bytes(value, "big")), offset + size
+
+    def mmdb_field(self, data: bytes, offset: int, base: int) -> object:
+        """Decode one MaxMind DB data field, raising ValueError if it is malformed."""
+        try:
+            return self.mmdb_decode(data, offset, base)[0]
+        except (IndexError, struct.error, TypeError, RecursionError) as e:
+            # TypeError: a map key that is itself a map; RecursionError: pointers that loop
+            raise ValueError(f"malformed MaxMind DB data at offset {offset}: {e or type(e).__name__}") from e
+
+    def mmdb_open(self, path: str) -> dict:
+        """Load a MaxMind DB file (GeoLite2, DB-IP, ipinfo) and its metadata."""
+        with open(path, "rb") as f:
+            data = f.read()
+        marker = data.rfind(b"\xab\xcd\xefMaxMind.com")
+        if marker < 0:
+            raise ValueError(f"{path} is not a MaxMind DB file")
+        metadata = self.mmdb_field(data, marker + 14, marker + 14)
+        if not isinstance(metadata, dict) or metadata.get("record_size") not in (24, 28, 32) or \
+                not isinstance(metadata.get("node_count"), int):
+            raise ValueError(f"{path} has malformed metadata")
+        if metadata.get("ip_version") != 6:
+            raise ValueError(f"{path} only covers IPv4")
+        node_bytes = metadata["record_size"] // 4
+        if metadata["node_count"] * node_bytes + 16 > marker:
+            raise ValueError(f"{path} is truncated: its search tree runs past the data")
+        return {
+            "data": data,
+            "node_count": metadata["node_count"],
+            "record_size": metadata["record_size"],
+            "node_bytes": node_bytes,
+            "data_start": metadata["node_count"] * node_bytes + 16,
+        }
+
+    def mmdb_lookup(self, database: dict, address: ipaddress.IPv6Address) -> Optional[Tuple[dict, int]]:
+        """Walk the search tree for an address; returns the record and the matching prefix length."""
+        data, node_count, node_bytes = database["data"], database["node_count"], database["node_bytes"]
+        bits = int(address)
+        node = 0
+        for depth in range(128):
+            record = data[node * node_bytes:(node + 1) * node_bytes]
+            if database["record_size"] == 28:
+                left = ((record[3] & 0xf0) << 20) | int.from_bytes(record[:3], "big")
+                right = ((record[3] & 0x0f) << 24) | int.from_bytes(record[4:], "big")
+            else:
+                half = node_bytes // 2
+                left, right = int.from_bytes(record[:half], "big"), int.from_bytes(record[half:], "big")
+            node = right if bits >> (127 - depth) & 1 else left
+            if node == node_count:
+                return None
+            if node > node_count:
+                offset = database["data_start"] + node - node_count - 16
+                record = self.mmdb_field(data, offset, database["data_start"])
+                if not isinstance(record, dict):
+                    raise ValueError(f"malformed MaxMind DB record at offset {offset}")
+                return record, depth + 1
+        return None
+
+    def cymru_lookup(self, address: ipaddress.IPv6Address, timeout: float) -> dict:
+        """Look up the origin AS, prefix and country of an address in Team Cymru's IP-to-ASN DNS zone."""
+        def txt(name: str) -> Optional[str]:
+            query = self.build_dns_query(name, DNS_TYPES["TXT"]).encode()
+            response = DNSMessage.decode(self.resolve_do53(self.DEFAULT_RESOLVER, query, timeout)[0])
+            for record in response.answers:
+                if record.type == DNS_TYPES["TXT"] and record.rdata:
+                    return record.rdata[1:1 + record.rdata[0]].decode(errors="replace")
+            return None
+
+        # The zone is keyed on nibbles, and no routed IPv6 prefix is longer than /64
+        nibbles = ".".join(reversed(address.exploded.replace(":", "")[:16]))
+        origin = txt(f"{nibbles}.origin6.asn.cymru.com")
+        if origin is None:
+            return {}
+        fields = [field.strip() for field in origin.split("|")]
+        info = {"asn": fields[0].split()[0], "prefix": fields[1], "country": fields[2] if len(fields) > 2 else ""}
+        description = txt(f"AS{info['asn']}.asn.cymru.com")
+        if description:
+            info["name"] = description.split("|")[-1].strip()
+        return info
+
+    def enrich_address(self, text: str, databases: List[dict], cache: dict, timeout: float) -> str:
+        """Annotate an address with its AS, name, country and prefix, from MMDB files or Team Cymru."""
+        try:
+            address = ipaddress.IPv6Address(text.split("%")[0])
+        except ValueError:
+            return ""
+        if not address.is_global:
+            return ""
+        if text not in cache:
+            info = {}
+            try:
+                if databases:
+                    for database in databases:
+                        found = self.mmdb_lookup(database, address)
+                        if found is None:
+                            continue
+                        record, prefix_length = found
+                        network = ipaddress.IPv6Network((address, prefix_length), strict=False)
+                        info.setdefault("prefix", str(network))
+                        if "autonomous_system_number" in record:
+                            info["asn"] = str(record["autonomous_system_number"])
+                            info["name"] = record.get("autonomous_system_organization", "")
+                            info["prefix"] = str(network)
+                        country = record.get("country") or record.get("registered_country") or {}
+                        info.setdefault("country", country.get("iso_code", ""))
+                else:
+                    info = self.cymru_lookup(address, timeout)
+            except (OSError, ValueError, IndexError, KeyError):
+                pass
+            parts = [f"AS{info['asn']}" + (f" {info['name']}" if info.get("name") else "") if info.get("asn") else "",
+                     info.get("country", ""), info.get("prefix", "")]
+            cache[text] = f"[{', '.join(part for part in parts if part)}]" if any(parts) else ""
+        return cache[text]
+
+    def enrichment_databases(self, options: argparse.Namespace) -> Optional[List[dict]]:
+        """Open the --mmdb files of a probing tool; None when a file is unusable."""
+        databases = []
+        for path in options.mmdb or []:
+            try:
+                databases.append(self.mmdb_open(path))
+            except (OSError, ValueError, KeyError) as e:
+                self.logger.error(f"Cannot use {path}: {e}")
+                return None
+        return databases
+
+    def run_ping(self, args: List[str]) -> int:
+        """Ping over IPv6 with raw, unprivileged datagram ICMP, or UDP probes."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py ping",
+                                         description="Send ICMPv6 echo requests, falling back from raw sockets to "
+                                                     "unprivileged ICMP datagram sockets and then to UDP probes "
+                                                     "answered by port unreachable, so it works without NET_RAW.")
+        parser.add_argument("host", help="Hostname or IPv6 address")
+        parser.add_argument("-c", "--count", type=int, default=4, help="Number of probes (default: 4)")
+        parser.add_argument("-i", "--interval", type=float, default=1.0, help="Seconds between probes (default: 1)")
+        parser.add_argument("-s", "--size", type=int, default=56, help="Payload size in bytes (default: 56)")
+        parser.add_argument("--timeout", type=float, default=2.0, help="Seconds to wait for each reply (default: 2)")
+        parser.add_argument("--method", choices=["auto", "raw", "icmp", "udp"], default="auto",
+                            help="Probe socket to use (default: auto)")
+        parser.add_argument("--port", type=int, default=self.TRACEROUTE_PORT,
+                            help=f"Base destination port for UDP probes (default: {self.TRACEROUTE_PORT})")
+        parser.add_argument("--asn", action="store_true",
+                            help="Annotate addresses with AS, country and prefix from Team Cymru's DNS service")
+        parser.add_argument("--mmdb", action="append", metavar="FILE",
+                            help="Annotate addresses from a local MaxMind DB file instead (repeatable)")
+        options = parser.parse_args(args)
+
+        if options.count < 1:
+            parser.error("--count must be at least 1")
+        if not 1 <= options.port <= 65535:
+            parser.error("--port must be between 1 and 65535")
+        target = self.probe_target(options.host)
+        if target is None:
+            return 1
+        databases = self.enrichment_databases(options)
+        if databases is None:
+            return 1
+        cache = {}
+
+        def annotate(address: str) -> str:
+            if not (options.asn or databases):
+                return address
+            return f"{address} {self.enrich_address(address, databases, cache, options.timeout)}".rstrip()
+        try:
+            sock, method = self.open_probe_socket(options.method)
+        except PermissionError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        ident = os.getpid() & 0xffff
+        rtts = []
+        with sock:
+            self.logger.info(f"PING {options.host} ({annotate(target)}) using {self.PROBE_METHODS[method]}")
+            for seq in range(1, options.count + 1):
+                started = time.monotonic()
+                try:
+                    self.send_probe(sock, method, target, ident, seq, options.size, options.port)
+                    result = self.await_probe(sock, method, ident, seq, started + options.timeout)
+                except OSError as e:
+                    self.logger.info(f"seq={seq} error: {e}")
+                    result = None
+                else:
+                    if result is None:
+                        self.logger.info(f"seq={seq} timeout")
+                    elif result[0] == "reply":
+                        rtts.append((time.monotonic() - started) * 1000)
+                        self.logger.info(f"reply from {result[1]}: seq={seq} time={rtts[-1]:.3f} ms")
+                    else:
+                        self.logger.info(f"seq={seq} {result[0]} from {annotate(result[1])}")
+                if seq < options.count:
+                    time.sleep(max(0.0, started + options.interval - time.monotonic()))
+
+        lost = options.count - len(rtts)
+        self.logger.info(f"\n--- {options.host} ping statistics ---")
+        self.logger.info(f"{options.count} sent, {len(rtts)} received, {lost / options.count:.0%} loss")
+        if rtts:
+            self.logger.info(f"rtt min/avg/max = {min(rtts):.3f}/{sum(rtts) / len(rtts):.3f}/{max(rtts):.3f} ms")
+        return 0 if rtts else 1
+
+    def run_traceroute(self, args: List[str]) -> int:
+        """Trace the IPv6 path with raw, unprivileged datagram ICMP, or UDP probes."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py traceroute",
+                                         description="Trace the IPv6 path by raising the hop limit, using raw ICMPv6, "
+                                                     "unprivileged ICMP datagram sockets, or UDP probes, so it works "
+                                                     "without NET_RAW.")
+        parser.add_argument("host", help="Hostname or IPv6 address")
+        parser.add_argument("-m", "--max-hops", type=int, default=30, help="Maximum hop limit (default: 30)")
+        parser.add_argument("-q", "--queries", type=int, default=3, help="Probes per hop (default: 3)")
+        parser.add_argument("--timeout", type=float, default=2.0, help="Seconds to wait for each probe (default: 2)")
+        parser.add_argument("--method", choices=["auto", "raw", "icmp", "udp"], default="auto",
+                            help="Probe socket to use (default: auto)")
+        parser.add_argument("--port", type=int, default=self.TRACEROUTE_PORT,
+                            help=f"Base destination port for UDP probes (default: {self.TRACEROUTE_PORT})")
+        parser.add_argument("--asn", action="store_true",
+                            help="Annotate addresses with AS, country and prefix from Team Cymru's DNS service")
+        parser.add_argument("--mmdb", action="append", metavar="FILE",
+                            help="Annotate addresses from a local MaxMind DB file instead (repeatable)")
+        options = parser.parse_args(args)
+
+        if not 1 <= options.port <= 65535:
+            parser.error("--port must be between 1 and 65535")
+        target = self.probe_target(options.host)
+        if target is None:
+            return 1
+        databases = self.enrichment_databases(options)
+        if databases is None:
+            return 1
+        cache = {}
+
+        def annotate(address: str) -> str:
+            if not (options.asn or databases):
+                return address
+            return f"{address} {self.enrich_address(address, databases, cache, options.timeout)}".rstrip()
+        try:
+            sock, method = self.open_probe_socket(options.method)
+        except PermissionError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        if method != "raw" and not sys.platform.startswith("linux"):
+            self.logger.warning("Warning: without a raw socket, intermediate hops are only visible on Linux")
+        ident = os.getpid() & 0xffff
+        seq = 0
+        with sock:
+            self.logger.info(f"traceroute to {options.host} ({target}), {options.max_hops} hops max, "
+                             f"using {self.PROBE_METHODS[method]}")
+            for hop in range(1, options.max_hops + 1):
+                sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_UNICAST_HOPS, hop)
+                responders, times, reached = [], [], False
+                for _ in range(options.queries):
+                    seq += 1
+                    started = time.monotonic()
+                    try:
+                        self.send_probe(sock, method, target, ident, seq, 0, options.port)
+                        result = self.await_probe(sock, method, ident, seq, started + options.timeout)
+                    except OSError as e:
+                        result = ("error", str(e))
+                    if result is None:
+                        times.append("*")
+                        continue
+                    kind, responder = result
+                    if responder == "target":
+                        responder = self.format_address(ipaddress.IPv6Address(target.split("%")[0]))
+                    if responder not in responders:
+                        responders.append(responder)
+                    mark = "" if kind in ("reply", "time-exceeded") else " !U" if kind == "unreachable" else " !E"
+                    times.append(f"{(time.monotonic() - started) * 1000:.3f} ms{mark}")
+                    reached = reached or kind in ("reply", "unreachable")
+                where = f"{', '.join(annotate(responder) for responder in responders)}  " if responders else ""
+                self.logger.info(f"{hop:>2}  {where}{'  '.join(times)}")
+                if reached:
+                    return 0
+        return 1
+
+    def default_routes(self) -> List[Tuple[str, str]]:
+        """Return (gateway, interface) for each usable IPv6 default route, from /proc on Linux."""
+        routes = []
+        try:
+            with open("/proc/net/ipv6_route") as f:
+                for line in f:
+                    fields = line.split()
+                    # RTF_REJECT (0x0200) marks the unreachable default the kernel keeps on lo
+                    if fields[0] == "0" * 32 and fields[1] == "00" and not int(fields[8], 16) & 0x0200:
+                        gateway = ipaddress.IPv6Address(bytes.fromhex(fields[4]))
+                        routes.append((str(gateway) if int(gateway) else "", fields[9]))
+        except OSError:
+            pass
+        return routes
+
+    def pcp_map(self, gateway: str, client: str, protocol: int, port: int, lifetime: int,
+                nonce: bytes, timeout: float) -> dict:
+        """Send a PCP MAP request (RFC 6887 section 11) and return the decoded response."""
+        request = struct.pack("!BBHI16s", 2, 1, 0, lifetime, ipaddress.IPv6Address(client).packed)
+        request += nonce + struct.pack("!B3xHH16s", protocol, port, port, bytes(16))
+        address = socket.getaddrinfo(gateway, self.PCP_PORT, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            # The server checks that the client address in the request matches the packet's source
+            sock.bind((client, 0))
+            sock.settimeout(timeout)
+            for _ in range(3):
+                sock.sendto(request, address)
+                try:
+                    while True:
+                        data, _ = sock.recvfrom(1100)
+                        if len(data) >= 2 and data[0] == 0:
+                            raise ConnectionError("the gateway only speaks NAT-PMP (PCP version 0), "
+                                                  "which cannot map IPv6")
+                        if len(data) >= 60 and data[1] == 0x81 and data[24:36] == nonce:
+                            break
+                except socket.timeout:
+                    continue
+                _, _, _, result, granted, epoch = struct.unpack("!BBBBII", data[:12])
+                external_port = struct.unpack("!H", data[42:44])[0]
+                return {
+                    "result": result,
+                    "lifetime": granted,
+                    "epoch": epoch,
+                    "external": f"[{ipaddress.IPv6Address(data[44:60])}]:{external_port}",
+                }
+        raise TimeoutError(f"no PCP response from {gateway}")
+
+    def upnp_discover(self, interface: str, timeout: float) -> Optional[str]:
+        """Search ff02::c for a WANIPv6FirewallControl service and return its description URL."""
+        search = (f"M-SEARCH * HTTP/1.1\r\nHOST: [FF02::C]:{self.SSDP_PORT}\r\nMAN: \"ssdp:discover\"\r\n"
+                  f"MX: 2\r\nST: {self.UPNP_FIREWALL_SERVICE}\r\n\r\n").encode()
+        scope = socket.if_nametoindex(interface)
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_IF, scope)
+            sock.sendto(search, ("ff02::c", self.SSDP_PORT, 0, scope))
+            deadline = time.monotonic() + timeout
+            while (remaining := deadline - time.monotonic()) > 0:
+                sock.settimeout(remaining)
+                try:
+                    data, sender = sock.recvfrom(4096)
+                except socket.timeout:
+                    break
+                for line in data.decode(errors="replace").split("\r\n"):
+                    name, _, value = line.partition(":")
+                    if name.strip().lower() == "location":
+                        location = value.strip()
+                        # A link-local host in the URL needs the interface to be reachable
+                        host = urllib.parse.urlsplit(location).hostname or ""
+                        if host.startswith("fe80") and "%" not in host:
+                            location = location.replace(f"[{host}]", f"[{host}%25{interface}]", 1)
+                        return location
+        return None
+
+    def upnp_request(self, url: str, action: Optional[str] = None, arguments: Optional[dict] = None,
+                     timeout: float = 5.0) -> Tuple[int, str]:
+        """GET a description document, or POST a SOAP action to a control URL."""
+        parts = urllib.parse.urlsplit(url)
+        host = urllib.parse.unquote(parts.hostname or "")
+        connection = http.client.HTTPConnection(host, parts.port or 80, timeout=timeout)
+        path = parts.path + (f"?{parts.query}" if parts.query else "") or "/"
+        try:
+            if action is None:
+                connection.request("GET", path)
+            else:
+                body = "".join(f"<{name}>{value}</{name}>" for name, value in (arguments or {}).items())
+                envelope = ('<?xml version="1.0"?>'
+                            '<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" '
+                            's:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>'
+                            f'<u:{action} xmlns:u="{self.UPNP_FIREWALL_SERVICE}">{body}</u:{action}>'
+                            '</s:Body></s:Envelope>')
+                connection.request("POST", path, envelope.encode(), {
+                    "Content-Type": 'text/xml; charset="utf-8"',
+                    "SOAPAction": f'"{self.UPNP_FIREWALL_SERVICE}#{action}"',
+                })
+            response = connection.getresponse()
+            return response.status, response.read().decode(errors="replace")
+        finally:
+            connection.close()
+
+    def xml_values(self, document: str) -> dict:
+        """Map the local name of every leaf element in an XML document to its text."""
+        values = {}
+        for element in ElementTree.fromstring(document).iter():
+            if len(element) == 0:
+                values.setdefault(element.tag.rsplit("}", 1)[-1], (element.text or "").strip())
+        return values
+
+    def upnp_pinhole(self, location: str, client: str, protocol: int, port: int, lifetime: int,
+                     keep: bool, timeout: float) -> Tuple[bool, str]:
+        """Ask the IGD's IPv6 firewall for an inbound pinhole; returns (opened, description)."""
+        _, description = self.upnp_request(location, timeout=timeout)
+        control = None
+        for service in ElementTree.fromstring(description).iter():
+            if service.tag.endswith("service"):
+                fields = {child.tag.rsplit("}", 1)[-1]: (child.text or "").strip() for child in service}
+                if fields.get("serviceType", "").startswith("urn:schemas-upnp-org:service:WANIPv6FirewallControl"):
+                    control = urllib.parse.urljoin(location, fields.get("controlURL", ""))
+        if control is None:
+            return False, "device description lists no WANIPv6FirewallControl service"
+
+        status, body = self.upnp_request(control, "GetFirewallStatus", timeout=timeout)
+        values = self.xml_values(body)
+        if status != 200:
+            return False, f"GetFirewallStatus failed: {values.get('errorDescription', f'HTTP {status}')}"
+        if values.get("InboundPinholeAllowed") != "1":
+            return False, (f"firewall {'enabled' if values.get('FirewallEnabled') == '1' else 'disabled'}, "
+                           f"but inbound pinholes are not allowed")
+
+        status, body = self.upnp_request(control, "AddPinhole", {
+            "RemoteHost": "", "RemotePort": 0, "InternalClient": client, "InternalPort": port,
+            "Protocol": protocol, "LeaseTime": lifetime,
+        }, timeout)
+        values = self.xml_values(body)
+        if status != 200:
+            return False, (f"AddPinhole refused: {values.get('errorCode', status)} "
+                           f"{values.get('errorDescription', '')}".rstrip())
+        detail = f"pinhole {values.get('UniqueID', '?')} opened for {lifetime} s"
+        if not keep:
+            self.upnp_request(control, "DeletePinhole", {"UniqueID": values.get("UniqueID", "")}, timeout)
+            detail += " (deleted again)"
+        return True, detail
+
+    def run_portmap(self, args: List[str]) -> int:
+        """Test whether the local router will open an inbound IPv6 port through PCP or UPnP."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py portmap",
+                                         description="Ask the local router to open an inbound IPv6 port with a PCP "
+                                                     "MAP request (RFC 6887) and a UPnP WANIPv6FirewallControl "
+                                                     "pinhole, and report which of them works. Mappings are removed "
+                                                     "again unless --keep is given.")
+        parser.add_argument("--port", type=int, default=self.DEFAULT_PORT,
+                            help=f"Inbound port to open (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--protocol", choices=["tcp", "udp"], default="tcp", help="Protocol (default: tcp)")
+        parser.add_argument("--lifetime", type=int, default=120, help="Mapping lifetime in seconds (default: 120)")
+        parser.add_argument("--gateway", help="PCP server address (default: the IPv6 default gateway)")
+        parser.add_argument("--interface", help="Interface to search for UPnP devices on (default: the "
+                                                "default route's interface)")
+        parser.add_argument("--client", help="Global address to open the port for (default: the source address "
+                                             "used for Internet traffic)")
+        parser.add_argument("--no-pcp", action="store_true", help="Skip the PCP test")
+        parser.add_argument("--no-upnp", action="store_true", help="Skip the UPnP test")
+        parser.add_argument("--keep", action="store_true", help="Leave the mappings in place")
+        parser.add_argument("--timeout", type=float, default=2.0, help="Timeout in seconds (default: 2)")
+        options = parser.parse_args(args)
+
+        protocol = {"tcp": socket.IPPROTO_TCP, "udp": socket.IPPROTO_UDP}[options.protocol]
+        routes = self.default_routes()
+        gateway = options.gateway
+        interface = options.interface or (routes[0][1] if routes else None)
+        if gateway is None and routes and routes[0][0]:
+            gateway = routes[0][0] + (f"%{routes[0][1]}" if routes[0][0].startswith("fe80") else "")
+        client = options.client
+        if client is None:
+            try:
+                with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+                    # Connecting a UDP socket sends nothing but selects the source address
+                    sock.connect((self.DEFAULT_RESOLVER, 53))
+                    client = sock.getsockname()[0]
+            except OSError as e:
+                self.logger.error(f"Cannot determine a global source address: {e}")
+                return 1
+
+        self.logger.info(f"Inbound {options.protocol.upper()} port {options.port} for {client}:")
+        opened = []
+        if not options.no_pcp:
+            if gateway is None:
+                self.logger.info("  PCP: no IPv6 default gateway found; use --gateway")
+            else:
+                nonce = secrets.token_bytes(12)
+                try:
+                    response = self.pcp_map(gateway, client, protocol, options.port, options.lifetime, nonce,
+                                            options.timeout)
+                    result = self.PCP_RESULTS.get(response["result"], f"result {response['result']}")
+                    if response["result"] == 0:
+                        opened.append("PCP")
+                        detail = f"mapped {response['external']} for {response['lifetime']} s"
+                        if not options.keep:
+                            self.pcp_map(gateway, client, protocol, options.port, 0, nonce, options.timeout)
+                            detail += " (deleted again)"
+                        self.logger.info(f"  PCP via {gateway}: {detail}")
+                    else:
+                        self.logger.info(f"  PCP via {gateway}: {result}")
+                except (OSError, ConnectionError) as e:
+                    self.logger.info(f"  PCP via {gateway}: {e}")
+
+        if not options.no_upnp:
+            if interface is None:
+                self.logger.info("  UPnP: no interface to search on; use --interface")
+            else:
+                try:
+                    location = self.upnp_discover(interface, options.timeout)
+                    if location is None:
+                        self.logger.info(f"  UPnP: no WANIPv6FirewallControl service answered on {interface}")
+                    else:
+                        success, detail = self.upnp_pinhole(location, client, protocol, options.port,
+                                                            options.lifetime, options.keep, options.timeout)
+                        if success:
+                            opened.append("UPnP")
+                        self.logger.info(f"  UPnP at {location}: {detail}")
+                except (OSError, ValueError, ElementTree.ParseError, http.client.HTTPException) as e:
+                    self.logger.info(f"  UPnP: {e}")
+
+        if opened:
+            self.logger.info(f"\nResult: inbound connectivity can be provisioned via {' and '.join(opened)}")
+            return 0
+        self.logger.info("\nResult: the router did not open the port; inbound connections need manual "
+                         "firewall configuration")
+        return 1
+
+    def container_runtime(self) -> List[str]:
+        """Return the evidence that this process runs in a container, if any."""
+        evidence = []
+        markers = {"/.dockerenv": "Docker (/.dockerenv)", "/run/.containerenv": "Podman (/run/.containerenv)"}
+        evidence += [label for path, label in markers.items() if os.path.exists(path)]
+        if os.environ.get("KUBERNETES_SERVICE_HOST"):
+            evidence.append("Kubernetes pod (KUBERNETES_SERVICE_HOST is set)")
+        try:
+            with open("/proc/1/cgroup") as f:
+                cgroups = f.read()
+            for keyword in ("kubepods", "docker", "containerd", "crio", "libpod", "lxc"):
+                if keyword in cgroups:
+                    evidence.append(f"cgroup of PID 1 mentions {keyword}")
+                    break
+        except OSError:
+            pass
+        return evidence
+
+    def run_container_check(self, args: List[str]) -> int:
+        """Score whether IPv6 actually works inside the current container or network namespace."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py container-check",
+                                         description="Detect whether this process runs in a container, and check "
+                                                     "that its network namespace has IPv6 enabled, a global address, "
+                                                     "a default route, AAAA answers from DNS, and IPv6 egress.")
+        parser.add_argument("--name", default="www.google.com",
+                            help="Name to resolve and connect to (default: www.google.com)")
+        parser.add_argument("--port", type=int, default=443, help="Port for the egress check (default: 443)")
+        parser.add_argument("--no-egress", action="store_true", help="Skip the outbound connection")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        if not sys.platform.startswith("linux"):
+            self.logger.error("container-check reads /proc and only runs on Linux")
+            return 1
+
+        evidence = self.container_runtime()
+        self.logger.info("Container check:")
+        self.logger.info(f"  Runtime: {'; '.join(evidence) if evidence else 'no container detected'}")
+        try:
+            self.logger.info(f"  Network namespace: {os.readlink('/proc/self/ns/net')}")
+        except OSError:
+            pass
+
+        results = []
+
+        def check(status: str, label: str, detail: str) -> None:
+            results.append(status)
+            self.logger.info(f"  [{status}] {label}: {detail}")
+
+        try:
+            with open("/proc/sys/net/ipv6/conf/all/disable_ipv6") as f:
+                disabled = f.read().strip() == "1"
+            check("FAIL" if disabled else "PASS", "IPv6 enabled",
+                  "disabled by net.ipv6.conf.all.disable_ipv6" if disabled else "yes")
+        except OSError:
+            check("FAIL", "IPv6 enabled", "no IPv6 support in this kernel or namespace")
+
+        global_addresses, ula_addresses = [], []
+        try:
+            with open("/proc/net/if_inet6") as f:
+                for line in f:
+                    address, _, prefix_length, scope, flags, interface = line.split()
+                    # Skip tentative addresses and those that failed duplicate address detection
+                    if scope != "00" or int(flags, 16) & 0x48:
+                        continue
+                    value = ipaddress.IPv6Address(bytes.fromhex(address))
+                    entry = f"{value}/{int(prefix_length, 16)} on {interface}"
+                    (ula_addresses if value in ipaddress.IPv6Network("fc00::/7") else global_addresses).append(entry)
+        except OSError:
+            pass
+        if global_addresses:
+            check("PASS", "Global address", ", ".join(global_addresses))
+        elif ula_addresses:
+            check("WARN", "Global address", f"only ULA ({', '.join(ula_addresses)}); egress needs NAT66 or a proxy")
+        else:
+            check("FAIL", "Global address", "none; only loopback or link-local addresses")
+
+        default_routes = [f"via {gateway} dev {interface}" if gateway else f"dev {interface}"
+                          for gateway, interface in self.default_routes()]
+        check("PASS" if default_routes else "FAIL", "Default route", ", ".join(default_routes) or "none")
+
+        try:
+            with open("/etc/resolv.conf") as f:
+                nameservers = [line.split()[1] for line in f if line.startswith("nameserver") and len(line.split()) > 1]
+            self.logger.info(f"  Resolvers: {', '.join(nameservers) or 'none configured'}")
+        except OSError:
+            pass
+
+        aaaa = []
+        try:
+            infos = socket.getaddrinfo(options.name, options.port, socket.AF_INET6, socket.SOCK_STREAM)
+            aaaa = list(dict.fromkeys(info[4][0] for info in infos))
+            check("PASS", "DNS AAAA", f"{options.name} -> {', '.join(aaaa)}")
+        except socket.gaierror as e:
+            check("FAIL", "DNS AAAA", f"{options.name}: {e.strerror}")
+
+        if not options.no_egress:
+            if not aaaa:
+                check("FAIL", "IPv6 egress", "skipped, no AAAA address to connect to")
+            else:
+                try:
+                    started = time.monotonic()
+                    with socket.create_connection((aaaa[0], options.port), timeout=options.timeout):
+                        elapsed = (time.monotonic() - started) * 1000
+                    check("PASS", "IPv6 egress", f"connected to [{aaaa[0]}]:{options.port} in {elapsed:.1f} ms")
+                except OSError as e:
+                    check("FAIL", "IPv6 egress", f"[{aaaa[0]}]:{options.port}: {e}")
+
+        passed = results.count("PASS")
+        self.logger.info(f"\nScore: {passed}/{len(results)} checks passed")
+        if "FAIL" in results:
+            self.logger.info("Result: IPv6 is not usable in this namespace")
+            return 1
+        self.logger.info("Result: IPv6 is usable in this namespace")
+        return 0
+
+    async def probe_egress(self, targets: List[Tuple[str, int]], timeout: float) -> List[str]:
+        """Open a TCP connection to each target over IPv6, returning a failure description per target."""
+        async def probe(host: str, port: int) -> Optional[str]:
+            try:
+                _, writer = await asyncio.wait_for(
+                    asyncio.open_connection(host, port, family=socket.AF_INET6), timeout)
+                writer.close()
+                await writer.wait_closed()
+                return None
+            except asyncio.TimeoutError:
+                return f"[{host}]:{port} timed out"
+            except OSError as e:
+                return f"[{host}]:{port} {e.strerror or e}"
+
+        results = await asyncio.gather(*(probe(host, port) for host, port in targets))
+        return [failure for failure in results if failure]
+
+    async def run_health_server(self, address: str, port: int, targets: List[Tuple[str, int]],
+                                interval: float, timeout: float, require_all: bool) -> None:
+        """Serve /healthz and /readyz, with readiness tracking periodic IPv6 egress probes."""
+        state = {"ready": False, "detail": "no probe has completed yet"}
+
+        async def prober() -> None:
+            while True:
+                failures = await self.probe_egress(targets, timeout)
+                reachable = len(targets) - len(failures)
+                ready = not failures if require_all else reachable > 0
+                detail = f"{reachable}/{len(targets)} targets reachable over IPv6"
+                if failures:
+                    detail += f" ({'; '.join(failures)})"
+                if ready != state["ready"] or detail != state["detail"]:
+                    self.logger.info(f"{'Ready' if ready else 'Not ready'}: {detail}")
+                state.update(ready=ready, detail=detail)
+                await asyncio.sleep(interval)
+
+        async def handle(reader: asyncio.StreamReader, writer: asyncio.StreamWriter) -> None:
+            try:
+                request = await asyncio.wait_for(reader.readline(), timeout)
+                # Drain the headers; probes never send a body
+                while (await asyncio.wait_for(reader.readline(), timeout)) not in (b"\r\n", b"\n", b""):
+                    pass
+                parts = request.decode(errors="replace").split()
+                path = parts[1].split("?")[0] if len(parts) >= 2 else ""
+                if path == "/healthz":
+                    status, body = "200 OK", "ok\n"
+                elif path == "/readyz":
+                    status = "200 OK" if state["ready"] else "503 Service Unavailable"
+                    body = f"{'ready' if state['ready'] else 'not ready'}: {state['detail']}\n"
+                else:
+                    status, body = "404 Not Found", "not found\n"
+                writer.write(f"HTTP/1.1 {status}\r\nContent-Type: text/plain\r\nContent-Length: {len(body)}\r\n"
+                             f"Connection: close\r\n\r\n{body}".encode())
+                await writer.drain()
+            except (asyncio.TimeoutError, ValueError, OSError):
+                pass
+            finally:
+                writer.close()
+
+        server = await asyncio.start_server(handle, address, port, family=socket.AF_INET6,
+                                            limit=self.MAX_LINE_LENGTH)
+        self.logger.info(f"Health endpoints on http://[{address}]:{port}/healthz and /readyz, probing "
+                         f"{', '.join(f'[{host}]:{target_port}' for host, target_port in targets)} "
+                         f"every {interval:g} s")
+        async with server:
+            await asyncio.gather(server.serve_forever(), prober())
+
+    def run_health(self, args: List[str]) -> int:
+        """Run the readiness and liveness probe server."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py health",
+                                         description="Serve /healthz and /readyz over IPv6 for use as a Kubernetes "
+                                                     "probe. /readyz returns 200 only while periodic TCP probes to the "
+                                                     "targets succeed over IPv6, so dual-stack rollouts can gate on "
+                                                     "working IPv6 egress.")
+        parser.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        parser.add_argument("port", nargs="?", type=int, default=self.HEALTH_PORT,
+                            help=f"Port to listen on (default: {self.HEALTH_PORT})")
+        parser.add_argument("--target", action="append", metavar="HOST:PORT",
+                            help="Egress target to probe, e.g. [2001:db8::1]:443 (repeatable; "
+                                 "default: www.google.com:443)")
+        parser.add_argument("--interval", type=float, default=10.0, help="Seconds between probes (default: 10)")
+        parser.add_argument("--timeout", type=float, default=3.0, help="Probe timeout in seconds (default: 3)")
+        parser.add_argument("--require", choices=["all", "any"], default="all",
+                            help="Targets that must be reachable to be ready (default: all)")
+        options = parser.parse_args(args)
+
+        targets = []
+        for target in options.target or ["www.google.com:443"]:
+            try:
+                parts = urllib.parse.urlsplit(f"//{target}")
+                if not parts.hostname or not parts.port:
+                    raise ValueError("expected HOST:PORT")
+            except ValueError as e:
+                parser.error(f"invalid --target '{target}': {e}")
+            targets.append((parts.hostname, parts.port))
+
+        try:
+            asyncio.run(self.run_health_server(options.ipv6_address, options.port, targets, options.interval,
+                                               options.timeout, options.require == "all"))
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+        except OSError as e:
+            self.logger.error(f"Server error: {e}")
+            return 1
+        return 0
+
+    def local_addresses(self) -> List[str]:
+        """List the non-link-local IPv6 addresses configured on this host."""
+        addresses = []
+        try:
+            with open("/proc/net/if_inet6") as f:
+                for line in f:
+                    address, _, _, scope, _, _ = line.split()
+                    if scope == "00":
+                        addresses.append(str(ipaddress.IPv6Address(bytes.fromhex(address))))
+        except OSError:
+            # Not Linux; fall back to whatever the resolver knows about this host
+            try:
+                infos = socket.getaddrinfo(socket.gethostname(), None, socket.AF_INET6)
+                addresses = [info[4][0] for info in infos if not info[4][0].startswith("fe80")]
+            except socket.gaierror:
+                pass
+        return list(dict.fromkeys(addresses))
+
+    def stun_message(self, message_type: int, transaction: bytes, attributes: List[Tuple[int, bytes]],
+                     key: Optional[bytes] = None) -> bytes:
+        """Encode a STUN message, appending MESSAGE-INTEGRITY when a long-term credential key is given."""
+        body = b"".join(struct.pack("!HH", kind, len(value)) + value + bytes(-len(value) % 4)
+                        for kind, value in attributes)
+        if key is None:
+            return struct.pack("!HHI", message_type, len(body), self.STUN_MAGIC_COOKIE) + transaction + body
+        # The length covers MESSAGE-INTEGRITY itself while the HMAC is computed (RFC 8489 section 14.5)
+        header = struct.pack("!HHI", message_type, len(body) + 24, self.STUN_MAGIC_COOKIE) + transaction
+        digest = hmac.new(key, header + body, hashlib.sha1).digest()
+        return header + body + struct.pack("!HH", 0x0008, 20) + digest
+
+    def stun_exchange(self, sock: socket.socket, message_type: int, attributes: List[Tuple[int, bytes]],
+                      timeout: float, key: Optional[bytes] = None) -> Tuple[int, dict, bytes]:
+        """Send a STUN request on a connected socket; returns the response type, attributes and header."""
+        transaction = secrets.token_bytes(12)
+        request = self.stun_message(message_type, transaction, attributes, key)
+        sock.settimeout(timeout)
+        # Retransmit like RFC 8489 section 6.2.1, with a shorter schedule
+        for _ in range(3):
+            sock.send(request)
+            try:
+                while True:
+                    data = sock.recv(2048)
+                    if len(data) >= 20 and data[8:20] == transaction:
+                        break
+            except socket.timeout:
+                continue
+            response_type, length = struct.unpack("!HH", data[:4])
+            values = {}
+            offset = 20
+            while offset + 4 <= min(len(data), 20 + length):
+                kind, size = struct.unpack("!HH", data[offset:offset + 4])
+                values.setdefault(kind, data[offset + 4:offset + 4 + size])
+                offset += 4 + (size + 3) // 4 * 4
+            return response_type, values, data[:20]
+        raise TimeoutError(f"no STUN response from [{sock.getpeername()[0]}]:{sock.getpeername()[1]}")
+
+    def stun_address(self, value: bytes, header: bytes, xor: bool) -> Optional[Tuple[str, int]]:
+        """Decode an IPv6 (XOR-)MAPPED-ADDRESS style attribute."""
+        if len(value) != 20 or value[1] != 0x02:
+            return None
+        port = struct.unpack("!H", value[2:4])[0]
+        raw = value[4:20]
+        if xor:
+            # The XOR hides the address from middleboxes that rewrite payloads
+            port ^= self.STUN_MAGIC_COOKIE >> 16
+            raw = bytes(a ^ b for a, b in zip(raw, header[4:20]))
+        return str(ipaddress.IPv6Address(raw)), port
+
+    def stun_error(self, values: dict) -> str:
+        """Describe the ERROR-CODE attribute of a STUN error response."""
+        value = values.get(0x0009, b"")
+        if len(value) < 4:
+            return "error response without ERROR-CODE"
+        return f"{value[2] * 100 + value[3]} {value[4:].decode(errors='replace')}".strip()
+
+    def stun_binding(self, host: str, port: int, timeout: float,
+                     sock: Optional[socket.socket] = None) -> Tuple[Tuple[str, int], Tuple[str, int]]:
+        """Send a STUN Binding request (RFC 8489) and return the (mapped, local) transport addresses."""
+        address = socket.getaddrinfo(host, port, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        own = sock is None
+        sock = sock or socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+        try:
+            # Connecting fixes the source address, so the local side of the binding is known
+            sock.connect(address)
+            response_type, values, header = self.stun_exchange(sock, 0x0001, [], timeout)
+            if response_type != 0x0101:
+                raise ConnectionError(f"STUN error from [{address[0]}]:{port}: {self.stun_error(values)}")
+            mapped = None
+            if 0x0020 in values:
+                mapped = self.stun_address(values[0x0020], header, True)
+            if mapped is None and 0x0001 in values:
+                mapped = self.stun_address(values[0x0001], header, False)
+            if mapped is None:
+                raise ConnectionError("STUN response carries no IPv6 mapped address")
+            return mapped, sock.getsockname()[:2]
+        finally:
+            if own:
+                sock.close()
+
+    def https_address(self, url: str, timeout: float) -> Tuple[str, str]:
+        """Fetch a what-is-my-IP URL over IPv6 and return the (reported, local source) addresses."""
+        parts = urllib.parse.urlsplit(url)
+        port = parts.port or (443 if parts.scheme == "https" else 80)
+        address = socket.getaddrinfo(parts.hostname, port, socket.AF_INET6, socket.SOCK_STREAM)[0][4]
+        raw = socket.create_connection(address[:2], timeout=timeout)
+        if parts.scheme == "https":
+            connection = http.client.HTTPSConnection(parts.hostname, port, timeout=timeout)
+            connection.sock = self.tls_context(False, ["http/1.1"]).wrap_socket(raw, server_hostname=parts.hostname)
+        else:
+            connection = http.client.HTTPConnection(parts.hostname, port, timeout=timeout)
+            connection.sock = raw
+        try:
+            local = raw.getsockname()[0]
+            connection.request("GET", (parts.path or "/") + (f"?{parts.query}" if parts.query else ""),
+                               headers={"User-Agent": "ipv6_tester", "Accept": "text/plain, application/json"})
+            response = connection.getresponse()
+            body = response.read().decode(errors="replace").strip()
+            if response.status != 200:
+                raise ConnectionError(f"HTTP {response.status} {response.reason}")
+        finally:
+            connection.close()
+        if body.startswith("{"):
+            body = str(json.loads(body).get("ip", ""))
+        return str(ipaddress.IPv6Address(body)), local
+
+    def run_myip(self, args: List[str]) -> int:
+        """Show the global IPv6 address this host appears as, and whether it is translated on the way."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py myip",
+                                         description="Discover the IPv6 address this host appears as from outside, "
+                                                     "via an HTTPS echo endpoint and a STUN server, and compare it "
+                                                     "with the local addresses to detect NAT66 or proxying.")
+        parser.add_argument("--url", default=self.MYIP_URL,
+                            help=f"Endpoint that returns the caller's address (default: {self.MYIP_URL})")
+        parser.add_argument("--stun", default=self.DEFAULT_STUN_SERVER, metavar="HOST[:PORT]",
+                            help=f"STUN server (default: {self.DEFAULT_STUN_SERVER})")
+        parser.add_argument("--method", choices=["https", "stun", "both"], default="both",
+                            help="Discovery method (default: both)")
+        parser.add_argument("--timeout", type=float, default=5.0, help="Timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        local_addresses = self.local_addresses()
+        observed = {}
+        if options.method in ("https", "both"):
+            try:
+                external, source = self.https_address(options.url, options.timeout)
+                observed[urllib.parse.urlsplit(options.url).scheme.upper()] = (external, source)
+            except (OSError, ValueError, ConnectionError, http.client.HTTPException) as e:
+                self.logger.info(f"{urllib.parse.urlsplit(options.url).scheme.upper()} ({options.url}): {e}")
+        if options.method in ("stun", "both"):
+            try:
+                parts = urllib.parse.urlsplit(f"//{options.stun}")
+                (external, _), (source, _) = self.stun_binding(parts.hostname, parts.port or self.STUN_PORT,
+                                                              options.timeout)
+                observed["STUN"] = (external, source)
+            except (OSError, ValueError, ConnectionError) as e:
+                self.logger.info(f"STUN ({options.stun}): {e}")
+        if not observed:
+            self.logger.error("Could not discover the external IPv6 address")
+            return 1
+
+        for method, (external, source) in observed.items():
+            if external == source:
+                verdict = "matches the local source address; no translation"
+            elif external in local_addresses:
+                verdict = f"a local address, but not the source address {source}"
+            else:
+                verdict = f"not a local address (source was {source}); the path uses NAT66, NPTv6 or a proxy"
+            self.logger.info(f"{method}: {external} - {verdict}")
+        if len({external for external, _ in observed.values()}) > 1:
+            self.logger.info("The methods disagree; web traffic is probably going through a proxy")
+        sys.stdout.write(f"{next(iter(observed.values()))[0]}\n")
+        return 0
+
+    def turn_allocate(self, host: str, port: int, username: str, password: str,
+                      timeout: float) -> dict:
+        """Allocate an IPv6 relay on a TURN server (RFC 8656, RFC 6156) and release it again."""
+        address = socket.getaddrinfo(host, port, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        # REQUESTED-TRANSPORT UDP and REQUESTED-ADDRESS-FAMILY IPv6
+        attributes = [(0x0019, bytes([17, 0, 0, 0])), (0x0017, bytes([2, 0, 0, 0]))]
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.connect(address)
+            response_type, values, header = self.stun_exchange(sock, 0x0003, attributes, timeout)
+            key = None
+            credentials = []
+            if response_type == 0x0113 and self.stun_error(values).startswith("401"):
+                # The first request only collects the realm and nonce for the long-term credential
+                realm = values.get(0x0014, b"")
+                key = hashlib.md5(f"{username}:{realm.decode(errors='replace')}:{password}".encode()).digest()
+                credentials = [(0x0006, username.encode()), (0x0014, realm), (0x0015, values.get(0x0015, b""))]
+                response_type, values, header = self.stun_exchange(sock, 0x0003, attributes + credentials,
+                                                                   timeout, key)
+            if response_type != 0x0103:
+                raise ConnectionError(f"allocation refused: {self.stun_error(values)}")
+            allocation = {
+                "relayed": self.stun_address(values.get(0x0016, b""), header, True),
+                "mapped": self.stun_address(values.get(0x0020, b""), header, True),
+                "lifetime": struct.unpack("!I", values[0x000D])[0] if len(values.get(0x000D, b"")) == 4 else None,
+                "local": sock.getsockname()[:2],
+            }
+            # A Refresh with LIFETIME 0 deletes the allocation
+            self.stun_exchange(sock, 0x0004, [(0x000D, bytes(4))] + credentials, timeout, key)
+            return allocation
+
+    def run_stun(self, args: List[str]) -> int:
+        """Show the ICE candidates an IPv6 network yields, using STUN and optionally TURN."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py stun",
+                                         description="Send STUN Binding requests over IPv6 to show the host and "
+                                                     "server-reflexive candidates WebRTC would gather, check whether "
+                                                     "the mapping depends on the destination, and optionally "
+                                                     "allocate an IPv6 relay on a TURN server.")
+        parser.add_argument("--server", action="append", metavar="HOST[:PORT]",
+                            help=f"STUN server (repeatable; default: {self.DEFAULT_STUN_SERVER} and "
+                                 f"stun1.l.google.com:19302)")
+        parser.add_argument("--turn", metavar="HOST[:PORT]", help="TURN server to allocate a relay on")
+        parser.add_argument("--username", default="", help="TURN username")
+        parser.add_argument("--password", default="", help="TURN password")
+        parser.add_argument("--timeout", type=float, default=3.0, help="Timeout in seconds (default: 3)")
+        options = parser.parse_args(args)
+
+        servers = options.server or [self.DEFAULT_STUN_SERVER, "stun1.l.google.com:19302"]
+        mappings = []
+        # One socket for every server, so the mappings can be compared
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.bind(("::", 0))
+            for server in servers:
+                parts = urllib.parse.urlsplit(f"//{server}")
+                try:
+                    mapped, local = self.stun_binding(parts.hostname, parts.port or self.STUN_PORT, options.timeout,
+                                                      sock)
+                except (OSError, ValueError, ConnectionError) as e:
+                    self.logger.info(f"STUN {server}: {e}")
+                    continue
+                translated = "same as host" if mapped == local else "translated"
+                self.logger.info(f"STUN {server}:")
+                self.logger.info(f"  Host candidate:             [{local[0]}]:{local[1]}")
+                self.logger.info(f"  Server-reflexive candidate: [{mapped[0]}]:{mapped[1]} ({translated})")
+                mappings.append(mapped)
+
+        if len(mappings) > 1:
+            if len(set(mappings)) == 1:
+                self.logger.info("Mapping: endpoint-independent; peers can reach the same candidate")
+            else:
+                self.logger.info("Mapping: depends on the destination; server-reflexive candidates will not "
+                                 "work for peers and a TURN relay is needed")
+
+        relayed = True
+        if options.turn:
+            parts = urllib.parse.urlsplit(f"//{options.turn}")
+            try:
+                allocation = self.turn_allocate(parts.hostname, parts.port or self.STUN_PORT, options.username,
+                                                options.password, options.timeout)
+                relay = allocation["relayed"]
+                self.logger.info(f"TURN {options.turn}:")
+                self.logger.info("  Relayed candidate: " + (f"[{relay[0]}]:{relay[1]}" if relay else "not IPv6")
+                                 + (f" for {allocation['lifetime']} s" if allocation["lifetime"] else ""))
+                self.logger.info("  Allocation released")
+                relayed = relay is not None
+            except (OSError, ValueError, ConnectionError) as e:
+                self.logger.info(f"TURN {options.turn}: {e}")
+                relayed = False
+
+        return 0 if mappings and relayed else 1
+
+    def fetch_json(self, url: str, timeout: float, accept: str = "application/json") -> Tuple[dict, str]:
+        """GET a JSON document over HTTP(S), following redirects; returns the document and final URL."""
+        for _ in range(5):
+            parts = urllib.parse.urlsplit(url)
+            connection_class = http.client.HTTPSConnection if parts.scheme == "https" else http.client.HTTPConnection
+            connection = connection_class(parts.hostname, parts.port, timeout=timeout)
+            try:
+                connection.request("GET", parts.path + (f"?{parts.query}" if parts.query else ""),
+                                   headers={"Accept": accept, "User-Agent": "ipv6_tester"})
+                response = connection.getresponse()
+                body = response.read()
+                if response.status in (301, 302, 303, 307, 308) and response.getheader("Location"):
+                    url = urllib.parse.urljoin(url, response.getheader("Location"))
+                    continue
+                if response.status == 404:
+                    raise LookupError(f"{url}: not found")
+                if response.status != 200:
+                    raise ConnectionError(f"{url}: HTTP {response.status} {response.reason}")
+                return json.loads(body), url
+            finally:
+                connection.close()
+        raise ConnectionError(f"{url}: too many redirects")
+
+    def rdap_server(self, network: ipaddress.IPv6Network, timeout: float) -> str:
+        """Find the RDAP base URL for a prefix in the IANA bootstrap registry (RFC 9224)."""
+        registry, _ = self.fetch_json(self.RDAP_BOOTSTRAP, timeout)
+        best, base = -1, None
+        for prefixes, urls in registry.get("services", []):
+            for prefix in prefixes:
+                candidate = ipaddress.IPv6Network(prefix)
+                if network.subnet_of(candidate) and candidate.prefixlen > best:
+                    # Prefer HTTPS when the registry lists both
+                    best, base = candidate.prefixlen, sorted(urls, key=lambda url: not url.startswith("https"))[0]
+        if base is None:
+            raise LookupError(f"no RDAP service covers {network}")
+        return base
+
+    def rdap_summary(self, document: dict) -> dict:
+        """Reduce an RDAP IP network object (RFC 9083) to its allocation, holder and contacts."""
+        def vcard(entity: dict) -> dict:
+            card = {}
+            for item in (entity.get("vcardArray") or [None, []])[1]:
+                name, _, _, value = item[:4]
+                if name == "adr" and isinstance(item[1], dict) and item[1].get("label"):
+                    value = item[1]["label"].replace("\n", ", ")
+                if isinstance(value, list):
+                    value = " ".join(str(part) for part in value if part)
+                if name in ("fn", "email", "tel", "adr") and value:
+                    card.setdefault(name, str(value).removeprefix("tel:"))
+            return card
+
+        contacts = []
+
+        def walk(entities: List[dict]) -> None:
+            for entity in entities:
+                card = vcard(entity)
+                contacts.append({
+                    "handle": entity.get("handle", ""),
+                    "roles": entity.get("roles", []),
+                    "name": card.get("fn", ""),
+                    "email": card.get("email", ""),
+                    "phone": card.get("tel", ""),
+                    "address": card.get("adr", ""),
+                })
+                # ARIN nests the abuse and technical contacts under the organisation
+                walk(entity.get("entities", []))
+
+        walk(document.get("entities", []))
+        cidrs = [f"{cidr['v6prefix']}/{cidr['length']}" for cidr in document.get("cidr0_cidrs", [])
+                 if "v6prefix" in cidr]
+        if not cidrs and document.get("startAddress"):
+            start = ipaddress.IPv6Address(document["startAddress"].split("/")[0])
+            end = ipaddress.IPv6Address(document.get("endAddress", document["startAddress"]).split("/")[0])
+            cidrs = [str(network) for network in ipaddress.summarize_address_range(start, end)]
+        events = {event.get("eventAction"): event.get("eventDate", "") for event in document.get("events", [])}
+        remarks = [" ".join(remark.get("description", [])) for remark in document.get("remarks", [])]
+        return {
+            "handle": document.get("handle", ""),
+            "name": document.get("name", ""),
+            "prefixes": cidrs,
+            "type": document.get("type", ""),
+            "country": document.get("country", ""),
+            "parent": document.get("parentHandle", ""),
+            "status": document.get("status", []),
+            "registered": events.get("registration", ""),
+            "last_changed": events.get("last changed", ""),
+            "holder": next((contact["name"] for contact in contacts if "registrant" in contact["roles"]), ""),
+            "abuse": [contact for contact in contacts if "abuse" in contact["roles"]],
+            "contacts": contacts,
+            "remarks": [remark for remark in remarks if remark],
+        }
+
+    def run_rdap(self, args: List[str]) -> int:
+        """Look up the registration of an IPv6 address or prefix over RDAP."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py rdap",
+                                         description="Query RDAP (RFC 9083) for an IPv6 address or prefix and print "
+                                                     "the allocation, holder and abuse contacts. The responsible "
+                                                     "registry is found through the IANA bootstrap file.")
+        parser.add_argument("address", help="IPv6 address or prefix")
+        parser.add_argument("--server", help="RDAP base URL to query instead of the bootstrap result, "
+                                             "e.g. https://rdap.db.ripe.net/")
+        parser.add_argument("--json", action="store_true", help="Print the summary as JSON")
+        parser.add_argument("--raw", action="store_true", help="Print the registry's full RDAP response as JSON")
+        parser.add_argument("--timeout", type=float, default=10.0, help="Timeout in seconds (default: 10)")
+        options = parser.parse_args(args)
+
+        try:
+            network = ipaddress.IPv6Network(options.address.split("%")[0], strict=False)
+        except ValueError:
+            parser.error(f"'{options.address}' is not an IPv6 address or prefix")
+        try:
+            base = options.server or self.rdap_server(network, options.timeout)
+            query = str(network.network_address) if network.prefixlen == 128 else str(network)
+            document, url = self.fetch_json(urllib.parse.urljoin(base.rstrip("/") + "/", f"ip/{query}"),
+                                            options.timeout, "application/rdap+json")
+        except (OSError, ValueError, LookupError, ConnectionError, http.client.HTTPException) as e:
+            self.logger.error(f"RDAP lookup failed: {e}")
+            return 1
+
+        if options.raw:
+            sys.stdout.write(json.dumps(document, indent=2) + "\n")
+            return 0
+        summary = self.rdap_summary(document)
+        if options.json:
+            sys.stdout.write(json.dumps(dict(summary, source=url), indent=2) + "\n")
+            return 0
+        lines = [
+            f"RDAP for {options.address} ({url}):",
+            f"  Range:        {', '.join(summary['prefixes']) or '?'} ({summary['handle']})",
+            f"  Name:         {summary['name']}",
+            f"  Type:         {summary['type'] or ', '.join(summary['status'])}",
+            f"  Country:      {summary['country'] or '?'}",
+            f"  Holder:       {summary['holder'] or '?'}",
+            f"  Registered:   {summary['registered'][:10] or '?'}",
+            f"  Last changed: {summary['last_changed'][:10] or '?'}",
+        ]
+        for contact in summary["abuse"] or [{"name": "none listed", "email": "", "phone": ""}]:
+            lines.append("  Abuse:        " + ", ".join(value for value in (contact["name"], contact["email"],
+                                                                            contact["phone"]) if value))
+        for contact in summary["contacts"]:
+            roles = [role for role in contact["roles"] if role not in ("registrant", "abuse")]
+            if roles:
+                lines.append(f"  {roles[0].capitalize() + ':':<14}{contact['name'] or contact['handle']}"
+                             + (f", {contact['email']}" if contact["email"] else ""))
+        sys.stdout.write("\n".join(lines) + "\n")
+        return 0
+
+    def ripestat(self, endpoint: str, resource: str, timeout: float, **parameters: str) -> dict:
+        """Query a RIPEstat data call and return its data object."""
+        query = urllib.parse.urlencode({"resource": resource, **parameters, "sourceapp": "ipv6_tester"})
+        document, _ = self.fetch_json(f"{self.RIPESTAT_URL}{endpoint}/data.json?{query}", timeout)
+        if document.get("status") not in (None, "ok"):
+            messages = [message[1] for message in document.get("messages", []) if len(message) > 1]
+            raise ConnectionError(f"RIPEstat {endpoint}: {'; '.join(messages) or document['status']}")
+        return document.get("data", {})
+
+    def rtr_vrps(self, host: str, port: int, timeout: float) -> List[Tuple[ipaddress.IPv6Network, int, int]]:
+        """Fetch the IPv6 validated ROA payloads from an RPKI-to-Router cache (RFC 8210, or RFC 6810)."""
+        for version in (1, 0):
+            vrps = []
+            with socket.create_connection((host, port), timeout=timeout) as sock:
+                # Reset Query: send the full set of VRPs
+                sock.sendall(struct.pack("!BBHI", version, 2, 0, 8))
+                while True:
+                    _, pdu_type, field, length = struct.unpack("!BBHI", self.recv_exactly(sock, 8))
+                    body = self.recv_exactly(sock, length - 8)
+                    if pdu_type == 10:
+                        # Error Report; code 4 means the cache does not speak this protocol version
+                        if field == 4 and version == 1:
+                            break
+                        raise ConnectionError(f"RTR error report {field}")
+                    if pdu_type == 8:
+                        raise ConnectionError("RTR cache has no data yet (Cache Reset)")
+                    if pdu_type == 6:
+                        flags, prefix_length, max_length, _, prefix, asn = struct.unpack("!BBBB16sI", body)
+                        # Only announcements; a reset response carries no withdrawals
+                        if flags & 1:
+                            vrps.append((ipaddress.IPv6Network((prefix, prefix_length)), max_length, asn))
+                    if pdu_type == 7:
+                        return vrps
+        raise ConnectionError("RTR cache supports neither protocol version 1 nor 0")
+
+    def rpki_state(self, prefix: ipaddress.IPv6Network, origin: int,
+                   vrps: List[Tuple[ipaddress.IPv6Network, int, int]]) -> str:
+        """Classify a route against validated ROA payloads (RFC 6811)."""
+        covering = [(vrp, max_length, asn) for vrp, max_length, asn in vrps if prefix.subnet_of(vrp)]
+        if not covering:
+            return "unknown"
+        if any(asn == origin and asn != 0 and prefix.prefixlen <= max_length for _, max_length, asn in covering):
+            return "valid"
+        if any(asn == origin for _, _, asn in covering):
+            return "invalid_length"
+        return "invalid_asn"
+
+    def run_bgp(self, args: List[str]) -> int:
+        """Report the BGP route covering an IPv6 address, as seen by RIPE RIS."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py bgp",
+                                         description="Look up the BGP route covering an IPv6 address in RIPE RIS "
+                                                     "(via the RIPEstat API): the announced prefix, origin AS and how "
+                                                     "many route collector peers see it, and its RPKI validity. This "
+                                                     "tells whether a reachability failure is a routing problem or a "
+                                                     "host problem.")
+        parser.add_argument("address", help="IPv6 address or prefix")
+        parser.add_argument("--paths", type=int, default=0, metavar="N",
+                            help="Also show N sample AS paths from the RIS looking glass")
+        parser.add_argument("--rtr", metavar="HOST[:PORT]",
+                            help=f"Validate against a local RPKI cache over RTR (default port: {self.RTR_PORT}) "
+                                 f"instead of the RIPEstat validator")
+        parser.add_argument("--no-rpki", action="store_true", help="Skip the RPKI validity check")
+        parser.add_argument("--json", action="store_true", help="Print the result as JSON")
+        parser.add_argument("--timeout", type=float, default=15.0, help="Timeout in seconds (default: 15)")
+        options = parser.parse_args(args)
+
+        try:
+            network = ipaddress.IPv6Network(options.address.split("%")[0], strict=False)
+        except ValueError:
+            parser.error(f"'{options.address}' is not an IPv6 address or prefix")
+        resource = str(network.network_address) if network.prefixlen == 128 else str(network)
+        try:
+            overview = self.ripestat("prefix-overview", resource, options.timeout)
+            result = {
+                "resource": resource,
+                "announced": bool(overview.get("announced")),
+                "prefix": overview.get("resource", "") if overview.get("announced") else "",
+                "origins": [{"asn": asn.get("asn"), "holder": asn.get("holder", "")}
+                            for asn in overview.get("asns", [])],
+                "visibility": None,
+                "paths": [],
+            }
+            if result["announced"]:
+                status = self.ripestat("routing-status", result["prefix"], options.timeout)
+                visibility = status.get("visibility", {}).get("v6", {})
+                if visibility.get("total_ris_peers"):
+                    result["visibility"] = {"seeing": visibility.get("ris_peers_seeing", 0),
+                                            "total": visibility["total_ris_peers"]}
+                result["first_seen"] = (status.get("first_seen") or {}).get("time", "")
+                result["more_specifics"] = [entry.get("prefix", "") for entry in status.get("more_specifics", [])]
+                if not options.no_rpki:
+                    prefix = ipaddress.IPv6Network(result["prefix"])
+                    vrps = None
+                    if options.rtr:
+                        parts = urllib.parse.urlsplit(f"//{options.rtr}")
+                        vrps = self.rtr_vrps(parts.hostname, parts.port or self.RTR_PORT, options.timeout)
+                    for origin in result["origins"]:
+                        if vrps is not None:
+                            origin["rpki"] = self.rpki_state(prefix, int(origin["asn"]), vrps)
+                        else:
+                            validation = self.ripestat("rpki-validation", str(origin["asn"]), options.timeout,
+                                                       prefix=result["prefix"])
+                            origin["rpki"] = validation.get("status", "unknown")
+                if options.paths:
+                    glass = self.ripestat("looking-glass", result["prefix"], options.timeout)
+                    for collector in glass.get("rrcs", []):
+                        for peer in collector.get("peers", []):
+                            if len(result["paths"]) < options.paths:
+                                result["paths"].append(f"{collector.get('rrc', '?')}: {peer.get('as_path', '')}")
+        except (OSError, ValueError, LookupError, ConnectionError, http.client.HTTPException) as e:
+            self.logger.error(f"BGP lookup failed: {e}")
+            return 1
+
+        if not result["announced"]:
+            verdict = "no announced route covers this address; traffic to it cannot be delivered (routing problem)"
+        elif (any(origin.get("rpki", "").startswith("invalid") for origin in result["origins"])
+              and not any(origin.get("rpki") == "valid" for origin in result["origins"])):
+            verdict = "the route is RPKI invalid; networks that drop invalid routes cannot reach it (routing problem)"
+        elif result["visibility"] and result["visibility"]["seeing"] * 2 < result["visibility"]["total"]:
+            verdict = "the route is only partly visible; failures from some networks are likely a routing problem"
+        else:
+            verdict = "the route is widely visible; reachability failures are more likely a host or firewall problem"
+        result["verdict"] = verdict
+        if options.json:
+            sys.stdout.write(json.dumps(result, indent=2) + "\n")
+            return 0 if result["announced"] else 1
+
+        lines = [f"BGP route for {resource} (RIPE RIS):"]
+        if result["announced"]:
+            lines.append(f"  Prefix:      {result['prefix']}")
+            lines += [f"  Origin:      AS{origin['asn']} {origin['holder']}".rstrip()
+                      + (f" (RPKI {origin['rpki']})" if "rpki" in origin else "") for origin in result["origins"]]
+            if result["visibility"]:
+                seeing, total = result["visibility"]["seeing"], result["visibility"]["total"]
+                lines.append(f"  Visibility:  {seeing}/{total} RIS peers ({seeing / total:.0%})")
+            if result.get("first_seen"):
+                lines.append(f"  First seen:  {result['first_seen'][:10]}")
+            if result.get("more_specifics"):
+                lines.append(f"  Specifics:   {', '.join(result['more_specifics'][:5])}"
+                             + (" ..." if len(result["more_specifics"]) > 5 else ""))
+            lines += [f"  Path {path}" for path in result["paths"]]
+        lines.append(f"Result: {verdict}")
+        sys.stdout.write("\n".join(lines) + "\n")
+        return 0 if result["announced"] else 1
+
+    def read_trace(self, path: str) -> List[Tuple[float, str, str, bytes]]:
+        """Parse a --trace hexdump (from either implementation) into (time, peer, direction, data) chunks."""
+        header = re.compile(r"^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d+) (\S+) (>>>|<<<) (\d+) bytes$")
+        chunks = []
+        with open(path) as f:
+            for line in f:
+                line = line.rstrip("\n")
+                match = header.match(line)
+                if match:
+                    when = datetime.datetime.strptime(match.group(1), "%Y-%m-%d %H:%M:%S.%f").timestamp()
+                    chunks.append((when, match.group(2), match.group(3), bytearray()))
+                elif line.startswith("  ") and chunks:
+                    # The hex columns are fixed width; the text column may contain anything
+                    chunks[-1][3].extend(bytes.fromhex(line[12:61]))
+        return [(when, peer, direction, bytes(data)) for when, peer, direction, data in chunks]
+
+    async def replay_session(self, ipv6_address: str, port: int, sends: List[Tuple[float, bytes]],
+                             expected: int, speed: float, timeout: float) -> bytes:
+        """Replay the client side of a session, preserving its timing, and collect what the server sends."""
+        reader, writer = await self.dial(ipv6_address, port)
+        reader, writer = self.trace(reader, writer, f"[{ipv6_address}]:{port}")
+        received = bytearray()
+
+        async def receive() -> None:
+            while chunk := await reader.read(65536):
+                received.extend(chunk)
+
+        loop = asyncio.get_running_loop()
+        task = asyncio.create_task(receive())
+        started = loop.time()
+        try:
+            for offset, data in sends:
+                if speed > 0:
+                    await asyncio.sleep(max(0.0, started + offset / speed - loop.time()))
+                writer.write(data)
+                await writer.drain()
+            # Wait until the server has sent as much as it did in the recording, closes, or goes quiet
+            deadline = loop.time() + timeout
+            while len(received) < expected and not task.done() and loop.time() < deadline:
+                await asyncio.sleep(0.05)
+        finally:
+            task.cancel()
+            writer.close()
+        return bytes(received)
+
+    def run_replay(self, args: List[str]) -> int:
+        """Replay a recorded client session against another server and compare the responses."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py replay",
+                                         description="Replay the client side of a session recorded with --trace "
+                                                     "against another server, with the original timing or faster, "
+                                                     "and compare the server's responses with the recording. Useful "
+                                                     "for reproducing a failure seen on one IPv6 path on another.")
+        parser.add_argument("recording", help="Trace file written with --trace by either implementation")
+        parser.add_argument("address", help="IPv6 address of the server to replay against")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Server port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--peer", help="Session to replay, as written in the trace, e.g. [::1]:8080 "
+                                           "(default: the first one)")
+        parser.add_argument("--recorded-by", choices=["client", "server"], default="client",
+                            help="Which end wrote the trace (default: client)")
+        parser.add_argument("--speed", type=float, default=1.0,
+                            help="Timing factor: 2 replays twice as fast, 0 sends without delays (default: 1)")
+        parser.add_argument("--list", action="store_true", help="List the sessions in the recording and exit")
+        parser.add_argument("--timeout", type=float, default=5.0,
+                            help="Seconds to wait for responses after the last send (default: 5)")
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump the replayed session to FILE")
+        options = parser.parse_args(args)
+
+        try:
+            chunks = self.read_trace(options.recording)
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Cannot read {options.recording}: {e}")
+            return 1
+        peers = list(dict.fromkeys(peer for _, peer, _, _ in chunks))
+        if options.list or not peers:
+            for peer in peers:
+                session = [chunk for chunk in chunks if chunk[1] == peer]
+                self.logger.info(f"{peer}: {len(session)} chunks, {sum(len(chunk[3]) for chunk in session)} bytes")
+            if not peers:
+                self.logger.error(f"No sessions in {options.recording}")
+            return 0 if peers else 1
+        peer = options.peer or peers[0]
+        if peer not in peers:
+            self.logger.error(f"No session with {peer} in {options.recording}; use --list")
+            return 1
+
+        # A client trace records its own sends as >>>, a server trace records them as <<<
+        sent = ">>>" if options.recorded_by == "client" else "<<<"
+        session = [chunk for chunk in chunks if chunk[1] == peer]
+        sends = [(when - session[0][0], data) for when, _, direction, data in session if direction == sent]
+        recorded = b"".join(data for _, _, direction, data in session if direction != sent)
+        if options.trace and not self.open_tracer(options.trace):
+            return 1
+
+        self.logger.info(f"Replaying {len(sends)} writes ({sum(len(data) for _, data in sends)} bytes) from the "
+                         f"session with {peer} against [{options.address}]:{options.port}"
+                         + (f" at {options.speed:g}x speed" if options.speed > 0 else " without delays"))
+        try:
+            replayed = asyncio.run(self.replay_session(options.address, options.port, sends, len(recorded),
+                                                       options.speed, options.timeout))
+        except OSError as e:
+            self.logger.error(f"Replay failed: {e}")
+            return 1
+
+        self.logger.info(f"Received {len(replayed)} bytes (recorded: {len(recorded)})")
+        if replayed == recorded:
+            self.logger.info("Result: responses identical to the recording")
+            return 0
+        for pattern, replacement in self.REPLAY_VOLATILE:
+            recorded, replayed = pattern.sub(replacement, recorded), pattern.sub(replacement, replayed)
+        if replayed == recorded:
+            self.logger.info("Result: responses match the recording apart from timestamps and server addresses")
+            return 0
+        position = next((index for index, (a, b) in enumerate(zip(recorded, replayed)) if a != b),
+                        min(len(recorded), len(replayed)))
+
+        def line_at(data: bytes) -> str:
+            start = data.rfind(b"\n", 0, position) + 1
+            end = data.find(b"\n", position)
+            return repr(data[start:end if end >= 0 else len(data)].decode(errors="replace"))
+
+        self.logger.info(f"Result: responses differ from byte {position}")
+        self.logger.info(f"  Recorded: {line_at(recorded)}")
+        self.logger.info(f"  Replayed: {line_at(replayed)}")
+        return 1
+
+    def parse_weighted(self, text: str) -> List[Tuple[int, float]]:
+        """Parse 'value:weight,...' (weights default to 1) into a list of (value, weight)."""
+        choices = []
+        for item in text.split(","):
+            value, _, weight = item.strip().partition(":")
+            choices.append((int(value), float(weight) if weight else 1.0))
+        if not choices or any(weight < 0 for _, weight in choices) or not sum(weight for _, weight in choices):
+            raise ValueError(f"invalid weights in '{text}'")
+        return choices
+
+    def run_generate(self, args: List[str]) -> int:
+        """Send synthetic IPv6 traffic with a configurable size, burst, DSCP and protocol profile."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py generate",
+                                         description="Generate synthetic IPv6 traffic toward a sink (any UDP or TCP "
+                                                     "port that discards data) with a chosen packet size "
+                                                     "distribution, burstiness, DSCP markings and UDP/TCP mix, to "
+                                                     "exercise QoS policies and plan capacity. Weighted lists take "
+                                                     "the form value:weight,... e.g. --sizes 64:7,576:4,1400:1.")
+        parser.add_argument("address", help="IPv6 address of the sink")
+        parser.add_argument("port", nargs="?", type=int, default=9, help="Sink port (default: 9, discard)")
+        parser.add_argument("--profile", choices=sorted(self.GENERATE_PROFILES), default="imix",
+                            help="Starting profile; the options below override it (default: imix)")
+        parser.add_argument("--sizes", help="Weighted payload sizes in bytes")
+        parser.add_argument("--dscp", help="Weighted DSCP values, e.g. 46:1,0:3")
+        parser.add_argument("--mix", help="Weighted protocols, e.g. udp:4,tcp:1")
+        parser.add_argument("--rate", type=float, help="Average packets per second (0 for as fast as possible)")
+        parser.add_argument("--burst", type=int, help="Packets sent back to back in each burst")
+        parser.add_argument("--duration", type=float, default=10.0, help="Seconds to run (default: 10)")
+        parser.add_argument("--seed", type=int, help="Random seed, to repeat an identical packet sequence")
+        parser.add_argument("--sndbuf", type=int, default=0, metavar="BYTES",
+                            help="Socket send buffer size (default: the kernel's)")
+        options = parser.parse_args(args)
+
+        profile = dict(self.GENERATE_PROFILES[options.profile])
+        for name in ("sizes", "dscp", "mix", "rate", "burst"):
+            if getattr(options, name) is not None:
+                profile[name] = getattr(options, name)
+        try:
+            sizes = self.parse_weighted(profile["sizes"])
+            dscps = self.parse_weighted(profile["dscp"])
+            protocols = [(name.strip(), float(weight) if weight else 1.0) for name, _, weight
+                         in (item.partition(":") for item in profile["mix"].split(","))]
+        except ValueError as e:
+            parser.error(str(e))
+        if any(name not in ("udp", "tcp") for name, _ in protocols):
+            parser.error("--mix accepts only udp and tcp")
+        if any(not 0 <= dscp <= 63 for dscp, _ in dscps) or any(not 1 <= size <= 65000 for size, _ in sizes):
+            parser.error("DSCP values must be 0-63 and sizes 1-65000 bytes")
+
+        rng = random.Random(options.seed)
+        payload = bytes(rng.getrandbits(8) for _ in range(max(size for size, _ in sizes)))
+        udp_sockets, tcp_sockets = {}, {}
+        stats = {}
+        try:
+            # One socket per protocol and DSCP value, so every packet carries its own traffic class
+            for dscp, _ in dscps:
+                for name, _ in protocols:
+                    kind = socket.SOCK_DGRAM if name == "udp" else socket.SOCK_STREAM
+                    sock = socket.socket(socket.AF_INET6, kind)
+                    (udp_sockets if name == "udp" else tcp_sockets)[dscp] = sock
+                    sock.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_TCLASS", 67), dscp << 2)
+                    self.set_buffer_sizes(sock, options.sndbuf, 0)
+                    sock.connect((options.address, options.port))
+        except OSError as e:
+            self.logger.error(f"Cannot open a connection to [{options.address}]:{options.port}: {e}")
+            for sock in [*udp_sockets.values(), *tcp_sockets.values()]:
+                sock.close()
+            return 1
+
+        burst = max(1, int(profile["burst"]))
+        gap = burst / profile["rate"] if profile["rate"] > 0 else 0.0
+        self.logger.info(f"Generating '{options.profile}' traffic to [{options.address}]:{options.port} for "
+                         f"{options.duration:g} s: sizes {profile['sizes']}, DSCP {profile['dscp']}, "
+                         f"mix {profile['mix']}, "
+                         + (f"{profile['rate']:g} pps in bursts of {burst}" if gap else "as fast as possible"))
+        started = time.monotonic()
+        next_burst = started
+        try:
+            while time.monotonic() - started < options.duration:
+                for _ in range(burst):
+                    size = rng.choices([size for size, _ in sizes], [weight for _, weight in sizes])[0]
+                    dscp = rng.choices([dscp for dscp, _ in dscps], [weight for _, weight in dscps])[0]
+                    name = rng.choices([name for name, _ in protocols], [weight for _, weight in protocols])[0]
+                    sock = udp_sockets[dscp] if name == "udp" else tcp_sockets[dscp]
+                    try:
+                        sent = sock.send(payload[:size])
+                    except (ConnectionRefusedError, BlockingIOError):
+                        # An ICMP port unreachable from a previous UDP datagram; keep going
+                        sent = 0
+                    entry = stats.setdefault((name, dscp), [0, 0])
+                    entry[0] += 1 if sent else 0
+                    entry[1] += sent
+                if gap:
+                    next_burst += gap
+                    time.sleep(max(0.0, next_burst - time.monotonic()))
+        except KeyboardInterrupt:
+            pass
+        except OSError as e:
+            self.logger.error(f"Send failed: {e}")
+            return 1
+        finally:
+            for sock in [*udp_sockets.values(), *tcp_sockets.values()]:
+                sock.close()
+
+        elapsed = time.monotonic() - started
+        packets = sum(entry[0] for entry in stats.values())
+        total = sum(entry[1] for entry in stats.values())
+        self.logger.info(f"\nSent {packets} packets, {total} bytes in {elapsed:.1f} s "
+                         f"({packets / elapsed:.0f} pps, {total * 8 / elapsed / 1e6:.2f} Mbit/s payload)")
+        for (name, dscp), (count, size) in sorted(stats.items()):
+            self.logger.info(f"  {name.upper()} DSCP {dscp:>2}: {count:>8} packets {size:>12} bytes")
+        return 0
+
+    async def run_sink_server(self, address: str, port: int, interval: float, stats: dict, rcvbuf: int = 0) -> None:
+        """Discard TCP and UDP traffic on one port, counting it per source in stats, until interrupted."""
+        loop = asyncio.get_running_loop()
+        tester = self
+
+        def entry(source: str) -> dict:
+            return stats.setdefault(source, {"udp_packets": 0, "udp_bytes": 0, "tcp_bytes": 0,
+                                             "tcp_connections": 0, "dscp": {}})
+
+        # Every connection reads into the same large buffer: the data is dropped anyway, and no bytes
+        # objects are allocated per read
+        discard_buffer = memoryview(bytearray(self.DISCARD_BUFFER_SIZE))
+
+        class Discard(asyncio.BufferedProtocol):
+            def connection_made(self, transport):
+                self.source = transport.get_extra_info("peername")[0]
+                entry(self.source)["tcp_connections"] += 1
+                tester.logger.info(f"TCP connection from [{self.source}]")
+
+            def get_buffer(self, sizehint):
+                return discard_buffer
+
+            def buffer_updated(self, nbytes):
+                entry(self.source)["tcp_bytes"] += nbytes
+
+        udp = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+        udp.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 1)
+        udp.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_RECVTCLASS", 66), 1)
+        udp.bind((address, port))
+        udp.setblocking(False)
+        self.set_buffer_sizes(udp, 0, rcvbuf)
+        ancillary_size = socket.CMSG_SPACE(4)
+
+        def drain() -> None:
+            # Read everything queued, so the socket buffer never overflows between wakeups
+            while True:
+                try:
+                    data, ancillary, _, sender = udp.recvmsg(65535, ancillary_size)
+                except (BlockingIOError, InterruptedError):
+                    return
+                counters = entry(sender[0])
+                counters["udp_packets"] += 1
+                counters["udp_bytes"] += len(data)
+                for level, kind, value in ancillary:
+                    if level == socket.IPPROTO_IPV6 and len(value) >= 4:
+                        dscp = int.from_bytes(value[:4], sys.byteorder) >> 2
+                        counters["dscp"][dscp] = counters["dscp"].get(dscp, 0) + 1
+
+        loop.add_reader(udp.fileno(), drain)
+        server = await loop.create_server(Discard, address, port, family=socket.AF_INET6)
+        for listener in server.sockets:
+            self.set_buffer_sizes(listener, 0, rcvbuf)
+        self.logger.info(f"Sink discarding TCP and UDP on [{address}]:{port}")
+        previous = {}
+        try:
+            while True:
+                await asyncio.sleep(interval)
+                for source, counters in stats.items():
+                    last = previous.get(source, {"udp_packets": 0, "udp_bytes": 0, "tcp_bytes": 0})
+                    packets = counters["udp_packets"] - last["udp_packets"]
+                    udp_bytes = counters["udp_bytes"] - last["udp_bytes"]
+                    tcp_bytes = counters["tcp_bytes"] - last["tcp_bytes"]
+                    if packets or tcp_bytes:
+                        self.logger.info(f"[{source}] UDP {packets / interval:.0f} pkt/s "
+                                         f"{udp_bytes * 8 / interval / 1e6:.2f} Mbit/s, "
+                                         f"TCP {tcp_bytes * 8 / interval / 1e6:.2f} Mbit/s")
+                    previous[source] = dict(counters)
+        finally:
+            loop.remove_reader(udp.fileno())
+            udp.close()
+            server.close()
+
+    def run_sink(self, args: List[str]) -> int:
+        """Run a discard server that counts what it receives per source."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py sink",
+                                         description="Accept TCP connections and UDP datagrams on one port and discard "
+                                                     "the data as fast as possible, counting bytes, packets and DSCP "
+                                                     "markings per source. The receiving end for generate and "
+                                                     "throughput tests, without echo overhead.")
+        parser.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        parser.add_argument("port", nargs="?", type=int, default=9, help="Port to listen on (default: 9, discard)")
+        parser.add_argument("--interval", type=float, default=5.0, help="Seconds between reports (default: 5)")
+        parser.add_argument("--rcvbuf", type=int, default=0, metavar="BYTES",
+                            help="Socket receive buffer size, for TCP and UDP (default: the kernel's)")
+        options = parser.parse_args(args)
+
+        stats = {}
+        try:
+            asyncio.run(self.run_sink_server(options.ipv6_address, options.port, options.interval, stats,
+                                             options.rcvbuf))
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+        except OSError as e:
+            self.logger.error(f"Server error: {e}")
+            return 1
+        for source, counters in stats.items():
+            dscp = " ".join(f"{value}:{count}" for value, count in sorted(counters["dscp"].items()))
+            self.logger.info(f"[{source}] UDP {counters['udp_packets']} packets {counters['udp_bytes']} bytes, "
+                             f"TCP {counters['tcp_bytes']} bytes in {counters['tcp_connections']} connections"
+                             + (f", UDP DSCP {dscp}" if dscp else ""))
+        return 0
+
+    def chargen_line(self, index: int) -> bytes:
+        """Return line index of the rotating 72-character chargen pattern (RFC 864)."""
+        characters = bytes(range(0x20, 0x7f))
+        start = index % len(characters)
+        return (characters + characters)[start:start + 72] + b"\r\n"
+
+    def classic_reply(self, service: str, data: bytes = b"") -> bytes:
+        """Build the reply of a stateless classic service; echo returns data unchanged."""
+        if service == "echo":
+            return data
+        if service == "daytime":
+            return time.strftime("%A, %B %d, %Y %H:%M:%S-%Z").encode() + b"\r\n"
+        if service == "time":
+            # Seconds since 1900-01-01, truncated to 32 bits (RFC 868)
+            return struct.pack("!I", (int(time.time()) + 2208988800) & 0xffffffff)
+        if service == "chargen":
+            # A UDP reply carries a random number of characters between 0 and 512
+            lines = b"".join(self.chargen_line(index) for index in range(8))
+            return lines[:random.randint(0, 512)]
+        return b""
+
+    async def run_classic_services(self, address: str, services: List[Tuple[str, int]], tcp: bool,
+                                   udp: bool) -> None:
+        """Serve the classic small services on their listeners until interrupted."""
+        loop = asyncio.get_running_loop()
+        tester = self
+
+        async def handle(reader: asyncio.StreamReader, writer: asyncio.StreamWriter, service: str) -> None:
+            peer = writer.get_extra_info("peername")
+            self.logger.info(f"{service}/tcp connection from [{peer[0]}]:{peer[1]}")
+            try:
+                if service in ("daytime", "time"):
+                    writer.write(self.classic_reply(service))
+                elif service == "chargen":
+                    # Runs until the client resets the connection
+                    index = 0
+                    while True:
+                        writer.write(b"".join(self.chargen_line(index + offset) for offset in range(64)))
+                        index += 64
+                        await writer.drain()
+                else:
+                    while data := await reader.read(self.DISCARD_BUFFER_SIZE):
+                        if service == "echo":
+                            writer.write(data)
+                            await writer.drain()
+                await writer.drain()
+            except (ConnectionError, OSError):
+                pass
+            finally:
+                writer.close()
+
+        ports = {port for _, port in services}
+        buckets = {}
+
+        class Datagram(asyncio.DatagramProtocol):
+            def __init__(self, service: str):
+                self.service = service
+
+            def connection_made(self, transport):
+                self.transport = transport
+
+            def datagram_received(self, data, addr):
+                if self.service == "discard":
+                    return
+                # A datagram "from" another small service is spoofed to start a reply loop between the two
+                # (echo and chargen, CVE-1999-0103); real clients use ephemeral ports
+                if addr[1] < 1024 or addr[1] in ports:
+                    return
+                if addr[0] not in buckets and len(buckets) >= tester.CLASSIC_UDP_MAX_SOURCES:
+                    buckets.clear()
+                bucket = buckets.setdefault(addr[0], TokenBucket(tester.CLASSIC_UDP_RATE, tester.clock))
+                reply = tester.classic_reply(self.service, data)
+                if bucket.take(len(reply)) == 0:
+                    self.transport.sendto(reply, addr)
+
+        servers, transports = [], []
+        for service, port in services:
+            if tcp:
+                # A large stream limit lets each read take a whole socket buffer's worth
+                servers.append(await asyncio.start_server(lambda r, w, service=service: handle(r, w, service),
+                                                          address, port, family=socket.AF_INET6,
+                                                          limit=self.DISCARD_BUFFER_SIZE))
+            if udp:
+                transport, _ = await loop.create_datagram_endpoint(lambda service=service: Datagram(service),
+                                                                   local_addr=(address, port),
+                                                                   family=socket.AF_INET6)
+                transports.append(transport)
+            protocols = "/".join(name for name, enabled in (("tcp", tcp), ("udp", udp)) if enabled)
+            self.logger.info(f"{service} ({protocols}) on [{address}]:{port}")
+        try:
+            await asyncio.gather(*(server.serve_forever() for server in servers), asyncio.Event().wait())
+        finally:
+            for transport in transports:
+                transport.close()
+
+    def run_inetd(self, args: List[str]) -> int:
+        """Run the classic inetd small services over IPv6."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py inetd",
+                                         description="Serve the classic inetd small services (echo RFC 862, discard "
+                                                     "RFC 863, chargen RFC 864, daytime RFC 867, time RFC 868) over "
+                                                     "TCP6, and UDP6 with --udp, to validate bidirectional IPv6 "
+                                                     "data flow with third-party clients such as nc and telnet.")
+        parser.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        parser.add_argument("--service", action="append", metavar="NAME[:PORT]",
+                            help=f"Service to run, optionally on a non-standard port (repeatable; default: all of "
+                                 f"{', '.join(f'{name}:{port}' for name, port in self.CLASSIC_SERVICES.items())})")
+        parser.add_argument("--udp", action="store_true",
+                            help="Also listen on UDP; replies to each source are rate limited, and datagrams from "
+                                 "ports below 1024 are ignored")
+        parser.add_argument("--udp-only", action="store_true", help="Only listen on UDP (implies --udp)")
+        options = parser.parse_args(args)
+
+        services = []
+        for item in options.service or list(self.CLASSIC_SERVICES):
+            name, _, port = item.partition(":")
+            if name not in self.CLASSIC_SERVICES or (port and not port.isdigit()):
+                parser.error(f"invalid --service '{item}'; choose from {', '.join(self.CLASSIC_SERVICES)}")
+            services.append((name, int(port) if port else self.CLASSIC_SERVICES[name]))
+        try:
+            asyncio.run(self.run_classic_services(options.ipv6_address, services, not options.udp_only,
+                                                  options.udp or options.udp_only))
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+        except OSError as e:
+            self.logger.error(f"Server error: {e}" + (" (ports below 1024 need root; try --service echo:7007)"
+                                                      if isinstance(e, PermissionError) else ""))
+            return 1
+        return 0
+
+    def tcp_info_options(self, sock: socket.socket) -> Optional[Tuple[int, int, int]]:
+        """Return the negotiated option flags and send/receive window scales from TCP_INFO (Linux)."""
+        try:
+            info = sock.getsockopt(socket.IPPROTO_TCP, getattr(socket, "TCP_INFO", 11), 8)
+        except OSError:
+            return None
+        return info[5], info[6] & 0x0f, info[6] >> 4
+
+    def handshake_variants(self, host: str, port: int, payload: bytes, timeout: float) -> List[Tuple[str, str, str]]:
+        """Try the handshake variants against a listener; returns (status, variant, detail) per variant."""
+        address = socket.getaddrinfo(host, port, socket.AF_INET6, socket.SOCK_STREAM)[0][4]
+        results = []
+        try:
+            started = time.monotonic()
+            with socket.create_connection(address[:2], timeout=timeout) as sock:
+                elapsed = (time.monotonic() - started) * 1000
+                options = self.tcp_info_options(sock)
+        except OSError as e:
+            return [("FAIL", "Three-way handshake", str(e))]
+        if options is None:
+            results.append(("PASS", "Three-way handshake", f"{elapsed:.1f} ms (TCP_INFO unavailable)"))
+            return results
+        flags, send_scale, receive_scale = options
+        negotiated = [name for bit, name in ((1, "timestamps"), (2, "SACK"), (4, "window scaling")) if flags & bit]
+        missing = [name for bit, name in ((1, "timestamps"), (2, "SACK"), (4, "window scaling"))
+                   if not flags & bit]
+        detail = f"{elapsed:.1f} ms; options {', '.join(negotiated) or 'none'}"
+        if flags & 4:
+            detail += f" (scale {send_scale}/{receive_scale})"
+        if missing:
+            detail += f"; missing {', '.join(missing)}, stripped by a middlebox or unsupported by the server"
+        results.append(("PASS" if not missing else "WARN", "Three-way handshake", detail))
+
+        try:
+            with open("/proc/sys/net/ipv4/tcp_ecn") as f:
+                ecn_mode = f.read().strip()
+        except OSError:
+            ecn_mode = "?"
+        if ecn_mode != "1":
+            results.append(("SKIP", "ECN", f"not requested; set net.ipv4.tcp_ecn=1 to test (now {ecn_mode})"))
+        elif flags & 8:
+            results.append(("PASS", "ECN", "negotiated"))
+        else:
+            results.append(("WARN", "ECN", "requested but not negotiated; the server or a middlebox declined it"))
+
+        if not hasattr(socket, "MSG_FASTOPEN"):
+            results.append(("SKIP", "Fast Open", "MSG_FASTOPEN is not available on this platform"))
+        else:
+            # The first connection only fetches a cookie; the second can carry data in its SYN
+            detail = "no cookie; the server or a middlebox does not support TCP Fast Open"
+            status = "WARN"
+            for attempt in range(2):
+                try:
+                    with socket.socket(socket.AF_INET6, socket.SOCK_STREAM) as sock:
+                        sock.setblocking(False)
+                        try:
+                            sock.sendto(payload, socket.MSG_FASTOPEN, address)
+                        except BlockingIOError:
+                            # The SYN is out; wait for the handshake to finish
+                            if not select.select([], [sock], [], timeout)[1]:
+                                raise TimeoutError("handshake timed out")
+                        error = sock.getsockopt(socket.SOL_SOCKET, socket.SO_ERROR)
+                        if error:
+                            raise OSError(error, os.strerror(error))
+                        options = self.tcp_info_options(sock)
+                        if options and options[0] & 0x20:
+                            status, detail = "PASS", f"data in SYN acknowledged on connection {attempt + 1}"
+                            break
+                except OSError as e:
+                    status, detail = "FAIL", f"connection with data in SYN failed: {e}"
+                    break
+            results.append((status, "Fast Open", detail))
+
+        try:
+            with socket.create_connection(address[:2], timeout=timeout) as sock:
+                sock.sendall(payload)
+                sock.shutdown(socket.SHUT_WR)
+                received = 0
+                while data := sock.recv(65536):
+                    received += len(data)
+            if received:
+                results.append(("PASS", "Half-close", f"{received} bytes received after sending FIN"))
+            else:
+                results.append(("WARN", "Half-close", "connection closed without a response after FIN"))
+        except socket.timeout:
+            results.append(("WARN", "Half-close", "no response or close after sending FIN"))
+        except OSError as e:
+            results.append(("FAIL", "Half-close", f"reset after sending FIN: {e}"))
+        return results
+
+    def simultaneous_open(self, host: str, port: int, local_port: int, timeout: float) -> Tuple[bool, str]:
+        """Connect from a fixed port to a peer doing the same, so that the SYNs cross (RFC 9293 section 3.5)."""
+        address = socket.getaddrinfo(host, port, socket.AF_INET6, socket.SOCK_STREAM)[0][4]
+        deadline = time.monotonic() + timeout
+        attempts = refused = 0
+        while time.monotonic() < deadline:
+            attempts += 1
+            sock = socket.socket(socket.AF_INET6, socket.SOCK_STREAM)
+            try:
+                sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+                if hasattr(socket, "SO_REUSEPORT"):
+                    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEPORT, 1)
+                sock.bind(("::", local_port))
+                sock.settimeout(min(1.0, max(0.1, deadline - time.monotonic())))
+                sock.connect(address)
+                sock.sendall(b"SIMOPEN\n")
+                sock.settimeout(2.0)
+                reply = sock.recv(64)
+                return True, (f"connected after {attempts} attempts; peer sent {reply!r}" if reply
+                              else f"connected after {attempts} attempts")
+            except ConnectionRefusedError:
+                # The peer's stack answered our SYN with RST before its own SYN went out; retry
+                refused += 1
+                time.sleep(0.2)
+            except OSError:
+                pass
+            finally:
+                sock.close()
+        if refused == attempts:
+            return False, f"the peer answered all {attempts} SYNs with RST; is it running with this port as --local-port?"
+        return False, f"no connection after {attempts} attempts; a firewall on the path drops crossing SYNs"
+
+    def run_handshake(self, args: List[str]) -> int:
+        """Characterize how the IPv6 path treats unusual TCP handshakes."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py handshake",
+                                         description="Try edge-case TCP handshakes over IPv6 and report which "
+                                                     "variants survive the path: option negotiation (timestamps, "
+                                                     "SACK, window scaling, ECN), Fast Open data in SYN, and "
+                                                     "half-close. With --simultaneous, run it on both ends at once "
+                                                     "to test TCP simultaneous open.")
+        parser.add_argument("host", help="Hostname or IPv6 address of the listener (or the peer with --simultaneous)")
+        parser.add_argument("port", type=int, help="Port of the listener (or the peer's --local-port)")
+        parser.add_argument("--payload", default="HEAD / HTTP/1.0\r\n\r\n",
+                            help="Data to send in the Fast Open and half-close tests (default: an HTTP HEAD request)")
+        parser.add_argument("--simultaneous", action="store_true",
+                            help="Simultaneous open: connect from --local-port while the peer connects back")
+        parser.add_argument("--local-port", type=int, help="Local port for --simultaneous (default: same as port)")
+        parser.add_argument("--timeout", type=float, default=5.0,
+                            help="Timeout in seconds; with --simultaneous, how long to keep trying (default: 5)")
+        options = parser.parse_args(args)
+
+        try:
+            if options.simultaneous:
+                local_port = options.local_port or options.port
+                self.logger.info(f"Simultaneous open from port {local_port} to [{options.host}]:{options.port}; "
+                                 f"start the peer within {options.timeout:g} s")
+                success, detail = self.simultaneous_open(options.host, options.port, local_port, options.timeout)
+                self.logger.info(f"  [{'PASS' if success else 'FAIL'}] Simultaneous open: {detail}")
+                return 0 if success else 1
+            results = self.handshake_variants(options.host, options.port, options.payload.encode(), options.timeout)
+        except socket.gaierror as e:
+            self.logger.error(f"Cannot resolve {options.host} to an IPv6 address: {e}")
+            return 1
+        self.logger.info(f"TCP handshake variants with [{options.host}]:{options.port}:")
+        for status, variant, detail in results:
+            self.logger.info(f"  [{status}] {variant}: {detail}")
+        return 1 if any(status == "FAIL" for status, _, _ in results) else 0
+
+    def listen_queue(self, port: int) -> Optional[int]:
+        """Return the accept queue length of the IPv6 listener on port, from /proc/net/tcp6 on Linux."""
+        try:
+            with open("/proc/net/tcp6") as f:
+                for line in f.readlines()[1:]:
+                    fields = line.split()
+                    # For listeners rx_queue holds the connections waiting for accept()
+                    if fields[3] == "0A" and int(fields[1].rsplit(":", 1)[1], 16) == port:
+                        return int(fields[4].split(":")[1], 16)
+        except OSError:
+            pass
+        return None
+
+    def tcp_ext_counters(self) -> dict:
+        """Read the listen overflow and SYN cookie counters from /proc/net/netstat on Linux."""
+        counters = {}
+        try:
+            with open("/proc/net/netstat") as f:
+                lines = f.read().splitlines()
+            for names, values in zip(lines[::2], lines[1::2]):
+                if names.startswith("TcpExt:"):
+                    counters = dict(zip(names.split()[1:], (int(value) for value in values.split()[1:])))
+        except (OSError, ValueError):
+            pass
+        return {name: counters.get(name, 0) for name in ("ListenOverflows", "ListenDrops", "SyncookiesSent")}
+
+    async def report_queue_pressure(self, port: int, interval: float) -> None:
+        """Log accept queue depth and listen overflows for the server's port while they are non-zero."""
+        previous = self.tcp_ext_counters()
+        while True:
+            await asyncio.sleep(interval)
+            queue = self.listen_queue(port)
+            counters = self.tcp_ext_counters()
+            changes = {name: counters[name] - previous[name] for name in counters if counters[name] != previous[name]}
+            previous = counters
+            if queue or changes:
+                detail = f"accept queue {queue}" if queue is not None else "accept queue unknown"
+                if changes:
+                    # The kernel counters are host-wide, not per listener
+                    detail += ", host-wide " + ", ".join(f"{name} +{delta}" for name, delta in changes.items())
+                self.logger.warning(f"Queue pressure on port {port}: {detail}")
+
+    async def hold_connection(self, ipv6_address: str, port: int, mode: str, hold: float, trickle: float,
+                              connect_timeout: float, chunk: int = 1) -> dict:
+        """Open one connection and keep it without completing a request; returns what happened."""
+        loop = asyncio.get_running_loop()
+        started = loop.time()
+        try:
+            reader, writer = await asyncio.wait_for(self.dial(ipv6_address, port), connect_timeout)
+        except asyncio.TimeoutError:
+            return {"error": "connect timed out"}
+        except OSError as e:
+            return {"error": e.strerror or str(e)}
+        result = {"connect": loop.time() - started, "closed_after": None, "sent": 0, "reply": b""}
+        opened = loop.time()
+        try:
+            while loop.time() - opened < hold:
+                if mode == "partial":
+                    # A few bytes of a request line that never ends
+                    writer.write(b"X" * chunk)
+                    await writer.drain()
+                    result["sent"] += chunk
+                wait = min(trickle if mode == "partial" else hold, hold - (loop.time() - opened))
+                try:
+                    data = await asyncio.wait_for(reader.read(4096), max(0.0, wait))
+                except asyncio.TimeoutError:
+                    continue
+                if not data:
+                    result["closed_after"] = loop.time() - opened
+                    break
+                result["reply"] += data
+        except OSError:
+            result["closed_after"] = loop.time() - opened
+        finally:
+            writer.close()
+        return result
+
+    async def backlog_test(self, ipv6_address: str, port: int, count: int, rate: float, mode: str, hold: float,
+                           trickle: float, connect_timeout: float, chunk: int = 1) -> List[dict]:
+        """Open count connections at rate per second and hold them all."""
+        tasks = []
+        for index in range(count):
+            tasks.append(asyncio.create_task(
+                self.hold_connection(ipv6_address, port, mode, hold, trickle, connect_timeout, chunk)))
+            if (index + 1) % max(10, count // 10) == 0:
+                self.logger.info(f"  {index + 1}/{count} connections started")
+            await asyncio.sleep(1 / rate)
+        return await asyncio.gather(*tasks)
+
+    def run_backlog(self, args: List[str]) -> int:
+        """Stress a listener with connections that never complete the application handshake."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py backlog",
+                                         description="Open many IPv6 connections to a listener and hold them "
+                                                     "without sending a complete request (idle, or trickling one "
+                                                     "byte at a time), to check that its accept queue, SYN flood "
+                                                     "defenses and idle timeouts cope. Only run it against "
+                                                     "listeners you operate; run the server with --queue-report to "
+                                                     "watch the accept queue from the other side.")
+        parser.add_argument("ipv6_address", help="IPv6 address of the listener")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--count", type=int, default=100,
+                            help=f"Connections to open (default: 100, at most {self.BACKLOG_MAX_CONNECTIONS})")
+        parser.add_argument("--rate", type=float, default=20.0, help="New connections per second (default: 20)")
+        parser.add_argument("--mode", choices=["idle", "partial"], default="idle",
+                            help="idle sends nothing; partial trickles an unfinished request (default: idle)")
+        parser.add_argument("--hold", type=float, default=30.0, help="Seconds to hold each connection (default: 30)")
+        parser.add_argument("--trickle", type=float, default=5.0,
+                            help="Seconds between bytes in partial mode (default: 5)")
+        parser.add_argument("--connect-timeout", type=float, default=10.0,
+                            help="Seconds to wait for each handshake (default: 10)")
+        options = parser.parse_args(args)
+
+        if not 1 <= options.count <= self.BACKLOG_MAX_CONNECTIONS:
+            parser.error(f"--count must be between 1 and {self.BACKLOG_MAX_CONNECTIONS}")
+        if not 0 < options.rate <= 1000:
+            parser.error("--rate must be between 0 and 1000 connections per second")
+
+        self.logger.info(f"Opening {options.count} {options.mode} connections to [{options.ipv6_address}]:"
+                         f"{options.port} at {options.rate:g}/s, holding each for {options.hold:g} s")
+        try:
+            results = asyncio.run(self.backlog_test(options.ipv6_address, options.port, options.count,
+                                                    options.rate, options.mode, options.hold, options.trickle,
+                                                    options.connect_timeout))
+        except KeyboardInterrupt:
+            self.logger.info("\nInterrupted")
+            return 1
+
+        connected = sorted(result["connect"] * 1000 for result in results if "connect" in result)
+        errors = {}
+        for result in results:
+            if "error" in result:
+                errors[result["error"]] = errors.get(result["error"], 0) + 1
+        closed = sorted(result["closed_after"] for result in results if result.get("closed_after") is not None)
+        self.logger.info(f"\nConnected: {len(connected)}/{options.count}")
+        if connected:
+            self.logger.info(f"  Connect time min/median/p95/max = {connected[0]:.1f}/"
+                             f"{connected[len(connected) // 2]:.1f}/{connected[int(len(connected) * 0.95)]:.1f}/"
+                             f"{connected[-1]:.1f} ms")
+            slow = sum(1 for elapsed in connected if elapsed >= 900)
+            if slow:
+                self.logger.info(f"  {slow} handshakes took a second or more: SYNs were retransmitted because the "
+                                 f"listener's SYN or accept queue was full")
+        for error, number in errors.items():
+            self.logger.info(f"Failed: {number} ({error})")
+        if closed:
+            self.logger.info(f"Closed by the server before {options.hold:g} s: {len(closed)} "
+                             f"(first after {closed[0]:.1f} s); the listener enforces an idle or request timeout")
+        else:
+            self.logger.info("Closed by the server: none; the listener kept every incomplete connection open")
+        return 0 if not errors else 1
+
+    def run_slowloris(self, args: List[str]) -> int:
+        """Check that a listener drops clients that send requests extremely slowly."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py slowloris",
+                                         description="Hold a few IPv6 connections open while sending a request a "
+                                                     "byte or two at a time, slowloris style, and report whether and "
+                                                     "when the listener gives up on them. Use it to validate request "
+                                                     "and minimum data rate timeouts, such as the server's --min-rate, "
+                                                     "on listeners you operate.")
+        parser.add_argument("ipv6_address", help="IPv6 address of the listener")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Port (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--connections", type=int, default=10, help="Connections to hold (default: 10)")
+        parser.add_argument("--interval", type=float, default=10.0, help="Seconds between sends (default: 10)")
+        parser.add_argument("--bytes", type=int, default=1, help="Bytes in each send (default: 1)")
+        parser.add_argument("--duration", type=float, default=120.0,
+                            help="Seconds to keep each connection going (default: 120)")
+        parser.add_argument("--connect-timeout", type=float, default=10.0,
+                            help="Seconds to wait for each handshake (default: 10)")
+        options = parser.parse_args(args)
+
+        if not 1 <= options.connections <= self.BACKLOG_MAX_CONNECTIONS:
+            parser.error(f"--connections must be between 1 and {self.BACKLOG_MAX_CONNECTIONS}")
+        if options.interval <= 0 or options.bytes < 1:
+            parser.error("--interval must be positive and --bytes at least 1")
+
+        self.logger.info(f"Holding {options.connections} connections to [{options.ipv6_address}]:{options.port}, "
+                         f"sending {options.bytes} bytes every {options.interval:g} s "
+                         f"({options.bytes / options.interval:g} bytes/s) for up to {options.duration:g} s")
+        try:
+            results = asyncio.run(self.backlog_test(options.ipv6_address, options.port, options.connections, 10.0,
+                                                    "partial", options.duration, options.interval,
+                                                    options.connect_timeout, options.bytes))
+        except KeyboardInterrupt:
+            self.logger.info("\nInterrupted")
+            return 1
+
+        failed = [result for result in results if "error" in result]
+        for result in failed:
+            self.logger.info(f"  Connection failed: {result['error']}")
+        held = [result for result in results if "error" not in result]
+        closed = sorted((result for result in held if result["closed_after"] is not None),
+                        key=lambda result: result["closed_after"])
+        for result in closed:
+            reply = result["reply"].decode(errors="replace").strip()
+            self.logger.info(f"  Closed after {result['closed_after']:.1f} s and {result['sent']} bytes"
+                             + (f": {reply}" if reply else ""))
+        if not held:
+            return 1
+        if len(closed) == len(held):
+            self.logger.info(f"\nThe listener dropped all {len(held)} slow connections, the first after "
+                             f"{closed[0]['closed_after']:.1f} s and the last after {closed[-1]['closed_after']:.1f} s")
+            return 0
+        self.logger.info(f"\n{len(held) - len(closed)} of {len(held)} slow connections were still open after "
+                         f"{options.duration:g} s; the listener has no minimum data rate or request timeout that "
+                         f"catches {options.bytes / options.interval:g} bytes/s")
+        return 1
+
+    def raise_file_limit(self) -> int:
+        """Raise the soft open-file limit to the hard limit, and return the new soft limit."""
+        try:
+            import resource
+        except ImportError:
+            return 0
+        soft, hard = resource.getrlimit(resource.RLIMIT_NOFILE)
+        if hard == resource.RLIM_INFINITY or hard > soft:
+            try:
+                resource.setrlimit(resource.RLIMIT_NOFILE, (hard, hard))
+                soft = hard
+            except (ValueError, OSError):
+                pass
+        return soft
+
+    def memory_usage(self) -> Optional[int]:
+        """Return this process's resident set size in bytes, from /proc on Linux."""
+        try:
+            with open("/proc/self/status") as f:
+                for line in f:
+                    if line.startswith("VmRSS:"):
+                        return int(line.split()[1]) * 1024
+        except (OSError, ValueError, IndexError):
+            pass
+        return None
+
+    def memory_summary(self, connections: int, baseline: Optional[int]) -> str:
+        """Describe current memory use, and the increase per connection since baseline."""
+        rss = self.memory_usage()
+        if rss is None:
+            return "memory use unknown"
+        summary = f"RSS {rss / 1048576:.1f} MiB"
+        if baseline is not None and connections:
+            summary += f" ({(rss - baseline) / connections / 1024:.1f} KiB per connection)"
+        return summary
+
+    async def hold_idle_listener(self, address: str, port: int, interval: float) -> None:
+        """Accept connections and hold them with as little state as possible, reporting the count and memory."""
+        loop = asyncio.get_running_loop()
+        baseline = self.memory_usage()
+        held = {"now": 0, "peak": 0, "total": 0}
+
+        class Idle(asyncio.Protocol):
+            # A bare protocol instead of a stream pair: no reader, buffer or task per connection
+            def connection_made(self, transport):
+                self.transport = transport
+                held["now"] += 1
+                held["total"] += 1
+                held["peak"] = max(held["peak"], held["now"])
+
+            def data_received(self, data):
+                # Liveness probes from idle connect: answer each byte with one byte
+                self.transport.write(data[:1])
+
+            def connection_lost(self, exc):
+                held["now"] -= 1
+
+        server = await loop.create_server(Idle, address, port, family=socket.AF_INET6,
+                                          backlog=self.IDLE_LISTEN_BACKLOG)
+        self.logger.info(f"Holding idle connections on [{address}]:{port} "
+                         f"(open file limit {self.raise_file_limit()})")
+        try:
+            previous = None
+            while True:
+                await asyncio.sleep(interval)
+                if (held["now"], held["total"]) != previous:
+                    previous = held["now"], held["total"]
+                    self.logger.info(f"Holding {held['now']} connections (peak {held['peak']}, "
+                                     f"{held['total']} accepted); "
+                                     f"{self.memory_summary(held['now'], baseline)}")
+        finally:
+            server.close()
+
+    async def open_idle_connections(self, address: str, port: int, count: int, rate: float, sources: List[str],
+                                    hold: float, probe_interval: float, probe_timeout: float) -> Tuple[int, int]:
+        """Open count idle connections, probing them every probe_interval; returns (opened, alive at the end)."""
+        loop = asyncio.get_running_loop()
+        baseline = self.memory_usage()
+        connections = []
+        errors = {}
+
+        class Idle(asyncio.Protocol):
+            def __init__(self):
+                self.transport = None
+                self.answered = False
+                self.closed = False
+
+            def connection_made(self, transport):
+                self.transport = transport
+
+            def data_received(self, data):
+                self.answered = True
+
+            def connection_lost(self, exc):
+                self.closed = True
+
+        async def open_one(index: int) -> None:
+            source = sources[index % len(sources)] if sources else None
+            try:
+                _, protocol = await asyncio.wait_for(
+                    loop.create_connection(Idle, address, port, family=socket.AF_INET6,
+                                           local_addr=(source, 0) if source else None), probe_timeout)
+                connections.append(protocol)
+            except asyncio.TimeoutError:
+                errors["connect timed out"] = errors.get("connect timed out", 0) + 1
+            except OSError as e:
+                error = e.strerror or str(e)
+                errors[error] = errors.get(error, 0) + 1
+
+        started = loop.time()
+        tasks = []
+        for index in range(count):
+            tasks.append(asyncio.create_task(open_one(index)))
+            if (index + 1) % max(1000, count // 10) == 0:
+                self.logger.info(f"  {index + 1}/{count} connections started; "
+                                 f"{self.memory_summary(len(connections), baseline)}")
+            await asyncio.sleep(1 / rate)
+        await asyncio.gather(*tasks)
+        self.logger.info(f"Opened {len(connections)}/{count} connections in {loop.time() - started:.1f} s; "
+                         f"{self.memory_summary(len(connections), baseline)}")
+        for error, number in errors.items():
+            self.logger.info(f"  Failed: {number} ({error})")
+
+        alive = [protocol for protocol in connections if not protocol.closed]
+        deadline = loop.time() + hold
+        while alive and loop.time() < deadline:
+            await asyncio.sleep(max(0.0, min(probe_interval, deadline - loop.time())))
+            # One byte on every connection: silence means a device on the path forgot its state
+            for protocol in alive:
+                protocol.answered = False
+                if not protocol.closed:
+                    protocol.transport.write(b".")
+            await asyncio.sleep(probe_timeout)
+            reset = sum(1 for protocol in alive if protocol.closed)
+            silent = sum(1 for protocol in alive if not protocol.closed and not protocol.answered)
+            alive = [protocol for protocol in alive if protocol.answered and not protocol.closed]
+            self.logger.info(f"After {loop.time() - started:.0f} s: {len(alive)} alive, {reset} reset, "
+                             f"{silent} silent; {self.memory_summary(len(connections), baseline)}")
+        for protocol in connections:
+            if protocol.transport:
+                protocol.transport.abort()
+        return len(connections), len(alive)
+
+    def run_idle(self, args: List[str]) -> int:
+        """Hold very many idle IPv6 connections, to measure firewall and NAT state table capacity."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py idle",
+                                         description="Hold very many idle IPv6 TCP connections (100k and more) with "
+                                                     "as little memory per connection as possible. Run listen on one "
+                                                     "side of a firewall and connect on the other; connect probes "
+                                                     "every connection periodically, so connections whose state the "
+                                                     "firewall evicted show up as silent or reset.")
+        commands = parser.add_subparsers(dest="command", required=True)
+        listen = commands.add_parser("listen", help="Accept and hold connections")
+        listen.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        listen.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Port (default: {self.DEFAULT_PORT})")
+        listen.add_argument("--interval", type=float, default=10.0, help="Seconds between reports (default: 10)")
+        connect = commands.add_parser("connect", help="Open and hold connections")
+        connect.add_argument("ipv6_address", help="Address of the idle listener")
+        connect.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                             help=f"Port (default: {self.DEFAULT_PORT})")
+        connect.add_argument("--count", type=int, default=10000, help="Connections to open (default: 10000)")
+        connect.add_argument("--rate", type=float, default=500.0, help="New connections per second (default: 500)")
+        connect.add_argument("--source", action="append", default=[],
+                             help="Local source address (repeatable); each gives another ~28k ephemeral ports")
+        connect.add_argument("--hold", type=float, default=600.0,
+                             help="Seconds to hold the connections once open (default: 600)")
+        connect.add_argument("--probe-interval", type=float, default=60.0,
+                             help="Seconds between liveness probes (default: 60)")
+        connect.add_argument("--probe-timeout", type=float, default=5.0,
+                             help="Seconds to wait for probe answers and for each handshake (default: 5)")
+        options = parser.parse_args(args)
+
+        if options.command == "listen":
+            try:
+                asyncio.run(self.hold_idle_listener(options.ipv6_address, options.port, options.interval))
+            except KeyboardInterrupt:
+                self.logger.info("\nShutting down...")
+            except OSError as e:
+                self.logger.error(f"Server error: {e}")
+                return 1
+            return 0
+
+        try:
+            if options.count < 1 or options.rate <= 0:
+                parser.error("--count and --rate must be positive")
+            limit = self.raise_file_limit()
+            if limit and options.count > limit - 64:
+                self.logger.warning(f"The open file limit is {limit}; raise the hard limit (ulimit -Hn) to hold "
+                                    f"{options.count} connections")
+            self.logger.info(f"Opening {options.count} idle connections to [{options.ipv6_address}]:{options.port} "
+                             f"at {options.rate:g}/s from "
+                             + (", ".join(f"[{source}]" for source in options.source) if options.source
+                                else "the default source address"))
+            opened, alive = asyncio.run(self.open_idle_connections(
+                options.ipv6_address, options.port, options.count, options.rate, options.source, options.hold,
+                options.probe_interval, options.probe_timeout))
+        except KeyboardInterrupt:
+            self.logger.info("\nInterrupted")
+            return 1
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        return 0 if opened == options.count and alive == opened else 1
+
+    def time_calls(self, operation, duration: float, per_call: int = 1) -> float:
+        """Call operation repeatedly for about duration seconds and return operations per second."""
+        calls = 0
+        started = time.perf_counter()
+        while (elapsed := time.perf_counter() - started) < duration:
+            # Batches keep the clock reads out of the measurement
+            for _ in range(100):
+                operation()
+            calls += 100
+        return calls * per_call / elapsed
+
+    async def time_awaits(self, operation, duration: float, per_call: int = 1) -> float:
+        """Await operation() repeatedly for about duration seconds and return operations per second."""
+        calls = 0
+        started = time.perf_counter()
+        while (elapsed := time.perf_counter() - started) < duration:
+            await operation()
+            calls += 1
+        return calls * per_call / elapsed
+
+    async def loopback_benchmarks(self, duration: float) -> dict:
+        """Measure the server's connection handling and echo path against an in-process server on ::1."""
+        server = await asyncio.start_server(lambda r, w: self.handle_client(r, w, "::1"), "::1", 0,
+                                            family=socket.AF_INET6, limit=self.MAX_LINE_LENGTH)
+        port = server.sockets[0].getsockname()[1]
+        frame = f"ECHO 0 {zlib.crc32(b'x' * 64):08x} {'x' * 64}\n".encode()
+        results = {}
+
+        async def connection() -> None:
+            reader, writer = await asyncio.open_connection("::1", port, family=socket.AF_INET6)
+            writer.write(frame)
+            await reader.readline()
+            writer.close()
+            await writer.wait_closed()
+
+        results["loopback connections"] = await self.time_awaits(connection, duration)
+        reader, writer = await asyncio.open_connection("::1", port, family=socket.AF_INET6)
+
+        async def round_trip() -> None:
+            writer.write(frame)
+            await reader.readline()
+
+        results["loopback echo round trips"] = await self.time_awaits(round_trip, duration)
+        writer.close()
+        await writer.wait_closed()
+        server.close()
+        await server.wait_closed()
+        return results
+
+    def run_benchmarks(self, duration: float) -> dict:
+        """Run the micro-benchmarks and the loopback self-test; returns operations per second by name."""
+        results = {}
+        addresses = ["2001:db8::1", "2001:0db8:0000:0000:0000:ff00:0042:8329", "fe80::1%eth0", "::ffff:192.0.2.1",
+                     "2001:db8:1234::/48", "[2001:db8::5]"]
+        results["address parsing"] = self.time_calls(
+            lambda: [self.parse_address_or_prefix(text) for text in addresses], duration, len(addresses))
+        parsed = [ipaddress.IPv6Address(text) for text in ("2001:db8::1", "::ffff:192.0.2.1", "fe80::1%2")]
+        results["address formatting"] = self.time_calls(
+            lambda: [self.format_address(address) for address in parsed], duration, len(parsed))
+
+        query = DNSMessage(0x1234, DNSMessage.RD)
+        query.questions.append(("www.example.com.", DNS_TYPES["AAAA"], DNS_CLASS_IN))
+        query.answers.append(DNSRecord("www.example.com.", DNS_TYPES["AAAA"], DNS_CLASS_IN, 300,
+                                       ipaddress.IPv6Address("2001:db8::1").packed))
+        wire = query.encode()
+        results["DNS encode"] = self.time_calls(query.encode, duration)
+        results["DNS decode"] = self.time_calls(lambda: DNSMessage.decode(wire), duration)
+
+        lines = b"".join(f"ECHO {seq} 00000000 {'x' * 64}\n".encode() for seq in range(100))
+
+        async def framing() -> None:
+            # The server's line framing, fed from memory instead of a socket
+            reader = asyncio.StreamReader(limit=self.MAX_LINE_LENGTH)
+            reader.feed_data(lines)
+            reader.feed_eof()
+            pending = bytearray()
+            for _ in range(100):
+                await self.read_line(reader, pending)
+
+        async def run_async() -> None:
+            results["line framing"] = await self.time_awaits(framing, duration, 100)
+            results.update(await self.loopback_benchmarks(duration))
+
+        # The server logs every connection; keep that out of the output and the timing
+        level = self.logger.level
+        self.logger.setLevel(logging.WARNING)
+        try:
+            asyncio.run(run_async())
+        finally:
+            self.logger.setLevel(level)
+        return results
+
+    def run_bench(self, args: List[str]) -> int:
+        """Benchmark the tool's own hot paths and compare against a saved baseline."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py bench",
+                                         description="Measure operations per second for address parsing and "
+                                                     "formatting, DNS encoding, the server's line framing, and a "
+                                                     "loopback self-test of connection handling and echo over ::1, "
+                                                     "so that performance regressions in the tool itself are caught. "
+                                                     "Save a run with --json and pass it to --baseline later.")
+        parser.add_argument("--duration", type=float, default=1.0,
+                            help="Seconds to run each benchmark (default: 1)")
+        parser.add_argument("--json", action="store_true", help="Print the results as JSON, for use as a baseline")
+        parser.add_argument("--baseline", metavar="FILE", help="JSON results of an earlier run to compare against")
+        parser.add_argument("--tolerance", type=float, default=20.0,
+                            help="Percentage slowdown against the baseline that counts as a regression "
+                                 "(default: 20)")
+        options = parser.parse_args(args)
+
+        baseline = {}
+        if options.baseline:
+            try:
+                with open(options.baseline) as f:
+                    baseline = json.load(f)["results"]
+                if not isinstance(baseline, dict) or \
+                        not all(isinstance(rate, (int, float)) and rate > 0 for rate in baseline.values()):
+                    raise ValueError("results must map benchmark names to operations per second")
+            except (OSError, ValueError, KeyError, TypeError) as e:
+                self.logger.error(f"Cannot read baseline {options.baseline}: {e}")
+                return 1
+        try:
+            results = self.run_benchmarks(options.duration)
+        except OSError as e:
+            self.logger.error(f"Loopback self-test failed: {e} (is ::1 configured?)")
+            return 1
+
+        if options.json:
+            sys.stdout.write(json.dumps({"python": sys.version.split()[0], "results": results}, indent=2) + "\n")
+        regressions = 0
+        for name, rate in results.items():
+            line = f"  {name:<28} {rate:>14,.0f} ops/s"
+            if name in baseline:
+                change = (rate - baseline[name]) / baseline[name] * 100
+                line += f"  {change:+6.1f}%"
+                if change < -options.tolerance:
+                    line += "  REGRESSION"
+                    regressions += 1
+            if not options.json:
+                self.logger.info(line)
+        if regressions:
+            self.logger.info(f"{regressions} of {len(results)} benchmarks ran more than {options.tolerance:g}% "
+                             f"slower than {options.baseline}")
+        return 1 if regressions else 0
+
+    async def fleet_send(self, writer: asyncio.StreamWriter, message: dict) -> None:
+        """Send one fleet control message: a JSON object on a line of its own."""
+        writer.write(json.dumps(message).encode() + b"\n")
+        await writer.drain()
+
+    async def fleet_receive(self, reader: asyncio.StreamReader) -> Optional[dict]:
+        """Read one fleet control message; returns None when the other side closed the connection."""
+        line = await reader.readline()
+        if not line:
+            return None
+        message = json.loads(line)
+        if not isinstance(message, dict):
+            raise ValueError("fleet message is not a JSON object")
+        return message
+
+    async def fleet_probe(self, targets: List[dict], count: int) -> dict:
+        """Send count UDP echo probes to each target's agent, one at a time per target and all targets at once.
+
+        Returns probes sent and answered and the median round trip in milliseconds, by target name.
+        """
+        loop = asyncio.get_running_loop()
+
+        async def probe(target: dict) -> dict:
+            rtts = []
+            sock = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+            sock.setblocking(False)
+            try:
+                await loop.sock_connect(sock, (target["address"], int(target["port"])))
+                nonce = secrets.token_hex(4)
+                for sequence in range(count):
+                    payload = self.FLEET_PROBE_MAGIC + f" {nonce} {sequence}".encode()
+                    sent = loop.time()
+                    await loop.sock_sendall(sock, payload)
+                    # Skip late answers to earlier probes
+                    while (remaining := sent + self.FLEET_PROBE_TIMEOUT - loop.time()) > 0:
+                        try:
+                            data = await asyncio.wait_for(loop.sock_recv(sock, 64), remaining)
+                        except asyncio.TimeoutError:
+                            break
+                        if data == payload:
+                            rtts.append((loop.time() - sent) * 1000)
+                            break
+            except (OSError, KeyError, ValueError) as e:
+                return {"sent": count, "received": len(rtts), "rtt_ms": None, "error": str(e)}
+            finally:
+                sock.close()
+            rtts.sort()
+            return {"sent": count, "received": len(rtts), "rtt_ms": rtts[len(rtts) // 2] if rtts else None}
+
+        results = await asyncio.gather(*(probe(target) for target in targets))
+        return {target["name"]: result for target, result in zip(targets, results)}
+
+    def fleet_labels(self, agent: dict) -> str:
+        """Describe an agent by its site, ASN and address."""
+        return ", ".join(([f"site {agent['site']}"] if agent.get("site") else [])
+                         + ([f"AS{agent['asn']}"] if agent.get("asn") else []) + [f"[{agent['address']}]"])
+
+    def log_mesh(self, names: List[str], mesh: dict) -> None:
+        """Log the mesh as a matrix: one row per probing agent, one column per probed agent."""
+        width = max([12] + [len(name) + 2 for name in names])
+        self.logger.info("from / to".ljust(width) + "".join(f"{name:>{width}}" for name in names))
+        for source in names:
+            cells = []
+            for target in names:
+                result = mesh.get((source, target))
+                if source == target or result is None:
+                    cells.append(f"{'-':>{width}}")
+                elif not result["received"]:
+                    cells.append(f"{'lost':>{width}}")
+                else:
+                    loss = 100 * (result["sent"] - result["received"]) / result["sent"]
+                    cells.append(f"{result['rtt_ms']:.1f}ms/{loss:.0f}%".rjust(width))
+            self.logger.info(f"{source:<{width}}" + "".join(cells))
+
+    def mesh_csv(self, names: List[str], mesh: dict, metric: str) -> str:
+        """Format the mesh as a CSV matrix of median RTT in ms or loss in percent, ready for a heatmap."""
+        output = io.StringIO()
+        writer = csv.writer(output)
+        writer.writerow(["from/to"] + names)
+        for source in names:
+            row = [source]
+            for target in names:
+                result = mesh.get((source, target))
+                # Blank cells: the diagonal, missing results, and RTTs of pairs that lost every probe
+                if source == target or result is None or (metric == "rtt" and not result["received"]):
+                    row.append("")
+                elif metric == "loss":
+                    row.append(f"{100 * (result['sent'] - result['received']) / result['sent']:.0f}")
+                else:
+                    row.append(f"{result['rtt_ms']:.2f}")
+            writer.writerow(row)
+        return output.getvalue()
+
+    def mesh_dot(self, agents: dict, mesh: dict) -> str:
+        """Format the mesh as a GraphViz digraph, labeled with RTT and loss and colored by loss."""
+        lines = ["digraph mesh {", "  node [shape=box];"]
+        for name in sorted(agents):
+            label = "\\n".join([name] + ([str(agents[name]["site"])] if agents[name].get("site") else []))
+            lines.append(f'  "{name}" [label="{label}"];')
+        for (source, target), result in sorted(mesh.items()):
+            if source not in agents or target not in agents:
+                continue
+            if not result["received"]:
+                lines.append(f'  "{source}" -> "{target}" [label="lost", color=red, style=dashed];')
+                continue
+            loss = 100 * (result["sent"] - result["received"]) / result["sent"]
+            lines.append(f'  "{source}" -> "{target}" [label="{result["rtt_ms"]:.1f} ms\\n{loss:.0f}%", '
+                         f'color={"darkgreen" if not loss else "orange"}];')
+        lines.append("}")
+        return "\n".join(lines) + "\n"
+
+    def write_export(self, path: str, text: str) -> None:
+        """Replace path with text in one step, so a viewer polling the file never sees half of it."""
+        with open(f"{path}.tmp", "w", newline="") as f:
+            f.write(text)
+        os.replace(f"{path}.tmp", path)
+
+    async def run_fleet_coordinator(self, address: str, port: int, interval: float, count: int,
+                                    dot: Optional[str] = None, csv_path: Optional[str] = None,
+                                    csv_metric: str = "rtt") -> None:
+        """Accept agents, have each probe all the others every interval, and log the resulting mesh."""
+        agents = {}
+        mesh = {}
+        reported = set()
+        round_done = asyncio.Event()
+        round_number = 0
+
+        async def handle(reader: asyncio.StreamReader, writer: asyncio.StreamWriter) -> None:
+            peer = writer.get_extra_info("peername")[0]
+            name = None
+            # An agent that misses this many heartbeats is dropped from the mesh, even if its connection lingers
+            silence = self.FLEET_HEARTBEAT * self.FLEET_MISSED_HEARTBEATS
+            try:
+                hello = await asyncio.wait_for(self.fleet_receive(reader), self.READ_TIMEOUT)
+                if not hello or hello.get("type") != "register":
+                    return
+                # Agent names and sites follow the rules for session labels
+                requested = str(hello.get("name") or "")
+                probe_port = hello.get("probe_port")
+                site = hello.get("site")
+                asn = hello.get("asn")
+                if not self.SESSION_LABEL.fullmatch(requested) or requested in agents \
+                        or not isinstance(probe_port, int) or not 1 <= probe_port <= 65535 \
+                        or (site is not None and not self.SESSION_LABEL.fullmatch(str(site))) \
+                        or (asn is not None and not (isinstance(asn, int) and 0 < asn < 2 ** 32)):
+                    await self.fleet_send(writer, {"type": "error", "reason": f"name '{requested}' is taken, or "
+                                                                              f"the name, site, ASN or port is invalid"})
+                    return
+                name = requested
+                # Peers probe the address the agent connected from, so it can't point them at a third party
+                agents[name] = {"address": peer, "probe_port": probe_port, "writer": writer, "site": site, "asn": asn}
+                self.logger.info(f"Agent {name} registered: {self.fleet_labels(agents[name])}, probe port "
+                                 f"{probe_port} ({len(agents)} registered)")
+                await self.fleet_send(writer, {"type": "registered", "name": name,
+                                               "heartbeat": self.FLEET_HEARTBEAT})
+                while True:
+                    try:
+                        message = await asyncio.wait_for(self.fleet_receive(reader), silence)
+                    except asyncio.TimeoutError:
+                        self.logger.warning(f"Agent {name} sent no heartbeat for {silence} s; excluding it")
+                        break
+                    if message is None:
+                        break
+                    if message.get("type") == "result" and message.get("round") == round_number:
+                        for target, result in message.get("results", {}).items():
+                            mesh[(name, target)] = result
+                        reported.add(name)
+                        if reported >= set(agents):
+                            round_done.set()
+            except (OSError, ValueError, asyncio.TimeoutError) as e:
+                self.logger.info(f"Agent {name or f'[{peer}]'}: {e or 'timed out'}")
+            finally:
+                if name is not None:
+                    del agents[name]
+                    if agents and reported >= set(agents):
+                        # The round was only waiting for this agent
+                        round_done.set()
+                    self.logger.info(f"Agent {name} left ({len(agents)} registered)")
+                writer.close()
+
+        server = await asyncio.start_server(handle, address, port, family=socket.AF_INET6)
+        self.logger.info(f"Fleet coordinator listening on [{address}]:{port}; probing every {interval:g} s")
+        async with server:
+            while True:
+                await asyncio.sleep(interval)
+                if len(agents) < 2:
+                    self.logger.info(f"Waiting for agents: {len(agents)} registered, at least 2 needed")
+                    continue
+                round_number += 1
+                mesh.clear()
+                reported.clear()
+                round_done.clear()
+                for name, agent in list(agents.items()):
+                    targets = [{"name": other, "address": peer["address"], "port": peer["probe_port"]}
+                               for other, peer in agents.items() if other != name]
+                    try:
+                        await self.fleet_send(agent["writer"], {"type": "probe", "round": round_number,
+                                                                "count": count, "targets": targets})
+                    except OSError:
+                        pass
+                try:
+                    await asyncio.wait_for(round_done.wait(), count * self.FLEET_PROBE_TIMEOUT + 5)
+                except asyncio.TimeoutError:
+                    self.logger.info(f"No results from: {', '.join(sorted(set(agents) - reported))}")
+                self.logger.info(f"\nRound {round_number}: median RTT / loss over {count} probes")
+                self.log_mesh(sorted(agents), mesh)
+                for name in sorted(agents):
+                    self.logger.info(f"  {name}: {self.fleet_labels(agents[name])}")
+                try:
+                    if dot:
+                        self.write_export(dot, self.mesh_dot(agents, mesh))
+                    if csv_path:
+                        self.write_export(csv_path, self.mesh_csv(sorted(agents), mesh, csv_metric))
+                except OSError as e:
+                    self.logger.error(f"Cannot export the mesh: {e}")
+
+    async def fleet_agent_session(self, coordinator: str, port: int, registration: dict) -> None:
+        """Register with the coordinator, send heartbeats, and probe whoever it says until the connection ends."""
+        reader, writer = await asyncio.open_connection(coordinator, port, family=socket.AF_INET6)
+        heartbeat = None
+        try:
+            await self.fleet_send(writer, registration)
+            reply = await asyncio.wait_for(self.fleet_receive(reader), self.READ_TIMEOUT)
+            if not reply or reply.get("type") != "registered":
+                raise ValueError(f"registration refused: {reply.get('reason') if reply else 'connection closed'}")
+            self.logger.info(f"Registered as {registration['name']} with the coordinator at [{coordinator}]:{port}")
+
+            async def beat(interval: float) -> None:
+                while True:
+                    await asyncio.sleep(interval)
+                    await self.fleet_send(writer, {"type": "heartbeat"})
+
+            heartbeat = asyncio.create_task(beat(float(reply.get("heartbeat", self.FLEET_HEARTBEAT))))
+            while (message := await self.fleet_receive(reader)) is not None:
+                if message.get("type") == "probe":
+                    targets = message.get("targets", [])
+                    count = min(int(message.get("count", 5)), self.FLEET_MAX_PROBES)
+                    results = await self.fleet_probe(targets, count)
+                    self.logger.info(f"Round {message.get('round')}: probed "
+                                     f"{', '.join(str(target.get('name')) for target in targets) or 'no one'}")
+                    await self.fleet_send(writer, {"type": "result", "round": message.get("round"),
+                                                   "results": results})
+            raise ValueError("connection closed")
+        finally:
+            if heartbeat:
+                heartbeat.cancel()
+            writer.close()
+
+    async def run_fleet_agent(self, coordinator: str, port: int, name: str, probe_port: int,
+                              site: Optional[str] = None, asn: Optional[int] = None) -> None:
+        """Answer peers' probes and stay registered with the coordinator, reconnecting whenever it goes away."""
+        loop = asyncio.get_running_loop()
+        magic = self.FLEET_PROBE_MAGIC
+
+        class Echo(asyncio.DatagramProtocol):
+            def connection_made(self, transport):
+                self.transport = transport
+
+            def datagram_received(self, data, addr):
+                # Only our own small probes, so the responder can't be used to amplify anything
+                if data.startswith(magic) and len(data) <= 64:
+                    self.transport.sendto(data, addr)
+
+        transport, _ = await loop.create_datagram_endpoint(Echo, local_addr=("::", probe_port),
+                                                           family=socket.AF_INET6)
+        registration = {"type": "register", "name": name, "probe_port": probe_port, "site": site, "asn": asn}
+        delay = 1
+        try:
+            while True:
+                connected = loop.time()
+                try:
+                    await self.fleet_agent_session(coordinator, port, registration)
+                except (OSError, ValueError, asyncio.TimeoutError) as e:
+                    # A session that lasted a while was healthy, so start backing off afresh
+                    if loop.time() - connected > self.FLEET_HEARTBEAT:
+                        delay = 1
+                    self.logger.warning(f"Coordinator: {e or 'timed out'}; reconnecting in {delay} s")
+                await asyncio.sleep(delay)
+                delay = min(delay * 2, self.FLEET_MAX_RECONNECT_DELAY)
+        finally:
+            transport.close()
+
+    def run_fleet(self, args: List[str]) -> int:
+        """Measure a full mesh of IPv6 latency and loss between agents at several sites."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py fleet",
+                                         description="Validate a multi-site IPv6 deployment: agents at each site "
+                                                     "connect to a coordinator over IPv6, which has every agent probe "
+                                                     "every other with small UDP echoes and logs the full-mesh "
+                                                     "latency and loss matrix.")
+        commands = parser.add_subparsers(dest="command", required=True)
+        coordinator = commands.add_parser("coordinator", help="Accept agents and collect the mesh")
+        coordinator.add_argument("ipv6_address", nargs="?", default="::", help="Address to listen on (default: ::)")
+        coordinator.add_argument("port", nargs="?", type=int, default=self.FLEET_PORT,
+                                 help=f"Port (default: {self.FLEET_PORT})")
+        coordinator.add_argument("--interval", type=float, default=30.0, help="Seconds between rounds (default: 30)")
+        coordinator.add_argument("--count", type=int, default=5,
+                                 help=f"Probes per agent pair and round (default: 5, at most {self.FLEET_MAX_PROBES})")
+        coordinator.add_argument("--dot", metavar="FILE",
+                                 help="Write each round's mesh to FILE as a GraphViz digraph")
+        coordinator.add_argument("--csv", metavar="FILE", help="Write each round's mesh to FILE as a CSV matrix")
+        coordinator.add_argument("--csv-metric", choices=["rtt", "loss"], default="rtt",
+                                 help="Value in the CSV cells: median RTT in ms, or loss in percent (default: rtt)")
+        agent = commands.add_parser("agent", help="Join a coordinator and probe the other agents")
+        agent.add_argument("coordinator", help="Hostname or IPv6 address of the coordinator")
+        agent.add_argument("port", nargs="?", type=int, default=self.FLEET_PORT,
+                           help=f"Coordinator port (default: {self.FLEET_PORT})")
+        agent.add_argument("--name", default=socket.gethostname().split(".")[0],
+                           help="Name in the mesh (default: the short hostname)")
+        agent.add_argument("--probe-port", type=int, default=self.FLEET_PROBE_PORT,
+                           help=f"UDP port to answer other agents' probes on (default: {self.FLEET_PROBE_PORT})")
+        agent.add_argument("--site", help="Site label shown with the agent's results")
+        agent.add_argument("--asn", help="Autonomous system the agent is in, e.g. AS64500")
+        options = parser.parse_args(args)
+
+        try:
+            if options.command == "coordinator":
+                if not 1 <= options.count <= self.FLEET_MAX_PROBES or options.interval <= 0:
+                    parser.error(f"--count must be between 1 and {self.FLEET_MAX_PROBES}, and --interval positive")
+                asyncio.run(self.run_fleet_coordinator(options.ipv6_address, options.port, options.interval,
+                                                       options.count, options.dot, options.csv, options.csv_metric))
+            else:
+                asn = options.asn.upper().removeprefix("AS") if options.asn else None
+                if asn is not None and not asn.isdigit():
+                    parser.error(f"invalid --asn '{options.asn}'")
+                asyncio.run(self.run_fleet_agent(options.coordinator, options.port, options.name,
+                                                 options.probe_port, options.site, int(asn) if asn else None))
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+        except (OSError, ValueError, asyncio.TimeoutError) as e:
+            self.logger.error(f"Error: {e or 'timed out'}")
+            return 1
+        return 0
+
+    def internet_checksum(self, data: bytes) -> int:
+        """Compute the 16-bit ones' complement checksum of IP, ICMP and ICMPv6 (RFC 1071)."""
+        if len(data) % 2:
+            data += b"\0"
+        total = sum(struct.unpack(f"!{len(data) // 2}H", data))
+        while total >> 16:
+            total = (total & 0xffff) + (total >> 16)
+        return ~total & 0xffff
+
+    def ping_ipv4(self, address: str, count: int, timeout: float) -> Tuple[int, Optional[float]]:
+        """Send ICMP echo requests over IPv4; returns how many were answered and the best RTT in ms.
+
+        Uses an unprivileged ICMP datagram socket where ping_group_range allows it, else a raw socket.
+        """
+        try:
+            sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM, socket.IPPROTO_ICMP)
+            raw = False
+        except OSError:
+            sock = socket.socket(socket.AF_INET, socket.SOCK_RAW, socket.IPPROTO_ICMP)
+            raw = True
+        ident = os.getpid() & 0xffff
+        answered, best = 0, None
+        with sock:
+            for seq in range(count):
+                header = struct.pack("!BBHHH", 8, 0, 0, ident, seq)
+                payload = b"ipv6_tester tunnel check"
+                checksum = self.internet_checksum(header + payload)
+                sock.sendto(header[:2] + struct.pack("!H", checksum) + header[4:] + payload, (address, 0))
+                sent = time.monotonic()
+                while (remaining := sent + timeout - time.monotonic()) > 0:
+                    readable, _, _ = select.select([sock], [], [], remaining)
+                    if not readable:
+                        break
+                    data, _ = sock.recvfrom(2048)
+                    if raw:
+                        # Raw sockets see the IPv4 header, and every ICMP message for the host
+                        data = data[(data[0] & 0x0f) * 4:]
+                    if len(data) >= 8 and data[0] == 0 and struct.unpack("!H", data[6:8])[0] == seq \
+                            and (not raw or struct.unpack("!H", data[4:6])[0] == ident):
+                        answered += 1
+                        rtt = (time.monotonic() - sent) * 1000
+                        best = rtt if best is None else min(best, rtt)
+                        break
+        return answered, best
+
+    def tunnel_interfaces(self) -> List[str]:
+        """List the configured 6in4 (sit) interfaces, leaving out the kernel's catch-all sit0."""
+        names = []
+        try:
+            for name in sorted(os.listdir("/sys/class/net")):
+                with open(f"/sys/class/net/{name}/type") as f:
+                    if int(f.read()) == self.ARPHRD_SIT and name != "sit0":
+                        names.append(name)
+        except (OSError, ValueError):
+            pass
+        return names
+
+    def ip_json(self, *args: str) -> list:
+        """Run iproute2's ip with JSON output and return the parsed result; raises OSError if that fails."""
+        try:
+            result = subprocess.run(["ip", "-j", *args], capture_output=True, text=True, timeout=5)
+        except subprocess.SubprocessError as e:
+            raise OSError(f"ip {' '.join(args)}: {e}")
+        if result.returncode:
+            raise OSError(result.stderr.strip() or f"ip {' '.join(args)} failed")
+        return json.loads(result.stdout or "[]")
+
+    def run_tunnel_check(self, args: List[str]) -> int:
+        """Validate a 6in4 tunnel to a tunnel broker, from the interface to end-to-end IPv6."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py tunnel-check",
+                                         description="Check a 6in4 tunnel such as one from Hurricane Electric's "
+                                                     "tunnel broker: the tunnel interface and its endpoints, the "
+                                                     "broker's reachability over IPv4, the MTU inside the tunnel, and "
+                                                     "end-to-end IPv6 connectivity through it. Ends with a summary of "
+                                                     "what looks misconfigured. Linux only; needs iproute2.")
+        parser.add_argument("--interface", help="Tunnel interface (default: the only sit interface besides sit0)")
+        parser.add_argument("--target", default="www.google.com",
+                            help="IPv6 host to reach through the tunnel (default: www.google.com)")
+        parser.add_argument("--port", type=int, default=443, help="TCP port on the target (default: 443)")
+        parser.add_argument("--timeout", type=float, default=3.0, help="Timeout per probe in seconds (default: 3)")
+        options = parser.parse_args(args)
+
+        if not sys.platform.startswith("linux"):
+            self.logger.error("tunnel-check reads /sys and uses iproute2, so it only runs on Linux")
+            return 1
+        interface = options.interface
+        if interface is None:
+            tunnels = self.tunnel_interfaces()
+            if len(tunnels) != 1:
+                self.logger.error(f"Found {len(tunnels)} sit interfaces ({', '.join(tunnels) or 'none'}); "
+                                  f"pick one with --interface" if tunnels else
+                                  "No 6in4 (sit) tunnel interface is configured; name one with --interface")
+                return 1
+            interface = tunnels[0]
+
+        results = []
+
+        def check(status: str, label: str, detail: str, hint: str = "") -> None:
+            results.append((status, label, hint or detail))
+            self.logger.info(f"  [{status}] {label}: {detail}")
+
+        self.logger.info(f"Tunnel check for {interface}:")
+        try:
+            link = self.ip_json("-d", "link", "show", "dev", interface)[0]
+        except (OSError, ValueError, IndexError) as e:
+            check("FAIL", "Interface", f"{interface}: {e}", f"create the tunnel interface {interface}")
+            link = None
+        if link is not None:
+            info = link.get("linkinfo", {})
+            kind = info.get("info_kind")
+            data = info.get("info_data", {})
+            if kind != "sit":
+                check("WARN", "Interface", f"{interface} is a {kind or link.get('link_type')} interface, not 6in4 "
+                                           f"(sit); skipping the endpoint checks")
+            elif "UP" not in link.get("flags", []):
+                check("FAIL", "Interface", f"{interface} is down", f"bring it up: ip link set {interface} up")
+            else:
+                check("PASS", "Interface", f"{interface} is up, 6in4, ttl {data.get('ttl') or 'inherit'}")
+            remote, local = data.get("remote"), data.get("local")
+            if kind != "sit":
+                remote = None
+            elif not remote or remote == "any":
+                check("FAIL", "Endpoints", "no remote endpoint; the tunnel can't send anywhere",
+                      "set the broker's IPv4 server address as the tunnel's remote")
+                remote = None
+            else:
+                # The kernel's choice of source toward the broker is what the broker sees, unless NAT rewrites it
+                with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as probe:
+                    try:
+                        probe.connect((remote, 9))
+                        source = probe.getsockname()[0]
+                    except OSError as e:
+                        source = None
+                        check("FAIL", "Endpoints", f"no IPv4 route to the remote endpoint {remote}: {e.strerror}",
+                              f"add an IPv4 route to {remote}")
+                if source:
+                    private = ipaddress.IPv4Address(source).is_private
+                    if local and local != "any" and local != source:
+                        check("FAIL", "Endpoints", f"local {local} but packets to {remote} leave from {source}",
+                              f"set the tunnel's local address to {source} (it changed, or it's on another "
+                              f"interface)")
+                    elif private:
+                        check("WARN", "Endpoints", f"remote {remote}, local {local or 'any'}; this host is behind NAT, "
+                                                   f"with the private address {source} toward the broker",
+                              "forward protocol 41 to this host on the NAT router, and register the router's "
+                              "public IPv4 address with the broker")
+                    else:
+                        check("PASS", "Endpoints", f"remote {remote}, local {local if local != 'any' else source}")
+
+        if link is None:
+            remote = None
+        if remote:
+            try:
+                answered, best = self.ping_ipv4(remote, 3, options.timeout)
+                if answered:
+                    check("PASS", "Broker over IPv4", f"{remote} answered {answered}/3 pings, best {best:.1f} ms")
+                else:
+                    check("FAIL", "Broker over IPv4", f"{remote} answered no pings",
+                          f"check IPv4 connectivity to {remote}; the broker may also block pings from addresses "
+                          f"it doesn't know")
+            except PermissionError:
+                check("SKIP", "Broker over IPv4", "no ICMP socket; run as root or allow unprivileged ping "
+                                                  "(net.ipv4.ping_group_range)")
+            except OSError as e:
+                check("FAIL", "Broker over IPv4", f"{remote}: {e.strerror or e}")
+
+        global_addresses = []
+        try:
+            with open("/proc/net/if_inet6") as f:
+                for line in f:
+                    address, _, prefix_length, scope, _, name = line.split()
+                    if name == interface and scope == "00":
+                        global_addresses.append(str(ipaddress.IPv6Address(bytes.fromhex(address))))
+        except OSError:
+            pass
+        if global_addresses:
+            check("PASS", "Tunnel address", ", ".join(global_addresses))
+        elif link is not None:
+            check("FAIL", "Tunnel address", f"no global IPv6 address on {interface}",
+                  "add the client IPv6 address the broker assigned, e.g. ip addr add 2001:db8::2/64 dev "
+                  f"{interface}")
+
+        routes = self.default_routes()
+        if any(name == interface for _, name in routes):
+            check("PASS", "Default route", f"IPv6 default route via {interface}")
+        elif link is not None:
+            check("WARN", "Default route", "IPv6 default route uses "
+                  + (", ".join(name for _, name in routes) or "nothing") + f", not {interface}",
+                  f"route IPv6 through the tunnel: ip -6 route add default dev {interface}")
+
+        mtu = link.get("mtu") if link else None
+        try:
+            target = socket.getaddrinfo(options.target, None, socket.AF_INET6, socket.SOCK_STREAM)[0][4][0]
+        except socket.gaierror:
+            target = None
+        if mtu:
+            underlying = None
+            if remote:
+                try:
+                    route = self.ip_json("route", "get", remote)[0]
+                    underlying = self.ip_json("link", "show", "dev", route["dev"])[0].get("mtu")
+                except (OSError, ValueError, IndexError, KeyError):
+                    pass
+            if mtu < 1280:
+                check("FAIL", "MTU", f"{mtu} is below the IPv6 minimum of 1280", f"raise the MTU of {interface}")
+            elif underlying and mtu > underlying - 20:
+                check("FAIL", "MTU", f"{mtu}, but the IPv4 path only fits {underlying - 20} after the 20-byte "
+                                     f"encapsulation",
+                      f"lower it: ip link set {interface} mtu {underlying - 20}, and match it in the broker's "
+                      f"settings")
+            elif target:
+                # Full-size packets that can't be fragmented find out whether the path really carries the MTU
+                sock = None
+                try:
+                    sock, method = self.open_probe_socket("auto")
+                    sock.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_DONTFRAG", 62), 1)
+                    if global_addresses:
+                        sock.bind((global_addresses[0], 0))
+                    ident = os.getpid() & 0xffff
+                    passed = {}
+                    for seq, size in enumerate((1280, mtu)):
+                        self.send_probe(sock, method, target, ident, seq, size - 48, 33434)
+                        reply = self.await_probe(sock, method, ident, seq, time.monotonic() + options.timeout)
+                        passed[size] = reply is not None and reply[0] == "reply"
+                    if passed[mtu]:
+                        check("PASS", "MTU", f"{mtu}; full-size packets reach {options.target}")
+                    elif passed[1280]:
+                        check("FAIL", "MTU", f"{mtu}, but {mtu}-byte packets to {options.target} are lost while "
+                                             f"1280-byte ones get through",
+                              f"the path carries less than {mtu}; lower the MTU of {interface} and in the "
+                              f"broker's settings")
+                    else:
+                        check("WARN", "MTU", f"{mtu}; not verified, {options.target} answered no probes")
+                except OSError as e:
+                    check("SKIP", "MTU", f"{mtu}; not verified: {e.strerror or e}")
+                finally:
+                    if sock:
+                        sock.close()
+            else:
+                check("PASS", "MTU", f"{mtu}")
+
+        if target:
+            try:
+                with socket.socket(socket.AF_INET6, socket.SOCK_STREAM) as sock:
+                    sock.settimeout(options.timeout)
+                    if global_addresses:
+                        # From the tunnel's address, so replies come back through the tunnel
+                        sock.bind((global_addresses[0], 0))
+                    started = time.monotonic()
+                    sock.connect((target, options.port))
+                    elapsed = (time.monotonic() - started) * 1000
+                check("PASS", "End-to-end IPv6", f"connected to [{target}]:{options.port} in {elapsed:.1f} ms")
+            except OSError as e:
+                check("FAIL", "End-to-end IPv6", f"[{target}]:{options.port}: {e.strerror or e}",
+                      "fix the failures above; if there are none, the broker may not be routing your prefix yet")
+        else:
+            check("FAIL", "End-to-end IPv6", f"cannot resolve {options.target} to an IPv6 address",
+                  "check DNS, or pass an IPv6 literal with --target")
+
+        problems = [(status, label, hint) for status, label, hint in results if status in ("FAIL", "WARN")]
+        if not problems:
+            self.logger.info("\nResult: the tunnel looks healthy")
+            return 0
+        self.logger.info("\nMisconfigurations:")
+        for status, label, hint in problems:
+            self.logger.info(f"  [{status}] {label}: {hint}")
+        return 1 if any(status == "FAIL" for status, _, _ in problems) else 0
+
+    def encapsulated_echo(self, kind: int, source: ipaddress.IPv6Address, destination: ipaddress.IPv6Address,
+                          ident: int, seq: int, payload: bytes) -> bytes:
+        """Build an IPv6 packet carrying an ICMPv6 echo request (128) or reply (129), to send inside IPv4."""
+        icmp = struct.pack("!BBHHH", kind, 0, 0, ident, seq) + payload
+        # The ICMPv6 checksum covers a pseudo-header of the addresses, length and next header (RFC 8200 8.1)
+        pseudo = source.packed + destination.packed + struct.pack("!I3xB", len(icmp), socket.IPPROTO_ICMPV6)
+        icmp = icmp[:2] + struct.pack("!H", self.internet_checksum(pseudo + icmp)) + icmp[4:]
+        return struct.pack("!IHBB16s16s", 6 << 28, len(icmp), socket.IPPROTO_ICMPV6, 64, source.packed,
+                           destination.packed) + icmp
+
+    def parse_encapsulated_echo(self, data: bytes, prefix: bytes) -> Optional[dict]:
+        """Decode an ICMPv6 echo carried in an IPv4 packet from a raw socket, after the encapsulation prefix."""
+        inner = data[(data[0] & 0x0f) * 4:] if data else b""
+        if not inner.startswith(prefix):
+            return None
+        inner = inner[len(prefix):]
+        if len(inner) < 48 or inner[0] >> 4 != 6 or inner[6] != socket.IPPROTO_ICMPV6 or inner[40] not in (128, 129):
+            return None
+        _, _, _, ident, seq = struct.unpack("!BBHHH", inner[40:48])
+        return {"kind": inner[40], "source": ipaddress.IPv6Address(inner[8:24]),
+                "destination": ipaddress.IPv6Address(inner[24:40]), "ident": ident, "seq": seq,
+                "payload": inner[48:]}
+
+    def encap_listen(self, address: str, port: int) -> None:
+        """Answer encapsulated probes over 6in4 and GRE, and tell probers over UDP how many arrived."""
+        sockets = {}
+        for name, (protocol, prefix) in self.ENCAPSULATIONS.items():
+            sock = socket.socket(socket.AF_INET, socket.SOCK_RAW, protocol)
+            sock.bind((address, 0))
+            sockets[sock] = (name, prefix)
+        control = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        control.bind((address, port))
+        self.logger.info(f"Answering 6in4 (protocol 41) and GRE (protocol 47) probes on {address or '0.0.0.0'}, "
+                         f"control on UDP port {port}")
+        # (source, nonce) -> probes received; the oldest entries go first
+        seen = {}
+        try:
+            while True:
+                readable, _, _ = select.select([*sockets, control], [], [])
+                for sock in readable:
+                    if sock is control:
+                        data, sender = control.recvfrom(512)
+                        if data.startswith(self.ENCAP_MAGIC + b"?"):
+                            nonce = data[len(self.ENCAP_MAGIC) + 1:][:8]
+                            control.sendto(self.ENCAP_MAGIC + f" {seen.get((sender[0], nonce), 0)}".encode(), sender)
+                        continue
+                    name, prefix = sockets[sock]
+                    data, (source, _) = sock.recvfrom(65535)
+                    echo = self.parse_encapsulated_echo(data, prefix)
+                    # Raw sockets also see our own replies; answer only requests from our probe
+                    if not echo or echo["kind"] != 128 or not echo["payload"].startswith(self.ENCAP_MAGIC):
+                        continue
+                    nonce = echo["payload"][len(self.ENCAP_MAGIC):][:8]
+                    seen[(source, nonce)] = seen.pop((source, nonce), 0) + 1
+                    if len(seen) > 10000:
+                        seen.pop(next(iter(seen)))
+                    self.logger.info(f"{name} probe {echo['seq']} from {source}")
+                    reply = self.encapsulated_echo(129, echo["destination"], echo["source"], echo["ident"],
+                                                   echo["seq"], echo["payload"])
+                    sock.sendto(prefix + reply, (source, 0))
+        finally:
+            for sock in [*sockets, control]:
+                sock.close()
+
+    def encap_probe(self, server: str, port: int, kind: str, count: int, timeout: float) -> dict:
+        """Send encapsulated echo requests to an encap listener and count what got there and back."""
+        protocol, prefix = self.ENCAPSULATIONS[kind]
+        nonce = secrets.token_hex(4).encode()
+        payload = self.ENCAP_MAGIC + nonce
+        ident = os.getpid() & 0xffff
+        result = {"sent": count, "replies": 0, "arrived": None, "best": None}
+        with socket.socket(socket.AF_INET, socket.SOCK_RAW, protocol) as sock, \
+                socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as control:
+
+            def ask() -> Optional[int]:
+                # How many of our probes the listener saw, over plain UDP that the network surely passes
+                control.settimeout(timeout)
+                for _ in range(3):
+                    control.sendto(self.ENCAP_MAGIC + b"?" + nonce, (server, port))
+                    try:
+                        data, _ = control.recvfrom(512)
+                    except socket.timeout:
+                        continue
+                    fields = data.split()
+                    if len(fields) == 2 and fields[0] == self.ENCAP_MAGIC and fields[1].isdigit():
+                        return int(fields[1])
+                return None
+
+            if ask() is None:
+                return result
+            for seq in range(count):
+                packet = self.encapsulated_echo(128, *self.ENCAP_INNER, ident, seq, payload)
+                sock.sendto(prefix + packet, (server, 0))
+                sent = time.monotonic()
+                while (remaining := sent + timeout - time.monotonic()) > 0:
+                    readable, _, _ = select.select([sock], [], [], remaining)
+                    if not readable:
+                        break
+                    data, (source, _) = sock.recvfrom(65535)
+                    echo = self.parse_encapsulated_echo(data, prefix)
+                    if source == server and echo and echo["kind"] == 129 and echo["ident"] == ident \
+                            and echo["seq"] == seq and echo["payload"] == payload:
+                        rtt = (time.monotonic() - sent) * 1000
+                        result["replies"] += 1
+                        result["best"] = rtt if result["best"] is None else min(result["best"], rtt)
+                        break
+            result["arrived"] = ask()
+        return result
+
+    def run_encap(self, args: List[str]) -> int:
+        """Check whether the network passes 6in4 (protocol 41) or GRE tunnel traffic."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py encap",
+                                         description="Find out whether the local network lets IPv6-in-IPv4 tunnel "
+                                                     "traffic through; many enterprise networks silently drop it. Run "
+                                                     "listen on a host outside the network, then probe from inside. "
+                                                     "Probe sends ICMPv6 echo requests encapsulated in 6in4 (IPv4 "
+                                                     "protocol 41) or GRE (protocol 47). A UDP side channel tells apart "
+                                                     "traffic dropped on the way out from replies dropped on the way "
+                                                     "back. Both ends need root or CAP_NET_RAW.")
+        commands = parser.add_subparsers(dest="command", required=True)
+        listen = commands.add_parser("listen", help="Answer probes (run outside the network under test)")
+        listen.add_argument("ipv4_address", nargs="?", default="", help="IPv4 address to listen on (default: all)")
+        listen.add_argument("--port", type=int, default=self.ENCAP_PORT,
+                            help=f"UDP control port (default: {self.ENCAP_PORT})")
+        probe = commands.add_parser("probe", help="Send encapsulated probes to a listener")
+        probe.add_argument("server", help="Hostname or IPv4 address of the listener")
+        probe.add_argument("--type", choices=sorted(self.ENCAPSULATIONS), default="6in4",
+                           help="Encapsulation (default: 6in4)")
+        probe.add_argument("--port", type=int, default=self.ENCAP_PORT,
+                           help=f"UDP control port (default: {self.ENCAP_PORT})")
+        probe.add_argument("--count", type=int, default=5, help="Probes to send (default: 5)")
+        probe.add_argument("--timeout", type=float, default=2.0, help="Seconds to wait for each reply (default: 2)")
+        options = parser.parse_args(args)
+
+        try:
+            if options.command == "listen":
+                self.encap_listen(options.ipv4_address, options.port)
+                return 0
+            if not 1 <= options.count <= 100:
+                parser.error("--count must be between 1 and 100")
+            server = socket.getaddrinfo(options.server, None, socket.AF_INET, socket.SOCK_RAW)[0][4][0]
+            result = self.encap_probe(server, options.port, options.type, options.count, options.timeout)
+        except KeyboardInterrupt:
+            self.logger.info("\nShutting down...")
+            return 0
+        except PermissionError:
+            self.logger.error("Raw sockets need root or CAP_NET_RAW")
+            return 1
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        name = f"{options.type} ({'protocol 41' if options.type == '6in4' else 'protocol 47'})"
+        self.logger.info(f"Encapsulation probe to {server}, {name}:")
+        if result["arrived"] is None:
+            self.logger.info(f"  [FAIL] No answer from the listener on UDP port {options.port}; start "
+                             f"'encap listen' on {server} and check that the port is open")
+            return 1
+        self.logger.info(f"  Sent: {result['sent']}, arrived at the listener: {result['arrived']}, "
+                         f"replies received: {result['replies']}")
+        if result["replies"]:
+            self.logger.info(f"  [PASS] {name} passes in both directions (best RTT {result['best']:.1f} ms)")
+            return 0
+        if result["arrived"]:
+            self.logger.info(f"  [FAIL] Outgoing {options.type} reaches the listener but the replies are dropped on "
+                             f"the way back; typically a NAT or stateful firewall that doesn't track {name}")
+        else:
+            self.logger.info(f"  [FAIL] {name} is dropped on the way out, though UDP to the same host works")
+        return 1
+
+    def x25519(self, scalar: bytes, point: bytes = b"\x09" + bytes(31)) -> bytes:
+        """Curve25519 scalar multiplication (RFC 7748); with the default point, derive a public key."""
+        p = 2 ** 255 - 19
+        k = bytearray(scalar)
+        k[0] &= 248
+        k[31] = (k[31] & 127) | 64
+        k = int.from_bytes(k, "little")
+        x1 = int.from_bytes(point, "little") & ((1 << 255) - 1)
+        x2, z2, x3, z3, swap = 1, 0, x1, 1, 0
+        for t in reversed(range(255)):
+            bit = (k >> t) & 1
+            if swap ^ bit:
+                x2, x3, z2, z3 = x3, x2, z3, z2
+            swap = bit
+            a, b, c, d = x2 + z2, x2 - z2, x3 + z3, x3 - z3
+            aa, bb, da, cb = a * a, b * b, d * a, c * b
+            e = aa - bb
+            x3, z3 = (da + cb) ** 2 % p, x1 * (da - cb) ** 2 % p
+            x2, z2 = aa * bb % p, e * (aa + 121665 * e) % p
+        if swap:
+            x2, z2 = x3, z3
+        return (x2 * pow(z2, p - 2, p) % p).to_bytes(32, "little")
+
+    def chacha20_block(self, key: bytes, counter: int, nonce: bytes) -> bytes:
+        """Return one 64-byte ChaCha20 keystream block (RFC 8439 section 2.3)."""
+        state = [0x61707865, 0x3320646e, 0x79622d32, 0x6b206574, *struct.unpack("<8I", key), counter,
+                 *struct.unpack("<3I", nonce)]
+        w = list(state)
+
+        def quarter(a: int, b: int, c: int, d: int) -> None:
+            for x, y, z, shift in ((a, b, d, 16), (c, d, b, 12), (a, b, d, 8), (c, d, b, 7)):
+                w[x] = (w[x] + w[y]) & 0xffffffff
+                w[z] ^= w[x]
+                w[z] = ((w[z] << shift) & 0xffffffff) | (w[z] >> (32 - shift))
+
+        for _ in range(10):
+            quarter(0, 4, 8, 12), quarter(1, 5, 9, 13), quarter(2, 6, 10, 14), quarter(3, 7, 11, 15)
+            quarter(0, 5, 10, 15), quarter(1, 6, 11, 12), quarter(2, 7, 8, 13), quarter(3, 4, 9, 14)
+        return struct.pack("<16I", *((w[i] + state[i]) & 0xffffffff for i in range(16)))
+
+    def chacha20_poly1305(self, key: bytes, counter: int, data: bytes, aad: bytes, decrypt: bool = False) -> \
+            Optional[bytes]:
+        """Seal or open data with ChaCha20-Poly1305 (RFC 8439) and WireGuard's 64-bit counter nonce.
+
+        Opening returns None when the tag doesn't verify.
+        """
+        return self.aead_chacha20_poly1305(key, struct.pack("<IQ", 0, counter), data, aad, decrypt)
+
+    def aead_chacha20_poly1305(self, key: bytes, nonce: bytes, data: bytes, aad: bytes, decrypt: bool = False) -> \
+            Optional[bytes]:
+        """AEAD_CHACHA20_POLY1305 (RFC 8439 section 2.8) with a 12-byte nonce; None if an opened tag is wrong."""
+        body = data[:-16] if decrypt else data
+        stream = b"".join(self.chacha20_block(key, block + 1, nonce) for block in range((len(body) + 63) // 64))
+        output = bytes(x ^ y for x, y in zip(body, stream))
+        ciphertext = body if decrypt else output
+        # Poly1305 over the padded AAD and ciphertext and their lengths, keyed from block 0
+        one_time = self.chacha20_block(key, 0, nonce)[:32]
+        r = int.from_bytes(one_time[:16], "little") & 0x0ffffffc0ffffffc0ffffffc0fffffff
+        message = (aad + bytes(-len(aad) % 16) + ciphertext + bytes(-len(ciphertext) % 16)
+                   + struct.pack("<QQ", len(aad), len(ciphertext)))
+        accumulator = 0
+        for offset in range(0, len(message), 16):
+            accumulator = (accumulator + int.from_bytes(message[offset:offset + 16] + b"\x01", "little")) * r \
+                          % (2 ** 130 - 5)
+        tag = ((accumulator + int.from_bytes(one_time[16:], "little")) & ((1 << 128) - 1)).to_bytes(16, "little")
+        if decrypt:
+            return output if hmac.compare_digest(tag, data[-16:]) else None
+        return output + tag
+
+    def wireguard_kdf(self, key: bytes, data: bytes, count: int) -> List[bytes]:
+        """WireGuard's HKDF over HMAC-BLAKE2s, returning count 32-byte outputs."""
+        secret = hmac.new(key, data, hashlib.blake2s).digest()
+        outputs, previous = [], b""
+        for index in range(1, count + 1):
+            previous = hmac.new(secret, previous + bytes([index]), hashlib.blake2s).digest()
+            outputs.append(previous)
+        return outputs
+
+    def wireguard_handshake(self, address: tuple, private_key: bytes, peer_key: bytes, preshared_key: bytes,
+                            attempts: int, timeout: float) -> Tuple[str, str]:
+        """Send WireGuard handshake initiations and check the response; returns (status, detail)."""
+        def blake2s(*parts: bytes) -> bytes:
+            return hashlib.blake2s(b"".join(parts)).digest()
+
+        def mac1(key: bytes, message: bytes) -> bytes:
+            return hashlib.blake2s(message, digest_size=16, key=blake2s(b"mac1----", key)).digest()
+
+        public_key = self.x25519(private_key)
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.connect(address)
+            sock.settimeout(timeout)
+            for attempt in range(attempts):
+                # Noise IKpsk2 initiation (WireGuard whitepaper section 5.4.2)
+                chain = blake2s(b"Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+                digest = blake2s(blake2s(chain, b"WireGuard v1 zx2c4 Jason@zx2c4.com"), peer_key)
+                ephemeral = secrets.token_bytes(32)
+                ephemeral_public = self.x25519(ephemeral)
+                chain, = self.wireguard_kdf(chain, ephemeral_public, 1)
+                digest = blake2s(digest, ephemeral_public)
+                chain, key = self.wireguard_kdf(chain, self.x25519(ephemeral, peer_key), 2)
+                static = self.chacha20_poly1305(key, 0, public_key, digest)
+                digest = blake2s(digest, static)
+                chain, key = self.wireguard_kdf(chain, self.x25519(private_key, peer_key), 2)
+                now = time.time_ns()
+                # TAI64N, as WireGuard implementations encode it
+                timestamp = self.chacha20_poly1305(key, 0, struct.pack("!QI", 0x400000000000000a + now // 10 ** 9,
+                                                                       now % 10 ** 9), digest)
+                digest = blake2s(digest, timestamp)
+                index = secrets.randbits(32)
+                message = struct.pack("<I", 1) + struct.pack("<I", index) + ephemeral_public + static + timestamp
+                message += mac1(peer_key, message)
+                sent = time.monotonic()
+                try:
+                    sock.send(message + bytes(16))
+                    while True:
+                        reply = sock.recv(4096)
+                        # A late response to an earlier attempt carries that attempt's index
+                        if len(reply) == 92 and reply[0] == 2 and struct.unpack("<I", reply[8:12])[0] != index:
+                            continue
+                        break
+                except socket.timeout:
+                    continue
+                except ConnectionRefusedError:
+                    return "FAIL", "port unreachable; nothing listens on that port over IPv6"
+                except OSError as e:
+                    return "FAIL", str(e)
+                elapsed = (time.monotonic() - sent) * 1000
+
+                if reply[0] == 3 and len(reply) == 64:
+                    return "WARN", (f"cookie reply in {elapsed:.1f} ms: the peer is reachable but under load, so "
+                                    f"the handshake wasn't completed")
+                if reply[0] != 2 or len(reply) != 92 or struct.unpack("<I", reply[8:12])[0] != index:
+                    return "FAIL", f"unexpected {len(reply)}-byte reply; is this a WireGuard endpoint?"
+                if not hmac.compare_digest(mac1(public_key, reply[:60]), reply[60:76]):
+                    return "FAIL", "response failed its mac1 check; is the private key right?"
+                responder_ephemeral = reply[12:44]
+                chain, = self.wireguard_kdf(chain, responder_ephemeral, 1)
+                digest = blake2s(digest, responder_ephemeral)
+                chain, = self.wireguard_kdf(chain, self.x25519(ephemeral, responder_ephemeral), 1)
+                chain, = self.wireguard_kdf(chain, self.x25519(private_key, responder_ephemeral), 1)
+                chain, tau, key = self.wireguard_kdf(chain, preshared_key, 3)
+                digest = blake2s(digest, tau)
+                if self.chacha20_poly1305(key, 0, reply[44:60], digest, decrypt=True) is None:
+                    return "FAIL", "response didn't authenticate; check the preshared key"
+                return "PASS", (f"handshake completed in {elapsed:.1f} ms"
+                                + (f" (attempt {attempt + 1})" if attempt else ""))
+        return "FAIL", (f"no response to {attempts} initiations; UDP to the port is blocked, or the peer doesn't "
+                        f"know our public key (WireGuard silently ignores unknown keys)")
+
+    def read_wireguard_config(self, path: str) -> dict:
+        """Read PrivateKey, and PublicKey, PresharedKey and Endpoint of the first peer, from a wg-quick file."""
+        values, section = {}, None
+        with open(path) as f:
+            for line in f:
+                line = line.split("#", 1)[0].strip()
+                if line.startswith("["):
+                    if section == "peer":
+                        break
+                    section = line.strip("[]").strip().lower()
+                elif "=" in line:
+                    name, value = (part.strip() for part in line.split("=", 1))
+                    if (section, name) == ("interface", "PrivateKey") or section == "peer":
+                        values[name] = value
+        return values
+
+    def run_wireguard(self, args: List[str]) -> int:
+        """Check that a WireGuard peer completes a handshake over IPv6."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py wireguard",
+                                         description="Perform a WireGuard handshake with a peer over IPv6 and verify "
+                                                     "its response, to check that the VPN works from this network, "
+                                                     "e.g. an IPv6-only client network. Needs the keys of a peer the "
+                                                     "server knows; take them from a wg-quick config with --config. "
+                                                     "No tunnel is set up. The server updates that peer's endpoint "
+                                                     "to this host until the real client sends again.")
+        parser.add_argument("endpoint", nargs="?",
+                            help="Server as [ADDRESS]:PORT or HOST:PORT (default: Endpoint from --config)")
+        parser.add_argument("--config", help="wg-quick config file to take the keys and endpoint from")
+        parser.add_argument("--private-key-file", help="File with our base64 private key")
+        parser.add_argument("--peer-key", help="The server's base64 public key")
+        parser.add_argument("--preshared-key-file", help="File with the base64 preshared key, if one is used")
+        parser.add_argument("--attempts", type=int, default=3, help="Initiations to send (default: 3)")
+        parser.add_argument("--timeout", type=float, default=2.0,
+                            help="Seconds to wait for each response (default: 2)")
+        options = parser.parse_args(args)
+
+        try:
+            values = self.read_wireguard_config(options.config) if options.config else {}
+            for option, name in ((options.private_key_file, "PrivateKey"),
+                                 (options.preshared_key_file, "PresharedKey")):
+                if option:
+                    with open(option) as f:
+                        values[name] = f.read().strip()
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        if options.peer_key:
+            values["PublicKey"] = options.peer_key
+        endpoint = options.endpoint or values.get("Endpoint")
+        keys = {}
+        for name in ("PrivateKey", "PublicKey", "PresharedKey"):
+            if name not in values:
+                if name != "PresharedKey":
+                    parser.error(f"no {name}; use --config or the key options")
+                # Without a preshared key WireGuard mixes in zeros
+                keys[name] = bytes(32)
+                continue
+            try:
+                keys[name] = base64.b64decode(values[name], validate=True)
+            except ValueError:
+                keys[name] = b""
+            if len(keys[name]) != 32:
+                parser.error(f"{name} is not a valid WireGuard key (base64 of 32 bytes)")
+        if not endpoint:
+            parser.error("no endpoint given, and --config has none")
+        host, _, port = endpoint.rpartition(":")
+        if not host or not port.isdigit():
+            parser.error(f"invalid endpoint '{endpoint}'; use [ADDRESS]:PORT or HOST:PORT")
+        host = host.strip("[]")
+        try:
+            address = socket.getaddrinfo(host, int(port), socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        except socket.gaierror as e:
+            self.logger.error(f"Cannot resolve {host} to an IPv6 address: {e}")
+            return 1
+
+        self.logger.info(f"WireGuard handshake with [{address[0]}]:{address[1]} as "
+                         f"{base64.b64encode(self.x25519(keys['PrivateKey'])).decode()}:")
+        status, detail = self.wireguard_handshake(address, keys["PrivateKey"], keys["PublicKey"],
+                                                  keys["PresharedKey"], options.attempts, options.timeout)
+        self.logger.info(f"  [{status}] {detail}")
+        return 1 if status == "FAIL" else 0
+
+    def read_pcap(self, path: str):
+        """Yield (timestamp, IPv6 packet) for each IPv6 packet in a classic pcap file."""
+        with open(path, "rb") as f:
+            header = f.read(24)
+            if len(header) < 24:
+                raise ValueError(f"{path} is not a pcap file")
+            magic = header[:4]
+            if magic == b"\x0a\x0d\x0d\x0a":
+                raise ValueError(f"{path} is pcapng; convert it with 'editcap -F pcap'")
+            for order in ("<", ">"):
+                if struct.unpack(f"{order}I", magic)[0] in (0xa1b2c3d4, 0xa1b23c4d):
+                    break
+            else:
+                raise ValueError(f"{path} is not a pcap file")
+            fraction = 1e9 if struct.unpack(f"{order}I", magic)[0] == 0xa1b23c4d else 1e6
+            link_type = struct.unpack(f"{order}I", header[20:24])[0] & 0x0fffffff
+            while len(record := f.read(16)) == 16:
+                seconds, sub_second, length, _ = struct.unpack(f"{order}IIII", record)
+                frame = f.read(length)
+                # Ethernet (with VLAN tags), Linux cooked v1 and v2, BSD loopback, and raw IP
+                if link_type == 1:
+                    offset, ether_type = 14, frame[12:14]
+                    while ether_type in (b"\x81\x00", b"\x88\xa8") and len(frame) >= offset + 4:
+                        ether_type, offset = frame[offset + 2:offset + 4], offset + 4
+                    packet = frame[offset:] if ether_type == b"\x86\xdd" else b""
+                elif link_type == 113:
+                    packet = frame[16:] if frame[14:16] == b"\x86\xdd" else b""
+                elif link_type == 276:
+                    packet = frame[20:] if frame[:2] == b"\x86\xdd" else b""
+                elif link_type == 0:
+                    packet = frame[4:]
+                elif link_type in (101, 12, 14, 229):
+                    packet = frame
+                else:
+                    raise ValueError(f"unsupported pcap link type {link_type}")
+                if packet[:1] and packet[0] >> 4 == 6:
+                    yield seconds + sub_second / fraction, packet
+
+    def find_srh(self, packet: bytes) -> Optional[int]:
+        """Walk an IPv6 packet's extension headers to a Segment Routing Header; returns its offset."""
+        if len(packet) < 40:
+            return None
+        next_header, offset = packet[6], 40
+        while next_header in (0, 43, 44, 60) and offset + 8 <= len(packet):
+            if next_header == 43 and packet[offset + 2] == 4:
+                return offset
+            if next_header == 44 and struct.unpack("!H", packet[offset + 2:offset + 4])[0] & 0xfff8:
+                # Later fragments carry the rest of the payload, not more headers
+                return None
+            length = 8 if next_header == 44 else (packet[offset + 1] + 1) * 8
+            next_header, offset = packet[offset], offset + length
+        return None
+
+    def decode_srh(self, packet: bytes, offset: int) -> dict:
+        """Decode a Segment Routing Header (routing type 4, RFC 8754) at offset."""
+        header = packet[offset:offset + (packet[offset + 1] + 1) * 8]
+        next_header, _, _, segments_left, last_entry, flags, tag = struct.unpack("!BBBBBBH", header[:8])
+        segments = [ipaddress.IPv6Address(header[start:start + 16])
+                    for start in range(8, min(8 + 16 * (last_entry + 1), len(header) - 15), 16)]
+        tlvs, position = [], 8 + 16 * len(segments)
+        while position < len(header):
+            kind = header[position]
+            # Pad1 is a single byte with no length
+            size = 1 if kind == 0 else 2 + (header[position + 1] if position + 1 < len(header) else 0)
+            if kind not in (0, 4):
+                tlvs.append((kind, size))
+            position += size
+        return {"source": ipaddress.IPv6Address(packet[8:24]), "destination": ipaddress.IPv6Address(packet[24:40]),
+                "next_header": next_header, "segments_left": segments_left, "last_entry": last_entry,
+                "flags": flags, "tag": tag, "segments": segments, "tlvs": tlvs,
+                "truncated": len(header) < (packet[offset + 1] + 1) * 8}
+
+    def format_srh(self, timestamp: float, srh: dict) -> List[str]:
+        """Describe a decoded SRH with its segments in the order they are visited."""
+        next_header = self.SRV6_NEXT_HEADERS.get(srh["next_header"], "other")
+        lines = [f"{datetime.datetime.fromtimestamp(timestamp).strftime('%H:%M:%S.%f')} [{srh['source']}] > "
+                 f"[{srh['destination']}] SRH segments left {srh['segments_left']}, last entry {srh['last_entry']}, "
+                 f"next header {next_header} ({srh['next_header']}), tag {srh['tag']}, flags 0x{srh['flags']:02x}"]
+        width = max((len(str(segment)) for segment in srh["segments"]), default=0)
+        # Segment List[0] is the final segment; routers count Segments Left down towards it
+        for index in reversed(range(len(srh["segments"]))):
+            state = ("done" if index > srh["segments_left"] else
+                     "active" if index == srh["segments_left"] else "pending")
+            lines.append(f"  [{index}] {str(srh['segments'][index]).ljust(width)}  {state}"
+                         + ("  (final)" if index == 0 else ""))
+        for kind, size in srh["tlvs"]:
+            lines.append(f"  TLV {self.SRV6_TLVS.get(kind, 'type')} ({kind}), {size} bytes")
+        if srh["truncated"] or len(srh["segments"]) <= srh["last_entry"]:
+            lines.append("  Warning: header truncated in the capture")
+        elif srh["segments_left"] > srh["last_entry"]:
+            lines.append("  Warning: segments left is beyond the last entry")
+        elif srh["segments"][srh["segments_left"]] != srh["destination"]:
+            lines.append("  Warning: the destination address is not the active segment")
+        return lines
+
+    def run_srv6(self, args: List[str]) -> int:
+        """Capture or read IPv6 packets and decode their Segment Routing Headers."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py srv6",
+                                         description="Capture IPv6 packets and decode SRv6 Segment Routing Headers "
+                                                     "(routing header type 4, RFC 8754): the segment list in the order "
+                                                     "it is visited, the active segment, next header, tag, flags and "
+                                                     "TLVs. Capturing needs Linux and root or CAP_NET_RAW; --read "
+                                                     "decodes a pcap file instead.")
+        parser.add_argument("--interface", help="Interface to capture on (default: all)")
+        parser.add_argument("--read", metavar="FILE", help="Decode a pcap file instead of capturing")
+        parser.add_argument("--count", type=int, help="Stop after this many SRv6 packets")
+        options = parser.parse_args(args)
+
+        seen = {"ipv6": 0, "srv6": 0}
+
+        def decode(timestamp: float, packet: bytes) -> bool:
+            seen["ipv6"] += 1
+            offset = self.find_srh(packet)
+            if offset is None:
+                return True
+            seen["srv6"] += 1
+            for line in self.format_srh(timestamp, self.decode_srh(packet, offset)):
+                self.logger.info(line)
+            return options.count is None or seen["srv6"] < options.count
+
+        try:
+            if options.read:
+                for timestamp, packet in self.read_pcap(options.read):
+                    if not decode(timestamp, packet):
+                        break
+            else:
+                if not hasattr(socket, "AF_PACKET"):
+                    self.logger.error("Capturing needs Linux packet sockets; use --read with a pcap file")
+                    return 1
+                # Cooked packet sockets deliver the IPv6 packet without the link-layer header
+                with socket.socket(socket.AF_PACKET, socket.SOCK_DGRAM, socket.htons(0x86dd)) as sock:
+                    if options.interface:
+                        sock.bind((options.interface, 0x86dd))
+                    self.logger.info(f"Capturing SRv6 packets on {options.interface or 'all interfaces'}; "
+                                     f"Ctrl+C to stop")
+                    while decode(time.time(), sock.recv(65535)):
+                        pass
+        except KeyboardInterrupt:
+            pass
+        except PermissionError:
+            self.logger.error("Capturing needs root or CAP_NET_RAW")
+            return 1
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        self.logger.info(f"\n{seen['srv6']} of {seen['ipv6']} IPv6 packets carried an SRH")
+        return 0
+
+    def mld_query_packet(self, group: ipaddress.IPv6Address, max_response_ms: int) -> bytes:
+        """Build an MLDv2 query (RFC 3810 section 5.1); the kernel fills in the checksum."""
+        # S=0, QRV=2, QQIC=125 s, no sources
+        return struct.pack("!BBHHH16sBBH", 130, 0, 0, max_response_ms, 0, group.packed, 2, 125, 0)
+
+    def parse_mld(self, packet: bytes) -> Optional[dict]:
+        """Decode an MLD query, report or done message from an IPv6 packet, skipping extension headers."""
+        if len(packet) < 40 or packet[0] >> 4 != 6:
+            return None
+        next_header, offset = packet[6], 40
+        while next_header in (0, 60) and offset + 8 <= len(packet):
+            next_header, offset = packet[offset], offset + (packet[offset + 1] + 1) * 8
+        message = packet[offset:]
+        if next_header != socket.IPPROTO_ICMPV6 or len(message) < 8 or message[0] not in (130, 131, 132, 143):
+            return None
+        result = {"source": ipaddress.IPv6Address(packet[8:24]), "type": message[0], "records": []}
+        if message[0] == 143:
+            # MLDv2 report: multicast address records, each with a mode and sources
+            count, position = struct.unpack("!H", message[6:8])[0], 8
+            for _ in range(count):
+                if position + 20 > len(message):
+                    break
+                kind, aux, sources = struct.unpack("!BBH", message[position:position + 4])
+                group = ipaddress.IPv6Address(message[position + 4:position + 20])
+                addresses = [ipaddress.IPv6Address(message[start:start + 16])
+                             for start in range(position + 20, position + 20 + 16 * sources, 16)
+                             if start + 16 <= len(message)]
+                result["records"].append((kind, group, addresses))
+                position += 20 + 16 * sources + 4 * aux
+        elif len(message) >= 24:
+            group = ipaddress.IPv6Address(message[8:24])
+            if message[0] == 130:
+                result["group"] = group
+                result["max_response_ms"] = struct.unpack("!H", message[4:6])[0]
+                result["version"] = 2 if len(message) >= 28 else 1
+            else:
+                # MLDv1 reports join the group (exclude nothing); done leaves it (include nothing)
+                result["records"].append((2 if message[0] == 131 else 3, group, []))
+        return result
+
+    def describe_mld_record(self, kind: int, sources: List[ipaddress.IPv6Address]) -> Optional[str]:
+        """Summarize a report record as the host's membership; None when it leaves the group."""
+        exclude = kind in (2, 4)
+        if not exclude and not sources and kind != 5:
+            return None
+        if exclude:
+            return "any source" + (f" except {', '.join(map(str, sources))}" if sources else "")
+        verb = {5: "allow", 6: "block"}.get(kind, "from")
+        return f"{verb} {', '.join(map(str, sources))}"
+
+    def open_mld_capture(self, interface: str) -> socket.socket:
+        """Open a packet socket that sees all IPv6 multicast on an interface, including MLDv1 reports."""
+        sock = socket.socket(socket.AF_PACKET, socket.SOCK_DGRAM, socket.htons(0x86dd))
+        sock.bind((interface, 0x86dd))
+        # PACKET_ADD_MEMBERSHIP with PACKET_MR_ALLMULTI, so the NIC doesn't filter groups we haven't joined
+        sock.setsockopt(263, 1, struct.pack("iHH8s", socket.if_nametoindex(interface), 2, 0, b""))
+        return sock
+
+    def run_mld(self, args: List[str]) -> int:
+        """Send MLD queries and show which multicast groups hosts on a link have joined."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py mld",
+                                         description="Multicast Listener Discovery (RFC 3810) on one link. query "
+                                                     "sends an MLDv2 query and lists the groups that hosts report, "
+                                                     "including the solicited-node groups that NDP relies on. listen "
+                                                     "shows queries and reports as they go by. Linux only; needs root "
+                                                     "or CAP_NET_RAW. A query from an address lower than the "
+                                                     "router's makes routers stop querying for a few minutes, so "
+                                                     "don't repeat it in a loop on production links.")
+        commands = parser.add_subparsers(dest="command", required=True)
+        query = commands.add_parser("query", help="Send a query and collect the reports")
+        query.add_argument("interface", help="Interface of the link")
+        query.add_argument("--group", help="Query one group instead of all (group-specific query)")
+        query.add_argument("--wait", type=float, default=10.0,
+                           help="Seconds to collect reports; hosts answer within this time (default: 10, at most 30)")
+        listen = commands.add_parser("listen", help="Show MLD messages on the link until interrupted")
+        listen.add_argument("interface", help="Interface of the link")
+        options = parser.parse_args(args)
+
+        if not hasattr(socket, "AF_PACKET"):
+            self.logger.error("MLD needs Linux packet sockets")
+            return 1
+        names = {130: "Query", 131: "Report (v1)", 132: "Done (v1)", 143: "Report"}
+        modes = {1: "is include", 2: "is exclude", 3: "to include", 4: "to exclude", 5: "allow", 6: "block"}
+        group = ipaddress.IPv6Address("::")
+        if options.command == "query" and options.group:
+            try:
+                group = ipaddress.IPv6Address(options.group)
+            except ValueError as e:
+                parser.error(str(e))
+            if not group.is_multicast:
+                parser.error(f"{options.group} is not a multicast address")
+        try:
+            capture = self.open_mld_capture(options.interface)
+        except PermissionError:
+            self.logger.error("MLD needs root or CAP_NET_RAW")
+            return 1
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        with capture:
+            if options.command == "listen":
+                self.logger.info(f"MLD messages on {options.interface}; Ctrl+C to stop")
+                try:
+                    while True:
+                        message = self.parse_mld(capture.recv(65535))
+                        if not message:
+                            continue
+                        if message["type"] == 130:
+                            target = "general" if message.get("group") in (None, ipaddress.IPv6Address("::")) \
+                                else str(message["group"])
+                            self.logger.info(f"{time.strftime('%H:%M:%S')} Query (v{message.get('version', 1)}, "
+                                             f"{target}) from {message['source']}, max response "
+                                             f"{message.get('max_response_ms', 0)} ms")
+                            continue
+                        for kind, record_group, sources in message["records"]:
+                            self.logger.info(f"{time.strftime('%H:%M:%S')} {names[message['type']]} from "
+                                             f"{message['source']}: {record_group} {modes.get(kind, kind)}"
+                                             + (f" {', '.join(map(str, sources))}" if sources else ""))
+                except KeyboardInterrupt:
+                    return 0
+
+            if not 0 < options.wait <= 30:
+                parser.error("--wait must be between 0 and 30 seconds")
+            try:
+                with socket.socket(socket.AF_INET6, socket.SOCK_RAW, socket.IPPROTO_ICMPV6) as sock:
+                    index = socket.if_nametoindex(options.interface)
+                    sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_IF, index)
+                    sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_HOPS, 1)
+                    # MLD messages carry a hop-by-hop Router Alert option (value 0, MLD) and PadN
+                    sock.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_HOPOPTS", 54),
+                                    b"\x00\x00\x05\x02\x00\x00\x01\x00")
+                    # General queries go to all nodes, group-specific ones to the group itself
+                    destination = str(group) if options.group else "ff02::1"
+                    sock.sendto(self.mld_query_packet(group, int(options.wait * 1000)), (destination, 0, 0, index))
+            except OSError as e:
+                self.logger.error(f"Cannot send the query: {e}")
+                return 1
+            self.logger.info(f"MLDv2 {'query for ' + str(group) if options.group else 'general query'} sent on "
+                             f"{options.interface}; collecting reports for {options.wait:g} s")
+
+            # group -> {host: membership}
+            groups, queriers = {}, []
+            deadline = time.monotonic() + options.wait
+            while (remaining := deadline - time.monotonic()) > 0:
+                readable, _, _ = select.select([capture], [], [], remaining)
+                if not readable:
+                    break
+                data, (_, _, packet_type, _, _) = capture.recvfrom(65535)
+                message = self.parse_mld(data)
+                if not message:
+                    continue
+                if message["type"] == 130:
+                    # Skip our own query, which the packet socket sees going out
+                    if packet_type != socket.PACKET_OUTGOING and message["source"] not in queriers:
+                        queriers.append(message["source"])
+                    continue
+                for kind, record_group, sources in message["records"]:
+                    membership = self.describe_mld_record(kind, sources)
+                    if membership is None:
+                        groups.get(record_group, {}).pop(message["source"], None)
+                    else:
+                        groups.setdefault(record_group, {})[message["source"]] = membership
+
+        groups = {group: hosts for group, hosts in groups.items() if hosts}
+        if not groups:
+            self.logger.info("No reports; no host on the link listens to multicast, or MLD snooping keeps reports "
+                             "from reaching this port")
+            return 1
+        self.logger.info(f"\n{'Group':<28} {'Host':<28} Membership")
+        for record_group in sorted(groups):
+            for host, membership in sorted(groups[record_group].items()):
+                solicited = " (solicited-node)" if record_group in ipaddress.IPv6Network("ff02::1:ff00:0/104") else ""
+                self.logger.info(f"{str(record_group):<28} {str(host):<28} {membership}{solicited}")
+        hosts = {host for members in groups.values() for host in members}
+        self.logger.info(f"\nHosts reporting: {len(hosts)}, groups: {len(groups)}")
+        if queriers:
+            self.logger.info(f"Queries seen from: {', '.join(map(str, queriers))}")
+        return 0
+
+    def parse_router_advertisement(self, packet: bytes) -> Optional[dict]:
+        """Decode a Router Advertisement (RFC 4861 section 4.2) from an IPv6 packet, with its main options."""
+        if len(packet) < 40 or packet[0] >> 4 != 6:
+            return None
+        next_header, offset = packet[6], 40
+        while next_header in (0, 60) and offset + 8 <= len(packet):
+            next_header, offset = packet[offset], offset + (packet[offset + 1] + 1) * 8
+        message = packet[offset:]
+        if next_header != socket.IPPROTO_ICMPV6 or len(message) < 16 or message[0] != 134:
+            return None
+        current_hop_limit, flags, lifetime, reachable, retransmit = struct.unpack("!BBHII", message[4:16])
+        result = {"source": ipaddress.IPv6Address(packet[8:24]), "hop_limit": packet[7], "lifetime": lifetime,
+                  "current_hop_limit": current_hop_limit, "reachable": reachable, "retransmit": retransmit,
+                  "flags": "".join(name for bit, name in ((0x80, "M"), (0x40, "O")) if flags & bit) or "-",
+                  "preference": {0: "medium", 1: "high", 3: "low"}.get((flags >> 3) & 3, "reserved"),
+                  "lladdr": None, "mtu": None, "prefixes": [], "dns": []}
+        position = 16
+        while position + 2 <= len(message) and message[position + 1]:
+            kind, length = message[position], message[position + 1] * 8
+            option = message[position:position + length]
+            if kind == 1 and length >= 8:
+                result["lladdr"] = ":".join(f"{byte:02x}" for byte in option[2:8])
+            elif kind == 3 and length == 32:
+                valid, preferred = struct.unpack("!II", option[4:12])
+                result["prefixes"].append({"prefix": ipaddress.IPv6Network((option[16:32], option[2]), strict=False),
+                                           "valid": valid, "preferred": preferred,
+                                           "autonomous": bool(option[3] & 0x40)})
+            elif kind == 5 and length == 8:
+                result["mtu"] = struct.unpack("!I", option[4:8])[0]
+            elif kind == 25 and length >= 24:
+                result["dns"] += [str(ipaddress.IPv6Address(option[start:start + 16]))
+                                  for start in range(8, length - 15, 16)]
+            position += length
+        return result
+
+    def ra_conflicts(self, advertisement: dict, other: dict) -> List[str]:
+        """Compare the RAs of two routers on one link (RFC 4861 section 6.2.7) and list what conflicts.
+
+        Each RA carries the monotonic time it was received, since prefix lifetimes may count down in real time
+        (as those delegated by DHCPv6-PD do): they are compared by when they expire, not by their values.
+        """
+        conflicts = []
+        # Zero means unspecified for these, and doesn't conflict with anything
+        for key, label in (("current_hop_limit", "hop limit"), ("reachable", "reachable time (ms)"),
+                           ("retransmit", "retransmit timer (ms)"), ("mtu", "MTU")):
+            if advertisement[key] and other[key] and advertisement[key] != other[key]:
+                conflicts.append(f"{label} {advertisement[key]} vs {other[key]}")
+        if advertisement["flags"] != other["flags"]:
+            conflicts.append(f"M/O flags {advertisement['flags']} vs {other['flags']}")
+        for entry in advertisement["prefixes"]:
+            for theirs in other["prefixes"]:
+                if entry["prefix"] == theirs["prefix"]:
+                    for key in ("valid", "preferred"):
+                        if entry[key] == theirs[key]:
+                            continue
+                        # The infinite lifetime never counts down
+                        if 0xffffffff not in (entry[key], theirs[key]) and \
+                                abs(advertisement["received"] + entry[key] - other["received"] - theirs[key]) \
+                                <= self.RA_LIFETIME_TOLERANCE:
+                            continue
+                        conflicts.append(f"{entry['prefix']} {key} lifetime {entry[key]} s vs {theirs[key]} s")
+                    if entry["autonomous"] != theirs["autonomous"]:
+                        conflicts.append(f"{entry['prefix']} SLAAC {'on' if entry['autonomous'] else 'off'} vs "
+                                         f"{'on' if theirs['autonomous'] else 'off'}")
+                elif entry["prefix"].overlaps(theirs["prefix"]):
+                    conflicts.append(f"{entry['prefix']} overlaps {theirs['prefix']}")
+        return conflicts
+
+    def run_ra_guard(self, args: List[str]) -> int:
+        """Watch a link for Router Advertisements and alert on ones from routers that aren't allowed."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py ra-guard",
+                                         description="Monitor Router Advertisements on one link and alert when one "
+                                                     "comes from a router that isn't on the allowlist, or is invalid "
+                                                     "(hop limit below 255, a source that isn't link-local, a "
+                                                     "link-layer address option that doesn't match the frame), or "
+                                                     "conflicts with another router's RAs (different prefix "
+                                                     "lifetimes, MTU or flags, overlapping prefixes, one address "
+                                                     "from two MACs). Detects rogue RA attacks and misconfigured "
+                                                     "devices, such as a home router or a Windows host sharing its "
+                                                     "connection. Without --allow, it lists the routers it hears so "
+                                                     "you can build the allowlist. Linux only; needs root or "
+                                                     "CAP_NET_RAW.")
+        parser.add_argument("interface", help="Interface of the link")
+        parser.add_argument("--allow", action="append", metavar="ADDRESS_OR_MAC",
+                            help="Router link-local address or MAC that may send RAs, may be repeated")
+        parser.add_argument("--solicit", action="store_true",
+                            help="Send a Router Solicitation at start, so routers answer without waiting for their "
+                                 "next periodic RA")
+        parser.add_argument("--duration", type=float, help="Seconds to monitor (default: until interrupted)")
+        options = parser.parse_args(args)
+
+        if not hasattr(socket, "AF_PACKET"):
+            self.logger.error("RA monitoring needs Linux packet sockets")
+            return 1
+        allowed_addresses, allowed_macs = set(), set()
+        for entry in options.allow or []:
+            if re.fullmatch(r"[0-9a-fA-F]{2}([:-][0-9a-fA-F]{2}){5}", entry):
+                allowed_macs.add(entry.lower().replace("-", ":"))
+                continue
+            try:
+                allowed_addresses.add(ipaddress.IPv6Address(entry.split("%", 1)[0]))
+            except ValueError:
+                parser.error(f"--allow '{entry}' is neither an IPv6 address nor a MAC address")
+        try:
+            capture = self.open_mld_capture(options.interface)
+        except PermissionError:
+            self.logger.error("RA monitoring needs root or CAP_NET_RAW")
+            return 1
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        with capture:
+            if options.solicit:
+                try:
+                    with socket.socket(socket.AF_INET6, socket.SOCK_RAW, socket.IPPROTO_ICMPV6) as sock:
+                        index = socket.if_nametoindex(options.interface)
+                        sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_IF, index)
+                        # Routers drop solicitations that could have come from off-link (RFC 4861 section 6.1.1)
+                        sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_HOPS, 255)
+                        sock.sendto(struct.pack("!BBHI", 133, 0, 0, 0), ("ff02::2", 0, 0, index))
+                except OSError as e:
+                    self.logger.error(f"Cannot send the solicitation: {e}")
+                    return 1
+            self.logger.info(f"Router Advertisements on {options.interface}"
+                             + (f", allowing {', '.join(options.allow)}" if options.allow else
+                                ", no allowlist (listing routers)") + "; Ctrl+C to stop")
+
+            # source -> (what the last RA looked like, the RA), so periodic repeats aren't logged again
+            routers, alerts, rogue, conflicting = {}, 0, set(), set()
+            deadline = time.monotonic() + options.duration if options.duration else None
+            try:
+                while deadline is None or (remaining := deadline - time.monotonic()) > 0:
+                    readable, _, _ = select.select([capture], [], [], None if deadline is None else remaining)
+                    if not readable:
+                        break
+                    data, (_, _, packet_type, _, address) = capture.recvfrom(65535)
+                    advertisement = self.parse_router_advertisement(data)
+                    if not advertisement or packet_type == socket.PACKET_OUTGOING:
+                        continue
+                    advertisement["received"] = time.monotonic()
+                    source, mac = advertisement["source"], ":".join(f"{byte:02x}" for byte in address[:6])
+                    prefixes = ", ".join(f"{entry['prefix']}{' SLAAC' if entry['autonomous'] else ''}"
+                                         for entry in advertisement["prefixes"])
+                    summary = (f"lifetime {advertisement['lifetime']} s, preference {advertisement['preference']}, "
+                               f"flags {advertisement['flags']}" + (f", prefixes {prefixes}" if prefixes else "")
+                               + (f", MTU {advertisement['mtu']}" if advertisement["mtu"] else "")
+                               + (f", DNS {', '.join(advertisement['dns'])}" if advertisement["dns"] else ""))
+                    seen = (mac, summary, advertisement["hop_limit"], advertisement["lladdr"])
+                    previous = routers.get(source)
+                    if previous and previous[0] == seen:
+                        continue
+                    routers[source] = (seen, advertisement)
+                    problems = []
+                    if previous and previous[0][0] != mac:
+                        problems.append(f"the same router address was advertised from {previous[0][0]}; two "
+                                        f"devices claim it")
+                    if options.allow and source not in allowed_addresses and mac not in allowed_macs:
+                        problems.append("router is not on the allowlist")
+                        rogue.add(source)
+                    if not source.is_link_local:
+                        problems.append("source is not link-local, so hosts must ignore it")
+                    if advertisement["hop_limit"] != 255:
+                        problems.append(f"hop limit {advertisement['hop_limit']} instead of 255, so it may come "
+                                        f"from another link; hosts ignore it")
+                    if advertisement["lladdr"] and advertisement["lladdr"] != mac:
+                        problems.append(f"link-layer address option {advertisement['lladdr']} doesn't match the "
+                                        f"frame's source, a sign of spoofing")
+                    for other, (_, theirs) in routers.items():
+                        conflicts = self.ra_conflicts(advertisement, theirs) if other != source else []
+                        if conflicts:
+                            problems.append(f"conflicts with {other}: {', '.join(conflicts)}")
+                            conflicting.update((source, other))
+                    line = f"{time.strftime('%H:%M:%S')} RA from {source} ({mac}): {summary}"
+                    if problems:
+                        alerts += 1
+                        self.logger.warning(f"{line}\n  ALERT: {'; '.join(problems)}")
+                    else:
+                        self.logger.info(line)
+            except KeyboardInterrupt:
+                pass
+
+        self.logger.info(f"\nRouters heard: {len(routers)}"
+                         + (f" ({', '.join(map(str, sorted(rogue)))} not allowed)" if rogue else ""))
+        if conflicting:
+            self.logger.info(f"Routers with conflicting RAs: {', '.join(map(str, sorted(conflicting)))}")
+        if not routers:
+            self.logger.info("No Router Advertisements; try --solicit, or the link has no IPv6 router")
+        return 1 if alerts else 0
+
+    def neighbor_states(self, interface: str) -> dict:
+        """Count the kernel's IPv6 neighbor entries on an interface by state (Linux, iproute2)."""
+        counts = {}
+        for entry in self.ip_json("-6", "neigh", "show", "dev", interface):
+            for state in entry.get("state", ["NONE"]):
+                counts[state] = counts.get(state, 0) + 1
+        return counts
+
+    def drain_scan_errors(self, sock: socket.socket, errors: dict) -> None:
+        """Count the ICMPv6 errors queued for the scan socket by type and code."""
+        while True:
+            try:
+                _, ancillary, _, _ = sock.recvmsg(512, 512, socket.MSG_ERRQUEUE | socket.MSG_DONTWAIT)
+            except (BlockingIOError, InterruptedError):
+                return
+            for level, _, cmsg in ancillary:
+                if level == socket.IPPROTO_IPV6 and len(cmsg) >= 16:
+                    origin, icmp_type, icmp_code = struct.unpack("!BBB", cmsg[4:7])
+                    if origin == self.SO_EE_ORIGIN_ICMP6:
+                        errors[(icmp_type, icmp_code)] = errors.get((icmp_type, icmp_code), 0) + 1
+
+    def run_ndp_scan(self, args: List[str]) -> int:
+        """Lab only: send to many addresses in a /64 and watch how the neighbor cache copes."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py ndp-scan",
+                                         description="LAB ONLY. Simulate NDP exhaustion: send one UDP datagram to "
+                                                     "each of many random addresses in a target /64, so the router "
+                                                     "on that link (or this host, if the /64 is on-link) has to "
+                                                     "solicit every one of them, and measure how its neighbor cache "
+                                                     "copes: address-unreachable errors coming back, the latency "
+                                                     "and loss of a canary host on the link, and on-link the "
+                                                     "kernel's own neighbor entries. Safety interlocks: it needs "
+                                                     "--lab, refuses global prefixes without --allow-global, caps "
+                                                     "the rate and count, sends with hop limit 2 so only the "
+                                                     "first-hop router's links are reached, and stops as soon as "
+                                                     "the canary loses too many probes. Only run it on networks "
+                                                     "you operate.")
+        parser.add_argument("prefix", type=ipaddress.IPv6Network, help="Target /64")
+        parser.add_argument("--lab", action="store_true",
+                            help="Confirm that the target is a lab network you operate (required)")
+        parser.add_argument("--allow-global", action="store_true",
+                            help="Allow a global unicast prefix; by default only ULA and documentation prefixes")
+        parser.add_argument("--count", type=int, default=1000,
+                            help=f"Addresses to send to (default: 1000, at most {self.NDP_SCAN_MAX_ADDRESSES})")
+        parser.add_argument("--rate", type=float, default=50.0,
+                            help=f"Addresses per second (default: 50, at most {self.NDP_SCAN_MAX_RATE})")
+        parser.add_argument("--canary", help="Live host on the target link to probe every second (default: none)")
+        parser.add_argument("--stop-loss", type=float, default=50.0,
+                            help="Stop when the canary loses this many percent of its last 5 probes (default: 50)")
+        parser.add_argument("--settle", type=float, default=10.0,
+                            help="Seconds to keep measuring after the last datagram (default: 10)")
+        options = parser.parse_args(args)
+
+        if not options.lab:
+            parser.error("this floods a neighbor cache; confirm with --lab that the target is a lab network you "
+                         "operate")
+        prefix = options.prefix
+        if prefix.prefixlen != 64:
+            parser.error("the target must be a /64")
+        if prefix.network_address.is_global and not options.allow_global:
+            parser.error(f"{prefix} is global unicast; pass --allow-global if it is really your lab's")
+        if not 1 <= options.count <= self.NDP_SCAN_MAX_ADDRESSES:
+            parser.error(f"--count must be between 1 and {self.NDP_SCAN_MAX_ADDRESSES}")
+        if not 0 < options.rate <= self.NDP_SCAN_MAX_RATE:
+            parser.error(f"--rate must be between 0 and {self.NDP_SCAN_MAX_RATE} addresses per second")
+        if not 0 < options.stop_loss <= 100:
+            parser.error("--stop-loss must be between 0 and 100")
+        canary = None
+        if options.canary:
+            canary = self.probe_target(options.canary)
+            if canary is None:
+                return 1
+        if not self.has_route(socket.AF_INET6, str(prefix.network_address + 1)):
+            self.logger.error(f"No route to {prefix}")
+            return 1
+        local = next((candidate for candidate in self.address_candidates()
+                      if candidate["address"] in prefix and candidate["prefix"] == 64), None)
+
+        try:
+            probe, method = self.open_probe_socket("auto") if canary else (None, None)
+        except PermissionError as e:
+            self.logger.error(str(e))
+            return 1
+        scan = socket.socket(socket.AF_INET6, socket.SOCK_DGRAM)
+        # A hop limit of 2 reaches the first-hop router's links and expires anywhere further away
+        scan.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_UNICAST_HOPS, 2)
+        if sys.platform.startswith("linux"):
+            scan.setsockopt(socket.IPPROTO_IPV6, getattr(socket, "IPV6_RECVERR", 25), 1)
+
+        ident, seq = os.getpid() & 0xffff, 0
+        canary_results = {"before": [], "during": [], "after": []}
+        neighbors_peak = {}
+
+        def probe_canary(phase: str) -> None:
+            nonlocal seq
+            seq = (seq + 1) & 0xffff
+            started = time.monotonic()
+            try:
+                self.send_probe(probe, method, canary, ident, seq, 56, 33434)
+                reply = self.await_probe(probe, method, ident, seq, started + 1.0)
+            except OSError:
+                reply = None
+            ok = reply is not None and reply[0] == "reply"
+            canary_results[phase].append((time.monotonic() - started) * 1000 if ok else None)
+
+        def sample_neighbors() -> None:
+            try:
+                for state, number in self.neighbor_states(local["interface"]).items():
+                    neighbors_peak[state] = max(neighbors_peak.get(state, 0), number)
+            except (OSError, ValueError):
+                pass
+
+        target = (f"this host's neighbor cache on {local['interface']}" if local
+                  else "the neighbor cache of the router attached to it")
+        self.logger.info(f"NDP exhaustion test against {prefix}: {options.count} addresses at {options.rate:g}/s, "
+                         f"pressuring {target}" + (f"; canary {canary}" if canary else ""))
+        errors, sent, stopped = {}, 0, None
+        try:
+            with scan:
+                for _ in range(3 if canary else 0):
+                    probe_canary("before")
+                next_check = time.monotonic() + 1.0
+                started = time.monotonic()
+                while sent < options.count:
+                    address = ipaddress.IPv6Address(int(prefix.network_address) | random.getrandbits(64))
+                    if str(address) != canary and address != (local["address"] if local else None):
+                        # Read the errors for earlier datagrams first, or a pending one fails this send
+                        self.drain_scan_errors(scan, errors)
+                        scan.getsockopt(socket.SOL_SOCKET, socket.SO_ERROR)
+                        try:
+                            scan.sendto(b"\x00", (str(address), 9))
+                        except OSError as e:
+                            # The local kernel refusing to queue more unresolved packets is a result too
+                            errors[("send", e.strerror)] = errors.get(("send", e.strerror), 0) + 1
+                        sent += 1
+                    if time.monotonic() >= next_check:
+                        next_check += 1.0
+                        if local:
+                            sample_neighbors()
+                        if canary:
+                            probe_canary("during")
+                            recent = canary_results["during"][-5:]
+                            lost = 100 * sum(1 for rtt in recent if rtt is None) / len(recent)
+                            if len(recent) >= 2 and lost >= options.stop_loss:
+                                stopped = f"canary lost {lost:.0f}% of its last {len(recent)} probes"
+                                break
+                    time.sleep(max(0.0, started + sent / options.rate - time.monotonic()))
+                if stopped:
+                    self.logger.warning(f"Stopped after {sent} addresses: {stopped}")
+                else:
+                    self.logger.info(f"Sent to {sent} addresses; measuring for {options.settle:g} s more")
+                settle_end = time.monotonic() + options.settle
+                while time.monotonic() < settle_end:
+                    if local:
+                        sample_neighbors()
+                    if canary:
+                        probe_canary("after")
+                    time.sleep(max(0.0, min(1.0, settle_end - time.monotonic())))
+                self.drain_scan_errors(scan, errors)
+        except KeyboardInterrupt:
+            self.logger.info("\nInterrupted")
+        finally:
+            if probe:
+                probe.close()
+
+        self.logger.info(f"\nDatagrams sent: {sent}")
+        unreachable = errors.get((1, 3), 0)
+        self.logger.info(f"Address unreachable errors: {unreachable}")
+        for (kind, code), number in sorted(errors.items(), key=str):
+            if kind == "send":
+                self.logger.info(f"Local send failures ({code}): {number}")
+            elif (kind, code) != (1, 3):
+                self.logger.info(f"Other ICMPv6 errors (type {kind}, code {code}): {number}")
+        if not local and sent and unreachable < sent / 10:
+            self.logger.info("  The router reported few failed resolutions: it drops packets for unresolved "
+                             "addresses silently, rate-limits its ICMPv6 errors, or its neighbor cache filled up")
+        if local:
+            self.logger.info(f"Peak neighbor entries on {local['interface']}: "
+                             + (", ".join(f"{state} {number}" for state, number in sorted(neighbors_peak.items()))
+                                or "unknown"))
+            try:
+                with open("/proc/sys/net/ipv6/neigh/default/gc_thresh3") as f:
+                    self.logger.info(f"  Kernel limit (net.ipv6.neigh.default.gc_thresh3): {f.read().strip()}")
+            except OSError:
+                pass
+        for phase, results in canary_results.items():
+            if not results:
+                continue
+            replies = sorted(rtt for rtt in results if rtt is not None)
+            summary = f"median {replies[len(replies) // 2]:.1f} ms" if replies else "no replies"
+            self.logger.info(f"Canary {phase:<6} the scan: {len(replies)}/{len(results)} replies, {summary}")
+        return 1 if stopped else 0
+
+    def solicited_node_address(self, address: ipaddress.IPv6Address) -> ipaddress.IPv6Address:
+        """Return the solicited-node multicast address: ff02::1:ff00:0/104 plus the low 24 bits (RFC 4291 2.7.1)."""
+        return ipaddress.IPv6Address(int(ipaddress.IPv6Address("ff02::1:ff00:0")) | (int(address) & 0xffffff))
+
+    def multicast_mac(self, address: ipaddress.IPv6Address) -> str:
+        """Return the Ethernet MAC of an IPv6 multicast address: 33:33 plus the low 32 bits (RFC 2464 section 7)."""
+        return ":".join(f"{byte:02x}" for byte in b"\x33\x33" + address.packed[12:])
+
+    def run_solicited(self, args: List[str]) -> int:
+        """Compute solicited-node multicast addresses and their Ethernet MACs."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py solicited",
+                                         description="Compute the solicited-node multicast address that NDP uses for "
+                                                     "each IPv6 address, and the Ethernet multicast MAC it maps to, "
+                                                     "for switch filters and NDP debugging. Multicast addresses are "
+                                                     "mapped to their MAC directly. Addresses that share a "
+                                                     "solicited-node group are reported.")
+        parser.add_argument("addresses", nargs="*",
+                            help="Addresses (default: read one per line from --file or stdin)")
+        parser.add_argument("--file", help="Read addresses from this file")
+        options = parser.parse_args(args)
+
+        try:
+            entries = list(enumerate(options.addresses, start=1)) if options.addresses \
+                else self.read_entries(options.file)
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        rows, groups = [], {}
+        for number, entry in entries:
+            try:
+                address = ipaddress.IPv6Address(entry.split("/", 1)[0])
+            except ValueError as e:
+                self.logger.error(f"Error: entry {number} '{entry}': {e}")
+                return 1
+            group = address if address.is_multicast else self.solicited_node_address(address)
+            rows.append((str(address), "(multicast)" if address.is_multicast else str(group),
+                         self.multicast_mac(group)))
+            if not address.is_multicast:
+                groups.setdefault(group, set()).add(address)
+        if not rows:
+            self.logger.error("Error: No addresses given")
+            return 1
+
+        width = max(len("Address"), *(len(row[0]) for row in rows))
+        self.logger.info(f"{'Address'.ljust(width)}  {'Solicited-node':<22}  Ethernet MAC")
+        for address, group, mac in rows:
+            self.logger.info(f"{address.ljust(width)}  {group:<22}  {mac}")
+        for group, members in groups.items():
+            if len(members) > 1:
+                self.logger.info(f"Shared group {group}: {', '.join(map(str, sorted(members)))}")
+        return 0
+
+    def wol_packet(self, mac: bytes, password: bytes = b"") -> bytes:
+        """Build a Wake-on-LAN magic packet: six 0xff bytes, the MAC 16 times, and an optional SecureOn password."""
+        return b"\xff" * 6 + mac * 16 + password
+
+    def run_wol(self, args: List[str]) -> int:
+        """Send Wake-on-LAN magic packets as IPv6 UDP datagrams."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py wol",
+                                         description="Wake machines on IPv6-only networks with Wake-on-LAN magic "
+                                                     "packets in UDP datagrams. By default the packet goes to the "
+                                                     "all-nodes group ff02::1 on --interface, which reaches every NIC "
+                                                     "on the link. --address sends it to one address instead. That "
+                                                     "only works while the neighbor cache still has the sleeping "
+                                                     "machine, or its NIC answers neighbor solicitations.")
+        parser.add_argument("mac", help="MAC address of the machine to wake (EUI-48)")
+        parser.add_argument("--interface", help="Interface of the link, for the multicast packet")
+        parser.add_argument("--address", help="Send to this IPv6 address instead of ff02::1")
+        parser.add_argument("--port", type=int, default=9, help="UDP port (default: 9, discard)")
+        parser.add_argument("--password", help="SecureOn password, as a MAC-style 6-byte or dotted 4-byte value")
+        parser.add_argument("--count", type=int, default=3, help="Packets to send, 100 ms apart (default: 3)")
+        options = parser.parse_args(args)
+
+        try:
+            mac = self.parse_link_layer_address(options.mac)
+            if len(mac) != 6:
+                raise ValueError("Wake-on-LAN needs a 6-byte MAC address")
+            password = b""
+            if options.password:
+                password = bytes(int(part) for part in options.password.split(".")) if "." in options.password \
+                    else self.parse_link_layer_address(options.password)
+                if len(password) not in (4, 6):
+                    raise ValueError("the SecureOn password must be 4 or 6 bytes")
+        except ValueError as e:
+            parser.error(str(e))
+        if not options.address and not options.interface:
+            parser.error("give --interface for the multicast packet, or --address")
+        if not 1 <= options.count <= 100:
+            parser.error("--count must be between 1 and 100")
+
+        destination = options.address or "ff02::1"
+        try:
+            scope = socket.if_nametoindex(options.interface) if options.interface else 0
+            address = socket.getaddrinfo(destination, options.port, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+            with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+                if scope:
+                    sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_MULTICAST_IF, scope)
+                    target = ipaddress.IPv6Address(address[0])
+                    if target.is_link_local or target.is_multicast:
+                        address = (address[0], address[1], 0, scope)
+                packet = self.wol_packet(mac, password)
+                for index in range(options.count):
+                    sock.sendto(packet, address)
+                    if index + 1 < options.count:
+                        time.sleep(0.1)
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        shown = f"[{destination}%{options.interface}]" if scope and address[3] else f"[{destination}]"
+        self.logger.info(f"Magic packet for {':'.join(f'{byte:02x}' for byte in mac)} sent {options.count}x to "
+                         f"{shown}:{options.port}")
+        return 0
+
+    def der_element(self, tag: int, content: bytes) -> bytes:
+        """Encode one BER/DER element with a definite length."""
+        if len(content) < 0x80:
+            return bytes([tag, len(content)]) + content
+        length = len(content).to_bytes((len(content).bit_length() + 7) // 8, "big")
+        return bytes([tag, 0x80 | len(length)]) + length + content
+
+    def encode_oid(self, oid: str) -> bytes:
+        """Encode a dotted object identifier as BER contents."""
+        parts = [int(part) for part in oid.split(".")]
+        encoded = b""
+        for value in [parts[0] * 40 + parts[1]] + parts[2:]:
+            chunk = [value & 0x7f]
+            while value := value >> 7:
+                chunk.append(0x80 | (value & 0x7f))
+            encoded += bytes(reversed(chunk))
+        return encoded
+
+    def decode_oid(self, data: bytes) -> str:
+        """Decode BER object identifier contents to dotted form."""
+        values, value = [], 0
+        for byte in data:
+            value = (value << 7) | (byte & 0x7f)
+            if not byte & 0x80:
+                values.append(value)
+                value = 0
+        if not values:
+            return ""
+        first = values[0]
+        return ".".join(map(str, [min(first // 40, 2), first - 40 * min(first // 40, 2)] + values[1:]))
+
+    def snmp_request(self, sock: socket.socket, community: str, version: int, pdu_type: int,
+                     oids: List[str]) -> List[Tuple[str, int, bytes]]:
+        """Send one SNMPv1/v2c request and return the response's (oid, type, value) bindings."""
+        request_id = secrets.randbits(31)
+        bindings = b"".join(self.der_element(0x30, self.der_element(0x06, self.encode_oid(oid)) + b"\x05\x00")
+                            for oid in oids)
+        # INTEGERs are encoded in the fewest octets that keep them positive (X.690 section 8.3.2)
+        request = request_id.to_bytes((request_id.bit_length() + 8) // 8, "big")
+        pdu = self.der_element(pdu_type, self.der_element(0x02, request) + b"\x02\x01\x00"
+                               + b"\x02\x01\x00" + self.der_element(0x30, bindings))
+        message = self.der_element(0x30, self.der_element(0x02, bytes([version]))
+                                   + self.der_element(0x04, community.encode()) + pdu)
+        sock.send(message)
+        while True:
+            data = sock.recv(65535)
+            try:
+                _, _, response = self.der_children(self.der_read(data, 0)[1])
+                fields = self.der_children(response[1])
+                if response[0] != 0xa2 or int.from_bytes(fields[0][1], "big") != request_id:
+                    continue
+                status, index = int.from_bytes(fields[1][1], "big"), int.from_bytes(fields[2][1], "big")
+                results = []
+                for _, binding in self.der_children(fields[3][1]):
+                    (_, oid), (kind, value) = self.der_children(binding)
+                    results.append((self.decode_oid(oid), kind, value))
+            except (IndexError, ValueError):
+                # Not a response we can parse; keep waiting for ours
+                continue
+            if status:
+                name = self.SNMP_ERRORS.get(status, f"error {status}")
+                raise ValueError(f"agent returned {name}" + (f" for {oids[index - 1]}" if 0 < index <= len(oids) else ""))
+            return results
+
+    def format_snmp_value(self, kind: int, value: bytes) -> str:
+        """Render an SNMP value by its BER or SMI application type."""
+        if kind == 0x04:
+            # Multi-line text such as many sysDescr values goes on one line; only binary data is shown as hex
+            try:
+                text = " ".join(value.decode().split())
+            except UnicodeDecodeError:
+                return value.hex(":")
+            return text if text.isprintable() else value.hex(":")
+        if kind == 0x02:
+            return str(int.from_bytes(value, "big", signed=True))
+        if kind == 0x06:
+            return self.decode_oid(value)
+        if kind == 0x40 and len(value) == 4:
+            return str(ipaddress.IPv4Address(value))
+        if kind == 0x43:
+            seconds = int.from_bytes(value, "big") // 100
+            return f"{seconds // 86400}d {seconds % 86400 // 3600:02d}:{seconds % 3600 // 60:02d}:{seconds % 60:02d}"
+        if kind in (0x41, 0x42, 0x46):
+            return str(int.from_bytes(value, "big"))
+        return {0x05: "(null)", 0x80: "(no such object)", 0x81: "(no such instance)",
+                0x82: "(end of MIB view)"}.get(kind, value.hex())
+
+    def run_snmp(self, args: List[str]) -> int:
+        """Query an SNMP agent over IPv6 for its system description and interfaces."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py snmp",
+                                         description="Check that a network device can be managed over IPv6. Sends "
+                                                     "an SNMPv2c (or v1) GET for the system group, then walks "
+                                                     "ifTable, to the device's IPv6 address. SNMPv3 is not supported.")
+        parser.add_argument("host", help="Hostname or IPv6 address of the device")
+        parser.add_argument("--community", default="public", help="Community string (default: public)")
+        parser.add_argument("--version", choices=["1", "2c"], default="2c", help="SNMP version (default: 2c)")
+        parser.add_argument("--port", type=int, default=161, help="UDP port (default: 161)")
+        parser.add_argument("--timeout", type=float, default=2.0, help="Seconds to wait per attempt (default: 2)")
+        parser.add_argument("--retries", type=int, default=2, help="Retries per request (default: 2)")
+        parser.add_argument("--no-interfaces", action="store_true", help="Skip the ifTable walk")
+        parser.add_argument("--max-interfaces", type=int, default=200,
+                            help="Stop the ifTable walk after this many rows (default: 200)")
+        options = parser.parse_args(args)
+
+        version = 0 if options.version == "1" else 1
+        try:
+            address = socket.getaddrinfo(options.host, options.port, socket.AF_INET6, socket.SOCK_DGRAM)[0][4]
+        except socket.gaierror as e:
+            self.logger.error(f"Cannot resolve {options.host} to an IPv6 address: {e}")
+            return 1
+
+        with socket.socket(socket.AF_INET6, socket.SOCK_DGRAM) as sock:
+            sock.connect(address)
+            sock.settimeout(options.timeout)
+
+            def request(pdu_type: int, oids: List[str]) -> List[Tuple[str, int, bytes]]:
+                for attempt in range(options.retries + 1):
+                    try:
+                        return self.snmp_request(sock, options.community, version, pdu_type, oids)
+                    except socket.timeout:
+                        if attempt == options.retries:
+                            raise
+
+            self.logger.info(f"SNMPv{options.version} to [{address[0]}]:{address[1]}:")
+            try:
+                started = time.monotonic()
+                system = request(0xa0, list(self.SNMP_SYSTEM.values()))
+                elapsed = (time.monotonic() - started) * 1000
+                for name, (_, kind, value) in zip(self.SNMP_SYSTEM, system):
+                    self.logger.info(f"  {(name + ':').ljust(13)}{self.format_snmp_value(kind, value)}")
+                self.logger.info(f"  Response in {elapsed:.1f} ms")
+                if options.no_interfaces:
+                    return 0
+
+                rows, current = [], [f"{self.SNMP_IF_ENTRY}.{column}" for column in self.SNMP_IF_COLUMNS.values()]
+                while len(rows) < options.max_interfaces:
+                    try:
+                        row = request(0xa1, current)
+                    except ValueError:
+                        # SNMPv1 agents end a walk at the end of their MIB with noSuchName
+                        if version:
+                            raise
+                        break
+                    # The walk is done when the first column leaves ifDescr
+                    if len(row) != len(current) or not row[0][0].startswith(f"{self.SNMP_IF_ENTRY}.2.") \
+                            or row[0][1] in (0x80, 0x81, 0x82):
+                        break
+                    rows.append((row[0][0].rsplit(".", 1)[1], [self.format_snmp_value(kind, value)
+                                                               for _, kind, value in row]))
+                    current = [oid for oid, _, _ in row]
+            except socket.timeout:
+                self.logger.error(f"  No response after {options.retries + 1} attempts: UDP {options.port} is "
+                                  f"blocked over IPv6, the agent only listens on IPv4 (net-snmp needs "
+                                  f"'agentAddress udp6:161'), or the community is wrong (agents ignore those)")
+                return 1
+            except (OSError, ValueError) as e:
+                self.logger.error(f"  Error: {e}")
+                return 1
+
+        self.logger.info(f"\nInterfaces (ifTable, {len(rows)} rows):")
+        self.logger.info(f"  {'Index':<7}{'Description':<28}{'Admin':<7}{'Oper':<7}Speed")
+        for index, (description, admin, oper, speed) in rows:
+            admin = self.SNMP_IF_STATUS.get(admin, admin)
+            oper = self.SNMP_IF_STATUS.get(oper, oper)
+            speed = f"{int(speed) // 1000000} Mbit/s" if speed.isdigit() else speed
+            self.logger.info(f"  {index:<7}{description[:27]:<28}{admin:<7}{oper:<7}{speed}")
+        return 0
+
+    def has_route(self, family: int, destination: str) -> bool:
+        """Report whether the host has a route to destination; connecting a UDP socket sends nothing."""
+        with socket.socket(family, socket.SOCK_DGRAM) as sock:
+            try:
+                sock.connect((destination, 53))
+                return True
+            except OSError:
+                return False
+
+    def nameserver_findings(self, servers: List[str], source: str, ipv4: bool, ipv6: bool) -> List[Tuple[str, str]]:
+        """Check a list of resolver addresses against the address families the host can reach."""
+        findings = []
+
+        def local(server: str) -> bool:
+            # Loopback resolvers (a local unbound or dnsmasq) and link-local ones don't need a route
+            try:
+                address = ipaddress.ip_address(server.split("%", 1)[0])
+            except ValueError:
+                return False
+            return address.is_loopback or address.is_unspecified or address.is_link_local
+
+        remote = [server for server in servers if not local(server)]
+        v4 = [server for server in remote if ":" not in server]
+        v6 = [server for server in remote if ":" in server]
+        if v4 and not ipv4:
+            if not v6 and len(remote) == len(servers):
+                findings.append(("FAIL", f"{source}: every resolver in use is IPv4 ({', '.join(v4)}), but this host has no "
+                                         f"IPv4 route, so no name resolves"))
+            else:
+                findings.append(("WARN", f"{source}: IPv4 resolvers {', '.join(v4)} are unreachable without an IPv4 "
+                                         f"route; each query waits for them to time out"))
+        if v6 and not ipv6:
+            findings.append(("FAIL" if not v4 and len(remote) == len(servers) else "WARN",
+                             f"{source}: IPv6 resolvers {', '.join(v6)} are unreachable without an IPv6 route"))
+        for server in servers:
+            if server.lower().startswith("fe80") and "%" not in server:
+                findings.append(("FAIL", f"{source}: link-local resolver {server} has no %interface zone"))
+        return findings
+
+    def resolv_conf_findings(self, path: str, ipv4: bool, ipv6: bool) -> List[Tuple[str, str]]:
+        """Audit a resolv.conf(5) file for IPv6 problems."""
+        with open(path) as f:
+            lines = [line.split() for line in f if line.strip() and not line.lstrip().startswith(("#", ";"))]
+        servers = [fields[1] for fields in lines if fields[0] == "nameserver" and len(fields) > 1]
+        options = [option for fields in lines if fields[0] == "options" for option in fields[1:]]
+        self.logger.info(f"{path}: nameservers {', '.join(servers) or 'none'}"
+                         + (f"; options {' '.join(options)}" if options else ""))
+        findings = []
+        if not servers:
+            findings.append(("WARN", f"{path}: no nameserver lines; the resolver falls back to the local host"))
+        # glibc and musl only use the first MAXNS (3) nameservers
+        if len(servers) > 3:
+            ignored = servers[3:]
+            findings.append(("WARN" if any(":" in server for server in ignored) else "INFO",
+                             f"{path}: only the first 3 nameservers are used; {', '.join(ignored)} are ignored"))
+        if "no-aaaa" in options:
+            findings.append(("FAIL", f"{path}: options no-aaaa suppresses every AAAA lookup"))
+        if "inet6" in options:
+            findings.append(("WARN", f"{path}: options inet6 is obsolete and maps IPv4 answers into IPv6 addresses"))
+        if servers == ["127.0.0.53"] and os.path.exists("/run/systemd/resolve/resolv.conf"):
+            # The systemd-resolved stub; its upstream servers are what matter
+            findings += self.resolv_conf_findings("/run/systemd/resolve/resolv.conf", ipv4, ipv6)
+        else:
+            findings += self.nameserver_findings(servers[:3], path, ipv4, ipv6)
+        return findings
+
+    def hosts_findings(self, path: str) -> List[Tuple[str, str]]:
+        """Audit a hosts file for loopback overrides and unusable IPv6 entries."""
+        local_names = {"localhost", "localhost.localdomain", "ip6-localhost", "ip6-loopback", "localhost6",
+                       "localhost6.localdomain6", socket.gethostname().lower(), socket.getfqdn().lower()}
+        findings, localhost_v6 = [], False
+        with open(path, errors="replace") as f:
+            for number, line in enumerate(f, 1):
+                fields = line.split("#", 1)[0].split()
+                if len(fields) < 2:
+                    continue
+                text, names = fields[0], [name.lower() for name in fields[1:]]
+                try:
+                    address = ipaddress.ip_address(text.split("%", 1)[0])
+                except ValueError:
+                    findings.append(("WARN", f"{path}:{number}: '{text}' is not an address; the line is ignored"))
+                    continue
+                if address.version == 4:
+                    continue
+                if address.is_loopback:
+                    localhost_v6 = localhost_v6 or "localhost" in names
+                    pinned = [name for name in names if name not in local_names]
+                    if pinned:
+                        findings.append(("WARN", f"{path}:{number}: {', '.join(pinned)} pinned to ::1; connections "
+                                                 f"stay on this host, a common stale override"))
+                elif address.is_link_local and "%" not in text:
+                    findings.append(("WARN", f"{path}:{number}: link-local {text} for {', '.join(names)} has no "
+                                             f"%interface zone"))
+                elif address.is_site_local:
+                    findings.append(("WARN", f"{path}:{number}: {text} is in the deprecated site-local fec0::/10"))
+                elif address in self.NAT64_PREFIX:
+                    findings.append(("WARN", f"{path}:{number}: {text} is a NAT64 address; it breaks when the "
+                                             f"NAT64 prefix changes"))
+        if not localhost_v6:
+            findings.append(("WARN", f"{path}: localhost has no ::1 entry, so IPv6 loopback by name may fail"))
+        return findings
+
+    def windows_resolver_findings(self, ipv4: bool, ipv6: bool) -> List[Tuple[str, str]]:
+        """Audit interface DNS servers, NRPT rules and DisabledComponents in the Windows registry."""
+        import winreg
+
+        def values(path: str):
+            try:
+                with winreg.OpenKey(winreg.HKEY_LOCAL_MACHINE, path) as key:
+                    index = 0
+                    while True:
+                        try:
+                            name, value, _ = winreg.EnumValue(key, index)
+                        except OSError:
+                            return
+                        yield name, value
+                        index += 1
+            except OSError:
+                return
+
+        def subkeys(path: str) -> List[str]:
+            try:
+                with winreg.OpenKey(winreg.HKEY_LOCAL_MACHINE, path) as key:
+                    return [f"{path}\\{winreg.EnumKey(key, index)}" for index in range(winreg.QueryInfoKey(key)[0])]
+            except OSError:
+                return []
+
+        findings = []
+        disabled = dict(values(r"SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters")).get("DisabledComponents", 0)
+        if disabled & 0xff == 0xff:
+            findings.append(("FAIL", f"DisabledComponents 0x{disabled:x} disables IPv6 on every interface"))
+        elif disabled & 0x20:
+            findings.append(("WARN", f"DisabledComponents 0x{disabled:x} prefers IPv4 over IPv6 in address selection"))
+        servers = []
+        for family in ("Tcpip", "Tcpip6"):
+            for interface in subkeys(rf"SYSTEM\CurrentControlSet\Services\{family}\Parameters\Interfaces"):
+                settings = dict(values(interface))
+                listed = settings.get("NameServer") or settings.get("DhcpNameServer") or ""
+                servers += [server for server in re.split(r"[\s,;]+", listed) if server]
+        servers = list(dict.fromkeys(servers))
+        self.logger.info(f"Interface DNS servers: {', '.join(servers) or 'none'}")
+        findings += self.nameserver_findings(servers, "interface DNS servers", ipv4, ipv6)
+        for root in (r"SOFTWARE\Policies\Microsoft\Windows NT\DNSClient\DnsPolicyConfig",
+                     r"SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig"):
+            for rule in subkeys(root):
+                settings = dict(values(rule))
+                namespaces = settings.get("Name") or []
+                namespaces = ", ".join(namespaces if isinstance(namespaces, list) else [namespaces])
+                rule_servers = [server for server in re.split(r"[\s,;]+", settings.get("GenericDNSServers", ""))
+                                if server]
+                self.logger.info(f"NRPT rule for {namespaces}: {', '.join(rule_servers) or 'no servers'}")
+                findings += self.nameserver_findings(rule_servers, f"NRPT rule for {namespaces}", ipv4, ipv6)
+        return findings
+
+    def run_resolver_check(self, args: List[str]) -> int:
+        """Audit the resolver configuration and hosts file for IPv6 misconfigurations."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py resolver-check",
+                                         description="Inspect /etc/resolv.conf (or the Windows interface DNS "
+                                                     "servers and NRPT rules) and the hosts file for IPv6 "
+                                                     "misconfigurations: IPv4-only resolvers on an IPv6-only host, "
+                                                     "settings that suppress AAAA lookups, and stale ::1 overrides.")
+        parser.add_argument("--resolv-conf",
+                            help="resolv.conf file to audit (default: /etc/resolv.conf, or the registry on Windows)")
+        parser.add_argument("--hosts", help="Hosts file to audit (default: the system's)")
+        options = parser.parse_args(args)
+
+        ipv4 = self.has_route(socket.AF_INET, "192.0.2.1")
+        ipv6 = self.has_route(socket.AF_INET6, self.DEFAULT_RESOLVER)
+        shape = "dual-stack" if ipv4 and ipv6 else "IPv6-only" if ipv6 else "IPv4-only" if ipv4 else "offline"
+        self.logger.info(f"Routes: IPv4 {'yes' if ipv4 else 'no'}, IPv6 {'yes' if ipv6 else 'no'} ({shape} host)")
+        findings = []
+        if sys.platform == "win32" and options.resolv_conf is None:
+            findings += self.windows_resolver_findings(ipv4, ipv6)
+        else:
+            resolv_conf = options.resolv_conf or "/etc/resolv.conf"
+            try:
+                findings += self.resolv_conf_findings(resolv_conf, ipv4, ipv6)
+            except OSError as e:
+                findings.append(("WARN", f"cannot read {resolv_conf}: {e.strerror}"))
+        hosts = options.hosts or (os.path.join(os.environ.get("SystemRoot", r"C:\Windows"), "System32", "drivers",
+                                               "etc", "hosts") if sys.platform == "win32" else "/etc/hosts")
+        try:
+            findings += self.hosts_findings(hosts)
+        except OSError as e:
+            findings.append(("WARN", f"cannot read {hosts}: {e.strerror}"))
+
+        self.logger.info("\nFindings:" if findings else "\nNo IPv6 resolver misconfigurations found")
+        for status, detail in findings:
+            self.logger.info(f"  [{status}] {detail}")
+        return 1 if any(status == "FAIL" for status, _ in findings) else 0
+
+    def windows_prefix_policies(self) -> List[Tuple[ipaddress.IPv6Network, int, int]]:
+        """Return the Windows prefix policy table as (prefix, precedence, label), from netsh."""
+        result = subprocess.run(["netsh", "interface", "ipv6", "show", "prefixpolicies"], capture_output=True,
+                                text=True, timeout=10)
+        policies = []
+        for line in result.stdout.splitlines():
+            match = re.match(r"\s*(\d+)\s+(\d+)\s+(\S+/\d+)\s*$", line)
+            if match:
+                policies.append((ipaddress.IPv6Network(match[3]), int(match[1]), int(match[2])))
+        return policies
+
+    def sysconfig_checks(self, interfaces: Optional[List[str]]) -> List[Tuple[str, str, str, str]]:
+        """Read the platform's IPv6 knobs; returns (setting, knob, value, remediation template) tuples.
+
+        The template is formatted with the profile's preferred value, with enabled or disabled for it, and with
+        1 or 0 for it.
+        """
+        checks = []
+        if os.path.isdir("/proc/sys/net/ipv6/conf"):
+            names = interfaces or ["all", "default"] + sorted(
+                name for name in os.listdir("/proc/sys/net/ipv6/conf") if name not in ("all", "default", "lo"))
+            for name in names:
+                for knob in self.SYSCONFIG_KNOBS:
+                    try:
+                        with open(f"/proc/sys/net/ipv6/conf/{name}/{knob}") as f:
+                            value = f.read().strip()
+                    except OSError:
+                        continue
+                    setting = f"net.ipv6.conf.{name}.{knob}"
+                    checks.append((setting, knob, value, f"sysctl -w {setting}={{value}}"))
+        elif sys.platform == "win32":
+            import winreg
+            try:
+                with winreg.OpenKey(winreg.HKEY_LOCAL_MACHINE,
+                                    r"SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters") as key:
+                    disabled = winreg.QueryValueEx(key, "DisabledComponents")[0]
+            except OSError:
+                disabled = 0
+            checks.append(("DisabledComponents", "disable_ipv6", "1" if disabled & 0xff == 0xff else "0",
+                           r"reg add HKLM\SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters /v DisabledComponents "
+                           r"/t REG_DWORD /d 0 /f, then reboot"))
+            result = subprocess.run(["netsh", "interface", "ipv6", "show", "privacy"], capture_output=True, text=True,
+                                    timeout=10)
+            match = re.search(r"Use Temporary Addresses\s*:\s*(\w+)", result.stdout)
+            if match:
+                checks.append(("Use Temporary Addresses", "use_tempaddr", "2" if match[1] == "enabled" else "0",
+                               "netsh interface ipv6 set privacy state={enabled}"))
+            # The default table ranks ::/0 (40) above IPv4-mapped ::ffff:0:0/96 (35)
+            precedence = {str(prefix): value for prefix, value, _ in self.windows_prefix_policies()}
+            if "::/0" in precedence and "::ffff:0:0/96" in precedence:
+                checks.append(("Prefix policy ::ffff:0:0/96 vs ::/0", "prefer_ipv6",
+                               "1" if precedence["::/0"] > precedence["::ffff:0:0/96"] else "0",
+                               "netsh interface ipv6 set prefixpolicy ::ffff:0:0/96 35 4"))
+        else:
+            # macOS and the BSDs keep global knobs under net.inet6.ip6
+            for knob, name in (("forwarding", "forwarding"), ("accept_ra", "accept_rtadv"),
+                               ("use_tempaddr", "use_tempaddr")):
+                result = subprocess.run(["sysctl", "-n", f"net.inet6.ip6.{name}"], capture_output=True, text=True)
+                if result.returncode != 0:
+                    continue
+                value = result.stdout.strip()
+                if knob == "use_tempaddr":
+                    # Here 1 means enabled; compare it the way Linux spells that, and fix it with the BSD value
+                    checks.append((f"net.inet6.ip6.{name}={value}, as Linux use_tempaddr", knob,
+                                   "0" if value == "0" else "2", f"sysctl -w net.inet6.ip6.{name}={{flag}}"))
+                else:
+                    checks.append((f"net.inet6.ip6.{name}", knob, value, f"sysctl -w net.inet6.ip6.{name}={{value}}"))
+        return checks
+
+    def run_sysconfig(self, args: List[str]) -> int:
+        """Compare the OS-level IPv6 settings with a host, router or server profile."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py sysconfig",
+                                         description="Check the OS-level IPv6 knobs (disable_ipv6, forwarding, "
+                                                     "accept_ra, use_tempaddr, autoconf, accept_redirects on Linux; "
+                                                     "net.inet6.ip6 on macOS and BSD; DisabledComponents, privacy "
+                                                     "addresses and prefix policies on Windows) and report where "
+                                                     "they deviate from the chosen profile.")
+        parser.add_argument("--profile", choices=list(self.SYSCONFIG_PROFILES), default="host",
+                            help="What this machine is meant to be (default: host)")
+        parser.add_argument("--interface", action="append",
+                            help="Linux interface to check, may be repeated (default: all, default and every "
+                                 "interface but lo)")
+        parser.add_argument("--suggest", action="store_true", help="Print a command to fix each deviation")
+        options = parser.parse_args(args)
+
+        try:
+            checks = self.sysconfig_checks(options.interface)
+        except (OSError, subprocess.SubprocessError) as e:
+            self.logger.error(f"Cannot read the IPv6 settings: {e}")
+            return 1
+        if not checks:
+            self.logger.error("No IPv6 settings found; is IPv6 compiled into this kernel?")
+            return 1
+        profile = self.SYSCONFIG_PROFILES[options.profile]
+        self.logger.info(f"IPv6 settings against the {options.profile} profile:")
+        deviations = 0
+        for setting, knob, value, remedy in checks:
+            expected = profile.get(knob)
+            if expected is None or value in expected:
+                status = "OK" if expected else "--"
+                self.logger.info(f"  [{status:<4}] {setting} = {value}")
+                continue
+            deviations += 1
+            self.logger.info(f"  [WARN] {setting} = {value}, expected {' or '.join(expected)} for a "
+                             f"{options.profile}: {self.SYSCONFIG_KNOBS[knob][options.profile]}")
+            if options.suggest:
+                state = "disabled" if expected[0] in ("0", "-1") else "enabled"
+                fix = remedy.format(value=expected[0], enabled=state, flag="0" if state == "disabled" else "1")
+                self.logger.info(f"         fix: {fix}")
+        self.logger.info(f"\n{deviations} deviation{'s' if deviations != 1 else ''} from the {options.profile} "
+                         f"profile")
+        return 1 if deviations else 0
+
+    def policy_table(self, source: str, gai_conf: str) -> Tuple[List[Tuple[ipaddress.IPv6Network, int, int]], str]:
+        """Return the address selection policy table as (prefix, precedence, label) and where it came from."""
+        if source == "system" and sys.platform == "win32":
+            policies = self.windows_prefix_policies()
+            return sorted(policies, key=lambda entry: -entry[0].prefixlen), "Windows prefix policies"
+        if source == "rfc6724" or (source == "system" and not sys.platform.startswith("linux")):
+            return [(ipaddress.IPv6Network(prefix), precedence, label)
+                    for prefix, precedence, label in self.RFC6724_POLICY], "RFC 6724 default"
+        # glibc: any label or precedence line in gai.conf replaces that whole default column
+        precedences, labels = {}, {}
+        try:
+            with open(gai_conf) as f:
+                for line in f:
+                    fields = line.split("#", 1)[0].split()
+                    if len(fields) == 3 and fields[0] in ("label", "precedence"):
+                        (labels if fields[0] == "label" else precedences)[ipaddress.IPv6Network(fields[1])] = \
+                            int(fields[2])
+        except OSError:
+            pass
+        described = [name for name, table in (("labels", labels), ("precedences", precedences)) if table]
+        origin = f"glibc default{', ' + ' and '.join(described) + ' from ' + gai_conf if described else ''}"
+        labels = labels or {ipaddress.IPv6Network(prefix): label for prefix, label in self.GLIBC_LABELS.items()}
+        precedences = precedences or {ipaddress.IPv6Network(prefix): value
+                                      for prefix, value in self.GLIBC_PRECEDENCES.items()}
+
+        def lookup(table: dict, network: ipaddress.IPv6Network) -> int:
+            matches = [prefix for prefix in table if network.subnet_of(prefix)]
+            return table[max(matches, key=lambda prefix: prefix.prefixlen)] if matches else 0
+
+        # Merge the columns into rows, each with the longest match of both columns for its whole prefix
+        prefixes = sorted(set(labels) | set(precedences), key=lambda prefix: -prefix.prefixlen)
+        return [(prefix, lookup(precedences, prefix), lookup(labels, prefix)) for prefix in prefixes], origin
+
+    def policy_entry(self, policy: List[Tuple[ipaddress.IPv6Network, int, int]],
+                     address: ipaddress.IPv6Address) -> Tuple[int, int]:
+        """Return (precedence, label) for address from a policy table sorted longest prefix first."""
+        return next(((precedence, label) for prefix, precedence, label in policy if address in prefix), (0, 0))
+
+    def selection_scope(self, address: ipaddress.IPv6Address) -> int:
+        """Return the RFC 6724 section 3.1 scope of an address; IPv4 is mapped into ::ffff:0:0/96."""
+        if address.ipv4_mapped is not None:
+            ipv4 = address.ipv4_mapped
+            return 0x2 if ipv4.is_loopback or ipv4.is_link_local else 0xe
+        if address.is_multicast:
+            return address.packed[1] & 0x0f
+        if address.is_loopback or address.is_link_local:
+            return 0x2
+        return 0x5 if address.is_site_local else 0xe
+
+    def common_prefix_length(self, a: ipaddress.IPv6Address, b: ipaddress.IPv6Address, limit: int = 128) -> int:
+        """Return how many leading bits a and b share, up to limit."""
+        difference = int(a) ^ int(b)
+        return min(limit, 128 - difference.bit_length())
+
+    def address_candidates(self) -> List[dict]:
+        """List this host's usable IPv6 addresses with their prefix length and flags, from /proc on Linux."""
+        candidates = []
+        try:
+            with open("/proc/net/if_inet6") as f:
+                for line in f:
+                    address, _, prefix, _, flags, interface = line.split()
+                    flags = int(flags, 16)
+                    # IFA_F_DADFAILED and IFA_F_TENTATIVE addresses can't be used yet
+                    if flags & 0x48:
+                        continue
+                    candidates.append({"address": ipaddress.IPv6Address(bytes.fromhex(address)),
+                                       "prefix": int(prefix, 16), "interface": interface,
+                                       "deprecated": bool(flags & 0x20), "temporary": bool(flags & 0x01)})
+        except OSError:
+            pass
+        return candidates
+
+    def kernel_source(self, destination: ipaddress.IPv6Address) -> Optional[ipaddress.IPv6Address]:
+        """Return the source address the kernel picks for destination, or None without a route."""
+        family, target = ((socket.AF_INET, str(destination.ipv4_mapped)) if destination.ipv4_mapped is not None
+                          else (socket.AF_INET6, str(destination)))
+        with socket.socket(family, socket.SOCK_DGRAM) as sock:
+            try:
+                sock.connect((target, 53))
+            except OSError:
+                return None
+            address = ipaddress.ip_address(sock.getsockname()[0].split("%", 1)[0])
+        return ipaddress.IPv6Address(f"::ffff:{address}") if address.version == 4 else address
+
+    def compare_sources(self, a: dict, b: dict, destination: ipaddress.IPv6Address,
+                        policy: List[Tuple[ipaddress.IPv6Network, int, int]]) -> Tuple[int, str]:
+        """Apply RFC 6724 section 5 to two candidate sources; returns (-1 for a, 1 for b, 0 for a tie, reason)."""
+        label = lambda address: self.policy_entry(policy, address)[1]
+        sa, sb = a["address"], b["address"]
+        if sa == destination or sb == destination:
+            return (-1 if sa == destination else 1), "rule 1, same address as the destination"
+        scope_a, scope_b, scope_d = self.selection_scope(sa), self.selection_scope(sb), self.selection_scope(destination)
+        if scope_a != scope_b:
+            smaller = -1 if scope_a < scope_b else 1
+            return (-smaller if min(scope_a, scope_b) < scope_d else smaller), "rule 2, appropriate scope"
+        if a["deprecated"] != b["deprecated"]:
+            return (1 if a["deprecated"] else -1), "rule 3, avoid deprecated addresses"
+        if (label(sa) == label(destination)) != (label(sb) == label(destination)):
+            return (-1 if label(sa) == label(destination) else 1), \
+                f"rule 6, matching label {label(destination)}"
+        if a["temporary"] != b["temporary"]:
+            return (-1 if a["temporary"] else 1), "rule 7, prefer temporary addresses"
+        common_a = self.common_prefix_length(sa, destination, a["prefix"])
+        common_b = self.common_prefix_length(sb, destination, b["prefix"])
+        if common_a != common_b:
+            return (-1 if common_a > common_b else 1), \
+                f"rule 8, longest matching prefix ({max(common_a, common_b)} vs {min(common_a, common_b)} bits)"
+        return 0, "no rule decides"
+
+    def rank_sources(self, destination: ipaddress.IPv6Address, sources: Optional[List[dict]],
+                     policy: List[Tuple[ipaddress.IPv6Network, int, int]]) -> List[dict]:
+        """Order the candidate sources of the destination's family by RFC 6724 section 5, best first.
+
+        Without explicit sources, IPv6 candidates are this host's addresses and IPv4 the kernel's choice.
+        """
+        ipv4 = destination.ipv4_mapped is not None
+        if sources is None:
+            sources = self.address_candidates()
+            if ipv4:
+                # /proc/net/if_inet6 has no IPv4 addresses; use the one the kernel would pick
+                kernel = self.kernel_source(destination)
+                sources = [{"address": kernel, "prefix": 128, "interface": "", "deprecated": False,
+                            "temporary": False}] if kernel else []
+        candidates = [source for source in sources if (source["address"].ipv4_mapped is not None) == ipv4]
+        return sorted(candidates, key=functools.cmp_to_key(
+            lambda a, b: self.compare_sources(a, b, destination, policy)[0]))
+
+    def compare_destinations(self, a: dict, b: dict,
+                             policy: List[Tuple[ipaddress.IPv6Network, int, int]]) -> Tuple[int, str]:
+        """Apply RFC 6724 section 6 to two destinations with their chosen sources; returns (order, reason)."""
+        lookup = lambda address, column: self.policy_entry(policy, address)[column - 1]
+        da, db, sa, sb = a["address"], b["address"], a["source"], b["source"]
+        if (sa is None) != (sb is None):
+            return (1 if sa is None else -1), "rule 1, avoid unusable destinations (no source address)"
+        if sa is None:
+            return 0, "neither is usable"
+        match_a = self.selection_scope(da) == self.selection_scope(sa["address"])
+        match_b = self.selection_scope(db) == self.selection_scope(sb["address"])
+        if match_a != match_b:
+            return (-1 if match_a else 1), "rule 2, prefer matching scope"
+        if sa["deprecated"] != sb["deprecated"]:
+            return (1 if sa["deprecated"] else -1), "rule 3, avoid deprecated source addresses"
+        match_a = lookup(sa["address"], 2) == lookup(da, 2)
+        match_b = lookup(sb["address"], 2) == lookup(db, 2)
+        if match_a != match_b:
+            return (-1 if match_a else 1), "rule 5, prefer matching label"
+        precedence_a, precedence_b = lookup(da, 1), lookup(db, 1)
+        if precedence_a != precedence_b:
+            return (-1 if precedence_a > precedence_b else 1), \
+                f"rule 6, higher precedence ({max(precedence_a, precedence_b)} vs {min(precedence_a, precedence_b)})"
+        tunneled_a = any(da in prefix for prefix in self.TUNNELED_PREFIXES)
+        tunneled_b = any(db in prefix for prefix in self.TUNNELED_PREFIXES)
+        if tunneled_a != tunneled_b:
+            return (1 if tunneled_a else -1), "rule 7, prefer native transport over 6to4 or Teredo"
+        scope_a, scope_b = self.selection_scope(da), self.selection_scope(db)
+        if scope_a != scope_b:
+            return (-1 if scope_a < scope_b else 1), "rule 8, prefer smaller scope"
+        if da.ipv4_mapped is None and db.ipv4_mapped is None:
+            common_a = self.common_prefix_length(sa["address"], da, sa["prefix"])
+            common_b = self.common_prefix_length(sb["address"], db, sb["prefix"])
+            if common_a != common_b:
+                return (-1 if common_a > common_b else 1), \
+                    f"rule 9, longest matching prefix ({max(common_a, common_b)} vs {min(common_a, common_b)} bits)"
+        return 0, "rule 10, keep the original order"
+
+    def run_addrselect(self, args: List[str]) -> int:
+        """Show the address selection policy table and simulate RFC 6724 source and destination selection."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py addrselect",
+                                         description="Print the host's address selection policy table (gai.conf "
+                                                     "on Linux, prefix policies on Windows) and simulate RFC 6724 "
+                                                     "for a list of destinations: which source address each gets, "
+                                                     "how the destinations are ordered, and the rule behind each "
+                                                     "decision.")
+        parser.add_argument("destination", nargs="*",
+                            help="Addresses or hostnames to order; hostnames expand to all their addresses")
+        parser.add_argument("--table", choices=["system", "rfc6724", "glibc"], default="system",
+                            help="Policy table to use (default: system, the one getaddrinfo uses here)")
+        parser.add_argument("--gai-conf", default="/etc/gai.conf", help="glibc configuration (default: /etc/gai.conf)")
+        parser.add_argument("--source", action="append", metavar="ADDRESS[/LENGTH]",
+                            help="Candidate source address, may be repeated (default: this host's addresses)")
+        options = parser.parse_args(args)
+
+        try:
+            policy, origin = self.policy_table(options.table, options.gai_conf)
+        except (OSError, ValueError, subprocess.SubprocessError) as e:
+            self.logger.error(f"Cannot read the policy table: {e}")
+            return 1
+        self.logger.info(f"Policy table ({origin}):")
+        self.logger.info(f"  {'Prefix':<20} {'Precedence':>10} {'Label':>6}")
+        for prefix, precedence, label in policy:
+            self.logger.info(f"  {str(prefix):<20} {precedence:>10} {label:>6}")
+        if not options.destination:
+            return 0
+
+        sources = []
+        for text in options.source or []:
+            address, _, length = text.partition("/")
+            try:
+                parsed = ipaddress.ip_address(address)
+            except ValueError:
+                parser.error(f"invalid --source '{text}'")
+            if parsed.version == 4:
+                # IPv4 is compared as ::ffff:0:0/96, so its prefix length grows by 96 bits
+                mapped, prefix = ipaddress.IPv6Address(f"::ffff:{parsed}"), 96 + int(length or 32)
+            else:
+                mapped, prefix = parsed, int(length or 64)
+            sources.append({"address": mapped, "prefix": prefix, "interface": "", "deprecated": False,
+                            "temporary": False})
+
+        destinations, resolved = [], {}
+        for text in options.destination:
+            try:
+                infos = socket.getaddrinfo(text, None, socket.AF_UNSPEC, socket.SOCK_STREAM)
+            except socket.gaierror as e:
+                self.logger.error(f"Cannot resolve {text}: {e}")
+                return 1
+            addresses = list(dict.fromkeys(info[4][0].split("%", 1)[0] for info in infos))
+            resolved[text] = addresses
+            for address in addresses:
+                parsed = ipaddress.ip_address(address)
+                destinations.append({"text": address, "address": ipaddress.IPv6Address(f"::ffff:{parsed}")
+                                     if parsed.version == 4 else parsed})
+
+        self.logger.info("\nSource selection:")
+        for destination in destinations:
+            address = destination["address"]
+            kernel = self.kernel_source(address)
+            ranked = self.rank_sources(address, sources or None, policy)
+            destination["source"] = ranked[0] if ranked else None
+            show = lambda source: str(source["address"].ipv4_mapped or source["address"])
+            if not ranked:
+                self.logger.info(f"  {destination['text']}: no candidate source address")
+                continue
+            detail = ""
+            if len(ranked) > 1:
+                order, reason = self.compare_sources(ranked[0], ranked[1], address, policy)
+                detail = f", over {show(ranked[1])} by {reason}" if order else \
+                    f", tied with {show(ranked[1])} (no rule prefers either)"
+            self.logger.info(f"  {destination['text']} <- {show(ranked[0])}{detail}")
+            if kernel is not None and kernel != ranked[0]["address"] and not options.source:
+                self.logger.info(f"      the kernel picks {kernel.ipv4_mapped or kernel}; rules 4, 5 and 5.5 "
+                                 f"(home address, outgoing interface, next hop) are not simulated")
+
+        ordered = sorted(destinations, key=functools.cmp_to_key(
+            lambda a, b: self.compare_destinations(a, b, policy)[0]))
+        self.logger.info("\nDestination order:")
+        for index, destination in enumerate(ordered):
+            reason = ""
+            if index:
+                reason = f"  (after {ordered[index - 1]['text']}: " \
+                         f"{self.compare_destinations(ordered[index - 1], destination, policy)[1]})"
+            self.logger.info(f"  {index + 1}. {destination['text']}{reason}")
+        for text, addresses in resolved.items():
+            simulated = [destination["text"] for destination in ordered if destination["text"] in addresses]
+            if len(addresses) > 1:
+                verdict = "matches" if addresses == simulated else f"differs: {', '.join(addresses)}"
+                self.logger.info(f"getaddrinfo order for {text} {verdict}")
+        return 0
+
+    def dns_addresses(self, server: str, name: str, timeout: float) -> Tuple[List[str], List[str]]:
+        """Query server directly for the AAAA and A records of name; returns (IPv6, IPv4) address lists."""
+        results = []
+        for qtype in (DNS_TYPES["AAAA"], DNS_TYPES["A"]):
+            query = self.build_dns_query(name, qtype)
+            response = DNSMessage.decode(self.resolve_do53(server, query.encode(), timeout)[0])
+            # The answer section may start with the CNAME chain; only the final records count
+            results.append([record.value for record in response.answers if record.type == qtype])
+        return results[0], results[1]
+
+    def run_gai(self, args: List[str]) -> int:
+        """Show the order getaddrinfo returns for a name and compare it with a direct DNS lookup."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py gai",
+                                         description="Show the exact ordered address list the system resolver "
+                                                     "(getaddrinfo) returns for a hostname, with and without "
+                                                     "AI_ADDRCONFIG, compare it with the AAAA and A records from a "
+                                                     "direct DNS query, and explain why an application connecting "
+                                                     "to the first address would use IPv4.")
+        parser.add_argument("host", help="Hostname to look up")
+        parser.add_argument("port", nargs="?", type=int, default=443, help="Port to look up (default: 443)")
+        parser.add_argument("--server", help="Resolver for the direct query (default: the first nameserver in "
+                                             "/etc/resolv.conf)")
+        parser.add_argument("--timeout", type=float, default=5.0, help="DNS timeout in seconds (default: 5)")
+        options = parser.parse_args(args)
+
+        orders = {}
+        for label, flags in (("default flags", 0), ("AI_ADDRCONFIG", socket.AI_ADDRCONFIG)):
+            try:
+                infos = socket.getaddrinfo(options.host, options.port, socket.AF_UNSPEC, socket.SOCK_STREAM,
+                                           0, flags)
+                orders[label] = list(dict.fromkeys(info[4][0] for info in infos))
+            except socket.gaierror as e:
+                orders[label] = []
+                self.logger.info(f"getaddrinfo with {label} failed: {e}")
+        addresses = orders["default flags"]
+        self.logger.info(f"getaddrinfo order for {options.host} (AF_UNSPEC, default flags):")
+        for index, address in enumerate(addresses):
+            self.logger.info(f"  {index + 1}. {address}")
+        if orders["AI_ADDRCONFIG"] != addresses:
+            self.logger.info(f"With AI_ADDRCONFIG: {', '.join(orders['AI_ADDRCONFIG']) or 'no addresses'}")
+        else:
+            self.logger.info("With AI_ADDRCONFIG: the same")
+
+        server = options.server
+        if server is None:
+            try:
+                with open("/etc/resolv.conf") as f:
+                    server = next(fields[1] for fields in (line.split() for line in f)
+                                  if len(fields) > 1 and fields[0] == "nameserver")
+            except (OSError, StopIteration):
+                server = self.DEFAULT_RESOLVER
+        # The DNS tools use IPv6 sockets; reach an IPv4 resolver through its mapped address
+        target = server if ":" in server else f"::ffff:{server}"
+        try:
+            dns_v6, dns_v4 = self.dns_addresses(target, options.host, options.timeout)
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Direct DNS query to {server} failed: {e}")
+            return 1
+        self.logger.info(f"\nDNS via {server}: AAAA {', '.join(dns_v6) or 'none'}; A {', '.join(dns_v4) or 'none'}")
+
+        hosts = (os.path.join(os.environ.get("SystemRoot", r"C:\Windows"), "System32", "drivers", "etc", "hosts")
+                 if sys.platform == "win32" else "/etc/hosts")
+        try:
+            with open(hosts, errors="replace") as f:
+                in_hosts = any(options.host.lower().rstrip(".") in [name.lower() for name in fields[1:]]
+                               for fields in (line.split("#", 1)[0].split() for line in f))
+        except OSError:
+            in_hosts = False
+        findings = []
+        normalized = {str(ipaddress.ip_address(address.split("%", 1)[0])) for address in addresses}
+        dns = {str(ipaddress.ip_address(address)) for address in dns_v6 + dns_v4}
+        if in_hosts and normalized != dns:
+            findings.append(f"{hosts} has an entry for {options.host}, which takes precedence over DNS")
+        elif not addresses and dns:
+            findings.append(f"getaddrinfo finds nothing that {server} answers: the system resolver asks a "
+                            f"different server or search domain")
+        elif dns - normalized:
+            missing = sorted(dns - normalized)
+            findings.append(f"getaddrinfo leaves out {', '.join(missing)}"
+                            + (": resolv.conf may set options no-aaaa" if set(missing) <= set(dns_v6) else ""))
+        if normalized - dns and not in_hosts:
+            findings.append(f"getaddrinfo adds {', '.join(sorted(normalized - dns))}, which DNS doesn't return: "
+                            f"another NSS source (mDNS, systemd-resolved) answers first")
+        if any(":" in address for address in addresses) and \
+                not any(":" in address for address in orders["AI_ADDRCONFIG"]):
+            findings.append("AI_ADDRCONFIG drops every IPv6 address because this host has no IPv6 address "
+                            "besides loopback and link-local; applications that pass it never try IPv6")
+        first_v6 = next((address for address in addresses if ":" in address), None)
+        if addresses and ":" not in addresses[0] and first_v6:
+            policy, origin = self.policy_table("system", "/etc/gai.conf")
+            ranked = []
+            for address in (first_v6, addresses[0]):
+                parsed = ipaddress.ip_address(address.split("%", 1)[0])
+                mapped = ipaddress.IPv6Address(f"::ffff:{parsed}") if parsed.version == 4 else parsed
+                sources = self.rank_sources(mapped, None, policy)
+                ranked.append({"address": mapped, "source": sources[0] if sources else None})
+            order, reason = self.compare_destinations(ranked[0], ranked[1], policy)
+            explanation = (f"RFC 6724 {reason}, with the {origin} policy table" if order > 0
+                           else "a resolver or NSS module reordered the list; RFC 6724 would put IPv6 first")
+            findings.append(f"IPv4 comes first, so most applications connect over IPv4: {explanation}")
+        self.logger.info("\nFindings:" if findings else "\ngetaddrinfo agrees with DNS")
+        for finding in findings:
+            self.logger.info(f"  - {finding}")
+        return 1 if findings else 0
+
+    def parse_link_layer_address(self, value: str) -> bytes:
+        """Parse an IEEE 802.15.4 short (16-bit), EUI-48, or EUI-64 link-layer address."""
+        raw = bytes.fromhex(value.replace(':', '').replace('-', '').replace('.', ''))
+        if len(raw) not in (2, 6, 8):
+            raise ValueError(f"link-layer address must be 2, 6, or 8 bytes, got {len(raw)}")
+        return raw
+
+    def lowpan_iid(self, link_layer: bytes) -> bytes:
+        """Derive the interface identifier for a link-layer address (RFC 4944 section 6, RFC 6282)."""
+        if len(link_layer) == 2:
+            return bytes.fromhex("000000fffe00") + link_layer
+        eui64 = link_layer[:3] + b"\xff\xfe" + link_layer[3:] if len(link_layer) == 6 else link_layer
+        return bytes([eui64[0] ^ 0x02]) + eui64[1:]
+
+    def lowpan_expand(self, m: int, ac: int, am: int, inline: bytes, dest: bool,
+                      context: Optional[ipaddress.IPv6Network],
+                      link_layer: Optional[bytes]) -> ipaddress.IPv6Address:
+        """Reconstruct an address from its IPHC mode bits and in-line bytes."""
+        if (m, ac, am) not in self.LOWPAN_INLINE_LENGTHS or (m and not dest) or (dest and (m, ac, am) == (0, 1, 0)):
+            raise ValueError(f"reserved address mode M={m} AC={ac} AM={am:02b}")
+        expected = self.LOWPAN_INLINE_LENGTHS[(m, ac, am)]
+        if len(inline) != expected:
+            raise ValueError(f"mode requires {expected} in-line bytes, got {len(inline)}")
+        if ac and context is None:
+            raise ValueError("stateful compression requires a context prefix")
+
+        if m:
+            if ac:
+                if context.prefixlen > 64:
+                    raise ValueError("multicast context prefixes must be /64 or shorter")
+                prefix = context.network_address.packed[:8]
+                return ipaddress.IPv6Address(b"\xff" + inline[:2] + bytes([context.prefixlen]) + prefix + inline[2:])
+            if am == 0:
+                return ipaddress.IPv6Address(inline)
+            if am == 3:
+                return ipaddress.IPv6Address(b"\xff\x02" + bytes(13) + inline)
+            return ipaddress.IPv6Address(b"\xff" + inline[:1] + bytes(15 - len(inline)) + inline[1:])
+
+        if am == 0:
+            return ipaddress.IPv6Address(inline if not ac else bytes(16))
+        if am == 1:
+            iid = inline
+        elif am == 2:
+            iid = bytes.fromhex("000000fffe00") + inline
+        else:
+            if link_layer is None:
+                raise ValueError("fully elided addresses require the link-layer address")
+            iid = self.lowpan_iid(link_layer)
+
+        if not ac:
+            return ipaddress.IPv6Address(self.LINK_LOCAL_PREFIX.network_address.packed[:8] + iid)
+        # Bits covered by the context always win over the derived or in-line bits.
+        mask = int(context.netmask)
+        value = (int.from_bytes(bytes(8) + iid, "big") & ~mask) | int(context.network_address)
+        return ipaddress.IPv6Address(value)
+
+    def lowpan_compress(self, address: ipaddress.IPv6Address, dest: bool,
+                        context: Optional[ipaddress.IPv6Network],
+                        link_layer: Optional[bytes]) -> Tuple[int, int, int, bytes]:
+        """Pick the most compact IPHC encoding (M, AC, AM, in-line bytes) for an address."""
+        packed = address.packed
+        if address.is_multicast:
+            if not dest:
+                raise ValueError("multicast addresses are only valid as a destination")
+            candidates = [(1, 0, 3, packed[15:]), (1, 0, 2, packed[1:2] + packed[13:]),
+                          (1, 0, 1, packed[1:2] + packed[11:])]
+            if context is not None:
+                candidates.append((1, 1, 0, packed[1:3] + packed[12:]))
+        else:
+            if address.is_unspecified:
+                if dest:
+                    raise ValueError("the unspecified address is not valid as a destination")
+                return 0, 1, 0, b""
+            candidates = []
+            for ac in (0, 1):
+                for am, inline in ((3, b""), (2, packed[14:]), (1, packed[8:])):
+                    candidates.append((0, ac, am, inline))
+
+        for m, ac, am, inline in candidates:
+            try:
+                if self.lowpan_expand(m, ac, am, inline, dest, context, link_layer) == address:
+                    return m, ac, am, inline
+            except ValueError:
+                continue
+        return int(address.is_multicast), 0, 0, packed
+
+    def format_lowpan_mode(self, m: int, ac: int, am: int, dest: bool) -> str:
+        """Format IPHC address mode bits the way RFC 6282 names them."""
+        if not dest:
+            return f"SAC={ac} SAM={am:02b}"
+        return f"M={m} DAC={ac} DAM={am:02b}"
+
+    def run_lowpan(self, args: List[str]) -> int:
+        """Compress or expand IPv6 addresses with 6LoWPAN IPHC context rules."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py lowpan",
+                                         description="6LoWPAN IPHC address compression (RFC 6282)")
+        commands = parser.add_subparsers(dest="command", required=True)
+        for name in ("compress", "expand"):
+            command = commands.add_parser(name)
+            command.add_argument("--context", help="Context prefix shared with the border router, e.g. 2001:db8::/64")
+            command.add_argument("--ll-addr", help="Link-layer address (16-bit short, EUI-48, or EUI-64)")
+            command.add_argument("--dest", action="store_true", help="Treat the address as a destination address")
+        commands.choices["compress"].add_argument("address", help="IPv6 address to compress")
+        expand = commands.choices["expand"]
+        expand.add_argument("--am", type=int, choices=range(4), required=True, help="SAM/DAM value (0-3)")
+        expand.add_argument("--ac", action="store_true", help="Stateful (context-based) compression, SAC/DAC=1")
+        expand.add_argument("--multicast", action="store_true", help="Multicast destination, M=1 (implies --dest)")
+        expand.add_argument("--inline", default="", help="In-line address bytes in hex")
+        options = parser.parse_args(args)
+
+        try:
+            context = ipaddress.IPv6Network(options.context, strict=False) if options.context else None
+            link_layer = self.parse_link_layer_address(options.ll_addr) if options.ll_addr else None
+            dest = options.dest
+            if options.command == "compress":
+                address = ipaddress.IPv6Address(options.address)
+                m, ac, am, inline = self.lowpan_compress(address, dest, context, link_layer)
+            else:
+                m, ac, am = int(options.multicast), int(options.ac), options.am
+                dest = dest or bool(m)
+                inline = bytes.fromhex(options.inline)
+                address = self.lowpan_expand(m, ac, am, inline, dest, context, link_layer)
+        except ValueError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        self.logger.info(f"Address: {address}")
+        self.logger.info(f"Mode: {self.format_lowpan_mode(m, ac, am, dest)}")
+        self.logger.info(f"In-line: {len(inline)} bytes ({inline.hex() or 'elided'})")
+        return 0
+
+    def anonymize_address(self, address: ipaddress.IPv6Address, prefix_length: int, key: bytes) -> ipaddress.IPv6Address:
+        """Keep the first prefix_length bits and replace the rest with a keyed hash of the address."""
+        digest = hmac.new(key, address.packed, hashlib.sha256).digest()
+        mask = int(ipaddress.IPv6Network(f"::/{prefix_length}").netmask)
+        return ipaddress.IPv6Address((int(address) & mask) | (int.from_bytes(digest[:16], "big") & ~mask & (2**128 - 1)))
+
+    def anonymize_text(self, line: str, prefix_length: int, key: bytes) -> str:
+        """Rewrite every IPv6 address found in a line of text."""
+        def replace(match: re.Match) -> str:
+            candidate = match.group(0)
+            # A trailing dot or colon is punctuation ("peer 2001:db8::5: refused"), unless the address needs it
+            stripped = candidate.rstrip(".")
+            while True:
+                text, _, length = stripped.partition("/")
+                text, _, zone = text.partition("%")
+                try:
+                    address = ipaddress.IPv6Address(text)
+                    network = ipaddress.IPv6Network(f"{text}/{length}", strict=False) if length else None
+                    break
+                except ValueError:
+                    if stripped.endswith(":") and not length and not zone:
+                        stripped = stripped[:-1]
+                        continue
+                    # Times and MAC addresses match too; anything else shaped like an address is masked, not leaked
+                    if "::" in candidate or candidate.count(":") >= 6 and not self.MAC_ADDRESS.fullmatch(candidate):
+                        return "<unparsed IPv6 address>"
+                    return candidate
+            if address.is_loopback or address.is_unspecified:
+                return candidate
+            if network is not None and network.prefixlen <= prefix_length:
+                # Prefixes no longer than the kept prefix reveal nothing new
+                return candidate
+            anonymized = self.anonymize_address(address, prefix_length, key)
+            if network is not None:
+                anonymized = ipaddress.IPv6Network(f"{anonymized}/{length}", strict=False).network_address
+            result = str(anonymized)
+            if zone:
+                result += f"%{zone}"
+            if length:
+                result += f"/{length}"
+            return result + candidate[len(stripped):]
+        return self.IPV6_CANDIDATE.sub(replace, line)
+
+    def run_anonymize(self, args: List[str]) -> int:
+        """Anonymize IPv6 addresses given on the command line or found in text input."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py anonymize",
+                                         description="Mask IPv6 addresses to a prefix using a keyed, consistent hash. "
+                                                     "Without addresses, rewrites every address found in the input text.")
+        parser.add_argument("addresses", nargs="*", help="Addresses to anonymize")
+        parser.add_argument("--prefix-length", type=int, default=self.DEFAULT_ANONYMIZE_PREFIX,
+                            help=f"Number of leading bits to keep (default: {self.DEFAULT_ANONYMIZE_PREFIX})")
+        parser.add_argument("--key", default=os.environ.get("IPV6_ANONYMIZE_KEY"),
+                            help="Secret hashing key (default: $IPV6_ANONYMIZE_KEY, or a random key for this run)")
+        parser.add_argument("--file", help="Read text from this file instead of stdin")
+        options = parser.parse_args(args)
+
+        if not 0 <= options.prefix_length <= 128:
+            self.logger.error("Error: Prefix length must be between 0 and 128")
+            return 1
+        if options.key:
+            key = options.key.encode()
+        else:
+            key = secrets.token_bytes(32)
+            self.logger.warning("No key given; using a random key, so results are only consistent within this run")
+
+        if options.addresses:
+            for text in options.addresses:
+                try:
+                    address = ipaddress.IPv6Address(text)
+                except ValueError as e:
+                    self.logger.error(f"Error: {e}")
+                    return 1
+                self.logger.info(f"{address} -> {self.anonymize_address(address, options.prefix_length, key)}")
+            return 0
+
+        try:
+            source = open(options.file, "r") if options.file else sys.stdin
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        with source:
+            for line in source:
+                sys.stdout.write(self.anonymize_text(line, options.prefix_length, key))
+        return 0
+
+    def format_address(self, address: ipaddress.IPv6Address) -> str:
+        """Format an address in RFC 5952 canonical form, including mixed notation for IPv4-mapped addresses."""
+        if address.ipv4_mapped is not None:
+            text = f"::ffff:{address.ipv4_mapped}"
+        else:
+            text = str(ipaddress.IPv6Address(int(address)))
+        return f"{text}%{address.scope_id}" if address.scope_id else text
+
+    def parse_address_or_prefix(self, text: str, strict: bool = False) -> Tuple[str, Optional[str]]:
+        """Parse an address or prefix and return its canonical form plus an optional warning."""
+        text = text.strip()
+        if text.startswith("[") and text.endswith("]"):
+            text = text[1:-1]
+        if "/" not in text:
+            return self.format_address(ipaddress.IPv6Address(text)), None
+        network = ipaddress.IPv6Network(text, strict=False)
+        canonical = f"{self.format_address(network.network_address)}/{network.prefixlen}"
+        if network.network_address != ipaddress.IPv6Address(text.split("/")[0]):
+            if strict:
+                raise ValueError(f"{text} has host bits set")
+            return canonical, f"host bits set, truncated to {canonical}"
+        return canonical, None
+
+    def run_normalize(self, args: List[str]) -> int:
+        """Canonicalize a list of addresses and prefixes, reporting invalid and duplicate entries."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py normalize",
+                                         description="Read one address or prefix per line, print the RFC 5952 "
+                                                     "canonical form, and report duplicates and invalid entries. "
+                                                     "Blank lines and '#' comments are ignored.")
+        parser.add_argument("file", nargs="?", help="Input file (default: stdin)")
+        parser.add_argument("--unique", action="store_true", help="Drop duplicates from the output")
+        parser.add_argument("--strict", action="store_true", help="Treat prefixes with host bits set as invalid")
+        options = parser.parse_args(args)
+
+        try:
+            source = open(options.file, "r") if options.file else sys.stdin
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        seen = {}
+        invalid = duplicates = 0
+        with source:
+            for number, line in enumerate(source, start=1):
+                entry = line.split("#", 1)[0].strip()
+                if not entry:
+                    continue
+                try:
+                    canonical, warning = self.parse_address_or_prefix(entry, options.strict)
+                except ValueError as e:
+                    self.logger.error(f"line {number}: invalid entry '{entry}': {e}")
+                    invalid += 1
+                    continue
+                if warning:
+                    self.logger.warning(f"line {number}: {warning}")
+                if canonical in seen:
+                    self.logger.warning(f"line {number}: duplicate of line {seen[canonical]} ({canonical})")
+                    duplicates += 1
+                    if options.unique:
+                        continue
+                else:
+                    seen[canonical] = number
+                sys.stdout.write(canonical + "\n")
+
+        self.logger.info(f"{len(seen)} unique entries, {duplicates} duplicates, {invalid} invalid")
+        return 1 if invalid else 0
+
+    def read_entries(self, path: Optional[str]) -> List[Tuple[int, str]]:
+        """Read non-empty, non-comment lines from a file or stdin as (line number, entry) pairs."""
+        with (open(path, "r") if path else sys.stdin) as source:
+            entries = [(number, line.split("#", 1)[0].strip()) for number, line in enumerate(source, start=1)]
+        return [(number, entry) for number, entry in entries if entry]
+
+    def covering_prefix(self, networks: List[ipaddress.IPv6Network]) -> ipaddress.IPv6Network:
+        """Return the smallest single prefix that covers all networks."""
+        low = int(min(network.network_address for network in networks))
+        high = int(max(network.broadcast_address for network in networks))
+        prefix_length = 128 - (low ^ high).bit_length()
+        return ipaddress.IPv6Network((low, prefix_length), strict=False)
+
+    def prefix_gaps(self, parent: ipaddress.IPv6Network,
+                    networks: List[ipaddress.IPv6Network]) -> List[ipaddress.IPv6Network]:
+        """Return the prefixes inside parent that none of the networks cover."""
+        remaining = [parent]
+        for network in ipaddress.collapse_addresses(networks):
+            pieces = []
+            for block in remaining:
+                if network.supernet_of(block):
+                    continue
+                if block.supernet_of(network):
+                    pieces.extend(block.address_exclude(network))
+                else:
+                    pieces.append(block)
+            remaining = pieces
+        return sorted(remaining)
+
+    def run_cidr(self, args: List[str]) -> int:
+        """Audit a set of prefixes for overlaps, containment, gaps, and aggregates."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py cidr",
+                                         description="Report duplicate and nested prefixes, the gaps between them, "
+                                                     "and the aggregates that cover them.")
+        parser.add_argument("prefixes", nargs="*", help="Prefixes to check (default: read one per line from --file or stdin)")
+        parser.add_argument("--file", help="Read prefixes from this file")
+        parser.add_argument("--within", help="Parent prefix to report gaps against (default: the covering aggregate)")
+        options = parser.parse_args(args)
+
+        try:
+            entries = list(enumerate(options.prefixes, start=1)) if options.prefixes else self.read_entries(options.file)
+        except OSError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        networks = []
+        for number, entry in entries:
+            try:
+                networks.append(ipaddress.IPv6Network(entry, strict=False))
+            except ValueError as e:
+                self.logger.error(f"Error: entry {number} '{entry}': {e}")
+                return 1
+        if not networks:
+            self.logger.error("Error: No prefixes given")
+            return 1
+
+        self.logger.info("Overlaps:")
+        overlaps = 0
+        unique = sorted(set(networks))
+        for network in unique:
+            if networks.count(network) > 1:
+                self.logger.info(f"  {network} is listed {networks.count(network)} times")
+                overlaps += 1
+        for i, outer in enumerate(unique):
+            for inner in unique[i + 1:]:
+                if inner.network_address > outer.broadcast_address:
+                    break
+                if outer.supernet_of(inner):
+                    self.logger.info(f"  {outer} contains {inner}")
+                    overlaps += 1
+        if not overlaps:
+            self.logger.info("  none")
+
+        try:
+            parent = ipaddress.IPv6Network(options.within, strict=False) if options.within else self.covering_prefix(networks)
+        except ValueError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+        for network in unique:
+            if not parent.supernet_of(network):
+                self.logger.warning(f"\nWarning: {network} is outside {parent}")
+
+        self.logger.info(f"\nGaps within {parent}:")
+        gaps = self.prefix_gaps(parent, [network for network in unique if parent.supernet_of(network)])
+        for gap in gaps:
+            self.logger.info(f"  {gap}")
+        if not gaps:
+            self.logger.info("  none")
+
+        self.logger.info("\nMinimal aggregate set:")
+        for network in ipaddress.collapse_addresses(networks):
+            self.logger.info(f"  {network}")
+        self.logger.info(f"\nCovering aggregate: {self.covering_prefix(networks)}")
+        return 0
+
+    def plan_allocations(self, parent: ipaddress.IPv6Network, sites: List[Tuple[str, int]],
+                         subnet_length: int) -> List[dict]:
+        """Allocate a nibble-aligned block for each site, largest sites first."""
+        requests = []
+        for name, count in sites:
+            # Round the subnet bits up to a nibble so every site block ends on a hex digit boundary
+            bits = (count - 1).bit_length()
+            bits = -(-bits // 4) * 4
+            requests.append((name, count, subnet_length - bits))
+        if any(length < parent.prefixlen for _, _, length in requests):
+            raise ValueError(f"a site needs more subnets than {parent} provides")
+
+        allocations = []
+        cursor = int(parent.network_address)
+        for name, count, length in sorted(requests, key=lambda request: request[2]):
+            block = ipaddress.IPv6Network((cursor, length))
+            if not parent.supernet_of(block):
+                raise ValueError(f"{parent} is too small for the requested sites (ran out at '{name}')")
+            subnets = block.subnets(new_prefix=subnet_length)
+            first = next(subnets)
+            last = ipaddress.IPv6Network((int(first.network_address) + (count - 1) * first.num_addresses, subnet_length))
+            allocations.append({
+                "site": name,
+                "prefix": str(block),
+                "subnets_required": count,
+                "subnets_available": 2 ** (subnet_length - length),
+                "first_subnet": str(first),
+                "last_subnet": str(last),
+            })
+            cursor += block.num_addresses
+        order = [name for name, _ in sites]
+        return sorted(allocations, key=lambda allocation: order.index(allocation["site"]))
+
+    def run_plan(self, args: List[str]) -> int:
+        """Produce a hierarchical, nibble-aligned prefix allocation plan."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py plan",
+                                         description="Split a parent prefix into nibble-aligned site blocks sized "
+                                                     "for each site's required number of subnets.")
+        parser.add_argument("parent", help="Parent prefix, e.g. 2001:db8::/48")
+        parser.add_argument("sites", nargs="*", help="Sites as name=subnet_count, e.g. hq=200 branch1=10")
+        parser.add_argument("--sites-file", help="Read sites from a file with one 'name count' pair per line")
+        parser.add_argument("--subnet-length", type=int, default=64, help="Subnet prefix length (default: 64)")
+        parser.add_argument("--format", choices=["text", "csv", "json"], default="text", help="Output format")
+        parser.add_argument("--output", help="Write the plan to this file instead of stdout")
+        options = parser.parse_args(args)
+
+        try:
+            parent = ipaddress.IPv6Network(options.parent)
+            if not parent.prefixlen <= options.subnet_length <= 128:
+                raise ValueError(f"subnet length must be between {parent.prefixlen} and 128")
+            pairs = [site.split("=", 1) for site in options.sites]
+            if options.sites_file:
+                pairs += [entry.split(None, 1) for _, entry in self.read_entries(options.sites_file)]
+            sites = []
+            for pair in pairs:
+                if len(pair) != 2 or not pair[1].strip().isdigit() or int(pair[1]) < 1:
+                    raise ValueError(f"invalid site '{' '.join(pair)}', expected a name and a positive subnet count")
+                if pair[0] in [name for name, _ in sites]:
+                    raise ValueError(f"site '{pair[0]}' is listed more than once")
+                sites.append((pair[0], int(pair[1])))
+            if not sites:
+                raise ValueError("no sites given")
+            if parent.prefixlen % 4:
+                self.logger.warning(f"Warning: {parent} is not nibble-aligned")
+            allocations = self.plan_allocations(parent, sites, options.subnet_length)
+        except (OSError, ValueError) as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        used = [ipaddress.IPv6Network(allocation["prefix"]) for allocation in allocations]
+        free = [str(gap) for gap in self.prefix_gaps(parent, used)]
+        output = open(options.output, "w", newline="") if options.output else sys.stdout
+        try:
+            if options.format == "json":
+                json.dump({"parent": str(parent), "subnet_length": options.subnet_length,
+                           "sites": allocations, "free": free}, output, indent=2)
+                output.write("\n")
+            elif options.format == "csv":
+                writer = csv.DictWriter(output, fieldnames=list(allocations[0].keys()))
+                writer.writeheader()
+                writer.writerows(allocations)
+            else:
+                output.write(f"Allocation plan for {parent} (/{options.subnet_length} subnets):\n")
+                for allocation in allocations:
+                    output.write(f"  {allocation['site']}: {allocation['prefix']} "
+                                 f"({allocation['subnets_required']} of {allocation['subnets_available']} subnets, "
+                                 f"{allocation['first_subnet']} - {allocation['last_subnet']})\n")
+                output.write("Free:\n")
+                for gap in free:
+                    output.write(f"  {gap}\n")
+        finally:
+            if options.output:
+                output.close()
+        return 0
+
+    def random_network(self, rng: random.Random, address_class: str, scope: str) -> ipaddress.IPv6Network:
+        """Pick the network to draw random addresses from for an address class."""
+        if address_class == "multicast":
+            # Transient (T=1) groups, since permanently assigned group IDs aren't random
+            return ipaddress.IPv6Network(((0xff10 | self.MULTICAST_SCOPES[scope]) << 112, 16))
+        if address_class == "ula":
+            # RFC 4193 locally assigned prefix with a random 40-bit global ID
+            global_id = rng.getrandbits(40)
+            return ipaddress.IPv6Network(((0xfd << 120) | (global_id << 80), 48))
+        return self.ADDRESS_CLASSES[address_class]
+
+    def random_prefix(self, rng: random.Random, network: ipaddress.IPv6Network, prefix_length: int) -> ipaddress.IPv6Network:
+        """Return a random prefix of prefix_length inside network."""
+        host_bits = prefix_length - network.prefixlen
+        offset = rng.getrandbits(host_bits) << (128 - prefix_length) if host_bits else 0
+        return ipaddress.IPv6Network((int(network.network_address) | offset, prefix_length))
+
+    def run_random(self, args: List[str]) -> int:
+        """Generate random but valid IPv6 addresses or prefixes."""
+        parser = argparse.ArgumentParser(prog="ipv6_tester.py random",
+                                         description="Generate random, valid IPv6 addresses or prefixes inside a "
+                                                     "prefix or address class. The same seed always produces the same output.")
+        source = parser.add_mutually_exclusive_group()
+        source.add_argument("--prefix", help="Generate inside this prefix")
+        source.add_argument("--class", dest="address_class", default="gua",
+                            choices=sorted(list(self.ADDRESS_CLASSES) + ["multicast"]),
+                            help="Address class to generate (default: gua)")
+        parser.add_argument("--scope", choices=list(self.MULTICAST_SCOPES), default="site",
+                            help="Multicast scope (default: site)")
+        parser.add_argument("--prefix-length", type=int, help="Generate prefixes of this length instead of addresses")
+        parser.add_argument("--count", type=int, default=1, help="Number of values to generate (default: 1)")
+        parser.add_argument("--seed", type=int, help="Random seed (default: random, printed for reproducibility)")
+        options = parser.parse_args(args)
+
+        seed = options.seed if options.seed is not None else secrets.randbits(32)
+        if options.seed is None:
+            self.logger.info(f"Seed: {seed}")
+        rng = random.Random(seed)
+
+        try:
+            if options.prefix:
+                network = ipaddress.IPv6Network(options.prefix, strict=False)
+            else:
+                network = self.random_network(rng, options.address_class, options.scope)
+            length = options.prefix_length if options.prefix_length is not None else 128
+            if not network.prefixlen <= length <= 128:
+                raise ValueError(f"prefix length must be between {network.prefixlen} and 128")
+        except ValueError as e:
+            self.logger.error(f"Error: {e}")
+            return 1
+
+        generated = 0
+        while generated < options.count:
+            if options.address_class == "ula" and not options.prefix and generated:
+                network = self.random_network(rng, "ula", options.scope)
+            prefix = self.random_prefix(rng, network, length)
+            if options.prefix_length is None:
+                address = prefix.network_address
+                # Skip the few values that are valid but not usable as host addresses
+                if network.prefixlen < 127 and address in (network.network_address, network.broadcast_address):
+                    continue
+                if options.address_class == "gua" and not options.prefix and not address.is_global:
+                    continue
+                sys.stdout.write(f"{self.format_address(address)}\n")
+            else:
+                sys.stdout.write(f"{prefix}\n")
+            generated += 1
+        return 0
+
+    def mode_parser(self, mode: str) -> argparse.ArgumentParser:
+        """Build the argument parser for server or client mode."""
+        parser = argparse.ArgumentParser(prog=f"ipv6_tester.py {mode}")
+        parser.add_argument("ipv6_address", nargs="?", default=self.DEFAULT_IPV6_ADDRESS,
+                            help=f"IPv6 address (default: {self.DEFAULT_IPV6_ADDRESS})")
+        parser.add_argument("port", nargs="?", type=int, default=self.DEFAULT_PORT,
+                            help=f"Port number (default: {self.DEFAULT_PORT})")
+        parser.add_argument("--trace", metavar="FILE", help="Hexdump every byte sent and received to FILE")
+        parser.add_argument("--sndbuf", type=int, default=0, metavar="BYTES",
+                            help="Socket send buffer size (default: the kernel's, with autotuning)")
+        parser.add_argument("--rcvbuf", type=int, default=0, metavar="BYTES",
+                            help="Socket receive buffer size (default: the kernel's, with autotuning)")
+        if mode == 'server':
+            parser.add_argument("--queue-report", type=float, default=0, metavar="SECONDS",
+                                help="Log accept queue depth and listen overflows every SECONDS while non-zero (Linux)")
+            parser.add_argument("--min-rate", type=float, default=0, metavar="BYTES",
+                                help=f"Close clients still sending a line slower than BYTES per second after "
+                                     f"{self.MIN_RATE_GRACE} seconds (slowloris mitigation)")
+            parser.add_argument("--diag-addr", metavar="[ADDRESS]:PORT",
+                                help="Serve /debug/vars, /debug/stacks and /debug/heap on this address, e.g. [::1]:6060")
+            parser.add_argument("--max-rate", type=float, default=0, metavar="BYTES",
+                                help="Cap what the server sends on each connection at BYTES per second")
+            parser.add_argument("--max-total-rate", type=float, default=0, metavar="BYTES",
+                                help="Cap what the server sends on all connections together at BYTES per second")
+            parser.add_argument("--max-session-rate", type=float, default=0, metavar="BYTES",
+                                help="Cap what the server sends on all connections of one named session together "
+                                     "at BYTES per second")
+            parser.add_argument("--require-auth", action="store_true",
+                                help="Serve echo, callback and timing tests only to clients that prove they know "
+                                     "the secret in IPV6_TESTER_SECRET")
+            parser.add_argument("--pow-bits", type=int, default=0, metavar="BITS",
+                                help=f"Require a SHA-256 proof of work of BITS leading zero bits before serving "
+                                     f"tests (at most {self.MAX_POW_BITS}; 20 takes about a second)")
+            parser.add_argument("--ipfix", metavar="[ADDRESS]:PORT",
+                                help="Export an IPFIX flow record per connection to this collector over UDP "
+                                     "(default port 4739)")
+            chaos = parser.add_argument_group("chaos", "Misbehave on purpose, to test clients against pathological "
+                                                       "servers; each response line or throughput chunk is one write")
+            chaos.add_argument("--delay", type=float, default=0, metavar="MS", help="Delay every write by MS ms")
+            chaos.add_argument("--jitter", type=float, default=0, metavar="MS",
+                               help="Vary the delay randomly by up to MS ms either way")
+            chaos.add_argument("--drop-rate", type=float, default=0, metavar="P",
+                               help="Silently drop writes with probability P (0-1)")
+            chaos.add_argument("--garble", type=float, default=0, metavar="P",
+                               help="Corrupt one byte of a write with probability P (0-1)")
+            chaos.add_argument("--close-after", type=int, default=0, metavar="BYTES",
+                               help="Close each connection once it has sent BYTES bytes")
+            chaos.add_argument("--fuzz", action="store_true",
+                               help=f"Answer FUZZ frames with adversarial responses ({', '.join(self.FUZZ_CASES)}), "
+                                    f"for the fuzz tool")
+            parser.add_argument("--workers", type=int, default=1, metavar="N",
+                                help="Accept in N processes, each with its own SO_REUSEPORT listener (default: 1)")
+        if mode == 'client':
+            parser.add_argument("--strict-v6", action="store_true",
+                                help="Fail if the server is reached over IPv4 at any layer: a name without native AAAA "
+                                     "records, a proxy from the environment that is IPv4-only, or an IPv4-mapped or "
+                                     "NAT64 peer address")
+        return parser
+
+    def tool_commands(self) -> dict:
+        """Map each tool name to the method that runs it."""
+        return {
+            'lowpan': self.run_lowpan,
+            'anonymize': self.run_anonymize,
+            'normalize': self.run_normalize,
+            'cidr': self.run_cidr,
+            'plan': self.run_plan,
+            'random': self.run_random,
+            'verify': self.run_verify,
+            'leak-check': self.run_leak_check,
+            'dns-server': self.run_dns_server_tool,
+            'resolve': self.run_resolve,
+            'dns-watch': self.run_dns_watch,
+            'browse': self.run_browse,
+            'ntp': self.run_ntp,
+            'banner': self.run_banner,
+            'sshkeys': self.run_ssh_keys,
+            'cert': self.run_cert,
+            'anycast': self.run_anycast,
+            'udp-server': self.run_udp_server,
+            'udp-test': self.run_udp_test,
+            'owd': self.run_owd,
+            'completion': self.run_completion,
+            'version': self.run_version,
+            'ping': self.run_ping,
+            'traceroute': self.run_traceroute,
+            'container-check': self.run_container_check,
+            'health': self.run_health,
+            'portmap': self.run_portmap,
+            'callback': self.run_callback,
+            'myip': self.run_myip,
+            'stun': self.run_stun,
+            'rdap': self.run_rdap,
+            'bgp': self.run_bgp,
+            'replay': self.run_replay,
+            'generate': self.run_generate,
+            'sink': self.run_sink,
+            'inetd': self.run_inetd,
+            'handshake': self.run_handshake,
+            'backlog': self.run_backlog,
+            'slowloris': self.run_slowloris,
+            'idle': self.run_idle,
+            'bench': self.run_bench,
+            'throughput': self.run_throughput,
+            'fleet': self.run_fleet,
+            'tunnel-check': self.run_tunnel_check,
+            'encap': self.run_encap,
+            'wireguard': self.run_wireguard,
+            'srv6': self.run_srv6,
+            'mld': self.run_mld,
+            'ra-guard': self.run_ra_guard,
+            'ndp-scan': self.run_ndp_scan,
+            'solicited': self.run_solicited,
+            'wol': self.run_wol,
+            'snmp': self.run_snmp,
+            'fuzz': self.run_fuzz,
+            'tls-matrix': self.run_tls_matrix,
+            'resolver-check': self.run_resolver_check,
+            'sysconfig': self.run_sysconfig,
+            'addrselect': self.run_addrselect,
+            'gai': self.run_gai,
+        }
+
+    def main(self) -> None:
+        """Main entry point for the IPv6 tester."""
+        if len(sys.argv) < 2:
+            self.print_usage()
+            sys.exit(1)
+
+        mode = "version" if sys.argv[1] == "--version" else sys.argv[1]
+        if os.environ.get("IPV6_TESTER_SYSLOG"):
+            try:
+                self.logger.addHandler(SyslogHandler(os.environ["IPV6_TESTER_SYSLOG"], f"ipv6_tester.{mode}"))
+            except (OSError, ValueError) as e:
+                self.logger.error(f"Cannot log to syslog: {e}")
+                sys.exit(1)
+        tools = self.tool_commands()
+        if mode in tools:
+            sys.exit(tools[mode](sys.argv[2:]))
+
+        if mode not in ['server', 'client']:
+            self.print_usage()
+            sys.exit(1)
+
+        parser = self.mode_parser(mode)
+        options = parser.parse_args(sys.argv[2:])
+        diag_address = None
+        if mode == 'server' and options.diag_addr:
+            parts = urllib.parse.urlsplit(f"//{options.diag_addr}")
+            if not parts.hostname or not parts.port:
+                parser.error(f"invalid --diag-addr '{options.diag_addr}': expected [ADDRESS]:PORT")
+            diag_address = (parts.hostname, parts.port)
+        if mode == 'server':
+            if options.require_auth:
+                if not os.environ.get("IPV6_TESTER_SECRET"):
+                    parser.error("--require-auth needs the shared secret in IPV6_TESTER_SECRET")
+                self.auth_secret = os.environ["IPV6_TESTER_SECRET"].encode()
+            if not 0 <= options.pow_bits <= self.MAX_POW_BITS:
+                parser.error(f"--pow-bits must be between 0 and {self.MAX_POW_BITS}")
+            self.pow_bits = options.pow_bits
+            if not 0 <= options.drop_rate <= 1 or not 0 <= options.garble <= 1:
+                parser.error("--drop-rate and --garble must be probabilities between 0 and 1")
+            if options.delay < 0 or options.jitter < 0 or options.close_after < 0:
+                parser.error("--delay, --jitter and --close-after must not be negative")
+            if options.delay or options.jitter or options.drop_rate or options.garble or options.close_after:
+                self.chaos = {"delay": options.delay, "jitter": options.jitter, "drop_rate": options.drop_rate,
+                              "garble": options.garble, "close_after": options.close_after}
+            self.fuzz = options.fuzz
+            if options.ipfix:
+                try:
+                    parts = urllib.parse.urlsplit(f"//{options.ipfix}")
+                    if not parts.hostname:
+                        raise ValueError("expected [ADDRESS]:PORT")
+                    collector = socket.getaddrinfo(parts.hostname, parts.port or 4739, socket.AF_INET6,
+                                                   socket.SOCK_DGRAM)[0][4]
+                    self.flow_exporter = FlowExporter(collector)
+                except (OSError, TypeError, ValueError) as e:
+                    parser.error(f"invalid --ipfix '{options.ipfix}': {e}")
+
+        if options.trace and not self.open_tracer(options.trace):
+            sys.exit(1)
+        try:
+            if mode == 'server' and options.workers > 1:
+                if not hasattr(socket, "SO_REUSEPORT") or not hasattr(os, "fork"):
+                    raise OSError("--workers needs SO_REUSEPORT and fork(), which this platform lacks")
+                self.run_workers(options.workers, options.ipv6_address, options.port, options.queue_report,
+                                 options.min_rate, options.sndbuf, options.rcvbuf, diag_address, options.max_rate,
+                                 options.max_total_rate, options.max_session_rate)
+            elif mode == 'server':
+                asyncio.run(self.run_server(options.ipv6_address, options.port, options.queue_report,
+                                            options.min_rate, sndbuf=options.sndbuf, rcvbuf=options.rcvbuf,
+                                            diag_address=diag_address, max_rate=options.max_rate,
+                                            max_total_rate=options.max_total_rate,
+                                            max_session_rate=options.max_session_rate))
+            elif not asyncio.run(self.run_client(options.ipv6_address, options.port, options.strict_v6,
+                                                 options.sndbuf, options.rcvbuf)):
+                sys.exit(1)
         except KeyboardInterrupt:
             self.logger.info("\nShutting down...")
         except Exception as e:
@@ -0,0 +1,506 @@
+"""Unit tests for the parsers and encoders in ipv6_tester.py.
+
+Run from the repository root with: python -m unittest discover -s python/tests
+"""
+import asyncio
+import contextlib
+import io
+import ipaddress
+import json
+import logging
+import os
+import random
+import socket
+import sys
+import tempfile
+import unittest
+
+sys.path.insert(0, os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "src"))
+
+from ipv6_tester import DNS_TYPES, DNSMessage, DNSRecord, IPv6Tester, TokenBucket  # noqa: E402
+
+
+class AnonymizeTest(unittest.TestCase):
+    def setUp(self):
+        self.tester = IPv6Tester()
+
+    def anonymize(self, line: str) -> str:
+        return self.tester.anonymize_text(line, 48, b"k")
+
+    def test_address_followed_by_colon(self):
+        result = self.anonymize("peer 2001:db8:1:2::5: refused\n")
+        self.assertNotIn("2001:db8:1:2::5", result)
+        self.assertRegex(result, r"^peer 2001:db8:1:[0-9a-f:]+: refused\n$")
+
+    def test_address_ending_in_double_colon(self):
+        result = self.anonymize("prefix 2001:db8:1:2:: assigned")
+        self.assertNotIn("2001:db8:1:2::", result)
+        self.assertTrue(result.startswith("prefix 2001:db8:1:"))
+
+    def test_unparsed_address_is_masked(self):
+        self.assertEqual(self.anonymize("bad 2001:db8::1::2 here"), "bad <unparsed IPv6 address> here")
+
+    def test_times_and_mac_addresses_are_kept(self):
+        line = "at 12:30:45 from 00:11:22:33:44:55"
+        self.assertEqual(self.anonymize(line), line)
+
+
+class X25519Test(unittest.TestCase):
+    """RFC 7748 test vectors."""
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+
+    def test_scalar_multiplication(self):
+        # Section 5.2, first vector
+        scalar = bytes.fromhex("a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4")
+        point = bytes.fromhex("e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c")
+        self.assertEqual(self.tester.x25519(scalar, point).hex(),
+                         "c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552")
+
+    def test_diffie_hellman(self):
+        # Section 6.1
+        alice = bytes.fromhex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+        bob = bytes.fromhex("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+        alice_public, bob_public = self.tester.x25519(alice), self.tester.x25519(bob)
+        self.assertEqual(alice_public.hex(), "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+        self.assertEqual(bob_public.hex(), "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+        shared = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+        self.assertEqual(self.tester.x25519(alice, bob_public).hex(), shared)
+        self.assertEqual(self.tester.x25519(bob, alice_public).hex(), shared)
+
+
+class ChaCha20Poly1305Test(unittest.TestCase):
+    """RFC 8439 test vectors."""
+    KEY = bytes(range(0x80, 0xa0))
+    NONCE = bytes.fromhex("070000004041424344454647")
+    AAD = bytes.fromhex("50515253c0c1c2c3c4c5c6c7")
+    PLAINTEXT = (b"Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, "
+                 b"sunscreen would be it.")
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+
+    def test_block_function(self):
+        # Section 2.3.2
+        block = self.tester.chacha20_block(bytes(range(32)), 1, bytes.fromhex("000000090000004a00000000"))
+        self.assertEqual(block.hex(), "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e"
+                                      "d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e")
+
+    def test_aead_encryption(self):
+        # Section 2.8.2
+        sealed = self.tester.aead_chacha20_poly1305(self.KEY, self.NONCE, self.PLAINTEXT, self.AAD)
+        self.assertEqual(len(sealed), len(self.PLAINTEXT) + 16)
+        self.assertEqual(sealed[:16].hex(), "d31a8d34648e60db7b86afbc53ef7ec2")
+        self.assertEqual(sealed[-16:].hex(), "1ae10b594f09e26a7e902ecbd0600691")
+
+    def test_aead_decryption(self):
+        sealed = self.tester.aead_chacha20_poly1305(self.KEY, self.NONCE, self.PLAINTEXT, self.AAD)
+        opened = self.tester.aead_chacha20_poly1305(self.KEY, self.NONCE, sealed, self.AAD, decrypt=True)
+        self.assertEqual(opened, self.PLAINTEXT)
+        tampered = sealed[:-1] + bytes([sealed[-1] ^ 1])
+        self.assertIsNone(self.tester.aead_chacha20_poly1305(self.KEY, self.NONCE, tampered, self.AAD, decrypt=True))
+        self.assertIsNone(self.tester.aead_chacha20_poly1305(self.KEY, self.NONCE, sealed, b"", decrypt=True))
+
+
+class LowpanTest(unittest.TestCase):
+    """RFC 6282 section 3.1.1 address modes."""
+    LINK_LAYER = bytes.fromhex("0212345678abcdef")
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+
+    def compress(self, address: str, dest: bool = False, context=None, link_layer=None):
+        return self.tester.lowpan_compress(ipaddress.IPv6Address(address), dest, context, link_layer)
+
+    def assertRoundTrip(self, address: str, dest: bool = False, context=None, link_layer=None):
+        m, ac, am, inline = self.compress(address, dest, context, link_layer)
+        expanded = self.tester.lowpan_expand(m, ac, am, inline, dest, context, link_layer)
+        self.assertEqual(expanded, ipaddress.IPv6Address(address))
+
+    def test_multicast_8_bit(self):
+        self.assertEqual(self.compress("ff02::1", dest=True), (1, 0, 3, b"\x01"))
+
+    def test_multicast_32_bit(self):
+        self.assertEqual(self.compress("ff05::1:3", dest=True), (1, 0, 2, bytes.fromhex("05010003")))
+
+    def test_multicast_48_bit(self):
+        self.assertEqual(self.compress("ff0e::12:3456:789a", dest=True), (1, 0, 1, bytes.fromhex("0e123456789a")))
+
+    def test_multicast_source_is_rejected(self):
+        with self.assertRaises(ValueError):
+            self.compress("ff02::1")
+
+    def test_link_local_16_bit(self):
+        self.assertEqual(self.compress("fe80::ff:fe00:1234"), (0, 0, 2, bytes.fromhex("1234")))
+
+    def test_link_local_64_bit(self):
+        self.assertEqual(self.compress("fe80::1:2:3:4"), (0, 0, 1, bytes.fromhex("0001000200030004")))
+
+    def test_link_local_from_link_layer(self):
+        # The interface identifier is the EUI-64 with the U/L bit inverted, so nothing is sent in-line
+        self.assertEqual(self.compress("fe80::12:3456:78ab:cdef", link_layer=self.LINK_LAYER), (0, 0, 3, b""))
+
+    def test_unspecified_source(self):
+        self.assertEqual(self.compress("::"), (0, 1, 0, b""))
+
+    def test_context_round_trips(self):
+        context = ipaddress.IPv6Network("2001:db8::/64")
+        self.assertEqual(self.compress("2001:db8::ff:fe00:42", context=context), (0, 1, 2, bytes.fromhex("0042")))
+        for address in ("2001:db8::1:2:3:4", "2001:db8:1::1", "fe80::12:3456:78ab:cdef"):
+            self.assertRoundTrip(address, context=context, link_layer=self.LINK_LAYER)
+
+
+def mutations(data: bytes, seed: int, count: int = 300):
+    """Yield every truncation of data, then seeded single and multi-byte corruptions of it."""
+    for end in range(len(data)):
+        yield data[:end]
+    generator = random.Random(seed)
+    for _ in range(count):
+        mutated = bytearray(data)
+        for _ in range(generator.randint(1, 4)):
+            mutated[generator.randrange(len(mutated))] = generator.randrange(256)
+        yield bytes(mutated)
+
+
+class DNSDecodeTest(unittest.TestCase):
+    def setUp(self):
+        message = DNSMessage(0x1234, DNSMessage.QR | DNSMessage.RD)
+        message.questions.append(("www.example.com.", DNS_TYPES["AAAA"], 1))
+        for rtype, value in (("AAAA", "2001:db8::1"), ("CNAME", "host.example.com."), ("MX", "10 mail.example.com."),
+                             ("SRV", "0 5 443 host.example.com."), ("TXT", '"v=spf1 -all"'),
+                             ("SOA", "ns.example.com. admin.example.com. 1 2 3 4 5")):
+            record = DNSRecord("www.example.com.", DNS_TYPES[rtype], 1, 300,
+                               DNSMessage.encode_rdata(DNS_TYPES[rtype], value))
+            message.answers.append(record)
+        self.encoded = message.encode()
+
+    def test_round_trip(self):
+        decoded = DNSMessage.decode(self.encoded)
+        self.assertEqual(decoded.questions, [("www.example.com.", DNS_TYPES["AAAA"], 1)])
+        self.assertEqual([record.value for record in decoded.answers][:3],
+                         ["2001:db8::1", "host.example.com.", "10 mail.example.com."])
+
+    def test_compression_pointer_loop(self):
+        # The question name points at itself
+        data = bytes.fromhex("000001000001000000000000") + b"\xc0\x0c" + bytes(4)
+        with self.assertRaises(ValueError):
+            DNSMessage.decode(data)
+
+    def test_malformed_input_raises_value_error(self):
+        for data in mutations(self.encoded, seed=53):
+            try:
+                DNSMessage.decode(data)
+            except ValueError:
+                pass
+
+
+class CertificateDecodeTest(unittest.TestCase):
+    def setUp(self):
+        self.tester = IPv6Tester()
+        element, oid = self.tester.der_element, self.tester.encode_oid
+
+        def name(common_name: str) -> bytes:
+            attribute = element(0x30, element(0x06, oid("2.5.4.3")) + element(0x0c, common_name.encode()))
+            return element(0x30, element(0x31, attribute))
+
+        algorithm = element(0x30, element(0x06, oid("1.2.840.10045.4.3.2")))
+        validity = element(0x30, element(0x17, b"250101000000Z") + element(0x18, b"20350101000000Z"))
+        key = element(0x30, element(0x30, element(0x06, oid("1.2.840.10045.2.1"))) + element(0x03, bytes(33)))
+        alt_names = element(0x30, element(0x82, b"www.example.com") +
+                            element(0x87, ipaddress.IPv6Address("2001:db8::1").packed))
+        extension = element(0x30, element(0x06, oid("2.5.29.17")) + element(0x04, alt_names))
+        extensions = element(0xa3, element(0x30, extension))
+        tbs = element(0x30, element(0xa0, element(0x02, b"\x02")) + element(0x02, b"\x01") + algorithm +
+                      name("Example CA") + validity + name("www.example.com") + key + extensions)
+        self.certificate = element(0x30, tbs + algorithm + element(0x03, bytes(65)))
+
+    def test_decode(self):
+        fields = self.tester.decode_certificate(self.certificate)
+        self.assertEqual(fields["subject"], "CN=www.example.com")
+        self.assertEqual(fields["issuer"], "CN=Example CA")
+        self.assertEqual(fields["not_before"].year, 2025)
+        self.assertEqual(fields["not_after"].year, 2035)
+        self.assertEqual(fields["names"], ["www.example.com", "2001:db8::1"])
+
+    def test_malformed_input_raises_value_error(self):
+        for data in mutations(self.certificate, seed=509):
+            try:
+                self.tester.decode_certificate(data)
+            except ValueError:
+                pass
+
+
+class MaxMindDecodeTest(unittest.TestCase):
+    MARKER = b"\xab\xcd\xefMaxMind.com"
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+
+    def open_database(self, data: bytes) -> dict:
+        with tempfile.NamedTemporaryFile(suffix=".mmdb", delete=False) as f:
+            f.write(data)
+        self.addCleanup(os.unlink, f.name)
+        return self.tester.mmdb_open(f.name)
+
+    def test_decode_map(self):
+        # {"en": "Test", "n": 42} with a pointer back to the "en" string
+        data = b"\xe2\x42en\x44Test\x41n\xa1\x2a" + b"\x20\x01"
+        self.assertEqual(self.tester.mmdb_field(data, 0, 0), {"en": "Test", "n": 42})
+        self.assertEqual(self.tester.mmdb_field(data, 13, 0), "en")
+
+    def test_pointer_loop(self):
+        with self.assertRaises(ValueError):
+            self.tester.mmdb_field(b"\x20\x00", 0, 0)
+
+    def test_malformed_fields_raise_value_error(self):
+        generator = random.Random(1996)
+        for _ in range(2000):
+            data = bytes(generator.randrange(256) for _ in range(generator.randint(0, 24)))
+            try:
+                self.tester.mmdb_field(data, 0, 0)
+            except ValueError:
+                pass
+
+    def test_malformed_metadata(self):
+        for metadata in (b"", b"\x41x", b"\xe1\x4brecord_size\xa1\x1c",
+                         b"\xe3\x4brecord_size\xa1\x1c\x4anode_count\xc1\x10\x4aip_version\xa1\x06"):
+            with self.assertRaises(ValueError):
+                self.open_database(self.MARKER + metadata)
+
+
+class MemoryWriter:
+    """The writing end of an in-memory pipe: written data is fed to the reader at the other end."""
+
+    def __init__(self, peer: asyncio.StreamReader, sockname: tuple, peername: tuple):
+        self.peer = peer
+        self.extra = {"sockname": sockname, "peername": peername}
+        self.eof = False
+
+    def write(self, data: bytes) -> None:
+        if not self.eof:
+            self.peer.feed_data(data)
+
+    async def drain(self) -> None:
+        # Let the other end run, as a socket's flow control would
+        await asyncio.sleep(0)
+
+    def get_extra_info(self, name: str, default=None):
+        return self.extra.get(name, default)
+
+    def can_write_eof(self) -> bool:
+        return True
+
+    def write_eof(self) -> None:
+        self.eof = True
+        self.peer.feed_eof()
+
+    def is_closing(self) -> bool:
+        return self.eof
+
+    def close(self) -> None:
+        if not self.eof:
+            self.write_eof()
+
+    async def wait_closed(self) -> None:
+        pass
+
+
+class MemoryPipeTest(unittest.TestCase):
+    """Run the client tools against handle_client over in-memory pipes, without binding sockets."""
+    CLIENT = ("2001:db8::2", 50000, 0, 0)
+    SERVER = ("2001:db8::1", 8080, 0, 0)
+
+    def setUp(self):
+        self.server = IPv6Tester()
+        self.client = IPv6Tester()
+        self.client.dial = self.dial
+        self.handlers = []
+        # The server logs every connection; keep test output to failures
+        logging.getLogger("ipv6_tester").setLevel(logging.WARNING)
+
+    async def dial(self, ipv6_address: str, port: int):
+        to_server = asyncio.StreamReader()
+        to_client = asyncio.StreamReader(limit=self.client.CLIENT_MAX_LINE)
+        server_writer = MemoryWriter(to_client, self.SERVER, self.CLIENT)
+        self.handlers.append(asyncio.ensure_future(
+            self.server.handle_client(to_server, server_writer, self.SERVER[0])))
+        return to_client, MemoryWriter(to_server, self.CLIENT, self.SERVER)
+
+    def run_client(self, coroutine):
+        async def run():
+            try:
+                return await asyncio.wait_for(coroutine, 10)
+            finally:
+                await asyncio.gather(*self.handlers)
+        return asyncio.run(run())
+
+    def exchange(self, *lines: bytes) -> list:
+        """Send raw request lines on one connection and return the server's response lines."""
+        async def run():
+            reader, writer = await self.client.dial(*self.SERVER[:2])
+            responses = []
+            for line in lines:
+                writer.write(line)
+                await writer.drain()
+                responses.append(await reader.readline())
+            writer.close()
+            return responses
+        return self.run_client(run())
+
+    def test_verify_echo(self):
+        self.assertTrue(self.run_client(self.client.verify_echo(*self.SERVER[:2], 5, 64, 0, 5)))
+        self.assertEqual(self.server.server_stats["accepted"], 1)
+        self.assertEqual(self.server.server_stats["active"], 0)
+
+    def test_session_is_counted(self):
+        self.assertTrue(self.run_client(self.client.verify_echo(*self.SERVER[:2], 3, 16, 0, 5, session="lab-1")))
+        self.assertEqual(self.server.sessions["lab-1"]["stats"]["accepted"], 1)
+        self.assertGreater(self.server.sessions["lab-1"]["stats"]["bytes_received"], 0)
+
+    def test_time_probes(self):
+        probes = self.run_client(self.client.time_probes(*self.SERVER[:2], 3, 0, 5))
+        self.assertEqual(len(probes), 3)
+        for t1, t2, t3, t4 in probes:
+            self.assertLessEqual(t1, t4)
+            self.assertLessEqual(t2, t3)
+
+    def test_authentication_required(self):
+        self.server.auth_secret = b"secret"
+        responses = self.exchange(b"ECHO 0 00000000 x\n", b"CHALLENGE\n", b"AUTH 00 0\n")
+        self.assertEqual(responses[0], b"ERROR authentication required; send CHALLENGE\n")
+        self.assertTrue(responses[1].startswith(b"CHALLENGE "))
+        self.assertEqual(responses[2], b"AUTH FAILED wrong secret\n")
+        self.assertEqual(self.server.server_stats["rejected"], 1)
+
+    def test_long_line_is_rejected(self):
+        responses = self.exchange(b"x" * (self.server.MAX_LINE_LENGTH + 2) + b"\n")
+        self.assertEqual(responses, [f"ERROR line exceeds {self.server.MAX_LINE_LENGTH} bytes\n".encode()])
+
+
+class FakeClock:
+    """A monotonic clock that only moves when told to, and by step on every read."""
+
+    def __init__(self, step: float = 0):
+        self.now = 1000.0
+        self.step = step
+
+    def __call__(self) -> float:
+        now = self.now
+        self.now += self.step
+        return now
+
+
+class ClockTest(unittest.TestCase):
+    """Rate limits, read timeouts and session expiry, driven by a fake clock instead of sleeps."""
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+        self.clock = self.tester.clock = FakeClock()
+
+    def read_line(self, data: bytes, pending: bytes = b"", min_rate: float = 0) -> bytes:
+        """Run read_line on a connection that has sent data, and pending before it, and then nothing more."""
+        async def run():
+            reader = asyncio.StreamReader()
+            reader.feed_data(data)
+            return await self.tester.read_line(reader, bytearray(pending), min_rate)
+        return asyncio.run(run())
+
+    def test_token_bucket(self):
+        bucket = TokenBucket(1000, self.clock)
+        self.assertEqual(bucket.take(1000), 0)
+        self.assertEqual(bucket.take(500), 0.5)
+        self.clock.now += 0.25
+        self.assertEqual(bucket.take(0), 0.25)
+        self.clock.now += 10
+        # The burst is capped at one second's worth
+        self.assertEqual(bucket.take(1000), 0)
+        self.assertEqual(bucket.take(1), 0.001)
+
+    def test_read_timeout(self):
+        self.clock.step = self.tester.READ_TIMEOUT
+        with self.assertRaises(asyncio.TimeoutError):
+            self.read_line(b"")
+
+    def test_read_within_timeout(self):
+        self.clock.step = self.tester.READ_TIMEOUT / 4
+        self.assertEqual(self.read_line(b"ping\n"), b"ping\n")
+
+    def test_min_rate(self):
+        # Three bytes over more than MIN_RATE_GRACE seconds is too slow for 100 bytes/s
+        self.clock.step = self.tester.MIN_RATE_GRACE
+        with self.assertRaisesRegex(ValueError, "slower than 100 bytes/s"):
+            self.read_line(b"", b"abc", min_rate=100)
+
+    def test_min_rate_grace(self):
+        self.clock.step = self.tester.MIN_RATE_GRACE / 4
+        self.assertEqual(self.read_line(b"def\n", b"abc", min_rate=100), b"abcdef\n")
+
+    def test_idle_sessions_expire(self):
+        stats = {"accepted": 1, "active": 0, "rejected": 0, "bytes_received": 0}
+        self.tester.sessions["old"] = {"stats": stats, "bucket": None, "idle_since": self.clock()}
+        self.clock.now += self.tester.SESSION_EXPIRY
+        self.assertTrue(self.tester.prune_sessions("new"))
+        self.assertIn("old", self.tester.sessions)
+        self.clock.now += 1
+        self.assertTrue(self.tester.prune_sessions("new"))
+        self.assertNotIn("old", self.tester.sessions)
+
+
+def loopback_available() -> bool:
+    try:
+        with socket.socket(socket.AF_INET6, socket.SOCK_STREAM) as sock:
+            sock.bind(("::1", 0))
+        return True
+    except OSError:
+        return False
+
+
+@unittest.skipUnless(loopback_available(), "needs ::1")
+class BenchTest(unittest.TestCase):
+    """The bench tool's measurements and its comparison against a saved baseline, with short runs."""
+    DURATION = "0.01"
+
+    def setUp(self):
+        self.tester = IPv6Tester()
+        logging.getLogger("ipv6_tester").setLevel(logging.WARNING)
+
+    def bench(self, *args: str) -> int:
+        with contextlib.redirect_stdout(io.StringIO()):
+            return self.tester.run_bench(["--duration", self.DURATION, *args])
+
+    def baseline(self, results, wrap: bool = True) -> str:
+        with tempfile.NamedTemporaryFile("w", suffix=".json", delete=False) as f:
+            json.dump({"results": results} if wrap else results, f)
+        self.addCleanup(os.unlink, f.name)
+        return f.name
+
+    def test_benchmarks_measure_every_path(self):
+        results = self.tester.run_benchmarks(float(self.DURATION))
+        self.assertEqual(set(results), {"address parsing", "address formatting", "DNS encode", "DNS decode",
+                                        "line framing", "loopback connections", "loopback echo round trips"})
+        for name, rate in results.items():
+            self.assertGreater(rate, 0, name)
+
+    def test_regression_against_baseline(self):
+        self.assertEqual(self.bench("--baseline", self.baseline({"DNS decode": 1e12})), 1)
+
+    def test_no_regression_against_baseline(self):
+        self.assertEqual(self.bench("--baseline", self.baseline({"DNS decode": 1e-3, "retired benchmark": 1})), 0)
+
+    def test_unreadable_baseline(self):
+        self.assertEqual(self.bench("--baseline", self.baseline([])), 1)
+        self.assertEqual(self.bench("--baseline", self.baseline({"DNS decode": 0})), 1)
+        self.assertEqual(self.bench("--baseline", self.baseline([], wrap=False)), 1)
+        self.assertEqual(self.bench("--baseline", os.path.join(tempfile.gettempdir(), "missing-baseline.json")), 1)
+
+    def test_json_output_is_a_baseline(self):
+        output = io.StringIO()
+        with contextlib.redirect_stdout(output):
+            self.assertEqual(self.tester.run_bench(["--duration", self.DURATION, "--json"]), 0)
+        results = json.loads(output.getvalue())["results"]
+        self.assertEqual(self.bench("--baseline", self.baseline(results), "--tolerance", "100"), 0)
+
+
+if __name__ == "__main__":
+    unittest.main()